@@ -8,17 +8,35 @@ import (
 	"gfs/util"
 	"reflect"
 
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/rpc"
 	//"math/rand"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -44,15 +62,86 @@ func errorAll(ch chan error, n int, t *testing.T) {
 	}
 }
 
+// testCluster is a standalone master with its own chunkservers, for tests
+// that would disturb the shared cluster started in TestMain.
+type testCluster struct {
+	m     *master.Master
+	mAdd  gfs.ServerAddress
+	cs    []*chunkserver.ChunkServer
+	csAdd []gfs.ServerAddress
+	c     *client.Client
+	root  string
+	tls   *tls.Config // nil if rpc is in plaintext
+}
+
+var nextPort = 20000
+
+func newTestCluster(n int, opts ...master.Option) *testCluster {
+	return newTLSTestCluster(n, nil, opts...)
+}
+
+// newTLSTestCluster starts a test cluster whose servers and client talk over TLS with config
+func newTLSTestCluster(n int, config *tls.Config, opts ...master.Option) *testCluster {
+	tc := &testCluster{
+		mAdd: gfs.ServerAddress(fmt.Sprintf(":%v", nextPort)),
+		root: path.Join(root, fmt.Sprintf("cluster%v", nextPort)),
+		tls:  config,
+	}
+	nextPort++
+
+	os.MkdirAll(path.Join(tc.root, "m"), 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), config, opts...)
+
+	for i := 0; i < n; i++ {
+		tc.addChunkServer()
+	}
+
+	tc.c = client.NewClient(tc.mAdd, tc.tls)
+	time.Sleep(300 * time.Millisecond)
+	return tc
+}
+
+// startMaster starts a master, tests cannot go on without it
+func startMaster(addr gfs.ServerAddress, root string, config *tls.Config, opts ...master.Option) *master.Master {
+	m, err := master.NewAndServe(addr, root, config, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// addChunkServer starts a new chunkserver in the cluster and returns its index
+func (tc *testCluster) addChunkServer() int {
+	tc.csAdd = append(tc.csAdd, gfs.ServerAddress(fmt.Sprintf(":%v", nextPort)))
+	tc.cs = append(tc.cs, nil)
+	nextPort++
+	tc.startChunkServer(len(tc.cs) - 1)
+	return len(tc.cs) - 1
+}
+
+// startChunkServer (re)starts the i-th chunkserver of the cluster
+func (tc *testCluster) startChunkServer(i int) {
+	dir := path.Join(tc.root, "cs"+strconv.Itoa(i))
+	os.MkdirAll(dir, 0755)
+	tc.cs[i] = chunkserver.NewAndServe(tc.csAdd[i], tc.mAdd, dir, tc.tls)
+}
+
+func (tc *testCluster) Shutdown() {
+	for _, v := range tc.cs {
+		v.Shutdown()
+	}
+	tc.m.Shutdown()
+}
+
 /*
  *  TEST SUITE 1 - Basic File Operation
  */
 func TestCreateFile(t *testing.T) {
-	err := m.RPCCreateFile(gfs.CreateFileArg{"/test1.txt"}, &gfs.CreateFileReply{})
+	err := m.RPCCreateFile(gfs.CreateFileArg{Path: "/test1.txt"}, &gfs.CreateFileReply{})
 	if err != nil {
 		t.Error(err)
 	}
-	err = m.RPCCreateFile(gfs.CreateFileArg{"/test1.txt"}, &gfs.CreateFileReply{})
+	err = m.RPCCreateFile(gfs.CreateFileArg{Path: "/test1.txt"}, &gfs.CreateFileReply{})
 	if err == nil {
 		t.Error("the same file has been created twice")
 	}
@@ -60,20 +149,20 @@ func TestCreateFile(t *testing.T) {
 
 func TestMkdirDeleteList(t *testing.T) {
 	ch := make(chan error, 9)
-	ch <- m.RPCMkdir(gfs.MkdirArg{"/dir1"}, &gfs.MkdirReply{})
-	ch <- m.RPCMkdir(gfs.MkdirArg{"/dir2"}, &gfs.MkdirReply{})
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{"/file1.txt"}, &gfs.CreateFileReply{})
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{"/file2.txt"}, &gfs.CreateFileReply{})
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{"/dir1/file3.txt"}, &gfs.CreateFileReply{})
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{"/dir1/file4.txt"}, &gfs.CreateFileReply{})
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{"/dir2/file5.txt"}, &gfs.CreateFileReply{})
-
-	err := m.RPCCreateFile(gfs.CreateFileArg{"/dir2/file5.txt"}, &gfs.CreateFileReply{})
+	ch <- m.RPCMkdir(gfs.MkdirArg{Path: "/dir1"}, &gfs.MkdirReply{})
+	ch <- m.RPCMkdir(gfs.MkdirArg{Path: "/dir2"}, &gfs.MkdirReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: "/file1.txt"}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: "/file2.txt"}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: "/dir1/file3.txt"}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: "/dir1/file4.txt"}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: "/dir2/file5.txt"}, &gfs.CreateFileReply{})
+
+	err := m.RPCCreateFile(gfs.CreateFileArg{Path: "/dir2/file5.txt"}, &gfs.CreateFileReply{})
 	if err == nil {
 		t.Error("the same file has been created twice")
 	}
 
-	err = m.RPCMkdir(gfs.MkdirArg{"/dir1"}, &gfs.MkdirReply{})
+	err = m.RPCMkdir(gfs.MkdirArg{Path: "/dir1"}, &gfs.MkdirReply{})
 	if err == nil {
 		t.Error("the same dirctory has been created twice")
 	}
@@ -85,7 +174,7 @@ func TestMkdirDeleteList(t *testing.T) {
 	todelete["file2.txt"] = true
 
 	var l gfs.ListReply
-	ch <- m.RPCList(gfs.ListArg{"/"}, &l)
+	ch <- m.RPCList(gfs.ListArg{Path: "/"}, &l)
 	for _, v := range l.Files {
 		delete(todelete, v.Name)
 	}
@@ -95,7 +184,7 @@ func TestMkdirDeleteList(t *testing.T) {
 
 	todelete["file3.txt"] = true
 	todelete["file4.txt"] = true
-	ch <- m.RPCList(gfs.ListArg{"/dir1"}, &l)
+	ch <- m.RPCList(gfs.ListArg{Path: "/dir1"}, &l)
 	for _, v := range l.Files {
 		delete(todelete, v.Name)
 	}
@@ -106,6 +195,82 @@ func TestMkdirDeleteList(t *testing.T) {
 	errorAll(ch, 9, t)
 }
 
+func TestDeleteFile(t *testing.T) {
+	p := gfs.Path("/TestDeleteFile.txt")
+	ch := make(chan error, 6)
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+	var r1 gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
+	ch <- m.RPCDeleteFile(gfs.DeleteFileArg{Path: p}, &gfs.DeleteFileReply{})
+
+	err := m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &gfs.GetFileInfoReply{})
+	if err == nil {
+		t.Error("a deleted file should not be found")
+	}
+	err = m.RPCDeleteFile(gfs.DeleteFileArg{Path: p}, &gfs.DeleteFileReply{})
+	if err == nil {
+		t.Error("an error should be returned when deleting a missing file")
+	}
+
+	// chunks are kept under the hidden name until garbage collection
+	var r2 gfs.GetPathsByChunkReply
+	ch <- m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{r1.Handle}, &r2)
+	if len(r2.Paths) != 1 || !strings.HasPrefix(string(r2.Paths[0]), "/"+gfs.DeletedFilePrefix) {
+		t.Error("chunk should belong to a hidden file after deletion, got", r2.Paths)
+	}
+
+	// non-empty directory
+	dir := gfs.Path("/TestDeleteDir")
+	ch <- m.RPCMkdir(gfs.MkdirArg{Path: dir}, &gfs.MkdirReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: dir + "/a.txt"}, &gfs.CreateFileReply{})
+	err = m.RPCDeleteFile(gfs.DeleteFileArg{Path: dir}, &gfs.DeleteFileReply{})
+	if err == nil {
+		t.Error("a non-empty directory should not be deleted without recursive flag")
+	}
+	err = m.RPCDeleteFile(gfs.DeleteFileArg{Path: dir, Recursive: true}, &gfs.DeleteFileReply{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: dir + "/a.txt"}, &gfs.GetFileInfoReply{})
+	if err == nil {
+		t.Error("a file in deleted directory should not be found")
+	}
+
+	errorAll(ch, 6, t)
+}
+
+func TestListOrder(t *testing.T) {
+	dir := gfs.Path("/TestListOrder")
+	ch := make(chan error, 6)
+	ch <- m.RPCMkdir(gfs.MkdirArg{Path: dir}, &gfs.MkdirReply{})
+	ch <- m.RPCMkdir(gfs.MkdirArg{Path: dir + "/b"}, &gfs.MkdirReply{})
+	ch <- m.RPCMkdir(gfs.MkdirArg{Path: dir + "/b/c"}, &gfs.MkdirReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: dir + "/c.txt"}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: dir + "/a.txt"}, &gfs.CreateFileReply{})
+
+	var l gfs.ListReply
+	ch <- m.RPCList(gfs.ListArg{Path: dir}, &l)
+	expected := []gfs.PathInfo{
+		{Name: "a.txt"},
+		{Name: "b", IsDir: true},
+		{Name: "c.txt"},
+	}
+	if !reflect.DeepEqual(l.Files, expected) {
+		t.Error("expect", expected, "got", l.Files)
+	}
+
+	err := m.RPCList(gfs.ListArg{Path: dir + "/a.txt"}, &gfs.ListReply{})
+	if err == nil {
+		t.Error("list a regular file should fail")
+	}
+	err = m.RPCList(gfs.ListArg{Path: dir + "/nothing"}, &gfs.ListReply{})
+	if err == nil {
+		t.Error("list a missing directory should fail")
+	}
+
+	errorAll(ch, 6, t)
+}
+
 func TestRPCGetChunkHandle(t *testing.T) {
 	var r1, r2 gfs.GetChunkHandleReply
 	path := gfs.Path("/test1.txt")
@@ -118,12 +283,171 @@ func TestRPCGetChunkHandle(t *testing.T) {
 		t.Error(err)
 	}
 	if r1.Handle != r2.Handle {
-		t.Error("got different handle: %v and %v", r1.Handle, r2.Handle)
+		t.Errorf("got different handle: %v and %v", r1.Handle, r2.Handle)
+	}
+
+	// no chunk is skipped without sparse files
+	var f gfs.GetFileInfoReply
+	if err := m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: path}, &f); err != nil {
+		t.Fatal(err)
+	}
+	err = m.RPCGetChunkHandle(gfs.GetChunkHandleArg{path, gfs.ChunkIndex(f.Chunks + 2)}, &r2)
+	if !gfs.IsError(err, gfs.ErrChunkGap) {
+		t.Error("expect chunk gap error, got", err)
+	}
+	if err := m.RPCGetChunkHandle(gfs.GetChunkHandleArg{path, -1}, &r2); err == nil {
+		t.Error("expect a negative index rejected")
+	}
+	var r3 gfs.GetChunkHandleReply
+	err = m.RPCGetChunkHandle(gfs.GetChunkHandleArg{path, gfs.ChunkIndex(f.Chunks)}, &r3)
+	if err != nil {
+		t.Error(err)
+	}
+	if r3.Handle == r1.Handle {
+		t.Errorf("expect a new handle for the next chunk, got %v", r3.Handle)
+	}
+}
+
+func TestGetPathsByChunk(t *testing.T) {
+	p := gfs.Path("/TestGetPathsByChunk.txt")
+	ch := make(chan error, 6)
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+
+	var r1 gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
+
+	var r2 gfs.GetPathsByChunkReply
+	ch <- m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{r1.Handle}, &r2)
+	if !reflect.DeepEqual(r2.Paths, []gfs.Path{p}) {
+		t.Error("expect paths", []gfs.Path{p}, "got", r2.Paths)
+	}
+
+	// the snapshots share the chunk with the source, the paths are sorted
+	q1, q2 := gfs.Path("/TestGetPathsByChunk-1.txt"), gfs.Path("/TestGetPathsByChunk-2.txt")
+	ch <- m.RPCSnapshot(gfs.SnapshotArg{p, q2}, &gfs.SnapshotReply{})
+	ch <- m.RPCSnapshot(gfs.SnapshotArg{p, q1}, &gfs.SnapshotReply{})
+	var r3 gfs.GetPathsByChunkReply
+	ch <- m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{r1.Handle}, &r3)
+	if expect := []gfs.Path{q1, q2, p}; !reflect.DeepEqual(r3.Paths, expect) {
+		t.Error("expect paths", expect, "got", r3.Paths)
+	}
+
+	err := m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{-1}, &gfs.GetPathsByChunkReply{})
+	if err == nil {
+		t.Error("an error should be returned for an unknown chunk")
+	}
+
+	errorAll(ch, 6, t)
+}
+
+func TestGetMasterMemoryUsage(t *testing.T) {
+	var r1, r2 gfs.GetMasterMemoryUsageReply
+	ch := make(chan error, 2+3*4)
+	ch <- m.RPCGetMasterMemoryUsage(gfs.GetMasterMemoryUsageArg{}, &r1)
+
+	// 3 directories and 9 files
+	for i := 0; i < 3; i++ {
+		dir := fmt.Sprintf("/TestGetMasterMemoryUsage%v", i)
+		ch <- m.RPCMkdir(gfs.MkdirArg{Path: gfs.Path(dir)}, &gfs.MkdirReply{})
+		for j := 0; j < 3; j++ {
+			p := gfs.Path(fmt.Sprintf("%v/file%v.txt", dir, j))
+			ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+		}
+	}
+
+	ch <- m.RPCGetMasterMemoryUsage(gfs.GetMasterMemoryUsageArg{}, &r2)
+	if r2.NamespaceNodes-r1.NamespaceNodes != 12 {
+		t.Error("expect 12 new namespace nodes, got", r2.NamespaceNodes-r1.NamespaceNodes)
+	}
+	if r2.ChunkServerEntries != csNum {
+		t.Error("expect", csNum, "chunkservers, got", r2.ChunkServerEntries)
+	}
+	if r2.EstimatedTotalBytes <= r1.EstimatedTotalBytes {
+		t.Error("estimated memory usage should grow after creating files")
+	}
+
+	errorAll(ch, 2+3*4, t)
+}
+
+// flakyTask fails every other run and blocks from its 11th run until released
+type flakyTask struct {
+	ct      int
+	release chan struct{}
+}
+
+func (f *flakyTask) Name() string            { return "TestFlakyTask" }
+func (f *flakyTask) Interval() time.Duration { return 10 * time.Millisecond }
+func (f *flakyTask) Run() error {
+	f.ct++
+	if f.ct > 10 {
+		<-f.release
+		return nil
+	}
+	if f.ct%2 == 0 {
+		return fmt.Errorf("flaky task fails at run %v", f.ct)
+	}
+	return nil
+}
+
+func TestBackgroundTaskStatus(t *testing.T) {
+	task := &flakyTask{release: make(chan struct{})}
+	defer close(task.release)
+	m.RegisterBackgroundTask(task)
+
+	var st gfs.TaskStatus
+	for wait := 0; wait < 100 && st.RunCount < 10; wait++ {
+		time.Sleep(20 * time.Millisecond)
+		var r gfs.GetBackgroundTaskStatusReply
+		if err := m.RPCGetBackgroundTaskStatus(gfs.GetBackgroundTaskStatusArg{}, &r); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range r.Tasks {
+			if v.Name == task.Name() {
+				st = v
+			}
+		}
 	}
 
-	err = m.RPCGetChunkHandle(gfs.GetChunkHandleArg{path, 2}, &r2)
+	if st.RunCount != 10 || st.ErrorCount != 5 {
+		t.Errorf("expect 10 runs and 5 errors, got %v runs and %v errors", st.RunCount, st.ErrorCount)
+	}
+	if st.LastError == "" {
+		t.Error("the error of the last run should be recorded")
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	p := gfs.Path("/TestExtendLease.txt")
+	ch := make(chan error, 4)
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+	var r1 gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
+
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r1.Handle}, &l)
+
+	time.Sleep(10 * time.Millisecond)
+	var r2 gfs.ExtendLeaseReply
+	ch <- m.RPCExtendLease(gfs.ExtendLeaseArg{r1.Handle, l.Primary}, &r2)
+	if !r2.Expire.After(l.Expire) {
+		t.Error("lease expire time should move forward, old", l.Expire, "new", r2.Expire)
+	}
+
+	err := m.RPCExtendLease(gfs.ExtendLeaseArg{r1.Handle, l.Secondaries[0]}, &gfs.ExtendLeaseReply{})
 	if err == nil {
-		t.Error("discontinuous chunk should not be created")
+		t.Error("a secondary should not extend the lease held by primary")
+	}
+	errorAll(ch, 4, t)
+
+	// a lease never granted is not taken by extending it
+	q := gfs.Path("/TestExtendLease-unleased.txt")
+	var r3 gfs.GetReplicasReply
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: q}, &gfs.CreateFileReply{})
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{q, 0}, &r1)
+	ch <- m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r1.Handle}, &r3)
+	errorAll(ch, 3, t)
+	if err := m.RPCExtendLease(gfs.ExtendLeaseArg{r1.Handle, r3.Locations[0]}, &gfs.ExtendLeaseReply{}); err == nil {
+		t.Error("a replica should not extend a lease nobody holds")
 	}
 }
 
@@ -131,7 +455,7 @@ func TestWriteChunk(t *testing.T) {
 	var r1 gfs.GetChunkHandleReply
 	p := gfs.Path("/TestWriteChunk.txt")
 	ch := make(chan error, N+2)
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{p}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
 	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
 	for i := 0; i < N; i++ {
 		go func(x int) {
@@ -168,7 +492,7 @@ func checkReplicas(handle gfs.ChunkHandle, length int, t *testing.T) int {
 
 	// get replicas location from master
 	var l gfs.GetReplicasReply
-	err := m.RPCGetReplicas(gfs.GetReplicasArg{handle}, &l)
+	err := m.RPCGetReplicas(gfs.GetReplicasArg{Handle: handle}, &l)
 	if err != nil {
 		t.Error(err)
 	}
@@ -210,7 +534,7 @@ func TestAppendChunk(t *testing.T) {
 	var r1 gfs.GetChunkHandleReply
 	p := gfs.Path("/TestAppendChunk.txt")
 	ch := make(chan error, 2*N+2)
-	ch <- m.RPCCreateFile(gfs.CreateFileArg{p}, &gfs.CreateFileReply{})
+	ch <- m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
 	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
 	expected := make(map[int][]byte)
 	for i := 0; i < N; i++ {
@@ -258,6 +582,45 @@ func TestAppendChunk(t *testing.T) {
 	errorAll(ch, 2*N+2, t)
 }
 
+func TestChunkServerStatsSummary(t *testing.T) {
+	tc := newTestCluster(0)
+	defer tc.Shutdown()
+
+	latency := make([]float64, 100)
+	for i := range latency {
+		latency[i] = float64(100 - i) // 100ms, 99ms, ..., 1ms
+	}
+	args := gfs.HeartbeatArg{
+		Address: ":1",
+		Stats: gfs.ChunkServerStats{
+			ReadLatencyMs:  latency,
+			WriteLatencyMs: latency[50:],
+			ReadBytes:      1000,
+			WriteBytes:     2000,
+		},
+	}
+	// the first heartbeat fails to ask the fake server for a report, but still registers it
+	tc.m.RPCHeartbeat(args, &gfs.HeartbeatReply{})
+
+	var r gfs.GetChunkServerStatsSummaryReply
+	if err := tc.m.RPCGetChunkServerStatsSummary(gfs.GetChunkServerStatsSummaryArg{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Servers) != 1 {
+		t.Fatal("expect 1 server, got", r.Servers)
+	}
+	sum := r.Servers[0]
+	if sum.P50ReadLatencyMs != 50 || sum.P95ReadLatencyMs != 95 || sum.P99ReadLatencyMs != 99 {
+		t.Error("wrong read latency percentiles", sum)
+	}
+	if sum.P50WriteLatencyMs != 25 {
+		t.Error("wrong write latency median", sum.P50WriteLatencyMs)
+	}
+	if sum.TotalReadBytes != 1000 || sum.TotalWriteBytes != 2000 {
+		t.Error("wrong byte counters", sum)
+	}
+}
+
 /*
  *  TEST SUITE 2 - Client API
  */
@@ -267,7 +630,7 @@ func TestAppendChunk(t *testing.T) {
 func TestPadOver(t *testing.T) {
 	p := gfs.Path("/appendover.txt")
 
-	ch := make(chan error, 6)
+	ch := make(chan error, 7)
 	ch <- c.Create(p)
 
 	bound := gfs.MaxAppendSize - 1
@@ -289,7 +652,20 @@ func TestPadOver(t *testing.T) {
 		t.Error("data should be appended to the beginning of next chunk")
 	}
 
-	errorAll(ch, 6, t)
+	res := make([]byte, len(buf))
+	_, err = c.Read(p, offset, res)
+	ch <- err
+	if !reflect.DeepEqual(buf, res) {
+		t.Error("read wrong data after pad", string(res))
+	}
+
+	// a single append may not exceed a quarter of chunk size
+	_, err = c.Append(p, make([]byte, gfs.MaxAppendSize+1))
+	if e, ok := err.(gfs.Error); !ok || e.Code != gfs.AppendExceedMaxSize {
+		t.Error("expect AppendExceedMaxSize, got", err)
+	}
+
+	errorAll(ch, 7, t)
 }
 
 // big data that invokes several chunks
@@ -379,7 +755,7 @@ func TestComprehensiveOperation(t *testing.T) {
 			j := (i - 1 + csNum) % csNum
 			jj := strconv.Itoa(j)
 			cs[i].Shutdown()
-			cs[j] = chunkserver.NewAndServe(csAdd[j], mAdd, path.Join(root, "cs"+jj))
+			cs[j] = chunkserver.NewAndServe(csAdd[j], mAdd, path.Join(root, "cs"+jj), nil)
 			i = (i + 1) % csNum
 			time.Sleep(gfs.ServerTimeout + gfs.LeaseExpire)
 		}
@@ -530,7 +906,7 @@ func TestShutdownInAppend(t *testing.T) {
 	var r1 gfs.GetChunkHandleReply
 	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
 	var l gfs.GetReplicasReply
-	ch <- m.RPCGetReplicas(gfs.GetReplicasArg{r1.Handle}, &l)
+	ch <- m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r1.Handle}, &l)
 
 	for i := 0; i < N; i++ {
 		go func(x int) {
@@ -582,7 +958,7 @@ func TestShutdownInAppend(t *testing.T) {
 	for i, _ := range cs {
 		if csAdd[i] == l.Locations[0] || csAdd[i] == l.Locations[1] {
 			ii := strconv.Itoa(i)
-			cs[i] = chunkserver.NewAndServe(csAdd[i], mAdd, path.Join(root, "cs"+ii))
+			cs[i] = chunkserver.NewAndServe(csAdd[i], mAdd, path.Join(root, "cs"+ii), nil)
 		}
 	}
 }
@@ -603,8 +979,8 @@ func TestReReplication(t *testing.T) {
 	cs[2].Shutdown()
 	time.Sleep(gfs.ServerTimeout * 2)
 
-	cs[1] = chunkserver.NewAndServe(csAdd[1], mAdd, path.Join(root, "cs1"))
-	cs[2] = chunkserver.NewAndServe(csAdd[2], mAdd, path.Join(root, "cs2"))
+	cs[1] = chunkserver.NewAndServe(csAdd[1], mAdd, path.Join(root, "cs1"), nil)
+	cs[2] = chunkserver.NewAndServe(csAdd[2], mAdd, path.Join(root, "cs2"), nil)
 
 	cs[3].Shutdown()
 	time.Sleep(gfs.ServerTimeout * 2)
@@ -612,14 +988,14 @@ func TestReReplication(t *testing.T) {
 	cs[4].Shutdown()
 	time.Sleep(gfs.ServerTimeout * 2)
 
-	cs[3] = chunkserver.NewAndServe(csAdd[3], mAdd, path.Join(root, "cs3"))
-	cs[4] = chunkserver.NewAndServe(csAdd[4], mAdd, path.Join(root, "cs4"))
+	cs[3] = chunkserver.NewAndServe(csAdd[3], mAdd, path.Join(root, "cs3"), nil)
+	cs[4] = chunkserver.NewAndServe(csAdd[4], mAdd, path.Join(root, "cs4"), nil)
 	time.Sleep(gfs.ServerTimeout)
 
 	cs[0].Shutdown()
 	time.Sleep(gfs.ServerTimeout * 2)
 
-	cs[0] = chunkserver.NewAndServe(csAdd[0], mAdd, path.Join(root, "cs0"))
+	cs[0] = chunkserver.NewAndServe(csAdd[0], mAdd, path.Join(root, "cs0"), nil)
 	time.Sleep(gfs.ServerTimeout)
 
 	// check equality and number of replicas
@@ -693,7 +1069,7 @@ func TestPersistentChunkServer(t *testing.T) {
 	// restart
 	for i := 0; i < csNum; i++ {
 		ii := strconv.Itoa(i)
-		cs[i] = chunkserver.NewAndServe(csAdd[i], mAdd, path.Join(root, "cs"+ii))
+		cs[i] = chunkserver.NewAndServe(csAdd[i], mAdd, path.Join(root, "cs"+ii), nil)
 	}
 
 	fmt.Println("###### Waiting for Chunk Servers to report their chunks to master...")
@@ -723,7 +1099,7 @@ func TestPersistentMaster(t *testing.T) {
 	time.Sleep(2*gfs.ServerTimeout + gfs.LeaseExpire)
 
 	// restart
-	m = master.NewAndServe(mAdd, path.Join(root, "m"))
+	m = startMaster(mAdd, path.Join(root, "m"), nil)
 	time.Sleep(2*gfs.ServerTimeout + gfs.LeaseExpire)
 
 	// check recovery
@@ -747,7 +1123,7 @@ func TestDiskError(t *testing.T) {
 	var r1 gfs.GetChunkHandleReply
 	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
 	var l gfs.GetReplicasReply
-	ch <- m.RPCGetReplicas(gfs.GetReplicasArg{r1.Handle}, &l)
+	ch <- m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r1.Handle}, &l)
 
 	fmt.Println("###### Destory two chunkserver's diskes")
 	// destory two server's disk
@@ -772,6 +1148,5231 @@ func TestDiskError(t *testing.T) {
 	errorAll(ch, 5, t)
 }
 
+// Operator forces re-replication of a chunk which lost a replica
+func TestForceChunkReplication(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/force-replication.txt")
+	ch := make(chan error, 4)
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+	var r1 gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r1)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r1.Handle}, &l)
+
+	// kill a server holding the chunk
+	dead := l.Locations[0]
+	for i, v := range tc.csAdd {
+		if v == dead {
+			tc.cs[i].Shutdown()
+		}
+	}
+	time.Sleep(2 * gfs.ServerTimeout)
+
+	// the background task may have re-replicated it already
+	err := tc.m.RPCForceChunkReplication(gfs.ForceChunkReplicationArg{r1.Handle}, &gfs.ForceChunkReplicationReply{})
+	if err != gfs.ErrAlreadyReplicated {
+		ch <- err
+	} else {
+		ch <- nil
+	}
+
+	var l2 gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r1.Handle}, &l2); err != nil {
+		t.Error(err)
+	}
+	if len(l2.Locations) != gfs.DefaultNumReplicas {
+		t.Error("expect", gfs.DefaultNumReplicas, "replicas after forced replication, got", l2.Locations)
+	}
+	for _, v := range l2.Locations {
+		if v == dead {
+			t.Error("dead server", dead, "should not hold a replica")
+		}
+	}
+
+	err = tc.m.RPCForceChunkReplication(gfs.ForceChunkReplicationArg{r1.Handle}, &gfs.ForceChunkReplicationReply{})
+	if err != gfs.ErrAlreadyReplicated {
+		t.Error("expect ErrAlreadyReplicated, got", err)
+	}
+
+	errorAll(ch, 4, t)
+}
+
+// Restart a standalone master on the same root and check its namespace and chunks
+func TestMasterRestartMetadata(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/meta/data.txt")
+	ch := make(chan error, 8)
+	ch <- tc.m.RPCMkdir(gfs.MkdirArg{Path: "/meta"}, &gfs.MkdirReply{})
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+	var r0, r1 gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r0)
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 1}, &r1)
+	ch <- tc.c.Write(p, 0, []byte("persistent"))
+
+	tc.m.Shutdown()
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	time.Sleep(gfs.ServerTimeout)
+
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.IsDir || f.Chunks != 2 {
+		t.Error("wrong file info after restart", f)
+	}
+	var d gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: "/meta"}, &d)
+	if !d.IsDir {
+		t.Error("/meta should still be a directory after restart")
+	}
+
+	var r2 gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 1}, &r2)
+	if r2.Handle != r1.Handle {
+		t.Error("chunk handle changes after restart", r1.Handle, r2.Handle)
+	}
+
+	// new chunks must not reuse old handles
+	var r3 gfs.GetChunkHandleReply
+	if err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 2}, &r3); err != nil {
+		t.Error(err)
+	}
+	if r3.Handle == r0.Handle || r3.Handle == r1.Handle {
+		t.Error("new chunk reuses handle", r3.Handle)
+	}
+
+	buf := make([]byte, 10)
+	if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != "persistent" {
+		t.Error("read wrong data after restart", string(buf), err)
+	}
+
+	errorAll(ch, 8, t)
+}
+
+// A restarted master grants no lease of an old chunk until a lease granted before
+// the restart has expired, while a chunk allocated after the restart is leased at once
+func TestLeaseGraceAfterRestart(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestLeaseGraceAfterRestart.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("leased"))
+	var r0 gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r0)
+
+	tc.m.Shutdown()
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	restart := time.Now() // the grace period starts before master serves
+	time.Sleep(3 * gfs.HeartbeatInterval)
+
+	var l gfs.GetPrimaryAndSecondariesReply
+	err := tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r0.Handle}, &l)
+	if !gfs.IsError(err, gfs.ErrLeaseGrace) {
+		t.Error("expect no lease in the grace period, got", l, err)
+	}
+
+	var r1 gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 1}, &r1)
+	if err := tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r1.Handle}, &l); err != nil {
+		t.Error("a new chunk should be leased in the grace period:", err)
+	}
+
+	time.Sleep(time.Until(restart.Add(gfs.LeaseExpire)))
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r0.Handle}, &l)
+	errorAll(ch, 5, t)
+}
+
+// The port of a master can be bound again right after it shuts down
+func TestMasterShutdownReleasesPort(t *testing.T) {
+	tc := newTestCluster(0)
+	tc.m.Shutdown()
+
+	l, err := net.Listen("tcp", string(tc.mAdd))
+	if err != nil {
+		t.Fatal("port is still bound after shutdown: ", err)
+	}
+	l.Close()
+
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	if err := util.Call(tc.mAdd, "Master.RPCMkdir", gfs.MkdirArg{Path: "/restarted"}, &gfs.MkdirReply{}); err != nil {
+		t.Error(err)
+	}
+	tc.Shutdown()
+}
+
+// Crash a standalone master and recover its namespace from the operation log
+func TestMasterOperationLog(t *testing.T) {
+	tc := newTestCluster(0)
+	defer tc.Shutdown()
+
+	ch := make(chan error, 8)
+	ch <- tc.m.RPCMkdir(gfs.MkdirArg{Path: "/log"}, &gfs.MkdirReply{})
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: "/log/a.txt"}, &gfs.CreateFileReply{})
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: "/log/b.txt"}, &gfs.CreateFileReply{})
+	ch <- tc.m.RPCDeleteFile(gfs.DeleteFileArg{Path: "/log/b.txt"}, &gfs.DeleteFileReply{})
+
+	// keep the log as it is before the master crashes, and leave a torn record at its end
+	logFile := path.Join(tc.root, "m", master.LogFileName)
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m.Shutdown()
+	os.Remove(path.Join(tc.root, "m", master.MetaFileName))
+	ioutil.WriteFile(logFile, append(data, 42, 0, 0, 0, 1, 2), 0755)
+
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: "/log/a.txt"}, &f)
+	if err := tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: "/log/b.txt"}, &f); err == nil {
+		t.Error("deleted file is recovered")
+	}
+
+	// the deleted file is kept under its hidden name, which is not listed
+	var l gfs.ListReply
+	ch <- tc.m.RPCList(gfs.ListArg{Path: "/log"}, &l)
+	var st gfs.MasterStatsReply
+	ch <- tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &st)
+	if len(l.Files) != 1 || l.Files[0].Name != "a.txt" || st.Files != 2 {
+		t.Error("wrong namespace after replay", l.Files, st.Files)
+	}
+
+	// the torn record is cut off, so new records can be replayed later
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: "/log/c.txt"}, &gfs.CreateFileReply{})
+	data, _ = ioutil.ReadFile(logFile)
+	tc.m.Shutdown()
+	os.Remove(path.Join(tc.root, "m", master.MetaFileName))
+	ioutil.WriteFile(logFile, data, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	if err := tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: "/log/c.txt"}, &f); err != nil {
+		t.Error("file created after a torn record is lost: ", err)
+	}
+
+	errorAll(ch, 8, t)
+}
+
+// The operation log is compacted by a checkpoint once it grows past the limit, and the
+// checkpoint with the log after it is replayed after a crash
+func TestLogCompaction(t *testing.T) {
+	tc := newTestCluster(0, master.WithLogCompaction(4096, 0), master.WithBackgroundInterval(100*time.Millisecond))
+	defer tc.Shutdown()
+
+	n := 100
+	ch := make(chan error, n+3)
+	ch <- tc.m.RPCMkdir(gfs.MkdirArg{Path: "/compact"}, &gfs.MkdirReply{})
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/compact/%v.txt", i))
+		ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: p}, &gfs.CreateFileReply{})
+	}
+
+	logFile := path.Join(tc.root, "m", master.LogFileName)
+	metaFile := path.Join(tc.root, "m", master.MetaFileName)
+	compacted := false
+	for i := 0; i < 20 && !compacted; i++ {
+		time.Sleep(100 * time.Millisecond)
+		info, err := os.Stat(logFile)
+		compacted = err == nil && info.Size() < 4096
+	}
+	if !compacted {
+		t.Fatal("operation log is not compacted")
+	}
+
+	// the master crashes with operations logged after the checkpoint
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: "/compact/last.txt"}, &gfs.CreateFileReply{})
+	meta, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m.Shutdown()
+	ioutil.WriteFile(metaFile, meta, 0755)
+	ioutil.WriteFile(logFile, data, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+
+	var l gfs.ListReply
+	ch <- tc.m.RPCList(gfs.ListArg{Path: "/compact"}, &l)
+	if len(l.Files) != n+1 {
+		t.Error("expect", n+1, "files after replay, got", len(l.Files))
+	}
+	errorAll(ch, n+3, t)
+}
+
+// The operations in a checkpoint are not replayed again if master stops before the log is compacted
+func TestCheckpointReplay(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/replay.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Delete(p)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("live"))
+	errorAll(ch, 4, t)
+
+	// the checkpoint is stored on shutdown, but the log is kept as it is before compaction
+	logFile := path.Join(tc.root, "m", master.LogFileName)
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m.Shutdown()
+	ioutil.WriteFile(logFile, data, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+
+	buf := make([]byte, 4)
+	if n, err := tc.c.Read(p, 0, buf); err != nil || string(buf[:n]) != "live" {
+		t.Errorf("expect the live file after replay, got %q: %v", buf[:n], err)
+	}
+}
+
+// A chunkserver misses a write while it is offline, its replica must not be used after it comes back
+func TestStaleReplica(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	// the third server receives a new replica when the stale one is offline
+	p := gfs.Path("/stale.txt")
+	ch := make(chan error, 6)
+	ch <- tc.c.CreateWithReplicaFactor(p, 2)
+	ch <- tc.c.Write(p, 0, []byte("version one"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l0 gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l0)
+
+	stale := 0
+	for i, v := range tc.csAdd {
+		if v == l0.Locations[0] {
+			stale = i
+		}
+	}
+	tc.cs[stale].Shutdown()
+	time.Sleep(gfs.LeaseExpire)
+
+	// a new lease increases the version on the alive servers
+	ch <- tc.c.Write(p, 0, []byte("version two"))
+
+	tc.startChunkServer(stale)
+	time.Sleep(gfs.ServerTimeout)
+
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	for _, v := range l.Locations {
+		if v == tc.csAdd[stale] {
+			t.Error("stale replica on", v, "is returned")
+		}
+	}
+	if len(l.Locations) != 2 {
+		t.Error("expect 2 up-to-date replicas, got", l.Locations)
+	}
+
+	errorAll(ch, 6, t)
+}
+
+// Files with different replication factors keep their own number of replicas
+func TestReplicaFactor(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	cold := gfs.Path("/cold.txt")
+	hot := gfs.Path("/hot.txt")
+	ch := make(chan error, 8)
+	ch <- tc.c.CreateWithReplicaFactor(cold, 1)
+	ch <- tc.c.CreateWithReplicaFactor(hot, 3)
+	if err := tc.c.CreateWithReplicaFactor("/invalid.txt", -1); err == nil {
+		t.Error("negative replica factor should be rejected")
+	}
+
+	var rc, rh gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{cold, 0}, &rc)
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{hot, 0}, &rh)
+	var lc, lh gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: rc.Handle}, &lc)
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: rh.Handle}, &lh)
+	if len(lc.Locations) != 1 || len(lh.Locations) != 3 {
+		t.Fatal("wrong number of replicas", lc.Locations, lh.Locations)
+	}
+
+	// kill a server of hot file which does not hold cold file
+	var dead gfs.ServerAddress
+	for _, v := range lh.Locations {
+		if v != lc.Locations[0] {
+			dead = v
+		}
+	}
+	for i, v := range tc.csAdd {
+		if v == dead {
+			tc.cs[i].Shutdown()
+		}
+	}
+	time.Sleep(2*gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+
+	var lc2, lh2 gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: rc.Handle}, &lc2)
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: rh.Handle}, &lh2)
+	if len(lc2.Locations) != 1 {
+		t.Error("cold file should keep 1 replica, got", lc2.Locations)
+	}
+	if len(lh2.Locations) != 3 {
+		t.Error("hot file should be re-replicated to 3 replicas, got", lh2.Locations)
+	}
+	for _, v := range lh2.Locations {
+		if v == dead {
+			t.Error("dead server", dead, "should not hold a replica")
+		}
+	}
+
+	errorAll(ch, 8, t)
+}
+
+// A new chunkserver receives chunks from the loaded ones
+func TestRebalance(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	n := 6
+	ch := make(chan error, 3*n)
+	handles := make([]gfs.ChunkHandle, n)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/rebalance%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		handles[i] = r.Handle
+	}
+	errorAll(ch, 3*n, t)
+
+	// recently leased chunks are not moved
+	time.Sleep(2 * gfs.LeaseExpire)
+	added := tc.addChunkServer()
+	time.Sleep(4 * gfs.RebalanceInterval)
+
+	moved := 0
+	for _, h := range handles {
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h}, &l); err != nil {
+			t.Error(err)
+		}
+		if len(l.Locations) != gfs.DefaultNumReplicas {
+			t.Error("chunk", h, "has wrong number of replicas", l.Locations)
+		}
+		for _, v := range l.Locations {
+			if v == tc.csAdd[added] {
+				moved++
+			}
+		}
+	}
+	if moved < 3 {
+		t.Error("expect at least 3 chunks moved to the new server, got", moved)
+	}
+
+	// data is still readable from every replica
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/rebalance%v.txt", i))
+		for j := 0; j < 3; j++ {
+			buf := make([]byte, len(p))
+			if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != string(p) {
+				t.Error("read wrong data after rebalance", string(buf), err)
+			}
+		}
+	}
+}
+
+// Decommission a chunkserver, its chunks are moved to the other servers
+func TestDecommission(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	n := 4
+	ch := make(chan error, 3*n+2)
+	handles := make([]gfs.ChunkHandle, n)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/decommission%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		handles[i] = r.Handle
+	}
+
+	gone := tc.csAdd[0]
+	if err := tc.m.RPCDecommissionServer(gfs.DecommissionServerArg{"127.0.0.1:1"}, &gfs.DecommissionServerReply{}); err == nil {
+		t.Error("decommission an unknown server should fail")
+	}
+	ch <- tc.m.RPCDecommissionServer(gfs.DecommissionServerArg{gone}, &gfs.DecommissionServerReply{})
+
+	for _, h := range handles {
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h}, &l); err != nil {
+			t.Error(err)
+		}
+		if len(l.Locations) < gfs.DefaultNumReplicas {
+			t.Error("chunk", h, "is under-replicated", l.Locations)
+		}
+		for _, v := range l.Locations {
+			if v == gone {
+				t.Error("decommissioned server", gone, "still holds chunk", h)
+			}
+		}
+	}
+
+	// new chunks are not placed on the decommissioned server
+	p := gfs.Path("/decommission-new.txt")
+	ch <- tc.c.Create(p)
+	var r gfs.GetChunkHandleReply
+	if err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r); err != nil {
+		t.Error(err)
+	}
+	var l gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Error(err)
+	}
+	for _, v := range l.Locations {
+		if v == gone {
+			t.Error("new chunk is placed on decommissioned server", gone)
+		}
+	}
+
+	tc.cs[0].Shutdown()
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/decommission%v.txt", i))
+		buf := make([]byte, len(p))
+		if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != string(p) {
+			t.Error("read wrong data after decommission", string(buf), err)
+		}
+	}
+
+	errorAll(ch, 3*n+2, t)
+}
+
+// A chunk being drained is not locked while the drain waits for a lease it cannot revoke
+func TestDecommissionWaitUnlocked(t *testing.T) {
+	tc := newTestCluster(5)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/decommission-wait.txt")
+	ch := make(chan error, 6)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte(p))
+	var h gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{Path: p, Index: 0}, &h)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: h.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	// the lease cannot be revoked from a dead primary
+	for i, v := range tc.csAdd {
+		if v == l.Primary {
+			tc.cs[i].Shutdown()
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.m.RPCDecommissionServer(gfs.DecommissionServerArg{l.Secondaries[0]}, &gfs.DecommissionServerReply{})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	ch <- tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{Handle: h.Handle}, &gfs.GetChunkInfoReply{})
+	if d := time.Since(start); d > gfs.LeaseExpire/4 {
+		t.Error("chunk is locked by the waiting drain", d)
+	}
+	ch <- <-done
+	errorAll(ch, 2, t)
+}
+
+// A cluster with fewer servers than the default replicas stores as many replicas as it
+// can, and the chunks are not left waiting for re-replication
+func TestDefaultReplicas(t *testing.T) {
+	replicas := func(tc *testCluster, p gfs.Path) []gfs.ServerAddress {
+		ch := make(chan error, 3)
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte("replicas"))
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		errorAll(ch, 3, t)
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+			t.Error(err)
+		}
+		return l.Locations
+	}
+
+	tc := newTestCluster(2)
+	if l := replicas(tc, "/TestDefaultReplicas.txt"); len(l) != 2 {
+		t.Error("expect 2 replicas on two servers, got", l)
+	}
+	time.Sleep(2 * gfs.ServerCheckInterval)
+	var st gfs.MasterStatsReply
+	if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &st); err != nil {
+		t.Error(err)
+	}
+	if st.UnderReplicated != 0 || st.NeedListDepth != 0 || st.ReReplicateFailed != 0 {
+		t.Error("chunks wait for replicas two servers cannot hold", st)
+	}
+	tc.Shutdown()
+
+	tc = newTestCluster(3, master.WithDefaultReplicas(2))
+	defer tc.Shutdown()
+	if l := replicas(tc, "/TestDefaultReplicas.txt"); len(l) != 2 {
+		t.Error("expect the default of 2 replicas, got", l)
+	}
+}
+
+// New chunks are refused while too many chunks wait for re-replication, and the
+// existing ones are still read
+func TestClusterDegraded(t *testing.T) {
+	tc := newTestCluster(4, master.WithMaxNeedList(2))
+	defer tc.Shutdown()
+
+	// the spare server has no space, so the chunks on a dead server cannot be copied
+	tc.cs[3].SetCapacity(gfs.MinFreeSpace / 2)
+	time.Sleep(2 * gfs.HeartbeatInterval)
+	n := 3
+	ch := make(chan error, 2*n+1)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/degraded%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+	}
+	tc.cs[0].Shutdown()
+
+	var st gfs.MasterStatsReply
+	for i := 0; i < 50 && st.NeedListDepth <= 2; i++ {
+		time.Sleep(gfs.ServerTimeout / 5)
+		if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.NeedListDepth <= 2 {
+		t.Fatal("expect more than 2 chunks waiting for re-replication, got", st.NeedListDepth)
+	}
+
+	var r gfs.GetChunkHandleReply
+	err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{"/degraded0.txt", 1}, &r)
+	if !gfs.IsError(err, gfs.ErrClusterDegraded) {
+		t.Error("expect a new chunk refused in a degraded cluster, got", err)
+	}
+	ch <- tc.c.Create("/degraded-new.txt")
+	if err := tc.c.Write("/degraded-new.txt", 0, []byte("new")); !gfs.IsError(err, gfs.ErrClusterDegraded) {
+		t.Error("expect a write to a new chunk refused in a degraded cluster, got", err)
+	}
+
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/degraded%v.txt", i))
+		buf := make([]byte, len(p))
+		if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != string(p) {
+			t.Error("read", p, "in a degraded cluster:", string(buf), err)
+		}
+	}
+	errorAll(ch, 2*n+1, t)
+}
+
+// A nearly full chunkserver is not chosen for new chunks
+func TestChooseServersBySpace(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	tc.cs[0].SetCapacity(gfs.MinFreeSpace / 2)
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	n := 8
+	ch := make(chan error, 2*n+1)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/space%v.txt", i))
+		ch <- tc.c.Create(p)
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+			t.Error(err)
+		}
+		for _, v := range l.Locations {
+			if v == tc.csAdd[0] {
+				t.Error("new chunk is placed on full server", v)
+			}
+		}
+	}
+
+	// not enough servers with free space
+	tc.cs[1].SetCapacity(gfs.MinFreeSpace / 2)
+	time.Sleep(2 * gfs.HeartbeatInterval)
+	p := gfs.Path("/space-full.txt")
+	ch <- tc.c.Create(p)
+	var r gfs.GetChunkHandleReply
+	if err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r); err != gfs.ErrNoSpace {
+		t.Error("expect no space error, got", err)
+	}
+	var f gfs.GetFileInfoReply
+	if err := tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f); err != nil || f.Chunks != 0 {
+		t.Error("failed chunk allocation should not be counted", f.Chunks, err)
+	}
+
+	errorAll(ch, 2*n+1, t)
+}
+
+// The free space a chunkserver keeps is set by master option
+func TestMinFreeSpace(t *testing.T) {
+	addr := gfs.ServerAddress(fmt.Sprintf(":%v", nextPort))
+	nextPort++
+	if _, err := master.NewAndServe(addr, path.Join(root, "nofree"), nil, master.WithMinFreeSpace(-1)); err == nil {
+		t.Error("expect master to refuse a negative min free space")
+	}
+
+	tc := newTestCluster(3, master.WithMinFreeSpace(gfs.MinFreeSpace/4))
+	defer tc.Shutdown()
+	for _, cs := range tc.cs {
+		cs.SetCapacity(gfs.MinFreeSpace / 2)
+	}
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	// the servers are short of the default, but keep more than the option
+	p := gfs.Path("/TestMinFreeSpace.txt")
+	if err := tc.c.Create(p); err != nil {
+		t.Fatal(err)
+	}
+	var r gfs.GetChunkHandleReply
+	if err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r); err != nil {
+		t.Error("expect a new chunk on servers with more than min free space, got", err)
+	}
+
+	// with no min free space, servers with no free space at all are still chosen
+	tc0 := newTestCluster(3, master.WithMinFreeSpace(0))
+	defer tc0.Shutdown()
+	for _, cs := range tc0.cs {
+		cs.SetCapacity(gfs.MaxChunkSize) // filled up by the reservation of the first chunk
+	}
+	if err := tc0.c.Create(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc0.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * gfs.HeartbeatInterval)
+	var l gfs.ListChunkServersReply
+	if err := tc0.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &l); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range l.Servers {
+		if v.FreeBytes != 0 {
+			t.Error("expect no free space on", v.Address, "got", v.FreeBytes)
+		}
+	}
+	err := tc0.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 1}, &r)
+	if !gfs.IsError(err, gfs.ErrNoSpace) {
+		t.Error("expect a chunk refused by servers with no space, got", err)
+	}
+}
+
+// Flip a byte in a stored chunk, the replica is detected as corrupted and replaced
+func TestChecksumMismatch(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/checksum.txt")
+	data := make([]byte, 3*gfs.ChecksumBlockSize)
+	for i := range data {
+		data[i] = byte(i%26 + 'a')
+	}
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, data)
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	bad := -1
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			bad = i
+		}
+	}
+	tc.cs[bad].SetScrubRate(0) // the corruption is found by reads here, see TestScrub
+	filename := path.Join(tc.root, "cs"+strconv.Itoa(bad), fmt.Sprintf("chunk%v.chk", r.Handle))
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'#'}, gfs.ChecksumBlockSize+10)
+	f.Close()
+
+	// reading an intact block still works
+	var rr gfs.ReadChunkReply
+	if err := tc.cs[bad].RPCReadChunk(gfs.ReadChunkArg{r.Handle, 0, 100}, &rr); err != nil {
+		t.Error("read intact block:", err)
+	}
+	rr = gfs.ReadChunkReply{}
+	err = tc.cs[bad].RPCReadChunk(gfs.ReadChunkArg{r.Handle, gfs.ChecksumBlockSize, 100}, &rr)
+	if err != gfs.ErrChecksumMismatch || rr.ErrorCode != gfs.ChecksumMismatch {
+		t.Error("expect checksum mismatch, got", err)
+	}
+
+	// client reads from other replicas
+	buf := make([]byte, len(data))
+	if _, err := tc.c.Read(p, 0, buf); err != nil || !reflect.DeepEqual(buf, data) {
+		t.Error("read wrong data with a corrupted replica", err)
+	}
+
+	// the corrupted replica is reported and replaced
+	time.Sleep(2*gfs.HeartbeatInterval + 2*gfs.ServerCheckInterval)
+	var l2 gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l2); err != nil {
+		t.Error(err)
+	}
+	if len(l2.Locations) != gfs.DefaultNumReplicas {
+		t.Error("corrupted replica is not re-replicated", l2.Locations)
+	}
+	for _, v := range l2.Locations {
+		if v == tc.csAdd[bad] {
+			// re-created from a good replica
+			var rr gfs.ReadChunkReply
+			if err := tc.cs[bad].RPCReadChunk(gfs.ReadChunkArg{r.Handle, gfs.ChecksumBlockSize, 100}, &rr); err != nil {
+				t.Error("replica on", v, "is still corrupted:", err)
+			}
+		}
+	}
+}
+
+// The last replica of a chunk is kept when it is corrupted, its intact blocks can still be read
+func TestCorruptedLastReplica(t *testing.T) {
+	tc := newTestCluster(2)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestCorruptedLastReplica.txt")
+	data := make([]byte, 2*gfs.ChecksumBlockSize)
+	for i := range data {
+		data[i] = byte(i%26 + 'a')
+	}
+	ch := make(chan error, 4)
+	ch <- tc.c.CreateWithReplicaFactor(p, 1)
+	ch <- tc.c.Write(p, 0, data)
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+	if len(l.Locations) != 1 {
+		t.Fatal("expect a single replica, got", l.Locations)
+	}
+
+	bad := -1
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			bad = i
+		}
+		tc.cs[i].SetScrubRate(0)
+	}
+	filename := path.Join(tc.root, "cs"+strconv.Itoa(bad), fmt.Sprintf("chunk%v.chk", r.Handle))
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'#'}, gfs.ChecksumBlockSize+10)
+	f.Close()
+
+	var rr gfs.ReadChunkReply
+	if err := tc.cs[bad].RPCReadChunk(gfs.ReadChunkArg{r.Handle, gfs.ChecksumBlockSize, 100}, &rr); err != gfs.ErrChecksumMismatch {
+		t.Error("expect checksum mismatch, got", err)
+	}
+
+	// there is no good replica to copy from, the corrupted one is reported but kept
+	time.Sleep(2*gfs.HeartbeatInterval + 2*gfs.ServerCheckInterval)
+	var l2 gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l2); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(l2.Locations, l.Locations) {
+		t.Error("the last replica is dropped:", l2.Locations)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Error("the last replica is deleted:", err)
+	}
+	rr = gfs.ReadChunkReply{}
+	if err := tc.cs[bad].RPCReadChunk(gfs.ReadChunkArg{r.Handle, 0, 100}, &rr); err != nil || !bytes.Equal(rr.Data, data[:100]) {
+		t.Error("read intact block of the last replica:", err)
+	}
+}
+
+// A copy which does not match the checksums of its source is refused, so a corrupted
+// replica is not copied to another server
+func TestCopyChecksum(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestCopyChecksum.txt")
+	data := make([]byte, 2*gfs.ChecksumBlockSize+100)
+	for i := range data {
+		data[i] = byte(i%26 + 'a')
+	}
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, data)
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	src, dst := -1, -1
+	for i, v := range tc.csAdd {
+		held := false
+		for _, a := range l.Locations {
+			held = held || a == v
+		}
+		if held && src < 0 {
+			src = i
+		} else if !held {
+			dst = i
+		}
+	}
+	ch <- tc.cs[dst].RPCCreateChunk(gfs.CreateChunkArg{Handle: r.Handle}, &gfs.CreateChunkReply{})
+	empty := func() {
+		var rr gfs.ReadChunkReply
+		tc.cs[dst].RPCReadChunk(gfs.ReadChunkArg{r.Handle, 0, len(data)}, &rr)
+		if rr.Length != 0 {
+			t.Error("a bad copy is applied, read", rr.Length, "bytes")
+		}
+	}
+
+	// the data is corrupted on its way
+	var checksums []uint32
+	for i := 0; i < len(data); i += gfs.ChecksumBlockSize {
+		block := make([]byte, gfs.ChecksumBlockSize)
+		copy(block, data[i:])
+		checksums = append(checksums, crc32.ChecksumIEEE(block))
+	}
+	bad := append([]byte(nil), data...)
+	bad[gfs.ChecksumBlockSize+10] = '#'
+	err := tc.cs[dst].RPCApplyCopy(gfs.ApplyCopyArg{Handle: r.Handle, Data: bad, Checksums: checksums}, &gfs.ApplyCopyReply{})
+	if !gfs.IsError(err, gfs.ErrChecksumMismatch) {
+		t.Error("expect checksum mismatch, got", err)
+	}
+	empty()
+
+	// the source is corrupted on disk
+	tc.cs[src].SetScrubRate(0)
+	f, err := os.OpenFile(path.Join(tc.root, "cs"+strconv.Itoa(src), fmt.Sprintf("chunk%v.chk", r.Handle)), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'#'}, 10)
+	f.Close()
+	err = tc.cs[src].RPCSendCopy(gfs.SendCopyArg{r.Handle, tc.csAdd[dst], r.Handle}, &gfs.SendCopyReply{})
+	if !gfs.IsError(err, gfs.ErrChecksumMismatch) {
+		t.Error("expect checksum mismatch, got", err)
+	}
+	empty()
+	errorAll(ch, 1, t)
+}
+
+// An invalidated replica is deleted and re-replicated, but the last one is kept
+func TestInvalidateReplica(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestInvalidateReplica.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("invalidate"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	bad := l.Locations[0]
+	ch <- tc.m.RPCInvalidateReplica(gfs.InvalidateReplicaArg{Handle: r.Handle, Server: bad}, &gfs.InvalidateReplicaReply{})
+	errorAll(ch, 1, t)
+	for i, v := range tc.csAdd {
+		if v != bad {
+			continue
+		}
+		_, err := os.Stat(path.Join(tc.root, "cs"+strconv.Itoa(i), fmt.Sprintf("chunk%v.chk", r.Handle)))
+		if !os.IsNotExist(err) {
+			t.Error("invalidated replica is not deleted:", err)
+		}
+	}
+
+	time.Sleep(2 * gfs.ServerCheckInterval)
+	l = gfs.GetReplicasReply{}
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 1, t)
+	if len(l.Locations) != gfs.DefaultNumReplicas {
+		t.Error("expect", gfs.DefaultNumReplicas, "replicas after re-replication, got", l.Locations)
+	}
+
+	// a chunk with one replica
+	q := gfs.Path("/TestInvalidateReplica1.txt")
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: q, ReplicaFactor: 1}, &gfs.CreateFileReply{})
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{q, 0}, &r)
+	l = gfs.GetReplicasReply{}
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 3, t)
+	last := gfs.InvalidateReplicaArg{Handle: r.Handle, Server: l.Locations[0]}
+	if err := tc.m.RPCInvalidateReplica(last, &gfs.InvalidateReplicaReply{}); err == nil {
+		t.Error("the last replica is invalidated without force")
+	}
+	last.Force = true
+	ch <- tc.m.RPCInvalidateReplica(last, &gfs.InvalidateReplicaReply{})
+	errorAll(ch, 1, t)
+}
+
+// A replica with repeated checksum mismatches is quarantined and re-replicated elsewhere
+func TestQuarantineReplica(t *testing.T) {
+	tc := newTestCluster(5)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestQuarantineReplica.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("quarantine"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	bad := l.Locations[0]
+	held := func() bool {
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range l.Locations {
+			if v == bad {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 1; i <= gfs.MismatchQuarantine; i++ {
+		var rr gfs.ReportChecksumMismatchReply
+		ch <- tc.m.RPCReportChecksumMismatch(gfs.ReportChecksumMismatchArg{r.Handle, bad}, &rr)
+		errorAll(ch, 1, t)
+		if rr.Quarantined != (i == gfs.MismatchQuarantine) {
+			t.Error("quarantined is", rr.Quarantined, "after", i, "mismatches")
+		}
+		if held() != (i < gfs.MismatchQuarantine) {
+			t.Error("replica on", bad, "is held", held(), "after", i, "mismatches")
+		}
+	}
+
+	// the spare server gets the new replica, the quarantined one does not
+	time.Sleep(2 * gfs.ServerCheckInterval)
+	l = gfs.GetReplicasReply{}
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 1, t)
+	if len(l.Locations) != gfs.DefaultNumReplicas || held() {
+		t.Error("expect", gfs.DefaultNumReplicas, "replicas other than", bad, "got", l.Locations)
+	}
+}
+
+// The mismatches reported by client reads are counted towards quarantine
+func TestReportBadReplicaQuarantine(t *testing.T) {
+	tc := newTestCluster(5)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestReportBadReplicaQuarantine.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("quarantine"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	bad := l.Locations[0]
+	for i := 1; i < gfs.MismatchQuarantine; i++ {
+		ch <- tc.m.RPCReportBadReplica(gfs.ReportBadReplicaArg{r.Handle, bad}, &gfs.ReportBadReplicaReply{})
+	}
+	errorAll(ch, gfs.MismatchQuarantine-1, t)
+	var rr gfs.ReportChecksumMismatchReply
+	if err := tc.m.RPCReportChecksumMismatch(gfs.ReportChecksumMismatchArg{r.Handle, bad}, &rr); err != nil || !rr.Quarantined {
+		t.Error("expect the replica on", bad, "quarantined after the reads reporting it, got", rr.Quarantined, err)
+	}
+}
+
+// The replication factor of an existing file is raised and reduced
+func TestSetReplicationFactor(t *testing.T) {
+	chunkSize := int64(gfs.ChecksumBlockSize)
+	tc := newTestCluster(4, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestSetReplicationFactor.txt")
+	ch := make(chan error, 4)
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: p, ReplicaFactor: 2}, &gfs.CreateFileReply{})
+	ch <- tc.c.Write(p, 0, make([]byte, 3*chunkSize))
+	errorAll(ch, 2, t)
+
+	expect := func(n int) {
+		for i := 0; i < 3; i++ {
+			var r gfs.GetChunkHandleReply
+			var l gfs.GetReplicasReply
+			ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, gfs.ChunkIndex(i)}, &r)
+			ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+			errorAll(ch, 2, t)
+			if len(l.Locations) != n {
+				t.Errorf("expect %v replicas of chunk %v, got %v", n, i, l.Locations)
+			}
+		}
+	}
+	expect(2)
+
+	// a checkpoint with the old factor
+	restart := func() {
+		tc.m.Shutdown()
+		tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithChunkSize(chunkSize))
+		time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+	}
+	restart()
+	metaFile, logFile := path.Join(tc.root, "m", master.MetaFileName), path.Join(tc.root, "m", master.LogFileName)
+	meta, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch <- tc.c.SetReplicationFactor(p, 3)
+	errorAll(ch, 1, t)
+	time.Sleep(2 * gfs.ServerCheckInterval)
+	expect(3)
+
+	// the new factor is replayed from the log after a crash, no replica is trimmed
+	oplog, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m.Shutdown()
+	ioutil.WriteFile(metaFile, meta, 0755)
+	ioutil.WriteFile(logFile, oplog, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithChunkSize(chunkSize))
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+	expect(3)
+
+	ch <- tc.c.SetReplicationFactor(p, 1)
+	errorAll(ch, 1, t)
+	time.Sleep(2 * gfs.ServerCheckInterval)
+	expect(1)
+
+	if err := tc.c.SetReplicationFactor(p, 0); err == nil {
+		t.Error("replication factor is set to 0")
+	}
+	if err := tc.c.SetReplicationFactor("/", 3); err == nil {
+		t.Error("replication factor of a directory is set")
+	}
+}
+
+// The chunks, versions and length of a file written after the last checkpoint are replayed from the log
+func TestOperationLogChunks(t *testing.T) {
+	chunkSize := int64(gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestOperationLogChunks.txt")
+	ch := make(chan error, 3)
+	ch <- tc.c.Create(p)
+	errorAll(ch, 1, t)
+
+	// a checkpoint with the file empty
+	tc.m.Shutdown()
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithChunkSize(chunkSize))
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+	metaFile, logFile := path.Join(tc.root, "m", master.MetaFileName), path.Join(tc.root, "m", master.LogFileName)
+	meta, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*chunkSize)
+	rand.Read(data)
+	length := 2 * chunkSize
+	ch <- tc.c.Write(p, 0, data)
+	ch <- tc.c.Truncate(p, chunkSize+chunkSize/2)
+	ch <- tc.c.Write(p, gfs.Offset(chunkSize+chunkSize/2), data[chunkSize+chunkSize/2:length])
+	errorAll(ch, 3, t)
+
+	// crash before another checkpoint
+	oplog, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m.Shutdown()
+	ioutil.WriteFile(metaFile, meta, 0755)
+	ioutil.WriteFile(logFile, oplog, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithChunkSize(chunkSize))
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+
+	var info gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &info)
+	errorAll(ch, 1, t)
+	if info.Length != length || info.Chunks != 2 {
+		t.Errorf("expect %v bytes in 2 chunks, got %v bytes in %v chunks", length, info.Length, info.Chunks)
+	}
+	buf := make([]byte, length)
+	if n, err := tc.c.Read(p, 0, buf); err != nil || !bytes.Equal(buf[:n], data[:length]) {
+		t.Error("data written before crash is lost:", n, err)
+	}
+}
+
+func TestOperationLogCopies(t *testing.T) {
+	chunkSize := int64(gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestOperationLogCopies.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	errorAll(ch, 1, t)
+
+	// a checkpoint with the file empty
+	tc.m.Shutdown()
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithChunkSize(chunkSize))
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+	metaFile, logFile := path.Join(tc.root, "m", master.MetaFileName), path.Join(tc.root, "m", master.LogFileName)
+	meta, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full copy, and a snapshot whose chunks are unshared by the next write
+	q, s := gfs.Path("/TestOperationLogCopies-copy.txt"), gfs.Path("/TestOperationLogCopies-snap.txt")
+	data, update := make([]byte, 2*chunkSize), make([]byte, 2*chunkSize)
+	rand.Read(data)
+	rand.Read(update)
+	ch <- tc.c.Write(p, 0, data)
+	ch <- tc.c.CopyFile(p, q)
+	ch <- tc.c.Snapshot(p, s)
+	ch <- tc.c.Write(p, 0, update)
+	errorAll(ch, 4, t)
+
+	// crash before another checkpoint
+	oplog, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m.Shutdown()
+	ioutil.WriteFile(metaFile, meta, 0755)
+	ioutil.WriteFile(logFile, oplog, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithChunkSize(chunkSize))
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+
+	for f, expected := range map[gfs.Path][]byte{p: update, q: data, s: data} {
+		buf := make([]byte, len(expected))
+		if n, err := tc.c.Read(f, 0, buf); err != nil || !bytes.Equal(buf[:n], expected) {
+			t.Error("copied chunks of", f, "are lost:", n, err)
+		}
+	}
+}
+
+// copySink pretends to be the destination of copies, applying each after delay
+type copySink struct {
+	sync.Mutex
+	delay    time.Duration
+	inFlight int
+	peak     int // most copies applied at once
+	applied  int
+}
+
+func (s *copySink) RPCApplyCopy(args gfs.ApplyCopyArg, reply *gfs.ApplyCopyReply) error {
+	s.Lock()
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	s.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.Lock()
+	s.inFlight--
+	s.applied++
+	s.Unlock()
+	return nil
+}
+
+func (s *copySink) serve(t testing.TB) (gfs.ServerAddress, net.Listener) {
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("ChunkServer", s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return gfs.ServerAddress(l.Addr().String()), l
+}
+
+// A chunkserver sends no more copies at once than its limit, the rest are rejected and retried
+func TestSendCopyThrottle(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestSendCopyThrottle.txt")
+	ch := make(chan error, 3)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("throttle"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	errorAll(ch, 3, t)
+
+	limit, n := 2, 8
+	tc.cs[0].SetMaxSendCopies(limit)
+	sink := &copySink{delay: 200 * time.Millisecond}
+	addr, l := sink.serve(t)
+	defer l.Close()
+
+	var rejected int64
+	ch = make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			arg := gfs.SendCopyArg{Handle: r.Handle, Address: addr, NewHandle: gfs.ChunkHandle(1000 + i)}
+			for {
+				err := tc.cs[0].RPCSendCopy(arg, &gfs.SendCopyReply{})
+				if !gfs.IsError(err, gfs.ErrServerBusy) {
+					ch <- err
+					return
+				}
+				atomic.AddInt64(&rejected, 1)
+				time.Sleep(20 * time.Millisecond)
+			}
+		}(i)
+	}
+	errorAll(ch, n, t)
+
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.peak > limit {
+		t.Error("expect at most", limit, "copies sent at once, got", sink.peak)
+	}
+	if sink.applied != n {
+		t.Error("expect", n, "copies applied, got", sink.applied)
+	}
+	if atomic.LoadInt64(&rejected) == 0 {
+		t.Error("expect copies over the limit to be rejected")
+	}
+}
+
+// A small file is created with its data in one call to master
+func TestCreateSmallFile(t *testing.T) {
+	chunkSize := int64(gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	readBack := func(p gfs.Path, data []byte) {
+		var f gfs.GetFileInfoReply
+		if err := tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f); err != nil || f.Length != int64(len(data)) {
+			t.Error("length of", p, "is", f.Length, err)
+		}
+		buf := make([]byte, len(data))
+		if n, err := tc.c.Read(p, 0, buf); n != len(data) || err != nil && err != io.EOF || !bytes.Equal(buf, data) {
+			t.Error("read", p, n, err)
+		}
+	}
+
+	p := gfs.Path("/TestCreateSmallFile.conf")
+	data := []byte("small=true")
+	if err := tc.c.CreateSmallFile(p, data); err != nil {
+		t.Fatal(err)
+	}
+	readBack(p, data)
+	if err := tc.c.CreateSmallFile(p, data); !gfs.IsError(err, gfs.ErrAlreadyExists) {
+		t.Error("expect", gfs.ErrAlreadyExists, "got", err)
+	}
+
+	// a file longer than a chunk is rejected by master, and written by client in the normal way
+	large := make([]byte, chunkSize+10)
+	for i := range large {
+		large[i] = byte(i%26 + 'a')
+	}
+	q := gfs.Path("/TestCreateSmallFile.large")
+	if err := tc.m.RPCCreateSmallFile(gfs.CreateSmallFileArg{q, large}, &gfs.CreateSmallFileReply{}); err == nil {
+		t.Error("data longer than a chunk is accepted")
+	}
+	if err := tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: q}, &gfs.GetFileInfoReply{}); !gfs.IsError(err, gfs.ErrNotExist) {
+		t.Error("rejected file is created:", err)
+	}
+	if err := tc.c.CreateSmallFile(q, large); err != nil {
+		t.Fatal(err)
+	}
+	readBack(q, large)
+}
+
+// A client reading a corrupted replica reports it, and master replaces it with a clean copy
+func TestReadRepair(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+	for _, v := range tc.cs {
+		v.SetScrubRate(0)
+	}
+
+	p := gfs.Path("/TestReadRepair.txt")
+	data := []byte("repaired by a read")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, data)
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	index := func(addr gfs.ServerAddress) int {
+		for i, v := range tc.csAdd {
+			if v == addr {
+				return i
+			}
+		}
+		return -1
+	}
+	// the client reads the corrupted replica first
+	bad := index(l.Locations[0])
+	for i, v := range tc.cs {
+		if i == bad {
+			v.SetZone("near")
+		} else {
+			v.SetZone("far")
+		}
+	}
+	tc.c.SetZone("near")
+	time.Sleep(2 * gfs.HeartbeatInterval)
+	f, err := os.OpenFile(path.Join(tc.root, "cs"+strconv.Itoa(bad), fmt.Sprintf("chunk%v.chk", r.Handle)), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'#'}, 0)
+	f.Close()
+
+	buf := make([]byte, len(data))
+	if _, err := tc.c.Read(p, 0, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Error("read", string(buf), err)
+	}
+
+	// the corrupted replica is dropped once a good one replaces it
+	repaired := func() bool {
+		l = gfs.GetReplicasReply{}
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range l.Locations {
+			if index(v) == bad {
+				return false
+			}
+		}
+		return len(l.Locations) == gfs.DefaultNumReplicas
+	}
+	deadline := time.Now().Add(2 * gfs.ServerCheckInterval)
+	for !repaired() {
+		if time.Now().After(deadline) {
+			t.Fatal("expect", gfs.DefaultNumReplicas, "replicas other than the corrupted one, got", l.Locations)
+		}
+		time.Sleep(gfs.HeartbeatInterval)
+	}
+	for _, v := range l.Locations {
+		var rr gfs.ReadChunkReply
+		err := tc.cs[index(v)].RPCReadChunk(gfs.ReadChunkArg{r.Handle, 0, len(data)}, &rr)
+		if err != nil || !bytes.Equal(rr.Data, data) {
+			t.Error("replica on", v, "reads", string(rr.Data), err)
+		}
+	}
+}
+
+// A restarted server gets back only the leases of its up-to-date chunks that nobody else holds
+func TestRenewAllLeases(t *testing.T) {
+	lease := time.Second
+	tc := newTestCluster(4, master.WithLeaseDuration(lease))
+	defer tc.Shutdown()
+
+	ch := make(chan error, 16)
+	handles := make([]gfs.ChunkHandle, 4)
+	for i := range handles {
+		p := gfs.Path(fmt.Sprintf("/TestRenewAllLeases%v.txt", i))
+		ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: p, ReplicaFactor: 4}, &gfs.CreateFileReply{})
+		ch <- tc.c.Write(p, 0, []byte("renew"))
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		handles[i] = r.Handle
+	}
+	errorAll(ch, 12, t)
+	time.Sleep(lease + 100*time.Millisecond)
+
+	// the lease of handles[2] is held by another server, handles[3] is shared with a snapshot
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: handles[2]}, &l)
+	ch <- tc.m.RPCSnapshot(gfs.SnapshotArg{"/TestRenewAllLeases3.txt", "/TestRenewAllLeases3-snap.txt"}, &gfs.SnapshotReply{})
+	errorAll(ch, 2, t)
+	server := l.Secondaries[0]
+
+	versionsOf := func() []gfs.ChunkVersion {
+		versions := make([]gfs.ChunkVersion, len(handles))
+		for i, h := range handles {
+			var info gfs.GetChunkInfoReply
+			ch <- tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{Handle: h}, &info)
+			versions[i] = info.Version
+		}
+		errorAll(ch, len(handles), t)
+		return versions
+	}
+	versions := versionsOf()
+	versions[1]-- // the server is behind on handles[1]
+
+	var r gfs.RenewAllLeasesReply
+	ch <- tc.m.RPCRenewAllLeases(gfs.RenewAllLeasesArg{server, handles, versions}, &r)
+	errorAll(ch, 1, t)
+	if len(r.Granted) != 1 || r.Granted[0] != handles[0] {
+		t.Error("expect lease of", handles[0], "granted, got", r.Granted)
+	}
+	var info gfs.GetChunkInfoReply
+	ch <- tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{Handle: handles[0]}, &info)
+	errorAll(ch, 1, t)
+	if info.Primary != server || !info.Expire.Equal(r.Expire) {
+		t.Error("expect primary", server, "until", r.Expire, "got", info.Primary, info.Expire)
+	}
+	// a new lease gets a new version, as granted by GetPrimaryAndSecondaries
+	if info.Version != versions[0]+1 {
+		t.Error("expect version", versions[0]+1, "of a new lease, got", info.Version)
+	}
+
+	// the lease held is extended with the version unchanged
+	time.Sleep(10 * time.Millisecond)
+	versions = versionsOf()
+	r = gfs.RenewAllLeasesReply{}
+	ch <- tc.m.RPCRenewAllLeases(gfs.RenewAllLeasesArg{server, handles[:1], versions[:1]}, &r)
+	errorAll(ch, 1, t)
+	if len(r.Granted) != 1 || !r.Expire.After(info.Expire) {
+		t.Error("expect lease of", handles[0], "extended after", info.Expire, "got", r.Granted, r.Expire)
+	}
+	ch <- tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{Handle: handles[0]}, &info)
+	errorAll(ch, 1, t)
+	if info.Version != versions[0] {
+		t.Error("expect version", versions[0], "of an extended lease, got", info.Version)
+	}
+
+	err := tc.m.RPCRenewAllLeases(gfs.RenewAllLeasesArg{server, handles, versions[:1]}, &gfs.RenewAllLeasesReply{})
+	if err == nil {
+		t.Error("leases are renewed without versions of all handles")
+	}
+
+	// no lease granted before master restarts is taken over in the grace period
+	tc.m.Shutdown()
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, master.WithLeaseDuration(lease))
+	restart := time.Now()
+	time.Sleep(3 * gfs.HeartbeatInterval)
+	versions = versionsOf()
+	r = gfs.RenewAllLeasesReply{}
+	ch <- tc.m.RPCRenewAllLeases(gfs.RenewAllLeasesArg{server, handles[:2], versions[:2]}, &r)
+	errorAll(ch, 1, t)
+	if len(r.Granted) != 0 {
+		t.Error("expect no lease granted in the grace period, got", r.Granted)
+	}
+	time.Sleep(time.Until(restart.Add(lease + 100*time.Millisecond)))
+	r = gfs.RenewAllLeasesReply{}
+	ch <- tc.m.RPCRenewAllLeases(gfs.RenewAllLeasesArg{server, handles[:2], versions[:2]}, &r)
+	errorAll(ch, 1, t)
+	if len(r.Granted) != 2 {
+		t.Error("expect leases of", handles[:2], "granted after the grace period, got", r.Granted)
+	}
+}
+
+// The namespace is walked by io/fs through the fs.FS adapter of client
+func TestFS(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	files := map[string]string{
+		"a.txt":           "alpha",
+		"dir/b.txt":       "bravo",
+		"dir/sub/c.txt":   "charlie",
+		"dir/sub/empty":   "",
+		"other/delta.txt": "delta",
+	}
+	ch := make(chan error, 16)
+	for name, data := range files {
+		p := gfs.Path("/" + name)
+		if dir := path.Dir(string(p)); dir != "/" {
+			ch <- tc.c.MkdirAll(gfs.Path(dir))
+		} else {
+			ch <- nil
+		}
+		ch <- tc.c.Create(p)
+		if data != "" {
+			ch <- tc.c.Write(p, 0, []byte(data))
+		} else {
+			ch <- nil
+		}
+	}
+	ch <- tc.c.Mkdir("/emptydir")
+	errorAll(ch, 3*len(files)+1, t)
+
+	fsys := client.FS(tc.c)
+	var walked []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() != info.IsDir() || info.Name() != path.Base(name) {
+			t.Error("info of", name, "does not match its entry:", info.Name(), info.IsDir())
+		}
+		if d.IsDir() {
+			walked = append(walked, name+"/")
+			return nil
+		}
+		if info.Size() != int64(len(files[name])) || info.ModTime().IsZero() {
+			t.Error("wrong info of", name, info.Size(), info.ModTime())
+		}
+		walked = append(walked, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"./", "a.txt", "dir/", "dir/b.txt", "dir/sub/", "dir/sub/c.txt", "dir/sub/empty",
+		"emptydir/", "other/", "other/delta.txt"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Error("expect", expected, "walked", walked)
+	}
+
+	data, err := fs.ReadFile(fsys, "dir/sub/c.txt")
+	if err != nil || string(data) != files["dir/sub/c.txt"] {
+		t.Error("read", string(data), err)
+	}
+	if _, err := fs.Stat(fsys, "dir/nothing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("expect fs.ErrNotExist, got", err)
+	}
+	if _, err := fsys.Open("/a.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Error("expect fs.ErrInvalid, got", err)
+	}
+	if err := fstest.TestFS(fsys, "a.txt", "dir/b.txt", "dir/sub/c.txt", "dir/sub/empty", "other/delta.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+// A revoked primary rejects writes until a new lease is granted
+func TestRevokeLease(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/revoke.txt")
+	ch := make(chan error, 8)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l)
+
+	index := func(addr gfs.ServerAddress) int {
+		for i, v := range tc.csAdd {
+			if v == addr {
+				return i
+			}
+		}
+		return -1
+	}
+	write := func(primary gfs.ServerAddress, secondaries []gfs.ServerAddress, version gfs.ChunkVersion) error {
+		dataID := chunkserver.NewDataID(r.Handle)
+		chain := append(append([]gfs.ServerAddress(nil), secondaries...), primary)
+		var d gfs.PushDataReply
+		if err := tc.cs[index(chain[0])].RPCPushData(gfs.PushDataArg{dataID, []byte("world"), chain[1:]}, &d); err != nil {
+			return err
+		}
+		return tc.cs[index(primary)].RPCWriteChunk(gfs.WriteChunkArg{dataID, 0, secondaries, version}, &gfs.WriteChunkReply{})
+	}
+
+	// re-replication does not wait for the lease to expire
+	start := time.Now()
+	tc.cs[index(l.Secondaries[0])].Shutdown()
+	time.Sleep(gfs.ServerTimeout + 3*gfs.ServerCheckInterval)
+	var rl gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &rl)
+	if time.Since(start) < gfs.LeaseExpire && len(rl.Locations) != gfs.DefaultNumReplicas {
+		t.Error("chunk is not re-replicated before the lease expires", rl.Locations)
+	}
+
+	if err := write(l.Primary, l.Secondaries[1:], l.Version); err == nil {
+		t.Error("write to a revoked primary should fail")
+	}
+
+	// a new lease is granted to a replica
+	var l2 gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l2)
+	ch <- write(l2.Primary, l2.Secondaries, l2.Version)
+	buf := make([]byte, 5)
+	_, err := tc.c.Read(p, 0, buf)
+	ch <- err
+	if string(buf) != "world" {
+		t.Error("read wrong data", string(buf))
+	}
+
+	errorAll(ch, 8, t)
+}
+
+// Replicas are ordered by the proximity to the zone of the client
+func TestZoneAwareReplicas(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	zones := []string{"dc1/rack1", "dc1/rack2", "dc2/rack1", "dc2/rack2"}
+	for i, z := range zones {
+		tc.cs[i].SetZone(z)
+	}
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	p := gfs.Path("/zone.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.CreateWithReplicaFactor(p, 4)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+
+	zoneOf := func(addr gfs.ServerAddress) string {
+		for i, v := range tc.csAdd {
+			if v == addr {
+				return zones[i]
+			}
+		}
+		return ""
+	}
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle, ClientZone: "dc2/rack2"}, &l)
+	if len(l.Locations) != 4 {
+		t.Fatal("expect 4 replicas, got", l.Locations)
+	}
+	if zoneOf(l.Locations[0]) != "dc2/rack2" || zoneOf(l.Locations[1]) != "dc2/rack1" {
+		t.Error("replicas are not sorted by zone", l.Locations)
+	}
+
+	// no replica in the zone of the client
+	tc.c.SetZone("dc3/rack1")
+	buf := make([]byte, 5)
+	if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != "hello" {
+		t.Error("read without local replica failed", string(buf), err)
+	}
+
+	errorAll(ch, 4, t)
+}
+
+// Reads of the same chunk ask master for its location only once until the entry expires
+func TestLocationCache(t *testing.T) {
+	p := gfs.Path("/TestLocationCache.txt")
+	cc := client.NewClient(mAdd, nil)
+
+	ch := make(chan error, 5)
+	ch <- cc.Create(p)
+	ch <- cc.Write(p, 0, []byte("hello"))
+
+	before := cc.LocationLookups()
+	buf := make([]byte, 5)
+	for i := 0; i < 2; i++ {
+		_, err := cc.Read(p, 0, buf)
+		ch <- err
+	}
+	if n := cc.LocationLookups() - before; n != 1 {
+		t.Error("expect 1 location lookup for two reads, got", n)
+	}
+
+	time.Sleep(gfs.LocationCacheTTL + 100*time.Millisecond)
+	_, err := cc.Read(p, 0, buf)
+	ch <- err
+	if n := cc.LocationLookups() - before; n != 2 {
+		t.Error("expired location is not fetched again, lookups", n)
+	}
+	if string(buf) != "hello" {
+		t.Error("read wrong data", string(buf))
+	}
+
+	errorAll(ch, 5, t)
+}
+
+type failingTask struct{}
+
+func (failingTask) Name() string            { return "failing" }
+func (failingTask) Interval() time.Duration { return 50 * time.Millisecond }
+func (failingTask) Run() error              { return fmt.Errorf("injected error") }
+
+// A failing background task does not stop the master, and a bind failure is returned
+func TestMasterRecoverableErrors(t *testing.T) {
+	tc := newTestCluster(0)
+	defer tc.Shutdown()
+
+	if _, err := master.NewAndServe(tc.mAdd, path.Join(tc.root, "m2"), nil); err == nil {
+		t.Error("master should fail to listen on a used address")
+	}
+
+	tc.m.RegisterBackgroundTask(failingTask{})
+	time.Sleep(200 * time.Millisecond)
+
+	var r gfs.GetBackgroundTaskStatusReply
+	if err := util.Call(tc.mAdd, "Master.RPCGetBackgroundTaskStatus", gfs.GetBackgroundTaskStatusArg{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range r.Tasks {
+		if v.Name == "failing" && (v.ErrorCount < 2 || v.LastError != "injected error") {
+			t.Error("failing task is not run again after an error", v)
+		}
+	}
+	if err := util.Call(tc.mAdd, "Master.RPCMkdir", gfs.MkdirArg{Path: "/alive"}, &gfs.MkdirReply{}); err != nil {
+		t.Error("master stops serving after a background error: ", err)
+	}
+}
+
+// A master with short intervals detects a dead server and re-replicates quickly
+func TestMasterConfig(t *testing.T) {
+	tc := newTestCluster(4,
+		master.WithBackgroundInterval(50*time.Millisecond),
+		master.WithServerTimeout(500*time.Millisecond),
+		master.WithLeaseDuration(500*time.Millisecond))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/config.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			tc.cs[i].Shutdown()
+		}
+	}
+	// much shorter than the default gfs.ServerTimeout + gfs.ServerCheckInterval
+	time.Sleep(time.Second)
+
+	var l2 gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l2); err != nil {
+		t.Error(err)
+	}
+	if len(l2.Locations) != gfs.DefaultNumReplicas {
+		t.Error("chunk is not re-replicated quickly", l2.Locations)
+	}
+	for _, v := range l2.Locations {
+		if v == l.Locations[0] {
+			t.Error("dead server", v, "still holds a replica")
+		}
+	}
+}
+
+// Deleted files are reclaimed after the grace period, unless they are renamed back
+func TestGarbageCollection(t *testing.T) {
+	tc := newTestCluster(3,
+		master.WithGCInterval(100*time.Millisecond),
+		master.WithGCGracePeriod(time.Second))
+	defer tc.Shutdown()
+
+	ch := make(chan error, 10)
+	handles := make(map[gfs.Path]gfs.ChunkHandle)
+	for _, p := range []gfs.Path{"/gc.txt", "/undelete.txt"} {
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		handles[p] = r.Handle
+		ch <- tc.c.Delete(p)
+	}
+
+	// restore the file from its hidden name
+	var hidden gfs.GetPathsByChunkReply
+	ch <- tc.m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{handles["/undelete.txt"]}, &hidden)
+	for _, p := range hidden.Paths {
+		ch <- tc.c.Rename(p, "/undelete.txt")
+	}
+	errorAll(ch, 10, t)
+
+	chunkFile := func(i int, h gfs.ChunkHandle) string {
+		return path.Join(tc.root, "cs"+strconv.Itoa(i), fmt.Sprintf("chunk%v.chk", h))
+	}
+	for i := range tc.cs {
+		if _, err := os.Stat(chunkFile(i, handles["/gc.txt"])); err != nil {
+			t.Error("chunk is reclaimed within the grace period: ", err)
+		}
+	}
+
+	time.Sleep(time.Second + 2*gfs.HeartbeatInterval + 200*time.Millisecond)
+
+	for i := range tc.cs {
+		if _, err := os.Stat(chunkFile(i, handles["/gc.txt"])); !os.IsNotExist(err) {
+			t.Error("chunk of deleted file is not removed from chunkserver", i, err)
+		}
+		if _, err := os.Stat(chunkFile(i, handles["/undelete.txt"])); err != nil {
+			t.Error("chunk of restored file is removed: ", err)
+		}
+	}
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: handles["/gc.txt"]}, &gfs.GetReplicasReply{}); err == nil {
+		t.Error("reclaimed chunk is still known to master")
+	}
+	list, err := tc.c.List("/")
+	if err != nil || len(list) != 1 || list[0].Name != "undelete.txt" {
+		t.Error("deleted file is not purged from namespace", list, err)
+	}
+
+	buf := make([]byte, len("/undelete.txt"))
+	if _, err := tc.c.Read("/undelete.txt", 0, buf); err != nil || string(buf) != "/undelete.txt" {
+		t.Error("read wrong data from restored file", string(buf), err)
+	}
+}
+
+// A reclaimed chunk waiting for re-replication is dropped from the need list
+func TestGarbageCollectionNeedList(t *testing.T) {
+	tc := newTestCluster(4,
+		master.WithBackgroundInterval(100*time.Millisecond),
+		master.WithGCInterval(100*time.Millisecond),
+		master.WithGCGracePeriod(time.Second))
+	defer tc.Shutdown()
+
+	// the spare server has no space, so the fourth replica is never made
+	tc.cs[3].SetCapacity(gfs.MinFreeSpace / 2)
+	time.Sleep(2 * gfs.HeartbeatInterval)
+	p := gfs.Path("/gcneedlist.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte(p))
+	ch <- tc.c.SetReplicationFactor(p, 4)
+	time.Sleep(300 * time.Millisecond)
+
+	var st gfs.MasterStatsReply
+	ch <- tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &st)
+	if st.UnderReplicated != 1 {
+		t.Error("expect 1 under-replicated chunk, got", st.UnderReplicated)
+	}
+	ch <- tc.c.Delete(p)
+	errorAll(ch, 5, t)
+
+	// server checks keep running after the chunk is reclaimed
+	time.Sleep(time.Second + 500*time.Millisecond)
+	if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Chunks != 0 || st.UnderReplicated != 0 || st.NeedListDepth != 0 {
+		t.Error("reclaimed chunk is left in the need list", st.Chunks, st.UnderReplicated, st.NeedListDepth)
+	}
+}
+
+// The replicas of chunks newer than the metadata of master are not reclaimed
+func TestUnknownChunksKept(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/unknown.txt")
+	ch := make(chan error, 3)
+	ch <- tc.c.Create(p)
+	errorAll(ch, 1, t)
+
+	// metadata of master before the chunk is created
+	tc.m.Shutdown()
+	metaFile, logFile := path.Join(tc.root, "m", master.MetaFileName), path.Join(tc.root, "m", master.LogFileName)
+	meta, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oplog, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	errorAll(ch, 2, t)
+
+	// restart with the old metadata
+	tc.m.Shutdown()
+	ioutil.WriteFile(metaFile, meta, 0755)
+	ioutil.WriteFile(logFile, oplog, 0755)
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval + 2*gfs.HeartbeatInterval)
+
+	for i := range tc.cs {
+		chunkFile := path.Join(tc.root, "cs"+strconv.Itoa(i), fmt.Sprintf("chunk%v.chk", r.Handle))
+		if _, err := os.Stat(chunkFile); err != nil {
+			t.Error("unknown chunk is removed: ", err)
+		}
+	}
+}
+
+func TestTrimOverReplicated(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/trim.txt")
+	ch := make(chan error, 3)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte(p))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	errorAll(ch, 3, t)
+
+	var l gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Fatal(err)
+	}
+	down := -1
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			down = i
+		}
+	}
+
+	// the chunk is re-replicated while the server is down, and the server comes back with its copy
+	tc.cs[down].Shutdown()
+	time.Sleep(gfs.ServerTimeout + 5*gfs.ServerCheckInterval)
+	tc.startChunkServer(down)
+	time.Sleep(5*gfs.ServerCheckInterval + 2*gfs.HeartbeatInterval)
+
+	l = gfs.GetReplicasReply{}
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Error(err)
+	}
+	if len(l.Locations) != gfs.DefaultNumReplicas {
+		t.Error("expect", gfs.DefaultNumReplicas, "replicas, but got", l.Locations)
+	}
+
+	copies := 0
+	for i := range tc.cs {
+		if _, err := os.Stat(path.Join(tc.root, "cs"+strconv.Itoa(i), fmt.Sprintf("chunk%v.chk", r.Handle))); err == nil {
+			copies++
+		}
+	}
+	if copies != gfs.DefaultNumReplicas {
+		t.Error("expect", gfs.DefaultNumReplicas, "chunk files on disk, but got", copies)
+	}
+
+	buf := make([]byte, len(p))
+	if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != string(p) {
+		t.Error("read wrong data after trimming", string(buf), err)
+	}
+}
+
+func TestGetMasterStats(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	ch := make(chan error, 8)
+	ch <- tc.c.Mkdir("/stats")
+	ch <- tc.c.Mkdir("/stats/sub")
+	for _, p := range []gfs.Path{"/stats1.txt", "/stats/2.txt", "/stats/sub/3.txt"} {
+		ch <- tc.c.Create(p)
+	}
+	ch <- tc.c.Write("/stats1.txt", 0, []byte("stats"))
+
+	var r gfs.MasterStatsReply
+	ch <- tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &r)
+	errorAll(ch, 7, t)
+
+	if r.Files != 3 || r.Directories != 2 {
+		t.Error("expect 3 files and 2 directories, got", r.Files, r.Directories)
+	}
+	if r.Chunks != 1 || r.UnderReplicated != 0 {
+		t.Error("expect 1 fully replicated chunk, got", r.Chunks, r.UnderReplicated)
+	}
+	if r.ChunkServers != 3 {
+		t.Error("expect 3 chunkservers, got", r.ChunkServers)
+	}
+	if !r.OldestLeaseExpire.After(time.Now()) {
+		t.Error("expect an unexpired lease after write, got", r.OldestLeaseExpire)
+	}
+}
+
+// selfSignedTLS returns a config holding a self-signed certificate for localhost,
+// which is trusted as the only CA. It serves and verifies every node in tests.
+func selfSignedTLS(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gfs test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tc := newTLSTestCluster(4, selfSignedTLS(t))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/tls.txt")
+	ch := make(chan error, 3)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte(p))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	errorAll(ch, 3, t)
+
+	if err := client.NewClient(tc.mAdd, nil).Create("/plaintext.txt"); err == nil {
+		t.Error("plaintext client should not talk to a TLS master")
+	}
+
+	// chunkservers copy the chunk to each other over TLS in re-replication
+	var l gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			tc.cs[i].Shutdown()
+		}
+	}
+	time.Sleep(gfs.ServerTimeout + 5*gfs.ServerCheckInterval)
+
+	l = gfs.GetReplicasReply{}
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Error(err)
+	}
+	if len(l.Locations) != gfs.DefaultNumReplicas {
+		t.Error("chunk is not re-replicated over TLS", l.Locations)
+	}
+
+	buf := make([]byte, len(p))
+	if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != string(p) {
+		t.Error("read wrong data over TLS", string(buf), err)
+	}
+}
+
+// retryServer is an rpc server whose listener drops the first fails connections
+type retryServer struct {
+	fails   int32
+	accepts int32
+	drops   int32 // calls of Drop
+
+	sync.Mutex
+	conns []net.Conn
+}
+
+func (s *retryServer) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func (s *retryServer) Fail(args string, reply *string) error {
+	return fmt.Errorf("file %v not found", args)
+}
+
+// Drop closes all connections after the request is received, so it is never replied
+func (s *retryServer) Drop(args string, reply *string) error {
+	atomic.AddInt32(&s.drops, 1)
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *retryServer) serve(t testing.TB) (gfs.ServerAddress, net.Listener) {
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("RetryServer", s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&s.accepts, 1) <= atomic.LoadInt32(&s.fails) {
+				conn.Close()
+				continue
+			}
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return gfs.ServerAddress(l.Addr().String()), l
+}
+
+func TestCallWithRetry(t *testing.T) {
+	// every call dials, so connections are counted
+	util.SetMaxIdleConns(0)
+	defer util.SetMaxIdleConns(gfs.RPCMaxIdleConns)
+
+	s := &retryServer{fails: 2}
+	addr, l := s.serve(t)
+	defer l.Close()
+
+	var reply string
+	if err := util.CallWithRetry(addr, "RetryServer.Echo", "hello", &reply, 3); err != nil || reply != "hello" {
+		t.Error("call should succeed after retries", reply, err)
+	}
+	if n := atomic.LoadInt32(&s.accepts); n != 3 {
+		t.Error("expect 3 connections, got", n)
+	}
+
+	// application errors are not retried
+	atomic.StoreInt32(&s.accepts, 0)
+	atomic.StoreInt32(&s.fails, 0)
+	if err := util.CallWithRetry(addr, "RetryServer.Fail", "/a.txt", &reply, 3); err == nil {
+		t.Error("expect the error of rpc method")
+	}
+	if n := atomic.LoadInt32(&s.accepts); n != 1 {
+		t.Error("application error should not be retried, got", n, "connections")
+	}
+
+	// give up after maxRetries
+	atomic.StoreInt32(&s.accepts, 0)
+	atomic.StoreInt32(&s.fails, 10)
+	if err := util.CallWithRetry(addr, "RetryServer.Echo", "hello", &reply, 2); err == nil {
+		t.Error("call should fail after 2 retries")
+	}
+	if n := atomic.LoadInt32(&s.accepts); n != 3 {
+		t.Error("expect 3 connections, got", n)
+	}
+}
+
+// A pooled connection broken after the request is sent is not retried, the server may
+// have applied it
+func TestCallNotResent(t *testing.T) {
+	s := &retryServer{}
+	addr, l := s.serve(t)
+	defer l.Close()
+
+	var reply string
+	if err := util.Call(addr, "RetryServer.Echo", "hello", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.Call(addr, "RetryServer.Drop", "hello", &reply); err == nil {
+		t.Error("expect the error of the broken connection")
+	}
+	if n := atomic.LoadInt32(&s.drops); n != 1 {
+		t.Error("expect the request applied once, got", n)
+	}
+
+	// the broken connection is not reused
+	if err := util.Call(addr, "RetryServer.Echo", "hello", &reply); err != nil || reply != "hello" {
+		t.Error("call should succeed on a new connection", reply, err)
+	}
+}
+
+func benchmarkCall(b *testing.B, maxIdle int) {
+	util.SetMaxIdleConns(maxIdle)
+	defer util.SetMaxIdleConns(gfs.RPCMaxIdleConns)
+
+	addr, l := (&retryServer{}).serve(b)
+	defer l.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var reply string
+		if err := util.Call(addr, "RetryServer.Echo", "hello", &reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCallPooled(b *testing.B)   { benchmarkCall(b, gfs.RPCMaxIdleConns) }
+func BenchmarkCallUnpooled(b *testing.B) { benchmarkCall(b, 0) }
+
+func TestCreatePathValidation(t *testing.T) {
+	for _, p := range []gfs.Path{"/cleanpath/", "/cleanpath//dir/"} {
+		if err := m.RPCMkdir(gfs.MkdirArg{Path: p}, &gfs.MkdirReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		path gfs.Path
+		name string // created name in /cleanpath/dir, or "" if the path is rejected
+	}{
+		{"", ""},
+		{"/", ""},
+		{"//", ""},
+		{"cleanpath/dir/a", ""},
+		{"/cleanpath/dir/../b", ""},
+		{"/cleanpath/dir/./c", ""},
+		{"/cleanpath/dir/..", ""},
+		{"/cleanpath//dir//d", "d"},
+		{"/cleanpath/dir/e/", "e"},
+		{"/cleanpath/dir/f.txt", "f.txt"},
+		{"/cleanpath/dir/f.txt/", ""}, // already exists
+		{"/cleanpath/dir/" + gfs.DeletedFilePrefix + "1_g", ""},
+	}
+	for _, v := range cases {
+		err := m.RPCCreateFile(gfs.CreateFileArg{Path: v.path}, &gfs.CreateFileReply{})
+		if v.name == "" && err == nil {
+			t.Errorf("create %q should fail", v.path)
+		}
+		if v.name != "" && err != nil {
+			t.Errorf("create %q: %v", v.path, err)
+		}
+	}
+
+	var r gfs.ListReply
+	if err := m.RPCList(gfs.ListArg{Path: "/cleanpath/dir"}, &r); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range r.Files {
+		names = append(names, v.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"d", "e", "f.txt"}) {
+		t.Error("expect files [d e f.txt], got", names)
+	}
+}
+
+// Names of deleted files are reserved, so a live path is never taken for one and
+// reclaimed, and deleted files are hidden from List and Walk until restored
+func TestDeletedNameReserved(t *testing.T) {
+	ch := make(chan error, 6)
+	ch <- c.Mkdir("/reserved")
+	ch <- c.Create("/reserved/a.txt")
+	ch <- c.Write("/reserved/a.txt", 0, []byte("a"))
+	var r gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{"/reserved/a.txt", 0}, &r)
+	ch <- c.Delete("/reserved/a.txt")
+	var hidden gfs.GetPathsByChunkReply
+	ch <- m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{r.Handle}, &hidden)
+	errorAll(ch, 6, t)
+	if len(hidden.Paths) != 1 {
+		t.Fatal("expect 1 hidden path, got", hidden.Paths)
+	}
+
+	trash := gfs.Path("/reserved/" + gfs.DeletedFilePrefix + "1_b.txt")
+	for name, err := range map[string]error{
+		"create":      c.Create(trash),
+		"mkdir":       c.Mkdir(trash),
+		"mkdir -p":    c.MkdirAll(trash + "/c"),
+		"rename":      c.Rename("/reserved", trash),
+		"snapshot":    c.Snapshot("/reserved", trash),
+		"copy":        c.CopyFile(hidden.Paths[0], trash),
+		"create in":   c.Create(hidden.Paths[0] + "/c.txt"),
+		"rename into": c.Rename("/reserved", hidden.Paths[0]+"/c"),
+	} {
+		if err == nil {
+			t.Error(name, "takes the hidden name of a deleted file")
+		}
+	}
+
+	list, err := c.List("/reserved")
+	if err != nil || len(list) != 0 {
+		t.Error("deleted file is listed", list, err)
+	}
+	walk, err := c.Walk("/reserved")
+	if err != nil || len(walk) != 0 {
+		t.Error("deleted file is walked", walk, err)
+	}
+
+	ch <- c.Rename(hidden.Paths[0], "/reserved/a.txt")
+	list, err = c.List("/reserved")
+	ch <- err
+	errorAll(ch, 2, t)
+	if len(list) != 1 || list[0].Name != "a.txt" {
+		t.Error("restored file is not listed", list)
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	tc := newTestCluster(1)
+	defer tc.Shutdown()
+
+	if err := tc.c.MkdirAll("/a/b/c/d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []gfs.Path{"/", "/a", "/a/b", "/a/b/c"} {
+		list, err := tc.c.List(p)
+		if err != nil || len(list) != 1 || !list[0].IsDir {
+			t.Error("expect one directory in", p, "got", list, err)
+		}
+	}
+	if err := tc.c.MkdirAll("/a/b/c/d"); err != nil {
+		t.Error("mkdir on an existing directory should succeed", err)
+	}
+
+	if err := tc.c.Create("/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.c.MkdirAll("/a/file/e"); err == nil {
+		t.Error("mkdir under a file should fail")
+	}
+
+	// concurrent calls sharing a prefix
+	n := 10
+	ch := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			ch <- tc.c.MkdirAll(gfs.Path(fmt.Sprintf("/x/y/z%v", i)))
+		}(i)
+	}
+	errorAll(ch, n, t)
+	if list, err := tc.c.List("/x/y"); err != nil || len(list) != n {
+		t.Error("expect", n, "directories in /x/y, got", list, err)
+	}
+}
+
+func TestReReplicateLostServer(t *testing.T) {
+	tc := newTestCluster(5)
+	defer tc.Shutdown()
+
+	n := 6
+	ch := make(chan error, 3*n)
+	handles := make([]gfs.ChunkHandle, n)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/lost%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		handles[i] = r.Handle
+	}
+	errorAll(ch, 3*n, t)
+
+	// the server is detected dead within a cycle after timeout, its chunks are copied in that cycle
+	tc.cs[0].Shutdown()
+	time.Sleep(gfs.ServerTimeout + 2*gfs.ServerCheckInterval)
+
+	for _, h := range handles {
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h}, &l); err != nil {
+			t.Error(err)
+		}
+		if len(l.Locations) != gfs.DefaultNumReplicas {
+			t.Error("chunk", h, "is not re-replicated", l.Locations)
+		}
+		for _, v := range l.Locations {
+			if v == tc.csAdd[0] {
+				t.Error("dead server", v, "still holds chunk", h)
+			}
+		}
+	}
+}
+
+func TestConcurrentCopyLimit(t *testing.T) {
+	addr := gfs.ServerAddress(fmt.Sprintf(":%v", nextPort))
+	nextPort++
+	if _, err := master.NewAndServe(addr, path.Join(root, "nocopies"), nil, master.WithMaxConcurrentCopies(0)); err == nil {
+		t.Error("expect master to refuse a config without copy slots")
+	}
+
+	limit := 2
+	tc := newTestCluster(5, master.WithMaxConcurrentCopies(limit))
+	defer tc.Shutdown()
+
+	n := 8
+	data := make([]byte, 4<<20)
+	ch := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/copylimit%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, data)
+	}
+	errorAll(ch, 2*n, t)
+
+	tc.cs[0].Shutdown()
+	max := 0
+	deadline := time.Now().Add(gfs.ServerTimeout + 3*gfs.ServerCheckInterval + time.Second)
+	for time.Now().Before(deadline) {
+		var r gfs.MasterStatsReply
+		if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.CopiesInFlight > max {
+			max = r.CopiesInFlight
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if max == 0 || max > limit {
+		t.Error("expect at most", limit, "copies in flight, got", max)
+	}
+
+	var r gfs.MasterStatsReply
+	if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &r); err != nil || r.UnderReplicated != 0 {
+		t.Error("chunks are not re-replicated", r.UnderReplicated, err)
+	}
+}
+
+func TestNamespaceErrors(t *testing.T) {
+	ch := make(chan error, 2)
+	ch <- c.Create("/exists.txt")
+	ch <- c.Mkdir("/existsdir")
+	errorAll(ch, 2, t)
+
+	cases := []struct {
+		err    error
+		target gfs.Error
+	}{
+		{c.Create("/exists.txt"), gfs.ErrAlreadyExists},
+		{c.Mkdir("/existsdir"), gfs.ErrAlreadyExists},
+		{c.Rename("/existsdir", "/exists.txt"), gfs.ErrAlreadyExists},
+		{c.Delete("/missing.txt"), gfs.ErrNotExist},
+		{c.Rename("/missing.txt", "/missing2.txt"), gfs.ErrNotExist},
+		{c.Create("/missingdir/a.txt"), gfs.ErrNotExist},
+		{m.RPCCreateFile(gfs.CreateFileArg{Path: "/exists.txt"}, &gfs.CreateFileReply{}), gfs.ErrAlreadyExists},
+		{m.RPCDeleteFile(gfs.DeleteFileArg{Path: "/missing.txt"}, &gfs.DeleteFileReply{}), gfs.ErrNotExist},
+	}
+	for i, v := range cases {
+		if !gfs.IsError(v.err, v.target) {
+			t.Errorf("case %v: expect error %q, got %v", i, v.target, v.err)
+		}
+	}
+
+	// errors returned in process keep their type
+	err := m.RPCDeleteFile(gfs.DeleteFileArg{Path: "/missing.txt"}, &gfs.DeleteFileReply{})
+	if !errors.Is(err, gfs.ErrNotExist) || errors.Is(err, gfs.ErrAlreadyExists) {
+		t.Error("expect not-exist error, got", err)
+	}
+}
+
+// Write a chunk and a bit, truncate in the middle of the first chunk, then read to the new end
+func TestTruncate(t *testing.T) {
+	p := gfs.Path("/TestTruncate.txt")
+
+	ch := make(chan error, 5)
+	ch <- c.Create(p)
+
+	size := gfs.MaxChunkSize + 100
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch <- c.Write(p, 0, expected)
+	ch <- c.Truncate(p, 1000)
+
+	buf := make([]byte, 2000)
+	n, err := c.Read(p, 0, buf)
+	if err != io.EOF || n != 1000 || !reflect.DeepEqual(buf[:n], expected[:1000]) {
+		t.Error("expect 1000 bytes and io.EOF after truncate, got", n, err)
+	}
+
+	var f gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Chunks != 1 {
+		t.Error("expect 1 chunk, got", f.Chunks)
+	}
+
+	if err := c.Truncate(p, 2*gfs.MaxChunkSize); !gfs.IsError(err, gfs.ErrTruncateExceedLength) {
+		t.Error("truncate past the end of file should fail, got", err)
+	}
+	ch <- c.Truncate(p, 0)
+
+	errorAll(ch, 5, t)
+}
+
+// With a small chunk size, a write spanning several chunks is split at the same
+// boundaries by client, master and chunkservers
+func TestSmallChunkSize(t *testing.T) {
+	chunkSize := int64(4 * gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	if n, err := tc.c.ChunkSize(); err != nil || int64(n) != chunkSize {
+		t.Fatal("expect chunk size", chunkSize, "got", n, err)
+	}
+
+	p := gfs.Path("/small.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+
+	size := 3*int(chunkSize) + 100
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch <- tc.c.Write(p, 1000, expected)
+
+	buf := make([]byte, size)
+	n, err := tc.c.Read(p, 1000, buf)
+	ch <- err
+	if n != size || !reflect.DeepEqual(expected, buf) {
+		t.Error("read wrong data across small chunks")
+	}
+
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Chunks != 4 {
+		t.Error("expect 4 chunks, got", f.Chunks)
+	}
+
+	// the append limit follows the chunk size, and a record never crosses a chunk
+	if _, err := tc.c.Append(p, make([]byte, chunkSize/4+1)); err != gfs.ErrAppendExceedMaxSize {
+		t.Error("expect append exceeding 1/4 chunk size to fail, got", err)
+	}
+	record := expected[:chunkSize/4]
+	var offset gfs.Offset
+	for i := 0; i < 4; i++ {
+		offset, err = tc.c.Append(p, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(offset)/chunkSize != (int64(offset)+int64(len(record))-1)/chunkSize {
+			t.Error("record appended across chunks at", offset)
+		}
+	}
+	if int64(offset) != 4*chunkSize {
+		t.Error("expect the last record at the start of chunk 4, got", offset)
+	}
+	n, err = tc.c.Read(p, offset, buf[:len(record)])
+	ch <- err
+	if n != len(record) || !reflect.DeepEqual(record, buf[:n]) {
+		t.Error("read wrong appended record")
+	}
+
+	errorAll(ch, 5, t)
+}
+
+// The replicas of a chunk are spread over zones, and a lost replica is copied to
+// a zone holding no other replica
+func TestZoneSpread(t *testing.T) {
+	tc := newTestCluster(5)
+	defer tc.Shutdown()
+
+	zones := []string{"dc1/rack1", "dc1/rack1", "dc1/rack1", "dc1/rack2", "dc1/rack2"}
+	zoneOf := make(map[gfs.ServerAddress]string)
+	for i, z := range zones {
+		tc.cs[i].SetZone(z)
+		zoneOf[tc.csAdd[i]] = z
+	}
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	p := gfs.Path("/zones.txt")
+	ch := make(chan error, 2)
+	ch <- tc.c.Create(p)
+	var a gfs.AllocateChunksReply
+	ch <- tc.m.RPCAllocateChunks(gfs.AllocateChunksArg{p, 10}, &a)
+	errorAll(ch, 2, t)
+
+	// a chunk with a single replica in rack2
+	var handle gfs.ChunkHandle
+	var lost gfs.ServerAddress
+	for i, l := range a.Locations {
+		var rack2 []gfs.ServerAddress
+		for _, v := range l {
+			if zoneOf[v] == "dc1/rack2" {
+				rack2 = append(rack2, v)
+			}
+		}
+		if len(rack2) == 0 || len(rack2) == len(l) {
+			t.Error("expect chunk", a.Handles[i], "in both zones, got", l)
+		}
+		if len(rack2) == 1 {
+			handle, lost = a.Handles[i], rack2[0]
+		}
+	}
+	if lost == "" {
+		t.Fatal("expect a chunk with a single replica in rack2, got", a.Locations)
+	}
+
+	var other gfs.ServerAddress
+	for i, v := range tc.csAdd {
+		if v == lost {
+			tc.cs[i].Shutdown()
+		} else if zones[i] == "dc1/rack2" {
+			other = v
+		}
+	}
+	var l gfs.GetReplicasReply
+	for wait := 0; wait < 50; wait++ {
+		time.Sleep(gfs.ServerTimeout / 5)
+		l = gfs.GetReplicasReply{}
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: handle}, &l); err != nil {
+			t.Fatal(err)
+		}
+		removed := true
+		for _, v := range l.Locations {
+			removed = removed && v != lost
+		}
+		if removed && len(l.Locations) == gfs.DefaultNumReplicas {
+			break
+		}
+	}
+	found := false
+	for _, v := range l.Locations {
+		found = found || v == other
+	}
+	if !found {
+		t.Error("expect chunk", handle, "copied to", other, "in rack2, got", l.Locations)
+	}
+}
+
+// Data is pushed along a chain of replicas ordered by distance, the client sends it only once
+func TestPushDataChain(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	zones := []string{"dc1/rack1", "dc2/rack1", "dc1/rack2"}
+	for i, z := range zones {
+		tc.cs[i].SetZone(z)
+	}
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	p := gfs.Path("/push.txt")
+	ch := make(chan error, 9)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+
+	// nearest to the client first, then nearest to the previous replica
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{r.Handle, "dc1/rack1"}, &l)
+	expected := []gfs.ServerAddress{tc.csAdd[0], tc.csAdd[2], tc.csAdd[1]}
+	if !reflect.DeepEqual(l.Chain, expected) {
+		t.Error("expect push chain", expected, "got", l.Chain)
+	}
+
+	dataID := chunkserver.NewDataID(r.Handle)
+	var d gfs.PushDataReply
+	ch <- util.Call(l.Chain[0], "ChunkServer.RPCPushData", gfs.PushDataArg{dataID, []byte("world"), l.Chain[1:]}, &d)
+	ch <- util.Call(l.Primary, "ChunkServer.RPCWriteChunk", gfs.WriteChunkArg{dataID, 0, l.Secondaries, l.Version}, &gfs.WriteChunkReply{})
+	for i := range tc.cs {
+		var rr gfs.ReadChunkReply
+		ch <- tc.cs[i].RPCReadChunk(gfs.ReadChunkArg{r.Handle, 0, 5}, &rr)
+		if string(rr.Data) != "world" {
+			t.Error("replica", tc.csAdd[i], "has wrong data", string(rr.Data))
+		}
+	}
+
+	// a failure down the chain is reported to the sender
+	bad := gfs.ServerAddress("127.0.0.1:1")
+	chain := append([]gfs.ServerAddress{l.Chain[1]}, bad)
+	err := util.Call(l.Chain[0], "ChunkServer.RPCPushData", gfs.PushDataArg{chunkserver.NewDataID(r.Handle), []byte("lost"), chain}, &d)
+	if err == nil || !strings.Contains(err.Error(), string(bad)) {
+		t.Error("expect push failure at", bad, "got", err)
+	}
+
+	errorAll(ch, 9, t)
+}
+
+// Pushed data is evicted beyond the buffer size or after it expires, and a
+// mutation referring to it fails with a retriable error
+func TestDataBuffer(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/buffer.txt")
+	ch := make(chan error, 8)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l)
+
+	primary := l.Primary
+	push := func(data string) gfs.DataBufferID {
+		id := chunkserver.NewDataID(r.Handle)
+		chain := append(append([]gfs.ServerAddress(nil), l.Secondaries...), primary)
+		if err := util.Call(chain[0], "ChunkServer.RPCPushData", gfs.PushDataArg{id, []byte(data), chain[1:]}, &gfs.PushDataReply{}); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	write := func(id gfs.DataBufferID) error {
+		return util.Call(primary, "ChunkServer.RPCWriteChunk", gfs.WriteChunkArg{id, 0, l.Secondaries, l.Version}, &gfs.WriteChunkReply{})
+	}
+
+	// the least recently used data is evicted under the size cap
+	for _, v := range tc.cs {
+		v.SetDataBufferSize(10)
+	}
+	a, b, c := push("aaaa"), push("bbbb"), push("cccc")
+	if err := write(a); !gfs.IsError(err, gfs.ErrDataNotFound) {
+		t.Error("expect evicted data not found, got", err)
+	}
+	ch <- write(c)
+	ch <- write(b)
+
+	// expired data
+	for _, v := range tc.cs {
+		v.SetDataBufferExpire(100 * time.Millisecond)
+	}
+	d := push("dddd")
+	time.Sleep(200 * time.Millisecond)
+	if err := write(d); !gfs.IsError(err, gfs.ErrDataNotFound) {
+		t.Error("expect expired data not found, got", err)
+	}
+
+	// the client pushes the data again
+	ch <- tc.c.Write(p, 0, []byte("world"))
+	buf := make([]byte, 5)
+	_, err := tc.c.Read(p, 0, buf)
+	ch <- err
+	if string(buf) != "world" {
+		t.Error("read wrong data", string(buf))
+	}
+
+	errorAll(ch, 8, t)
+}
+
+// A write under a lease taken back by master is redirected to the new primary
+func TestWriteNewPrimary(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/newprimary.txt")
+	ch := make(chan error, 7)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello")) // the client buffers the lease
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l)
+
+	// the lease is revoked and the chunk moves off the primary
+	ch <- tc.m.RPCDecommissionServer(gfs.DecommissionServerArg{l.Primary}, &gfs.DecommissionServerReply{})
+
+	start := time.Now()
+	ch <- tc.c.Write(p, 0, []byte("world"))
+	if time.Since(start) > gfs.LeaseExpire {
+		t.Error("write waits for the old lease to expire instead of asking for the new primary")
+	}
+
+	var l2 gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l2)
+	if l2.Primary == l.Primary || l2.Version <= l.Version {
+		t.Error("expect a new lease on another server, got", l2.Primary, l2.Version)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := tc.c.Read(p, 0, buf); err != nil || string(buf) != "world" {
+		t.Error("read wrong data", string(buf), err)
+	}
+
+	errorAll(ch, 7, t)
+}
+
+// A replica lost without its server dying is found by the replica scan and restored
+func TestReplicaScan(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/scan.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+
+	// a chunkserver loses the replica while master is down, so it is not reported
+	tc.m.Shutdown()
+	ch <- tc.cs[0].RPCDeleteChunk(gfs.DeleteChunkArg{[]gfs.ChunkHandle{r.Handle}}, &gfs.DeleteChunkReply{})
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls)
+
+	var l gfs.GetReplicasReply
+	deadline := time.Now().Add(gfs.ServerTimeout + gfs.ReplicaScanInterval + 3*gfs.ServerCheckInterval)
+	for time.Now().Before(deadline) {
+		l = gfs.GetReplicasReply{}
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err == nil && len(l.Locations) == 3 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &gfs.GetReplicasReply{})
+	if len(l.Locations) != 3 {
+		t.Error("expect the lost replica restored, got", l.Locations)
+	}
+
+	errorAll(ch, 5, t)
+}
+
+func TestShadowMaster(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p1, p2 := gfs.Path("/shadow1.txt"), gfs.Path("/shadow2.txt")
+	ch := make(chan error, 8)
+	ch <- tc.c.Create(p1)
+	ch <- tc.c.Write(p1, 0, []byte("hello"))
+
+	sAdd := gfs.ServerAddress(fmt.Sprintf(":%v", nextPort))
+	nextPort++
+	s, err := master.NewShadowMaster(sAdd, tc.mAdd, tc.tls)
+	if err != nil {
+		t.Fatal("cannot start shadow master: ", err)
+	}
+	defer s.Shutdown()
+
+	// logged after the checkpoint is loaded, it reaches the shadow by tailing the log
+	ch <- tc.c.Create(p2)
+	time.Sleep(3 * gfs.ShadowPollInterval)
+
+	for _, p := range []gfs.Path{p1, p2} {
+		var expected, actual gfs.GetFileInfoReply
+		ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &expected)
+		// mtime of a written file is not logged, it reaches the shadow with the next checkpoint
+		err := s.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &actual)
+		if err != nil || actual.IsDir != expected.IsDir || actual.Chunks != expected.Chunks || !actual.Ctime.Equal(expected.Ctime) {
+			t.Errorf("expect %v of %v on shadow, got %v, %v", expected, p, actual, err)
+		}
+	}
+
+	if err := s.RPCMkdir(gfs.MkdirArg{Path: "/dir"}, &gfs.MkdirReply{}); !gfs.IsError(err, gfs.ErrReadOnly) {
+		t.Error("expect shadow master to reject mkdir, got", err)
+	}
+
+	var expected, actual gfs.MasterStatsReply
+	ch <- tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &expected)
+	ch <- s.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &actual)
+	if actual.LogIndex != expected.LogIndex || actual.Files != expected.Files || actual.Synced.IsZero() {
+		t.Errorf("expect shadow synced at %v with %v files, got %+v", expected.LogIndex, expected.Files, actual)
+	}
+
+	// a client reads through the shadow
+	c := client.NewClient(sAdd, tc.tls)
+	buf := make([]byte, 5)
+	n, err := c.Read(p1, 0, buf)
+	ch <- err
+	if n != 5 || string(buf) != "hello" {
+		t.Errorf("expect hello read through shadow, got %q", buf[:n])
+	}
+
+	errorAll(ch, 8, t)
+}
+
+// A shadow master serves a read only if it is not behind master by more than the read allows
+func TestShadowStaleness(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestShadowStaleness.txt")
+	ch := make(chan error, 8)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("stale"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	errorAll(ch, 3, t)
+
+	sAdd := gfs.ServerAddress(fmt.Sprintf(":%v", nextPort))
+	nextPort++
+	s, err := master.NewShadowMaster(sAdd, tc.mAdd, tc.tls)
+	if err != nil {
+		t.Fatal("cannot start shadow master: ", err)
+	}
+	defer s.Shutdown()
+
+	read := func(staleness time.Duration) []error {
+		return []error{
+			s.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p, MaxStaleness: staleness}, &gfs.GetFileInfoReply{}),
+			s.RPCList(gfs.ListArg{Path: "/", MaxStaleness: staleness}, &gfs.ListReply{}),
+			s.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle, MaxStaleness: staleness}, &gfs.GetReplicasReply{}),
+		}
+	}
+	strict, lenient := 5*gfs.ShadowPollInterval, time.Minute
+	time.Sleep(2 * gfs.ShadowPollInterval)
+	for _, err := range read(strict) {
+		if err != nil {
+			t.Error("a synced shadow rejects a strict read:", err)
+		}
+	}
+
+	// the shadow falls behind without master
+	tc.m.Shutdown()
+	time.Sleep(strict + gfs.ShadowPollInterval)
+	for _, err := range read(strict) {
+		if !gfs.IsError(err, gfs.ErrTooStale) || !strings.Contains(err.Error(), string(tc.mAdd)) {
+			t.Error("expect", gfs.ErrTooStale, "naming master, got", err)
+		}
+	}
+	for _, staleness := range []time.Duration{lenient, 0} {
+		for _, err := range read(staleness) {
+			if err != nil {
+				t.Error("a lagging shadow rejects a read allowing staleness", staleness, ":", err)
+			}
+		}
+	}
+}
+
+func TestLeaseExtension(t *testing.T) {
+	lease := time.Second
+	tc := newTestCluster(3, master.WithLeaseDuration(lease))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/extend.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var first gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &first)
+
+	// the primary asks for extensions in heartbeats while the chunk is being written
+	for start := time.Now(); time.Since(start) < 2*lease; {
+		if err := tc.c.Write(p, 0, []byte("hello")); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(gfs.HeartbeatInterval)
+	}
+
+	var l gfs.GetPrimaryAndSecondariesReply
+	if err := tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l); err != nil {
+		t.Error(err)
+	}
+	if l.Primary != first.Primary || l.Version != first.Version || !l.Expire.After(first.Expire) {
+		t.Errorf("expect lease of %v at version %v extended past %v, got %+v", first.Primary, first.Version, first.Expire, l)
+	}
+
+	errorAll(ch, 4, t)
+}
+
+func TestQuota(t *testing.T) {
+	chunkSize := int64(gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	dir := gfs.Path("/quota")
+	p, q := dir+"/a.txt", dir+"/sub/b.txt"
+	ch := make(chan error, 9)
+	ch <- tc.c.Mkdir(dir)
+	ch <- tc.c.Mkdir(dir + "/sub")
+	ch <- tc.c.SetQuota(dir, 3*chunkSize)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Create(q)
+
+	// files in subdirectories count too
+	ch <- tc.c.Write(p, 0, make([]byte, 2*chunkSize))
+	ch <- tc.c.Write(q, 0, []byte("full"))
+
+	var r gfs.GetChunkHandleReply
+	err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 2}, &r)
+	if !gfs.IsError(err, gfs.ErrQuotaExceeded) {
+		t.Error("expect chunk allocation beyond quota rejected, got", err)
+	}
+	if err := tc.c.Write(p, gfs.Offset(2*chunkSize), []byte("over")); err == nil {
+		t.Error("expect write beyond quota to fail")
+	}
+
+	// space is given back by truncate
+	ch <- tc.c.Truncate(p, chunkSize)
+	ch <- tc.c.Write(p, gfs.Offset(chunkSize), []byte("fits"))
+
+	errorAll(ch, 9, t)
+}
+
+func TestFileTimes(t *testing.T) {
+	dir := gfs.Path("/times")
+	p := dir + "/a.txt"
+	ch := make(chan error, 8)
+	ch <- c.Mkdir(dir)
+	ch <- c.Create(p)
+
+	var f1, d1 gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f1)
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: dir}, &d1)
+	if f1.Ctime.IsZero() || !f1.Mtime.Equal(f1.Ctime) || d1.Mtime.Before(f1.Ctime) {
+		t.Errorf("expect times set on create, got file %v, dir %v", f1, d1)
+	}
+
+	// master learns of the write from the heartbeat of primary
+	time.Sleep(10 * time.Millisecond)
+	ch <- c.Write(p, 0, []byte("hello"))
+	time.Sleep(3 * gfs.HeartbeatInterval)
+	var f2 gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f2)
+	if !f2.Mtime.After(f1.Mtime) || !f2.Ctime.Equal(f1.Ctime) {
+		t.Errorf("expect mtime advanced by write, got %v then %v", f1, f2)
+	}
+
+	ch <- c.Delete(p)
+	var d2 gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: dir}, &d2)
+	if !d2.Mtime.After(d1.Mtime) || !d2.Ctime.Equal(d1.Ctime) {
+		t.Errorf("expect directory mtime advanced by delete, got %v then %v", d1, d2)
+	}
+
+	errorAll(ch, 8, t)
+}
+
+func TestLateHeartbeat(t *testing.T) {
+	timeout, interval := 300*time.Millisecond, 100*time.Millisecond
+	tc := newTestCluster(3, master.WithServerTimeout(timeout), master.WithBackgroundInterval(interval),
+		master.WithDeadServerChecks(5))
+	defer tc.Shutdown()
+
+	numServers := func() int {
+		var r gfs.MasterStatsReply
+		if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &r); err != nil {
+			t.Error(err)
+		}
+		return r.ChunkServers
+	}
+
+	// heartbeats of a server nobody listens on, master fails to ask it for chunks when it registers
+	addr := gfs.ServerAddress(fmt.Sprintf("127.0.0.1:%v", nextPort))
+	nextPort++
+	heartbeat := func() error {
+		return tc.m.RPCHeartbeat(gfs.HeartbeatArg{Address: addr, FreeBytes: gfs.MinFreeSpace}, &gfs.HeartbeatReply{})
+	}
+	heartbeat()
+	if n := numServers(); n != 4 {
+		t.Fatal("expect 4 chunkservers, got", n)
+	}
+
+	// past the timeout, but back before it fails enough checks
+	time.Sleep(timeout + 2*interval)
+	if err := heartbeat(); err != nil {
+		t.Error("expect the late server not registered again, got", err)
+	}
+	time.Sleep(2 * interval)
+	if n := numServers(); n != 4 {
+		t.Error("expect the late server kept, got", n, "chunkservers")
+	}
+
+	time.Sleep(timeout + 8*interval)
+	if n := numServers(); n != 3 {
+		t.Error("expect the silent server removed, got", n, "chunkservers")
+	}
+}
+
+func TestChunkServerRestart(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/restart.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+
+	// the server loses the replica behind master's back and restarts before it is detected as dead
+	ch <- tc.cs[0].RPCDeleteChunk(gfs.DeleteChunkArg{[]gfs.ChunkHandle{r.Handle}}, &gfs.DeleteChunkReply{})
+	tc.cs[0].Shutdown()
+	tc.startChunkServer(0)
+	time.Sleep(3 * gfs.HeartbeatInterval)
+
+	var l gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Error(err)
+	}
+	// it may get a new copy by re-replication, but never stays listed without one
+	var report gfs.ReportSelfReply
+	ch <- tc.cs[0].RPCReportSelf(gfs.ReportSelfArg{}, &report)
+	held := false
+	for _, v := range report.Chunks {
+		held = held || v.Handle == r.Handle
+	}
+	for _, v := range l.Locations {
+		if v == tc.csAdd[0] && !held {
+			t.Error("expect", v, "no longer listed as a replica after restart, got", l.Locations)
+		}
+	}
+
+	errorAll(ch, 5, t)
+}
+
+func TestHealthCheck(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%v", nextPort)
+	nextPort++
+	tc := newTestCluster(0, master.WithHealthAddress(addr))
+	defer tc.Shutdown()
+
+	status := func(p string) int {
+		resp, err := http.Get("http://" + addr + p)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Error("expect master healthy, got", code)
+	}
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Error("expect master not ready without chunkservers, got", code)
+	}
+
+	tc.addChunkServer()
+	time.Sleep(2 * gfs.HeartbeatInterval)
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Error("expect master ready after a chunkserver registers, got", code)
+	}
+}
+
+// The progress of re-replication shows in master stats and the metrics page. A lost
+// replica cannot be copied until a spare server joins.
+func TestDurabilityMetrics(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%v", nextPort)
+	nextPort++
+	tc := newTestCluster(4, master.WithHealthAddress(addr))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/metrics.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte(p))
+	var h gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &h)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	// the server without a replica has no space for one
+	held := make(map[gfs.ServerAddress]bool)
+	for _, v := range l.Locations {
+		held[v] = true
+	}
+	holder := -1
+	for i, v := range tc.csAdd {
+		if held[v] {
+			holder = i
+		} else {
+			tc.cs[i].SetCapacity(gfs.MinFreeSpace / 2)
+		}
+	}
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	stats := func() gfs.MasterStatsReply {
+		var r gfs.MasterStatsReply
+		if err := tc.m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	wait := func(ok func(r gfs.MasterStatsReply) bool) gfs.MasterStatsReply {
+		r := stats()
+		for i := 0; i < 50 && !ok(r); i++ {
+			time.Sleep(gfs.ServerTimeout / 5)
+			r = stats()
+		}
+		return r
+	}
+
+	if r := stats(); r.NeedListDepth != 0 || r.ReReplicated != 0 || r.ReReplicateFailed != 0 {
+		t.Errorf("expect no re-replication in a healthy cluster, got %+v", r)
+	}
+
+	tc.cs[holder].Shutdown()
+	r := wait(func(r gfs.MasterStatsReply) bool { return r.ReReplicateFailed > 0 })
+	if r.NeedListDepth != 1 || r.ReReplicateFailed == 0 || r.ReReplicated != 0 {
+		t.Errorf("expect 1 chunk queued and failing to copy without a spare server, got %+v", r)
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(body), "gfs_need_list_depth 1\n") {
+		t.Errorf("expect the need list in metrics, got %q %v", body, err)
+	}
+
+	tc.addChunkServer()
+	r = wait(func(r gfs.MasterStatsReply) bool { return r.ReReplicated > 0 && r.NeedListDepth == 0 })
+	if r.ReReplicated != 1 || r.NeedListDepth != 0 {
+		t.Errorf("expect 1 chunk copied to the new server, got %+v", r)
+	}
+}
+
+func TestAllocateChunks(t *testing.T) {
+	p := gfs.Path("/allocate.txt")
+	ch := make(chan error, 5)
+	ch <- c.Create(p)
+
+	var r gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+
+	n := 10
+	var a gfs.AllocateChunksReply
+	ch <- m.RPCAllocateChunks(gfs.AllocateChunksArg{p, n}, &a)
+	if a.Index != 1 || len(a.Handles) != n || len(a.Locations) != n {
+		t.Fatalf("expect %v chunks from index 1, got %+v", n, a)
+	}
+	for i, h := range a.Handles {
+		if h == r.Handle || (i > 0 && h != a.Handles[i-1]+1) {
+			t.Error("expect distinct contiguous handles, got", a.Handles)
+			break
+		}
+		if len(a.Locations[i]) != gfs.DefaultNumReplicas {
+			t.Errorf("expect %v replicas of chunk %v, got %v", gfs.DefaultNumReplicas, h, a.Locations[i])
+		}
+	}
+
+	var f gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Chunks != int64(n+1) {
+		t.Error("expect", n+1, "chunks in file, got", f.Chunks)
+	}
+	var last gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, gfs.ChunkIndex(n)}, &last)
+	if last.Handle != a.Handles[n-1] {
+		t.Error("expect the last chunk", a.Handles[n-1], "got", last.Handle)
+	}
+
+	errorAll(ch, 5, t)
+}
+
+func TestGetChunkInfo(t *testing.T) {
+	p := gfs.Path("/chunkinfo.txt")
+	ch := make(chan error, 4)
+	ch <- c.Create(p)
+	var r gfs.GetChunkHandleReply
+	ch <- m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l)
+
+	var info gfs.GetChunkInfoReply
+	ch <- m.RPCGetChunkInfo(gfs.GetChunkInfoArg{r.Handle}, &info)
+	expected := append([]gfs.ServerAddress{l.Primary}, l.Secondaries...)
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	sort.Slice(info.Locations, func(i, j int) bool { return info.Locations[i] < info.Locations[j] })
+	if !reflect.DeepEqual(info.Locations, expected) || info.Version != l.Version ||
+		info.Primary != l.Primary || !info.Expire.Equal(l.Expire) || info.NeedsReplica {
+		t.Errorf("expect info of lease %+v, got %+v", l, info)
+	}
+
+	if err := m.RPCGetChunkInfo(gfs.GetChunkInfoArg{-1}, &gfs.GetChunkInfoReply{}); err == nil {
+		t.Error("expect error for an unknown chunk")
+	}
+
+	errorAll(ch, 4, t)
+}
+
+func TestListChunkServers(t *testing.T) {
+	tc := newTestCluster(2)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/servers.txt")
+	ch := make(chan error, 4)
+	ch <- tc.m.RPCCreateFile(gfs.CreateFileArg{Path: p, ReplicaFactor: 2}, &gfs.CreateFileReply{})
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+
+	var r gfs.ListChunkServersReply
+	ch <- tc.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &r)
+	if len(r.Servers) != 2 {
+		t.Fatal("expect 2 chunkservers, got", r.Servers)
+	}
+	for i, s := range r.Servers {
+		if s.Address != tc.csAdd[i] || s.Chunks != 1 || s.FreeBytes == 0 || s.LastHeartbeat.IsZero() || s.Draining {
+			t.Errorf("expect %v alive with 1 chunk, got %+v", tc.csAdd[i], s)
+		}
+	}
+
+	// a dead server is absent
+	tc.cs[1].Shutdown()
+	time.Sleep(gfs.ServerTimeout + (gfs.DeadServerChecks+1)*gfs.ServerCheckInterval)
+	r = gfs.ListChunkServersReply{}
+	ch <- tc.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &r)
+	if len(r.Servers) != 1 || r.Servers[0].Address != tc.csAdd[0] {
+		t.Error("expect only", tc.csAdd[0], "listed, got", r.Servers)
+	}
+
+	errorAll(ch, 4, t)
+}
+
+// slowChunkServer pretends to hold chunks, but answers version checks after delay
+type slowChunkServer struct {
+	chunks []gfs.PersistentChunkInfo
+	delay  time.Duration
+}
+
+func (s *slowChunkServer) RPCReportSelf(args gfs.ReportSelfArg, reply *gfs.ReportSelfReply) error {
+	reply.Chunks = s.chunks
+	return nil
+}
+
+func (s *slowChunkServer) RPCCheckVersion(args gfs.CheckVersionArg, reply *gfs.CheckVersionReply) error {
+	time.Sleep(s.delay)
+	return nil
+}
+
+func (s *slowChunkServer) serve(t testing.TB) (gfs.ServerAddress, net.Listener) {
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("ChunkServer", s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return gfs.ServerAddress(l.Addr().String()), l
+}
+
+func TestLockTimeout(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	tc := newTestCluster(3, master.WithLockTimeout(timeout))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/locktimeout.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var info gfs.GetChunkInfoReply
+	ch <- tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{r.Handle}, &info)
+
+	s := &slowChunkServer{
+		chunks: []gfs.PersistentChunkInfo{{Handle: r.Handle, Version: info.Version}},
+		delay:  5 * timeout,
+	}
+	addr, l := s.serve(t)
+	defer l.Close()
+	ch <- tc.m.RPCHeartbeat(gfs.HeartbeatArg{Address: addr}, &gfs.HeartbeatReply{})
+
+	// granting a lease holds the chunk lock while the slow server checks its version
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &gfs.GetPrimaryAndSecondariesReply{})
+	}()
+	time.Sleep(timeout / 2)
+
+	start := time.Now()
+	err := tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{r.Handle}, &gfs.GetChunkInfoReply{})
+	if !gfs.IsError(err, gfs.ErrTimeout) {
+		t.Error("expect the competing rpc to time out, got", err)
+	}
+	if d := time.Since(start); d >= s.delay {
+		t.Error("expect the competing rpc to give up after", timeout, "got", d)
+	}
+
+	ch <- <-done
+	errorAll(ch, 5, t)
+}
+
+// A waiting writer blocks new readers, and gives way to them again when it gives up
+func TestRWMutex(t *testing.T) {
+	var m util.RWMutex
+	m.RLock()
+
+	locked := make(chan bool)
+	go func() {
+		m.Lock()
+		locked <- true
+		m.Unlock()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if m.RLockBefore(time.Now().Add(50 * time.Millisecond)) {
+		t.Error("a new reader goes before the waiting writer")
+	}
+	m.RUnlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the writer is not woken up when the readers leave")
+	}
+
+	m.RLock()
+	start := time.Now()
+	if m.LockBefore(start.Add(50 * time.Millisecond)) {
+		t.Error("the writer gets the lock held by a reader")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Error("expect the writer to give up at its deadline, got", d)
+	}
+	if !m.TryRLock() {
+		t.Error("readers are blocked by the writer which gives up")
+	}
+	m.RUnlock()
+	m.RUnlock()
+	if !m.TryLock() {
+		t.Error("the lock is not free")
+	}
+	m.Unlock()
+}
+
+// Shutdown of master waits for the rpcs in flight, until the drain timeout
+// Shutdown of master waits for the rpcs in flight, until the drain timeout
+func TestShutdownDrain(t *testing.T) {
+	// grantLease starts granting a lease over the network, which waits for a slow server
+	grantLease := func(tc *testCluster, delay time.Duration) (chan error, net.Listener) {
+		p := gfs.Path("/drain.txt")
+		ch := make(chan error, 4)
+		ch <- tc.c.Create(p)
+		var r gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+		var info gfs.GetChunkInfoReply
+		ch <- tc.m.RPCGetChunkInfo(gfs.GetChunkInfoArg{r.Handle}, &info)
+
+		s := &slowChunkServer{
+			chunks: []gfs.PersistentChunkInfo{{Handle: r.Handle, Version: info.Version}},
+			delay:  delay,
+		}
+		addr, l := s.serve(t)
+		ch <- tc.m.RPCHeartbeat(gfs.HeartbeatArg{Address: addr}, &gfs.HeartbeatReply{})
+		errorAll(ch, 4, t)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- util.Call(tc.mAdd, "Master.RPCGetPrimaryAndSecondaries",
+				gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &gfs.GetPrimaryAndSecondariesReply{})
+		}()
+		time.Sleep(200 * time.Millisecond)
+		return done, l
+	}
+
+	delay := time.Second
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+	done, l := grantLease(tc, delay)
+	defer l.Close()
+	start := time.Now()
+	tc.m.Shutdown()
+	if d := time.Since(start); d < delay/2 {
+		t.Error("expect shutdown to wait for the rpc in flight, it returns after", d)
+	}
+	// the reply is sent before shutdown returns, but may not be received yet
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("expect the rpc in flight to complete, got", err)
+		}
+	case <-time.After(delay / 2):
+		t.Error("the rpc in flight is not complete after shutdown")
+	}
+
+	// the rpc takes longer than the drain timeout
+	timeout := 200 * time.Millisecond
+	tc2 := newTestCluster(3, master.WithDrainTimeout(timeout))
+	defer tc2.Shutdown()
+	_, l2 := grantLease(tc2, 5*time.Second)
+	defer l2.Close()
+	start = time.Now()
+	tc2.m.Shutdown()
+	if d := time.Since(start); d < timeout || d > 2*time.Second {
+		t.Error("expect shutdown to give up after", timeout, "got", d)
+	}
+}
+
+func TestCompressedFile(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/compressed.log")
+	data := []byte(strings.Repeat("GET /index.html 200\n", 3*gfs.ChecksumBlockSize/20+100))
+	ch := make(chan error, 6)
+	ch <- tc.c.CreateCompressed(p)
+	ch <- tc.c.Write(p, 0, data)
+	// rewrite the middle of a block, the blocks after it are moved along
+	ch <- tc.c.Write(p, 100000, []byte("POST /login 302\n"))
+	copy(data[100000:], "POST /login 302\n")
+
+	buf := make([]byte, len(data))
+	if n, err := tc.c.Read(p, 0, buf); err != nil || n != len(data) || !reflect.DeepEqual(buf, data) {
+		t.Error("read wrong data of compressed file", n, err)
+	}
+	// a read across a block boundary
+	buf = make([]byte, 5000)
+	if _, err := tc.c.Read(p, gfs.ChecksumBlockSize-2000, buf); err != nil ||
+		!reflect.DeepEqual(buf, data[gfs.ChecksumBlockSize-2000:gfs.ChecksumBlockSize+3000]) {
+		t.Error("read wrong range of compressed file", err)
+	}
+
+	var info gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &info)
+	if !info.Compressed {
+		t.Error("expect file created compressed")
+	}
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	for i := range tc.cs {
+		st, err := os.Stat(path.Join(tc.root, "cs"+strconv.Itoa(i), fmt.Sprintf("chunk%v.chk", r.Handle)))
+		if err != nil {
+			t.Error(err)
+		} else if st.Size() >= int64(len(data)) {
+			t.Error("expect chunk file smaller than", len(data), "got", st.Size())
+		}
+	}
+
+	ch <- tc.c.Truncate(p, 70000)
+	buf = make([]byte, 70000)
+	if n, err := tc.c.Read(p, 0, buf); err != nil || n != len(buf) || !reflect.DeepEqual(buf, data[:70000]) {
+		t.Error("read wrong data of truncated compressed file", n, err)
+	}
+
+	errorAll(ch, 6, t)
+}
+
+func TestAppendOrCreate(t *testing.T) {
+	p := gfs.Path("/autocreate/ingest.log")
+	if _, err := c.AppendOrCreate(p, []byte("lost\n")); err == nil {
+		t.Error("expect error when the parent does not exist")
+	}
+	if err := c.Mkdir("/autocreate"); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 8
+	ch := make(chan error, n)
+	var lock sync.Mutex
+	offsets := make(map[gfs.Offset]bool)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			offset, err := c.AppendOrCreate(p, []byte(fmt.Sprintf("record %v\n", i)))
+			lock.Lock()
+			offsets[offset] = true
+			lock.Unlock()
+			ch <- err
+		}(i)
+	}
+	errorAll(ch, n, t)
+
+	if len(offsets) != n {
+		t.Error("expect", n, "records at distinct offsets, got", offsets)
+	}
+	list, err := c.List("/autocreate")
+	if err != nil || len(list) != 1 || list[0].Name != "ingest.log" {
+		t.Error("expect a single file created by appenders, got", list, err)
+	}
+}
+
+// A chunk reserves its full size on creation, a nearly full server refuses new chunks
+func TestCreateChunkNoSpace(t *testing.T) {
+	tc := newTestCluster(1)
+	defer tc.Shutdown()
+
+	tc.cs[0].SetCapacity(2*gfs.MaxChunkSize + gfs.MaxChunkSize/2)
+	create := func(h gfs.ChunkHandle) error {
+		return tc.cs[0].RPCCreateChunk(gfs.CreateChunkArg{Handle: h}, &gfs.CreateChunkReply{})
+	}
+	ch := make(chan error, 3)
+	ch <- create(1001)
+	ch <- create(1002)
+
+	err := create(1003)
+	if !gfs.IsError(err, gfs.ErrNoSpace) {
+		t.Error("expect no space error, got", err)
+	}
+	if _, err := os.Stat(path.Join(tc.root, "cs0", "chunk1003.chk")); !os.IsNotExist(err) {
+		t.Error("expect no chunk file created on a full server, got", err)
+	}
+
+	// the reservation is released with the chunk
+	ch <- tc.cs[0].RPCDeleteChunk(gfs.DeleteChunkArg{[]gfs.ChunkHandle{1001}}, &gfs.DeleteChunkReply{})
+	if err := create(1003); err != nil {
+		t.Error("expect space of deleted chunk reused, got", err)
+	}
+
+	errorAll(ch, 3, t)
+}
+
+// checkpoint has the layout of the metadata master stores, gob matches it by field names
+type checkpoint struct {
+	NamespaceTree  []checkpointNode
+	ChunkInfo      []checkpointFile
+	NumChunkHandle gfs.ChunkHandle
+}
+
+type checkpointNode struct {
+	IsDir    bool
+	Children map[string]int // index of children in NamespaceTree
+	Chunks   int64
+}
+
+type checkpointFile struct {
+	Path gfs.Path
+	Info []gfs.PersistentChunkInfo
+}
+
+// Load a checkpoint whose chunk lists disagree with the namespace
+func TestVerifyMetadata(t *testing.T) {
+	meta := checkpoint{
+		NamespaceTree: []checkpointNode{
+			{Chunks: 1}, // /good.txt
+			{Chunks: 3}, // /lost.txt
+			{IsDir: true, Children: map[string]int{"good.txt": 0, "lost.txt": 1}}, // root is the last
+		},
+		NumChunkHandle: 5,
+	}
+	file := func(p gfs.Path, handles ...gfs.ChunkHandle) {
+		var info []gfs.PersistentChunkInfo
+		for _, h := range handles {
+			info = append(info, gfs.PersistentChunkInfo{Handle: h, Version: 1})
+		}
+		meta.ChunkInfo = append(meta.ChunkInfo, checkpointFile{p, info})
+	}
+	file("/good.txt", 1)
+	file("/lost.txt", 2)
+	file("/orphan.txt", 3, 4)
+
+	write := func(dir string) {
+		os.MkdirAll(dir, 0755)
+		f, err := os.Create(path.Join(dir, master.MetaFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := gob.NewEncoder(f).Encode(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := path.Join(root, fmt.Sprintf("verify%v", nextPort))
+	write(dir)
+	addr := gfs.ServerAddress(fmt.Sprintf(":%v", nextPort))
+	nextPort++
+	if _, err := master.NewAndServe(addr, dir, nil, master.WithStrictMetadata(1)); err == nil {
+		t.Fatal("expect strict master to refuse inconsistent metadata")
+	}
+
+	dir = path.Join(root, fmt.Sprintf("verify%v", nextPort))
+	write(dir)
+	addr = gfs.ServerAddress(fmt.Sprintf(":%v", nextPort))
+	nextPort++
+	vm, err := master.NewAndServe(addr, dir, nil, master.WithStrictMetadata(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Shutdown()
+
+	var f gfs.GetFileInfoReply
+	if err := vm.RPCGetFileInfo(gfs.GetFileInfoArg{Path: "/lost.txt"}, &f); err != nil || f.Chunks != 1 || f.LostChunks != 2 {
+		t.Error("expect 2 of 3 chunks lost, got", f, err)
+	}
+	if err := vm.RPCGetFileInfo(gfs.GetFileInfoArg{Path: "/good.txt"}, &f); err != nil || f.Chunks != 1 || f.LostChunks != 0 {
+		t.Error("expect an intact file, got", f, err)
+	}
+	// chunks of a file which is not in namespace are forgotten
+	for _, h := range []gfs.ChunkHandle{3, 4} {
+		if err := vm.RPCGetChunkInfo(gfs.GetChunkInfoArg{h}, &gfs.GetChunkInfoReply{}); err == nil {
+			t.Error("expect orphan chunk", h, "dropped")
+		}
+	}
+	var stats gfs.MasterStatsReply
+	if err := vm.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &stats); err != nil || stats.Chunks != 2 {
+		t.Error("expect 2 chunks left, got", stats.Chunks, err)
+	}
+}
+
+// Hammer overlapping paths with operations taking namespace locks in different ways,
+// they must always finish. Run it with -race to check the locking as well.
+func TestNamespaceLockOrder(t *testing.T) {
+	tc := newTestCluster(3, master.WithLockTimeout(0)) // a deadlock is not broken by timeout
+	defer tc.Shutdown()
+
+	n := 4
+	ch := make(chan error, 5+2*n)
+	for _, d := range []gfs.Path{"/order", "/order/a", "/order/a/x", "/order/a/x/y", "/order/b"} {
+		ch <- tc.m.RPCMkdir(gfs.MkdirArg{Path: d}, &gfs.MkdirReply{})
+	}
+	files := make([]gfs.Path, n)
+	for i := range files {
+		files[i] = gfs.Path(fmt.Sprintf("/order/a/x/y/f%v", i))
+		ch <- tc.c.Create(files[i])
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{files[i], 0}, &gfs.GetChunkHandleReply{})
+	}
+	errorAll(ch, 5+2*n, t)
+
+	rounds := 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func(p gfs.Path) { // readers lock parents top-down, then the file
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &gfs.GetChunkHandleReply{})
+				tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &gfs.GetFileInfoReply{})
+			}
+		}(files[i])
+		go func(p gfs.Path, i int) { // rename locks two parents
+			defer wg.Done()
+			moved := gfs.Path(fmt.Sprintf("/order/b/f%v", i))
+			for j := 0; j < rounds; j++ {
+				tc.m.RPCRenameFile(gfs.RenameFileArg{p, moved}, &gfs.RenameFileReply{})
+				tc.m.RPCRenameFile(gfs.RenameFileArg{moved, p}, &gfs.RenameFileReply{})
+			}
+		}(files[i], i)
+		go func(i int) { // snapshot locks a whole subtree and the parent of target
+			defer wg.Done()
+			for j := 0; j < rounds/4; j++ {
+				target := gfs.Path(fmt.Sprintf("/order/b/snap%v-%v", i, j))
+				tc.m.RPCSnapshot(gfs.SnapshotArg{"/order/a/x", target}, &gfs.SnapshotReply{})
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("namespace operations deadlock")
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/copy.txt")
+	q := gfs.Path("/copy-of.txt")
+	ch := make(chan error, 9)
+	ch <- tc.c.Create(p)
+
+	size := gfs.MaxChunkSize + 1000
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch <- tc.c.Write(p, 0, expected)
+
+	// revokes the lease of the write instead of waiting for it to expire
+	start := time.Now()
+	ch <- tc.c.CopyFile(p, q)
+	if time.Since(start) > gfs.LeaseExpire/2 {
+		t.Error("copy waits for the outstanding lease")
+	}
+	if err := tc.c.CopyFile(p, q); err == nil {
+		t.Error("copy to an existing path should fail")
+	}
+	if err := tc.c.CopyFile("/", "/copy-dir"); err == nil {
+		t.Error("copy of a directory should fail")
+	}
+
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: q}, &f)
+	if f.Chunks != 2 {
+		t.Error("expect 2 chunks in copy, got", f.Chunks)
+	}
+
+	buf := make([]byte, size)
+	n, err := tc.c.Read(q, 0, buf)
+	ch <- err
+	if n != size || !reflect.DeepEqual(expected, buf) {
+		t.Error("copy reads differently from source")
+	}
+
+	// the copy has its own chunks
+	var h gfs.GetChunkHandleReply
+	var r gfs.GetPathsByChunkReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{q, 0}, &h)
+	ch <- tc.m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{h.Handle}, &r)
+	if len(r.Paths) != 1 || r.Paths[0] != q {
+		t.Error("chunk of copy should belong to copy only", r.Paths)
+	}
+
+	ch <- tc.c.Write(p, 0, []byte("HELLO"))
+	_, err = tc.c.Read(q, 0, buf[:5])
+	ch <- err
+	if string(buf[:5]) != "abcde" {
+		t.Error("copy is modified by write to source", string(buf[:5]))
+	}
+
+	errorAll(ch, 9, t)
+}
+
+func TestLeaseBalance(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	// every chunk is on all the servers, so any of them may be the primary
+	n := 30
+	ch := make(chan error, 3*n)
+	primaries := make(map[gfs.ServerAddress]int)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/lease%v.txt", i))
+		ch <- tc.c.Create(p)
+		var h gfs.GetChunkHandleReply
+		ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &h)
+		var l gfs.GetPrimaryAndSecondariesReply
+		ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: h.Handle}, &l)
+		primaries[l.Primary]++
+	}
+	errorAll(ch, 3*n, t)
+
+	if len(primaries) != 3 {
+		t.Fatal("primaries should be spread over all servers", primaries)
+	}
+	for addr, k := range primaries {
+		if k < n/3-1 || k > n/3+1 {
+			t.Error("unbalanced primaries, server", addr, "holds", k, "leases of", n)
+		}
+	}
+}
+
+func TestFileLength(t *testing.T) {
+	p := gfs.Path("/TestFileLength.txt")
+	ch := make(chan error, 17)
+	ch <- c.Create(p)
+
+	length := func() int64 {
+		var f gfs.GetFileInfoReply
+		ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+		if f.Length > f.Chunks*gfs.MaxChunkSize {
+			t.Error("length", f.Length, "is beyond", f.Chunks, "chunks")
+		}
+		return f.Length
+	}
+
+	var expected int64
+	for i := 1; i <= 5; i++ {
+		offset, err := c.AppendWith(gfs.AppendArg{Path: p, Data: make([]byte, i*100), Sync: true})
+		ch <- err
+		expected = int64(offset) + int64(i*100)
+		if l := length(); l != expected {
+			t.Errorf("expect length %v after append %v, got %v", expected, i, l)
+		}
+	}
+
+	// a write inside the file does not shrink it
+	ch <- c.Write(p, 0, []byte("hello"))
+	if l := length(); l != expected {
+		t.Errorf("expect length %v after overwrite, got %v", expected, l)
+	}
+	ch <- c.Write(p, gfs.Offset(expected), []byte("world"))
+	if l := length(); l != expected+5 {
+		t.Errorf("expect length %v after write at end, got %v", expected+5, l)
+	}
+
+	ch <- c.Truncate(p, 100)
+	if l := length(); l != 100 {
+		t.Error("expect length 100 after truncate, got", l)
+	}
+
+	errorAll(ch, 17, t)
+}
+
+// Flip a byte in a stored chunk which is never read, scrubbing finds it and the replica is replaced
+func TestScrub(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+	for _, cs := range tc.cs {
+		cs.SetScrubRate(1 << 30)
+	}
+
+	p := gfs.Path("/scrub.txt")
+	data := make([]byte, 3*gfs.ChecksumBlockSize)
+	for i := range data {
+		data[i] = byte(i%26 + 'a')
+	}
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, data)
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	bad := -1
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			bad = i
+		}
+	}
+	filename := path.Join(tc.root, "cs"+strconv.Itoa(bad), fmt.Sprintf("chunk%v.chk", r.Handle))
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'#'}, 2*gfs.ChecksumBlockSize+10)
+	f.Close()
+
+	// the corrupted replica is reported without any read, and re-created from a good one
+	intact := func() bool {
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Locations) != gfs.DefaultNumReplicas {
+			return false
+		}
+		for _, v := range l.Locations {
+			if v == tc.csAdd[bad] { // read the file, a read rpc would find the corruption too
+				b, err := ioutil.ReadFile(filename)
+				if err != nil || len(b) != len(data) || b[2*gfs.ChecksumBlockSize+10] == '#' {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(2*gfs.ScrubInterval + 2*gfs.HeartbeatInterval + 2*gfs.ServerCheckInterval)
+	for !intact() {
+		if time.Now().After(deadline) {
+			t.Fatal("corrupted replica is not found by scrubbing")
+		}
+		time.Sleep(gfs.HeartbeatInterval)
+	}
+}
+
+func TestReader(t *testing.T) {
+	p := gfs.Path("/TestReader.txt")
+	ch := make(chan error, 3)
+	ch <- c.Create(p)
+
+	size := gfs.MaxChunkSize + 12345
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch <- c.Write(p, 0, expected)
+
+	r, err := c.OpenReader(p)
+	ch <- err
+	errorAll(ch, 3, t)
+
+	lookups := c.LocationLookups()
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, r)
+	if err != nil || n != int64(size) {
+		t.Error("copy", n, "bytes of", size, "through reader:", err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("reader reads wrong data")
+	}
+	if k := c.LocationLookups() - lookups; k > 2 {
+		t.Error("expect at most one location lookup for each of 2 chunks, got", k)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Error("expect EOF at end of file, got", n, err)
+	}
+
+	if _, err := c.OpenReader("/"); err == nil {
+		t.Error("open a directory for read should fail")
+	}
+}
+
+// Many small records written through an appender are coalesced into few appends,
+// a write longer than the append limit is split, and all of them are read back in order
+func TestAppender(t *testing.T) {
+	chunkSize := int64(4 * gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/appender.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+
+	a, err := tc.c.OpenAppender(p)
+	ch <- err
+	var expected bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		record := []byte(fmt.Sprintf("record %05d\n", i))
+		expected.Write(record)
+		if _, err := a.Write(record); err != nil {
+			t.Fatal("write record", i, err)
+		}
+	}
+	big := bytes.Repeat([]byte("x"), int(chunkSize/4)+1000)
+	expected.Write(big)
+	if n, err := a.Write(big); n != len(big) || err != nil {
+		t.Error("write a record longer than append limit:", n, err)
+	}
+	offset, err := a.Close()
+	ch <- err
+
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if int64(offset) != f.Length {
+		t.Error("appender ends at", offset, "but file length is", f.Length)
+	}
+
+	// the padding at the end of chunks reads as zero
+	r, err := tc.c.OpenReader(p)
+	ch <- err
+	errorAll(ch, 5, t)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.Replace(data, []byte{0}, nil, -1), expected.Bytes()) {
+		t.Error("records read back differ from the ones written")
+	}
+
+	if _, err := tc.c.OpenAppender("/"); err == nil {
+		t.Error("open a directory for append should fail")
+	}
+}
+
+// A paginated walk returns every node of a nested tree exactly once, in sorted order
+func TestWalk(t *testing.T) {
+	ch := make(chan error, 15)
+	ch <- c.MkdirAll("/walk/a/b")
+	ch <- c.MkdirAll("/walk/a0")
+	ch <- c.Mkdir("/walk/c")
+	expected := []gfs.Path{"/walk/a", "/walk/a/b", "/walk/a0", "/walk/c"}
+	for _, p := range []gfs.Path{"/walk/a/1", "/walk/a/b/1", "/walk/a/b/2", "/walk/a0/1", "/walk/c/1", "/walk/d"} {
+		ch <- c.Create(p)
+		expected = append(expected, p)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return strings.Replace(string(expected[i]), "/", "\x00", -1) < strings.Replace(string(expected[j]), "/", "\x00", -1)
+	})
+
+	var got []gfs.Path
+	var after gfs.Path
+	for pages := 0; ; pages++ {
+		var r gfs.WalkReply
+		ch <- m.RPCWalk(gfs.WalkArg{Root: "/walk", After: after, Limit: 3}, &r)
+		if len(r.Entries) > 3 {
+			t.Error("page has", len(r.Entries), "entries, more than the limit")
+		}
+		for _, e := range r.Entries {
+			got = append(got, e.Path)
+		}
+		if r.Next == "" || pages > len(expected) {
+			break
+		}
+		if pages == 0 { // a node added behind the walk is not returned
+			ch <- c.Create("/walk/a/0")
+		}
+		after = r.Next
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Error("expect walk", expected, "got", got)
+	}
+
+	all, err := c.Walk("/walk")
+	ch <- err
+	if len(all) != len(expected)+1 {
+		t.Error("expect", len(expected)+1, "entries from client walk, got", len(all))
+	}
+
+	var r gfs.WalkReply
+	if err := m.RPCWalk(gfs.WalkArg{Root: "/walk/d"}, &r); err == nil {
+		t.Error("walk a file should fail")
+	}
+	errorAll(ch, 15, t)
+}
+
+// A record appended with Sync is seen by a reader opened right after, and concurrent
+// synced appends leave the length at the end of the last record
+func TestAppendSync(t *testing.T) {
+	p := gfs.Path("/TestAppendSync.txt")
+	ch := make(chan error, 13)
+	ch <- c.Create(p)
+
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("record %v", i))
+		offset, err := c.AppendWith(gfs.AppendArg{Path: p, Data: data, Sync: true})
+		ch <- err
+		r, err := c.OpenReader(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil || len(buf) < int(offset)+len(data) {
+			t.Error("reader misses record", i, "at", offset, "read", len(buf), "bytes:", err)
+		} else if !bytes.Equal(buf[offset:], data) {
+			t.Error("expect", data, "at", offset, "got", buf[offset:])
+		}
+	}
+
+	var wg sync.WaitGroup
+	ends := make(chan int64, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			data := make([]byte, 100*(x+1))
+			offset, err := c.AppendWith(gfs.AppendArg{Path: p, Data: data, Sync: true})
+			ch <- err
+			ends <- int64(offset) + int64(len(data))
+		}(i)
+	}
+	wg.Wait()
+	close(ends)
+	var last int64
+	for end := range ends {
+		if end > last {
+			last = end
+		}
+	}
+
+	var f gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Length != last {
+		t.Error("expect length", last, "after concurrent appends, got", f.Length)
+	}
+	errorAll(ch, 13, t)
+}
+
+// lengthlessMaster is a master whose length reports fail when fail is set
+type lengthlessMaster struct {
+	*master.Master
+	fail int32
+}
+
+func (m *lengthlessMaster) RPCUpdateFileLength(args gfs.UpdateFileLengthArg, reply *gfs.UpdateFileLengthReply) error {
+	if atomic.LoadInt32(&m.fail) != 0 {
+		return fmt.Errorf("length of %v is lost", args.Path)
+	}
+	return m.Master.RPCUpdateFileLength(args, reply)
+}
+
+// A write or a synchronous append whose data is written but whose length is not reported
+// fails with gfs.ErrLengthNotUpdated, so the caller does not write the data again
+func TestLengthNotUpdated(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	lm := &lengthlessMaster{Master: tc.m, fail: 1}
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("Master", lm)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	lc := client.NewClient(gfs.ServerAddress(l.Addr().String()), nil)
+
+	p := gfs.Path("/TestLengthNotUpdated.txt")
+	if err := lc.Create(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := lc.Write(p, 0, []byte("written")); !gfs.IsError(err, gfs.ErrLengthNotUpdated) {
+		t.Error("expect length not updated after write, got", err)
+	}
+	offset, err := lc.AppendWith(gfs.AppendArg{Path: p, Data: []byte("appended"), Sync: true})
+	if !gfs.IsError(err, gfs.ErrLengthNotUpdated) || offset != 7 {
+		t.Error("expect length not updated after append at 7, got", offset, err)
+	}
+
+	// the appended record is not buffered again, the next flush only reports the length
+	a, err := lc.OpenAppender(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write([]byte("flushed"))
+	if err := a.Flush(); !gfs.IsError(err, gfs.ErrLengthNotUpdated) {
+		t.Error("expect length not updated after flush, got", err)
+	}
+	atomic.StoreInt32(&lm.fail, 0)
+	if end, err := a.Close(); err != nil || end != 22 {
+		t.Error("expect end 22 after close, got", end, err)
+	}
+
+	var f gfs.GetFileInfoReply
+	if err := tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f); err != nil || f.Length != 22 {
+		t.Error("expect length 22, got", f.Length, err)
+	}
+	buf := make([]byte, 22)
+	if n, err := tc.c.Read(p, 0, buf); n != 22 || string(buf) != "writtenappendedflushed" {
+		t.Error("read", string(buf[:n]), err)
+	}
+}
+
+// On a cluster with an empty new server, the rebalance plan moves chunks from the loaded
+// servers to the new one, and nothing is moved by planning
+func TestRebalancePlan(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	n := 6
+	ch := make(chan error, 2*n+1)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/plan%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+	}
+	// the chunks are leased just now, so the background rebalancer does not move them yet
+	added := tc.addChunkServer()
+	time.Sleep(2 * gfs.HeartbeatInterval)
+
+	var r gfs.RebalancePlanReply
+	ch <- tc.m.RPCPlanRebalance(gfs.RebalancePlanArg{}, &r)
+	errorAll(ch, 2*n+1, t)
+
+	if len(r.Moves) != gfs.RebalanceMaxMoves {
+		t.Fatal("expect", gfs.RebalanceMaxMoves, "moves in plan, got", r.Moves)
+	}
+	for i, v := range r.Moves {
+		if v.To != tc.csAdd[added] {
+			t.Error("move", v, "is not to the empty server", tc.csAdd[added])
+		}
+		if i > 0 && v.Handle == r.Moves[i-1].Handle {
+			t.Error("chunk", v.Handle, "is moved twice")
+		}
+		var l gfs.GetReplicasReply
+		if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: v.Handle}, &l); err != nil {
+			t.Error(err)
+		}
+		held := false
+		for _, a := range l.Locations {
+			if a == tc.csAdd[added] {
+				t.Error("chunk", v.Handle, "is moved by planning")
+			}
+			held = held || a == v.From
+		}
+		if !held {
+			t.Error("move", v, "is from a server not holding the chunk", l.Locations)
+		}
+	}
+}
+
+// After a server is lost, the copies of its chunks are spread over all the servers
+// holding the other replicas
+func TestReReplicationSources(t *testing.T) {
+	tc := newTestCluster(5)
+	defer tc.Shutdown()
+
+	n := 20
+	ch := make(chan error, 2*n+1)
+	for i := 0; i < n; i++ {
+		p := gfs.Path(fmt.Sprintf("/sources%v.txt", i))
+		ch <- tc.c.Create(p)
+		ch <- tc.c.Write(p, 0, []byte(p))
+	}
+	var r gfs.ListChunkServersReply
+	ch <- tc.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &r)
+	errorAll(ch, 2*n+1, t)
+	lost := 0
+	for _, v := range r.Servers {
+		if v.Address == tc.csAdd[0] {
+			lost = v.Chunks
+		}
+	}
+
+	tc.cs[0].Shutdown()
+	sent := make(map[gfs.ServerAddress]int64)
+	var total int64
+	for wait := 0; wait < 50 && total < int64(lost); wait++ {
+		time.Sleep(gfs.ServerTimeout / 5)
+		if err := tc.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &r); err != nil {
+			t.Fatal(err)
+		}
+		total = 0
+		for _, v := range r.Servers {
+			sent[v.Address] = v.CopiesSent
+			total += v.CopiesSent
+		}
+	}
+
+	if total < int64(lost) {
+		t.Fatal("expect", lost, "copies after losing a server, got", total)
+	}
+	// each chunk has two replicas left on the four servers
+	sources := 0
+	for a, k := range sent {
+		if k > 0 {
+			sources++
+		}
+		if k > total/4+2 {
+			t.Error(a, "sends", k, "of", total, "copies")
+		}
+	}
+	if sources < 4 {
+		t.Error("expect copies sent by all the servers left, got", sent)
+	}
+}
+
+// The middle chunk of a three-chunk read is lost on all replicas, the read returns the
+// first chunk and reports where it fails
+func TestPartialRead(t *testing.T) {
+	chunkSize := int64(4 * gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/partial.txt")
+	size := 3 * int(chunkSize)
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch := make(chan error, 3)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, expected)
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 1}, &r)
+	errorAll(ch, 3, t)
+	var l gfs.GetReplicasReply
+	if err := tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range l.Locations {
+		err := util.Call(addr, "ChunkServer.RPCDeleteChunk", gfs.DeleteChunkArg{[]gfs.ChunkHandle{r.Handle}}, &gfs.DeleteChunkReply{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := 100
+	buf := make([]byte, size-start)
+	n, err := tc.c.Read(p, gfs.Offset(start), buf)
+	prefix := int(chunkSize) - start
+	e, ok := err.(gfs.PartialReadError)
+	if !ok {
+		t.Fatal("expect a partial read error, got", err)
+	}
+	if n != prefix || e.Read != prefix {
+		t.Error("expect", prefix, "bytes read before the failed chunk, got", n, e.Read)
+	}
+	if e.Offset != gfs.Offset(chunkSize) || e.Handle != r.Handle {
+		t.Error("expect chunk", r.Handle, "failing at", chunkSize, "got", e.Handle, e.Offset)
+	}
+	if !bytes.Equal(buf[:prefix], expected[start:chunkSize]) {
+		t.Error("read wrong data before the failed chunk")
+	}
+}
+
+// The load of a server follows a burst of operations reported in heartbeats, and decays after it
+func TestServerLoad(t *testing.T) {
+	tc := newTestCluster(1)
+	defer tc.Shutdown()
+
+	addr := gfs.ServerAddress(":1") // no server behind, only heartbeats are sent
+	var ops int64
+	beat := func() float64 {
+		args := gfs.HeartbeatArg{Address: addr, Stats: gfs.ChunkServerStats{ChunksServed: ops}, Incarnation: 1}
+		tc.m.RPCHeartbeat(args, &gfs.HeartbeatReply{}) // the first one fails to ask the server for its chunks
+		var r gfs.ListChunkServersReply
+		if err := tc.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &r); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range r.Servers {
+			if v.Address == addr {
+				return v.Load
+			}
+		}
+		t.Fatal("server", addr, "is not registered")
+		return 0
+	}
+
+	beat()
+	time.Sleep(200 * time.Millisecond)
+	if l := beat(); l != 0 {
+		t.Error("expect no load on an idle server, got", l)
+	}
+
+	// a second of 1000 operations per second
+	var peak float64
+	for i := 0; i < 5; i++ {
+		time.Sleep(200 * time.Millisecond)
+		ops += 200
+		l := beat()
+		if l <= peak {
+			t.Error("load does not grow during burst:", l, "after", peak)
+		}
+		peak = l
+	}
+	if peak < 200 || peak > 1000 {
+		t.Error("expect load between 200 and 1000 after burst, got", peak)
+	}
+
+	last := peak
+	for i := 0; i < 10; i++ {
+		time.Sleep(200 * time.Millisecond)
+		l := beat()
+		if l >= last {
+			t.Error("load does not decay after burst:", l, "after", last)
+		}
+		last = l
+	}
+	if last > peak/2 {
+		t.Error("expect load below half of", peak, "two seconds after burst, got", last)
+	}
+}
+
+// A file cannot get more chunks than the limit of master or its own limit,
+// and the chunks it has stay readable
+func TestMaxFileChunks(t *testing.T) {
+	chunkSize := int64(4 * gfs.ChecksumBlockSize)
+	tc := newTestCluster(3, master.WithChunkSize(chunkSize), master.WithMaxFileChunks(2))
+	defer tc.Shutdown()
+
+	size := 2 * int(chunkSize)
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	p := gfs.Path("/limited.txt")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, expected)
+
+	var r gfs.GetChunkHandleReply
+	if err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 2}, &r); !gfs.IsError(err, gfs.ErrFileTooLarge) {
+		t.Error("expect ErrFileTooLarge for chunk beyond the limit, got", err)
+	}
+	if err := tc.c.Write(p, gfs.Offset(size), []byte("more")); !gfs.IsError(err, gfs.ErrFileTooLarge) {
+		t.Error("expect ErrFileTooLarge for write beyond the limit, got", err)
+	}
+	buf := make([]byte, size)
+	n, err := tc.c.Read(p, 0, buf)
+	ch <- err
+	if n != size || !bytes.Equal(buf, expected) {
+		t.Error("read wrong data from a file at its limit")
+	}
+
+	// a file with its own limit
+	q := gfs.Path("/own-limit.txt")
+	ch <- tc.c.CreateWithMaxChunks(q, 3)
+	ch <- tc.c.Write(q, 0, append(expected, expected[:chunkSize]...))
+	if err := tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{q, 3}, &r); !gfs.IsError(err, gfs.ErrFileTooLarge) {
+		t.Error("expect ErrFileTooLarge beyond the limit of file, got", err)
+	}
+	errorAll(ch, 5, t)
+}
+
+// When all the cached replicas of a chunk are moved away, a read asks master for
+// the current replicas once and succeeds before the cached location expires
+func TestReadRefreshReplicas(t *testing.T) {
+	tc := newTestCluster(3, master.WithLeaseDuration(500*time.Millisecond))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/moved.txt")
+	data := []byte("the replicas of this chunk are all moved")
+	ch := make(chan error, 6)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, data)
+
+	var h gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &h)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h.Handle}, &l)
+	old := len(tc.cs)
+	for i := 0; i < 3; i++ {
+		tc.addChunkServer()
+	}
+	// wait for the new servers to register and the lease to be movable
+	time.Sleep(2*gfs.HeartbeatInterval + 3*500*time.Millisecond)
+
+	buf := make([]byte, len(data))
+	_, err := tc.c.Read(p, 0, buf)
+	ch <- err
+
+	var moves []gfs.ChunkMove
+	for i, v := range l.Locations {
+		moves = append(moves, gfs.ChunkMove{Handle: h.Handle, From: v, To: tc.csAdd[old+i]})
+	}
+	var r gfs.ApplyRebalanceReply
+	ch <- tc.m.RPCApplyRebalance(gfs.ApplyRebalanceArg{Moves: moves}, &r)
+	errorAll(ch, 6, t)
+	if r.Moved != len(moves) {
+		t.Fatal("expect", len(moves), "moves, got", r.Moved)
+	}
+	for i := 0; i < old; i++ {
+		tc.cs[i].Shutdown()
+	}
+
+	before := tc.c.LocationLookups()
+	buf = make([]byte, len(data))
+	n, err := tc.c.Read(p, 0, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(buf, data) {
+		t.Error("expect", string(data), "got", string(buf[:n]))
+	}
+	if k := tc.c.LocationLookups() - before; k != 1 {
+		t.Error("expect 1 lookup to refresh the replicas, got", k)
+	}
+}
+
+// A write is aborted on all the replicas if a secondary fails to prepare it,
+// here the secondary loses the pushed data as soon as it arrives
+func TestAbortMutation(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/abort.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	index := func(addr gfs.ServerAddress) int {
+		for i, v := range tc.csAdd {
+			if v == addr {
+				return i
+			}
+		}
+		return -1
+	}
+	check := func(expected string) {
+		for _, v := range append([]gfs.ServerAddress{l.Primary}, l.Secondaries...) {
+			var d gfs.ReadChunkReply
+			if err := tc.cs[index(v)].RPCReadChunk(gfs.ReadChunkArg{r.Handle, 0, len(expected)}, &d); err != nil {
+				t.Error(err)
+			} else if string(d.Data[:d.Length]) != expected {
+				t.Errorf("expect %q on %v, got %q", expected, v, d.Data[:d.Length])
+			}
+		}
+	}
+
+	bad := tc.cs[index(l.Secondaries[0])]
+	bad.SetDataBufferExpire(time.Nanosecond)
+	if err := tc.c.WriteChunk(r.Handle, 0, []byte("world")); err == nil {
+		t.Error("expect the write to fail when a secondary cannot prepare it")
+	}
+	check("hello")
+
+	bad.SetDataBufferExpire(gfs.DownloadBufferExpire)
+	if err := tc.c.WriteChunk(r.Handle, 0, []byte("world")); err != nil {
+		t.Error(err)
+	}
+	check("world")
+}
+
+// captureLogger keeps the logs sent to it, it is a master.Logger
+type captureLogger struct {
+	sync.Mutex
+	logs []string
+}
+
+func (l *captureLogger) log(level string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.logs = append(l.logs, level+" "+fmt.Sprint(args...))
+}
+
+func (l *captureLogger) Debug(args ...interface{}) { l.log("DEBU", args...) }
+func (l *captureLogger) Info(args ...interface{})  { l.log("INFO", args...) }
+func (l *captureLogger) Warn(args ...interface{})  { l.log("WARN", args...) }
+func (l *captureLogger) Error(args ...interface{}) { l.log("ERRO", args...) }
+
+// find returns the first log of level containing s
+func (l *captureLogger) find(level, s string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for _, v := range l.logs {
+		if strings.HasPrefix(v, level+" ") && strings.Contains(v, s) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// The logs of master go to the logger it is configured with
+func TestMasterLogger(t *testing.T) {
+	logger := new(captureLogger)
+	tc := newTestCluster(4, master.WithLogger(logger))
+	defer tc.Shutdown()
+
+	p := gfs.Path("/logged.txt")
+	ch := make(chan error, 4)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte(p))
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	if _, ok := logger.find("INFO", "Master is running now"); !ok {
+		t.Error("expect the start of master to be logged")
+	}
+
+	task := &flakyTask{release: make(chan struct{})}
+	defer close(task.release)
+	tc.m.RegisterBackgroundTask(task)
+	time.Sleep(10 * task.Interval())
+	if _, ok := logger.find("ERRO", "flaky task fails"); !ok {
+		t.Error("expect the error of a background task to be logged")
+	}
+
+	for i, v := range tc.csAdd {
+		if v == l.Locations[0] {
+			tc.cs[i].Shutdown()
+		}
+	}
+	event := fmt.Sprintf("allocate new chunk %v", r.Handle)
+	for wait := 0; wait < 50; wait++ {
+		if _, ok := logger.find("WARN", event); ok {
+			return
+		}
+		time.Sleep(gfs.ServerTimeout / 5)
+	}
+	t.Error("expect the re-replication of chunk", r.Handle, "to be logged")
+}
+
+// A write far past the end of an empty file leaves holes, which read as zero
+// and take no disk on chunkservers until they are written
+func TestSparseWrite(t *testing.T) {
+	chunkSize := int64(4 * gfs.ChecksumBlockSize)
+	opts := []master.Option{master.WithChunkSize(chunkSize), master.WithSparseFiles()}
+	tc := newTestCluster(3, opts...)
+	defer tc.Shutdown()
+
+	// with a capacity, the free space is counted by the chunks reserved rather than the disk
+	for _, cs := range tc.cs {
+		cs.SetCapacity(gfs.MinFreeSpace + 100*chunkSize)
+	}
+	free := func() int64 {
+		time.Sleep(2 * gfs.HeartbeatInterval)
+		var r gfs.ListChunkServersReply
+		if err := tc.m.RPCListChunkServers(gfs.ListChunkServersArg{}, &r); err != nil {
+			t.Fatal(err)
+		}
+		var sum int64
+		for _, v := range r.Servers {
+			sum += v.FreeBytes
+		}
+		return sum
+	}
+	before := free()
+
+	p := gfs.Path("/sparse.txt")
+	ch := make(chan error, 10)
+	ch <- tc.c.Create(p)
+	data := []byte("written at chunk 5")
+	ch <- tc.c.Write(p, gfs.Offset(5*chunkSize+10), data)
+
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Chunks != 6 {
+		t.Error("expect 6 chunks, got", f.Chunks)
+	}
+	if after := free(); before-after != 3*chunkSize {
+		t.Error("expect only chunk 5 to take", 3*chunkSize, "bytes, got", before-after)
+	}
+
+	buf := make([]byte, 100)
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	n, err := tc.c.Read(p, gfs.Offset(2*chunkSize), buf)
+	ch <- err
+	if n != len(buf) || !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Error("expect a hole of zero at chunk 2, got", n, "bytes", buf[:8])
+	}
+
+	// a read across the end of the hole gets both the zeros and the data
+	buf = make([]byte, 10+len(data))
+	n, err = tc.c.Read(p, gfs.Offset(5*chunkSize), buf)
+	if err != nil && err != io.EOF {
+		t.Error(err)
+	}
+	if n != len(buf) || !bytes.Equal(buf[10:], data) {
+		t.Error("expect", string(data), "after the hole, got", string(buf[:n]))
+	}
+
+	var h gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 2}, &h)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h.Handle}, &l)
+	if !l.Hole || len(l.Locations) != 0 {
+		t.Error("expect chunk 2 to be a hole without replicas, got", l.Hole, l.Locations)
+	}
+	for i := range tc.cs {
+		if _, err := os.Stat(path.Join(tc.root, "cs"+strconv.Itoa(i), fmt.Sprintf("chunk%v.chk", h.Handle))); !os.IsNotExist(err) {
+			t.Error("hole", h.Handle, "is created on", tc.csAdd[i], err)
+		}
+	}
+
+	// the holes are kept across restarts, and the first write to one creates its replicas
+	tc.m.Shutdown()
+	tc.m = startMaster(tc.mAdd, path.Join(tc.root, "m"), tc.tls, opts...)
+	time.Sleep(gfs.LeaseExpire)
+	ch <- tc.c.Write(p, gfs.Offset(2*chunkSize), data)
+	buf = make([]byte, len(data))
+	_, err = tc.c.Read(p, gfs.Offset(2*chunkSize), buf)
+	ch <- err
+	if !bytes.Equal(buf, data) {
+		t.Error("expect", string(data), "written to the hole, got", string(buf))
+	}
+	l = gfs.GetReplicasReply{}
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h.Handle}, &l)
+	if l.Hole || len(l.Locations) != 3 {
+		t.Error("expect 3 replicas of the written hole, got", l.Hole, l.Locations)
+	}
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: h.Handle - 1}, &l)
+	if !l.Hole {
+		t.Error("expect chunk 1 to be still a hole")
+	}
+	if after := free(); before-after != 6*chunkSize {
+		t.Error("expect chunks 2 and 5 to take", 6*chunkSize, "bytes, got", before-after)
+	}
+	errorAll(ch, 10, t)
+}
+
+// An append retried with the same record ID is not appended again
+func TestAppendDedup(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/dedup.log")
+	record := []byte("a record appended once\n")
+	ch := make(chan error, 5)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("head\n"))
+
+	args := gfs.AppendArg{Path: p, Data: record, Mode: gfs.ExactlyOnce, RecordID: 42}
+	first, err := tc.c.AppendWith(args)
+	ch <- err
+	retried, err := tc.c.AppendWith(args)
+	ch <- err
+	if retried != first {
+		t.Error("expect the retried record at", first, "got", retried)
+	}
+	count := func() int {
+		buf := make([]byte, 1000)
+		n, err := tc.c.Read(p, 0, buf)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		return strings.Count(string(buf[:n]), string(record))
+	}
+	if k := count(); k != 1 {
+		t.Error("expect the record once, got", k)
+	}
+
+	// another record is appended after it
+	args.RecordID = 43
+	other, err := tc.c.AppendWith(args)
+	ch <- err
+	if want := first + gfs.Offset(len(record)); other != want {
+		t.Error("expect the next record at", want, "got", other)
+	}
+	if k := count(); k != 2 {
+		t.Error("expect two records with two IDs, got", k)
+	}
+	errorAll(ch, 5, t)
+}
+
+// A retried record is appended again in at-least-once mode and once in exactly-once mode,
+// also by a client restarted after a crash, and the primary enforces the mode
+func TestAppendModes(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/modes.log")
+	record := []byte("a record\n")
+	ch := make(chan error, 12)
+	ch <- tc.c.Create(p)
+	count := func() int {
+		buf := make([]byte, 1000)
+		n, err := tc.c.Read(p, 0, buf)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		return strings.Count(string(buf[:n]), string(record))
+	}
+
+	// at least once, the ID is ignored
+	least := gfs.AppendArg{Path: p, Data: record, Sync: true, RecordID: 7}
+	_, err := tc.c.AppendWith(least)
+	ch <- err
+	_, err = tc.c.AppendWith(least)
+	ch <- err
+	if k := count(); k != 2 {
+		t.Error("expect the retried record twice in at-least-once mode, got", k)
+	}
+
+	// exactly once, the client crashes after the append and retries when it recovers
+	exact := gfs.AppendArg{Path: p, Data: record, Mode: gfs.ExactlyOnce, RecordID: 8}
+	first, err := tc.c.AppendWith(exact)
+	ch <- err
+	var f gfs.GetFileInfoReply
+	ch <- tc.m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Length != int64(first)+int64(len(record)) {
+		t.Error("expect the length confirmed by an exactly-once append, got", f.Length)
+	}
+	recovered := client.NewClient(tc.mAdd, tc.tls)
+	retried, err := recovered.AppendWith(exact)
+	ch <- err
+	if retried != first {
+		t.Error("expect the retried record at", first, "got", retried)
+	}
+	if k := count(); k != 3 {
+		t.Error("expect the record once more in exactly-once mode, got", k-2)
+	}
+
+	// the primary keeps no ID of an at-least-once append, and needs one for exactly once
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: r.Handle}, &l)
+	appendChunk := func(mode gfs.AppendMode, id uint64) (gfs.Offset, error) {
+		dataID := chunkserver.NewDataID(r.Handle)
+		chain := append([]gfs.ServerAddress{l.Primary}, l.Secondaries...)
+		if err := util.Call(chain[0], "ChunkServer.RPCPushData", gfs.PushDataArg{dataID, record, chain[1:]}, &gfs.PushDataReply{}); err != nil {
+			t.Fatal(err)
+		}
+		var a gfs.AppendChunkReply
+		err := util.Call(l.Primary, "ChunkServer.RPCAppendChunk", gfs.AppendChunkArg{dataID, l.Secondaries, l.Version, mode, id}, &a)
+		return a.Offset, err
+	}
+	o1, err := appendChunk(gfs.AtLeastOnce, 9)
+	ch <- err
+	o2, err := appendChunk(gfs.AtLeastOnce, 9)
+	ch <- err
+	if o1 == o2 {
+		t.Error("expect an at-least-once record appended again, both at", o1)
+	}
+	if _, err := appendChunk(gfs.ExactlyOnce, 0); err == nil {
+		t.Error("expect an exactly-once append without ID rejected")
+	}
+	errorAll(ch, 10, t)
+}
+
+// A batch stat returns the same info as stating each path alone, and a missing path
+// only fails its own entry
+func TestBatchGetFileInfo(t *testing.T) {
+	ch := make(chan error, 4)
+	ch <- c.MkdirAll("/batch/dir")
+	ch <- c.Create("/batch/f")
+	ch <- c.Write("/batch/f", 0, []byte("batch"))
+	paths := []gfs.Path{"/batch/f", "/batch/missing", "/batch/dir", "/nobatch/x", "/batch/f/x", "/batch", "/batch/f"}
+
+	infos, errs, err := c.BatchGetFileInfo(paths)
+	ch <- err
+	errorAll(ch, 4, t)
+	if len(infos) != len(paths) || len(errs) != len(paths) {
+		t.Fatal("expect", len(paths), "results, got", len(infos), "infos and", len(errs), "errors")
+	}
+	for i, p := range paths {
+		var r gfs.GetFileInfoReply
+		err := m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &r)
+		r.Ctime, r.Mtime = r.Ctime.Round(0), r.Mtime.Round(0) // as sent over RPC
+		if (err == nil) != (errs[i] == nil) {
+			t.Error(p, "expect error", err, "got", errs[i])
+		} else if err == nil && !reflect.DeepEqual(r, infos[i]) {
+			t.Error(p, "expect info", r, "got", infos[i])
+		} else if err != nil && !gfs.IsError(errs[i], gfs.ErrNotExist) {
+			t.Error(p, "expect not exist, got", errs[i])
+		}
+	}
+}
+
+// A read of a range gets only the bytes in it, and the range is checked against the chunk
+func TestReadChunkRange(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/TestReadChunkRange.txt")
+	data := make([]byte, 4*gfs.ChecksumBlockSize)
+	for i := range data {
+		data[i] = byte(i%26 + 'a')
+	}
+	ch := make(chan error, 6)
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, data)
+	var r gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &r)
+	var l gfs.GetReplicasReply
+	ch <- tc.m.RPCGetReplicas(gfs.GetReplicasArg{Handle: r.Handle}, &l)
+	errorAll(ch, 4, t)
+
+	read := func(offset gfs.Offset, length int) (gfs.ReadChunkReply, error) {
+		var rr gfs.ReadChunkReply
+		err := util.Call(l.Locations[0], "ChunkServer.RPCReadChunk", gfs.ReadChunkArg{r.Handle, offset, length}, &rr)
+		return rr, err
+	}
+
+	offset := gfs.Offset(2*gfs.ChecksumBlockSize - 50)
+	rr, err := read(offset, 100)
+	ch <- err
+	if rr.Length != 100 || !bytes.Equal(rr.Data, data[offset:offset+100]) {
+		t.Error("expect 100 bytes from the middle of chunk, got", rr.Length, len(rr.Data))
+	}
+
+	// past the end of data
+	offset = gfs.Offset(len(data) - 30)
+	rr, err = read(offset, 100)
+	ch <- err
+	if rr.ErrorCode != gfs.ReadEOF || rr.Length != 30 || !bytes.Equal(rr.Data, data[offset:]) {
+		t.Error("expect a short read of 30 bytes, got", rr.Length, len(rr.Data), rr.ErrorCode)
+	}
+
+	// out of the chunk
+	if _, err := read(gfs.Offset(gfs.MaxChunkSize-10), 100); err == nil {
+		t.Error("expect a read past the chunk size rejected")
+	}
+	if _, err := read(0, -1); err == nil {
+		t.Error("expect a negative length rejected")
+	}
+	errorAll(ch, 2, t)
+}
+
+// Write two chunks, then a chunk right after the end of file
+func TestWriteNewChunk(t *testing.T) {
+	p := gfs.Path("/TestWriteNewChunk.txt")
+
+	ch := make(chan error, 5)
+	ch <- c.Create(p)
+
+	size := 2 * gfs.MaxChunkSize
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch <- c.Write(p, 0, expected)
+
+	buf := make([]byte, size)
+	n, err := c.Read(p, 0, buf)
+	ch <- err
+	if n != size || !reflect.DeepEqual(expected, buf) {
+		t.Error("read wrong data of two chunks")
+	}
+
+	ch <- c.Write(p, gfs.Offset(size), expected[:10])
+
+	var f gfs.GetFileInfoReply
+	ch <- m.RPCGetFileInfo(gfs.GetFileInfoArg{Path: p}, &f)
+	if f.Chunks != 3 {
+		t.Error("expect 3 chunks, got", f.Chunks)
+	}
+
+	errorAll(ch, 5, t)
+}
+
+// Snapshot a directory, then write to both the source and the snapshot
+func TestSnapshot(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/snap/a.txt")
+	s := gfs.Path("/snap-copy/a.txt")
+	ch := make(chan error, 12)
+	ch <- tc.c.Mkdir("/snap")
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello world"))
+
+	// revokes the lease of the write instead of waiting for it to expire
+	start := time.Now()
+	ch <- tc.c.Snapshot("/snap", "/snap-copy")
+	if time.Since(start) > gfs.LeaseExpire/2 {
+		t.Error("snapshot waits for the outstanding lease")
+	}
+	if err := tc.c.Snapshot("/snap", "/snap-copy"); err == nil {
+		t.Error("snapshot to an existing path should fail")
+	}
+
+	var r gfs.GetPathsByChunkReply
+	var h gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &h)
+	ch <- tc.m.RPCGetPathsByChunk(gfs.GetPathsByChunkArg{h.Handle}, &r)
+	if len(r.Paths) != 2 {
+		t.Error("chunk should be shared by source and snapshot", r.Paths)
+	}
+
+	// the first write to source moves snapshot to a copy
+	ch <- tc.c.Write(p, 0, []byte("HELLO"))
+	buf := make([]byte, 11)
+	_, err := tc.c.Read(p, 0, buf)
+	ch <- err
+	if string(buf) != "HELLO world" {
+		t.Error("wrong data in source", string(buf))
+	}
+	_, err = tc.c.Read(s, 0, buf)
+	ch <- err
+	if string(buf) != "hello world" {
+		t.Error("snapshot is modified", string(buf))
+	}
+
+	// write to snapshot does not affect source
+	ch <- tc.c.Write(s, 6, []byte("WORLD"))
+	_, err = tc.c.Read(s, 0, buf)
+	ch <- err
+	if string(buf) != "hello WORLD" {
+		t.Error("wrong data in snapshot", string(buf))
+	}
+	_, err = tc.c.Read(p, 0, buf)
+	ch <- err
+	if string(buf) != "HELLO world" {
+		t.Error("source is modified by writing snapshot", string(buf))
+	}
+
+	errorAll(ch, 12, t)
+}
+
+// A snapshot waiting for a lease it cannot revoke does not block the namespace
+func TestSnapshotWaitUnlocked(t *testing.T) {
+	tc := newTestCluster(4)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/snapwait/a.txt")
+	ch := make(chan error, 6)
+	ch <- tc.c.Mkdir("/snapwait")
+	ch <- tc.c.Create(p)
+	ch <- tc.c.Write(p, 0, []byte("hello"))
+	var h gfs.GetChunkHandleReply
+	ch <- tc.m.RPCGetChunkHandle(gfs.GetChunkHandleArg{Path: p, Index: 0}, &h)
+	var l gfs.GetPrimaryAndSecondariesReply
+	ch <- tc.m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: h.Handle}, &l)
+	errorAll(ch, 5, t)
+
+	// the lease cannot be revoked from a dead primary
+	for i, v := range tc.csAdd {
+		if v == l.Primary {
+			tc.cs[i].Shutdown()
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.c.Snapshot("/snapwait", "/snapwait-copy")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	ch <- tc.c.Create("/snapwait/b.txt")
+	if d := time.Since(start); d > gfs.LeaseExpire/4 {
+		t.Error("create waits for the snapshot", d)
+	}
+	ch <- <-done
+	errorAll(ch, 2, t)
+
+	buf := make([]byte, 5)
+	if _, err := tc.c.Read("/snapwait-copy/a.txt", 0, buf); err != nil || string(buf) != "hello" {
+		t.Error("wrong data in snapshot", string(buf), err)
+	}
+}
+
+// Rename files between two directories in both directions concurrently
+func TestRename(t *testing.T) {
+	ch := make(chan error, 6)
+	ch <- c.Mkdir("/rename")
+	ch <- c.Mkdir("/rename/a")
+	ch <- c.Mkdir("/rename/b")
+	ch <- c.Create("/rename/a/x.txt")
+	ch <- c.Create("/rename/b/y.txt")
+	ch <- c.Write("/rename/a/x.txt", 0, []byte("xxx"))
+
+	if err := c.Rename("/rename/a/x.txt", "/rename/b/y.txt"); err == nil {
+		t.Error("rename to an existing path should fail")
+	}
+	if err := c.Rename("/rename/a/none.txt", "/rename/b/none.txt"); err == nil {
+		t.Error("rename a missing path should fail")
+	}
+	if err := c.Rename("/rename/a", "/rename/a/c"); err == nil {
+		t.Error("move a directory into itself should fail")
+	}
+
+	var wg sync.WaitGroup
+	move := func(from, to gfs.Path) {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := c.Rename(from, to); err != nil {
+				t.Error(err)
+			}
+			from, to = to, from
+		}
+	}
+	wg.Add(2)
+	go move("/rename/a/x.txt", "/rename/b/x.txt")
+	go move("/rename/b/y.txt", "/rename/a/y.txt")
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent renames deadlock")
+	}
+
+	// chunks move with the file
+	if err := c.Rename("/rename/a", "/rename/b/a"); err != nil {
+		t.Error(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := c.Read("/rename/b/a/x.txt", 0, buf); err != nil || string(buf) != "xxx" {
+		t.Error("read wrong data after rename", string(buf), err)
+	}
+
+	errorAll(ch, 6, t)
+}
+
+// Read a multi-chunk file while one replica is unreachable
+func TestReadReplicaFailover(t *testing.T) {
+	tc := newTestCluster(3)
+	defer tc.Shutdown()
+
+	p := gfs.Path("/failover.txt")
+	ch := make(chan error, 2)
+	ch <- tc.c.Create(p)
+
+	size := gfs.MaxChunkSize + gfs.MaxChunkSize/2
+	expected := make([]byte, size)
+	for i := range expected {
+		expected[i] = byte(i%26 + 'a')
+	}
+	ch <- tc.c.Write(p, 0, expected)
+
+	// master does not know the server is down yet
+	tc.cs[0].Shutdown()
+
+	for i := 0; i < 5; i++ {
+		begin := gfs.MaxChunkSize - 10
+		buf := make([]byte, 20)
+		n, err := tc.c.Read(p, gfs.Offset(begin), buf)
+		if err != nil || n != 20 || !reflect.DeepEqual(buf, expected[begin:begin+20]) {
+			t.Error("read across chunk boundary fails", n, err)
+		}
+	}
+
+	// read over EOF returns the bytes actually read
+	buf := make([]byte, 100)
+	n, err := tc.c.Read(p, gfs.Offset(size-30), buf)
+	if err != io.EOF || n != 30 || !reflect.DeepEqual(buf[:n], expected[size-30:]) {
+		t.Error("expect 30 bytes and io.EOF, got", n, err)
+	}
+	n, err = tc.c.Read(p, gfs.Offset(2*gfs.MaxChunkSize), buf)
+	if err != io.EOF || n != 0 {
+		t.Error("expect io.EOF when reading past the last chunk, got", n, err)
+	}
+
+	errorAll(ch, 2, t)
+}
+
 /*
  *  TEST SUITE 4 - Challenge
  */
@@ -793,7 +6394,7 @@ func TestMain(tm *testing.M) {
 
 	// run master
 	os.Mkdir(path.Join(root, "m"), 0755)
-	m = master.NewAndServe(mAdd, path.Join(root, "m"))
+	m = startMaster(mAdd, path.Join(root, "m"), nil)
 
 	// run chunkservers
 	csAdd = make([]gfs.ServerAddress, csNum)
@@ -802,11 +6403,11 @@ func TestMain(tm *testing.M) {
 		ii := strconv.Itoa(i)
 		os.Mkdir(path.Join(root, "cs"+ii), 0755)
 		csAdd[i] = gfs.ServerAddress(fmt.Sprintf(":%v", 10000+i))
-		cs[i] = chunkserver.NewAndServe(csAdd[i], mAdd, path.Join(root, "cs"+ii))
+		cs[i] = chunkserver.NewAndServe(csAdd[i], mAdd, path.Join(root, "cs"+ii), nil)
 	}
 
 	// init client
-	c = client.NewClient(mAdd)
+	c = client.NewClient(mAdd, nil)
 	time.Sleep(300 * time.Millisecond)
 
 	// run tests
@@ -18,7 +18,9 @@ func runMaster() {
 		return
 	}
 	addr := gfs.ServerAddress(os.Args[2])
-	master.NewAndServe(addr, os.Args[3])
+	if _, err := master.NewAndServe(addr, os.Args[3], nil); err != nil {
+		log.Fatal(err)
+	}
 
 	ch := make(chan bool)
 	<-ch
@@ -32,7 +34,7 @@ func runChunkServer() {
 	addr := gfs.ServerAddress(os.Args[2])
 	serverRoot := os.Args[3]
 	masterAddr := gfs.ServerAddress(os.Args[4])
-	chunkserver.NewAndServe(addr, masterAddr, serverRoot)
+	chunkserver.NewAndServe(addr, masterAddr, serverRoot, nil)
 
 	ch := make(chan bool)
 	<-ch
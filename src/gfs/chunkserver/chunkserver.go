@@ -1,16 +1,20 @@
 package chunkserver
 
 import (
+	"crypto/tls"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	//"math/rand"
 	"encoding/gob"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/rpc"
 	"os"
 	"path"
 	"sync"
+	"syscall"
 	"time"
 	//"strings"
 
@@ -25,19 +29,30 @@ type ChunkServer struct {
 	master   gfs.ServerAddress // master address
 	rootDir  string            // path to data storage
 	l        net.Listener
+	conns    *util.ArraySet // open connections, closed on shutdown
+	tls      *tls.Config    // nil if rpc is in plaintext
 	shutdown chan struct{}
 
 	dl                     *downloadBuffer                // expiring download buffer
 	chunk                  map[gfs.ChunkHandle]*chunkInfo // chunk information
 	dead                   bool                           // set to ture if server is shuntdown
 	pendingLeaseExtensions *util.ArraySet                 // pending lease extension
-	garbage                []gfs.ChunkHandle              // garbages
+	pendingCorruptions     *util.ArraySet                 // corrupted chunks to be reported
+	stats                  *serverStats                   // performance stats reported in heartbeat
+	capacity               int64                          // max bytes used by chunks, unlimited if 0
+	zone                   string                         // topology label reported in heartbeat
+	chunkSize              gfs.Offset                     // max chunk length, told by master in heartbeat
+	incarnation            int64                          // tells master the server is restarted, set on start
+	scrubRate              int64                          // bytes per second read by scrubbing, no scrubbing if 0
+	maxSendCopies          int                            // copies sent at once, unlimited if 0
+	sendingCopies          int                            // copies being sent
 }
 
 type Mutation struct {
 	mtype  gfs.MutationType
 	data   []byte
 	offset gfs.Offset
+	record uint64 // ID of the record appended, 0 if not given
 }
 
 type chunkInfo struct {
@@ -45,8 +60,36 @@ type chunkInfo struct {
 	length    gfs.Offset
 	version   gfs.ChunkVersion // version number of the chunk in disk
 	checksum  gfs.Checksum
+	checksums []uint32                       // crc32 of every ChecksumBlockSize block
 	mutations map[gfs.ChunkVersion]*Mutation // mutation buffer
 	abandoned bool                           // unrecoverable error
+	revoked   bool                           // lease is revoked by master, reject mutations until next grant
+	prepared  map[gfs.DataBufferID]*Mutation // mutations staged by primary, applied on commit
+	compressed bool                          // stored as gzip streams of blocks, see compress.go
+	blockEnds  []int64                       // end offset of every block stream if compressed
+
+	records     map[uint64]gfs.Offset // offsets of the latest records appended by ID, see remember
+	recordOrder []uint64              // IDs in records, the oldest first
+}
+
+// remember keeps the offset of an appended record, so a retry of it is not appended again.
+// Only the latest gfs.AppendDedupWindow records are kept. ck should be locked in advance.
+func (ck *chunkInfo) remember(id uint64, offset gfs.Offset) {
+	if id == 0 {
+		return
+	}
+	if ck.records == nil {
+		ck.records = make(map[uint64]gfs.Offset)
+	}
+	if _, ok := ck.records[id]; ok {
+		return
+	}
+	ck.records[id] = offset
+	ck.recordOrder = append(ck.recordOrder, id)
+	if len(ck.recordOrder) > gfs.AppendDedupWindow {
+		delete(ck.records, ck.recordOrder[0])
+		ck.recordOrder = ck.recordOrder[1:]
+	}
 }
 
 const (
@@ -55,15 +98,25 @@ const (
 )
 
 // NewAndServe starts a chunkserver and return the pointer to it.
-func NewAndServe(addr, masterAddr gfs.ServerAddress, rootDir string) *ChunkServer {
+// If config is not nil, rpc is served and sent over TLS with it, so it should hold
+// both the certificate of the chunkserver and the CAs to verify its peers.
+func NewAndServe(addr, masterAddr gfs.ServerAddress, rootDir string, config *tls.Config) *ChunkServer {
 	cs := &ChunkServer{
 		address:  addr,
+		tls:      config,
+		conns:    new(util.ArraySet),
 		shutdown: make(chan struct{}),
 		master:   masterAddr,
 		rootDir:  rootDir,
-		dl:       newDownloadBuffer(gfs.DownloadBufferExpire, gfs.DownloadBufferTick),
+		dl:       newDownloadBuffer(gfs.DownloadBufferExpire, gfs.DownloadBufferTick, gfs.DownloadBufferSize),
 		pendingLeaseExtensions: new(util.ArraySet),
+		pendingCorruptions:     new(util.ArraySet),
 		chunk: make(map[gfs.ChunkHandle]*chunkInfo),
+		stats: newServerStats(),
+		chunkSize: gfs.MaxChunkSize,
+		incarnation: time.Now().UnixNano(),
+		scrubRate: gfs.ScrubRate,
+		maxSendCopies: gfs.MaxSendCopies,
 	}
 	rpcs := rpc.NewServer()
 	rpcs.Register(cs)
@@ -71,6 +124,9 @@ func NewAndServe(addr, masterAddr gfs.ServerAddress, rootDir string) *ChunkServe
 	if e != nil {
 		log.Fatal("chunkserver listen error:", e)
 	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
 	cs.l = l
 
 	// Mkdir
@@ -97,24 +153,28 @@ func NewAndServe(addr, masterAddr gfs.ServerAddress, rootDir string) *ChunkServe
 			}
 			conn, err := cs.l.Accept()
 			if err == nil {
+				cs.conns.Add(conn)
 				go func() {
 					rpcs.ServeConn(conn)
 					conn.Close()
+					cs.conns.Delete(conn)
 				}()
 			} else {
-				if !cs.dead {
-					log.Fatal("chunkserver accept error: ", err)
+				select {
+				case <-cs.shutdown: // listener is closed by Shutdown
+					return
+				default:
 				}
+				log.Warning("chunkserver accept error: ", err)
 			}
 		}
 	}()
 
 	// Background Activity
-	// heartbeat, store persistent meta, garbage collection ...
+	// heartbeat, store persistent meta ...
 	go func() {
 		heartbeatTicker := time.Tick(gfs.HeartbeatInterval)
 		storeTicker := time.Tick(gfs.ServerStoreInterval)
-		garbageTicker := time.Tick(gfs.GarbageCollectionInt)
 		quickStart := make(chan bool, 1) // send first heartbeat right away..
 		quickStart <- true
 		for {
@@ -132,9 +192,6 @@ func NewAndServe(addr, masterAddr gfs.ServerAddress, rootDir string) *ChunkServe
 			case <-storeTicker:
 				branch = "storemeta"
 				err = cs.storeMeta()
-			case <-garbageTicker:
-				branch = "garbagecollecton"
-				err = cs.garbageCollection()
 			}
 
 			if err != nil {
@@ -143,6 +200,8 @@ func NewAndServe(addr, masterAddr gfs.ServerAddress, rootDir string) *ChunkServe
 		}
 	}()
 
+	go cs.scrub()
+
 	log.Infof("ChunkServer is now running. addr = %v, root path = %v, master addr = %v", addr, rootDir, masterAddr)
 
 	return cs
@@ -155,27 +214,137 @@ func (cs *ChunkServer) heartbeat() error {
 	for i, v := range pe {
 		le[i] = v.(gfs.ChunkHandle)
 	}
+	pc := cs.pendingCorruptions.GetAllAndClear()
+	corrupted := make([]gfs.ChunkHandle, len(pc))
+	for i, v := range pc {
+		corrupted[i] = v.(gfs.ChunkHandle)
+	}
+	used, free, err := cs.diskUsage()
+	if err != nil {
+		return err
+	}
+	cs.lock.RLock()
+	zone := cs.zone
+	cs.lock.RUnlock()
 	args := &gfs.HeartbeatArg{
-		Address:         cs.address,
-		LeaseExtensions: le,
+		Address:          cs.address,
+		LeaseExtensions:  le,
+		AbandondedChunks: corrupted,
+		Stats:            cs.stats.Report(),
+		UsedBytes:        used,
+		FreeBytes:        free,
+		Zone:             zone,
+		Incarnation:      cs.incarnation,
 	}
 	var r gfs.HeartbeatReply
-	err := util.Call(cs.master, "Master.RPCHeartbeat", args, &r)
+	err = util.CallTLS(cs.tls, cs.master, "Master.RPCHeartbeat", args, &r)
 	if err != nil {
+		for _, v := range corrupted {
+			cs.pendingCorruptions.Add(v)
+		}
 		return err
 	}
 
-	cs.garbage = append(cs.garbage, r.Garbage...)
-	return err
+	if r.ChunkSize > 0 {
+		cs.lock.Lock()
+		cs.chunkSize = gfs.Offset(r.ChunkSize)
+		cs.lock.Unlock()
+	}
+	return nil
+}
+
+// maxChunkSize returns the chunk size of master, a chunk never grows longer than it
+func (cs *ChunkServer) maxChunkSize() gfs.Offset {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.chunkSize
+}
+
+// diskUsage returns the bytes used by chunks and the bytes left for new chunks,
+// which is limited by both the file system and the capacity of the server
+func (cs *ChunkServer) diskUsage() (used, free int64, err error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.usage()
 }
 
-// garbage collection  Note: no lock are needed, since the background activities are single thread
-func (cs *ChunkServer) garbageCollection() error {
-	for _, v := range cs.garbage {
-		cs.deleteChunk(v)
+// usage is diskUsage, cs.lock should be held in top caller.
+// Every chunk reserves the space to grow to max chunk size, so a chunk created
+// on the server never fails to be written for lack of space. The space reserved
+// but not used yet is not free.
+func (cs *ChunkServer) usage() (used, free int64, err error) {
+	var reserved int64
+	for _, ck := range cs.chunk {
+		used += ck.diskSize()
+		if rest := int64(cs.chunkSize) - ck.diskSize(); rest > 0 {
+			reserved += rest
+		}
+	}
+	capacity := cs.capacity
+
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(cs.rootDir, &st); err != nil {
+		return
+	}
+	free = int64(st.Bavail) * int64(st.Bsize)
+	if capacity > 0 && capacity-used < free {
+		free = capacity - used
 	}
+	free -= reserved
+	if free < 0 {
+		free = 0
+	}
+	return
+}
 
-	cs.garbage = make([]gfs.ChunkHandle, 0)
+// SetCapacity limits the disk space used by chunks, 0 means unlimited
+func (cs *ChunkServer) SetCapacity(bytes int64) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.capacity = bytes
+}
+
+// SetDataBufferSize limits the bytes of pushed data waiting for mutations,
+// the least recently used data is evicted beyond it. 0 means unlimited.
+func (cs *ChunkServer) SetDataBufferSize(bytes int64) {
+	cs.dl.SetMaxSize(bytes)
+}
+
+// SetDataBufferExpire sets how long pushed data is kept if no mutation refers to it
+func (cs *ChunkServer) SetDataBufferExpire(d time.Duration) {
+	cs.dl.SetExpire(d)
+}
+
+// SetScrubRate limits the bytes per second read by background scrubbing, 0 stops scrubbing
+func (cs *ChunkServer) SetScrubRate(bytes int64) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.scrubRate = bytes
+}
+
+// SetMaxSendCopies limits the copies sent at once by RPCSendCopy, 0 is unlimited
+func (cs *ChunkServer) SetMaxSendCopies(n int) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.maxSendCopies = n
+}
+
+// SetZone sets the topology label of the server, such as "dc1/rack2"
+func (cs *ChunkServer) SetZone(zone string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.zone = zone
+}
+
+// RPCDeleteChunk is called by master in heartbeat to delete the replicas which are
+// stale or no longer referenced by any file
+func (cs *ChunkServer) RPCDeleteChunk(args gfs.DeleteChunkArg, reply *gfs.DeleteChunkReply) error {
+	for _, v := range args.Handles {
+		log.Infof("Server %v : delete chunk %v", cs.address, v)
+		if err := cs.deleteChunk(v); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -226,8 +395,11 @@ func (cs *ChunkServer) loadMeta() error {
 	for _, ck := range metas {
 		//log.Infof("Server %v restore %v version: %v length: %v", cs.address, ck.Handle, ck.Version, ck.Length)
 		cs.chunk[ck.Handle] = &chunkInfo{
-			length:  ck.Length,
-			version: ck.Version,
+			length:    ck.Length,
+			version:   ck.Version,
+			checksums: ck.BlockChecksums,
+			compressed: ck.Compressed,
+			blockEnds: ck.BlockEnds,
 		}
 	}
 
@@ -250,6 +422,8 @@ func (cs *ChunkServer) storeMeta() error {
 	for handle, ck := range cs.chunk {
 		metas = append(metas, gfs.PersistentChunkInfo{
 			Handle: handle, Length: ck.length, Version: ck.version,
+			BlockChecksums: ck.checksums,
+			Compressed: ck.compressed, BlockEnds: ck.blockEnds,
 		})
 	}
 
@@ -268,6 +442,9 @@ func (cs *ChunkServer) Shutdown() {
 		cs.dead = true
 		close(cs.shutdown)
 		cs.l.Close()
+		for _, conn := range cs.conns.GetAllAndClear() { // clients may keep idle connections
+			conn.(net.Conn).Close()
+		}
 	}
 	err := cs.storeMeta()
 	if err != nil {
@@ -289,6 +466,8 @@ func (cs *ChunkServer) RPCCheckVersion(args gfs.CheckVersionArg, reply *gfs.Chec
 
 	if ck.version+gfs.ChunkVersion(1) == args.Version {
 		ck.version++
+		ck.revoked = false // a new lease is granted
+		ck.prepared = nil  // mutations left by the last primary are never committed
 		reply.Stale = false
 	} else {
 		log.Warningf("%v : stale chunk %v", cs.address, args.Handle)
@@ -298,8 +477,10 @@ func (cs *ChunkServer) RPCCheckVersion(args gfs.CheckVersionArg, reply *gfs.Chec
 	return nil
 }
 
-// RPCForwardData is called by client or another replica who sends data to the current memory buffer.
-func (cs *ChunkServer) RPCForwardData(args gfs.ForwardDataArg, reply *gfs.ForwardDataReply) error {
+// RPCPushData is called by client or another replica who sends data to the current memory buffer.
+// The data is kept under its data ID until a mutation refers to it or it expires, and is forwarded
+// to the next replica in args.ChainOrder. A failure down the chain is returned to the caller.
+func (cs *ChunkServer) RPCPushData(args gfs.PushDataArg, reply *gfs.PushDataReply) error {
 	//log.Warning(cs.address, " data 1 ", args.DataID)
 	if _, ok := cs.dl.Get(args.DataID); ok {
 		return fmt.Errorf("Data %v already exists", args.DataID)
@@ -313,8 +494,10 @@ func (cs *ChunkServer) RPCForwardData(args gfs.ForwardDataArg, reply *gfs.Forwar
 	if len(args.ChainOrder) > 0 {
 		next := args.ChainOrder[0]
 		args.ChainOrder = args.ChainOrder[1:]
-		err := util.Call(next, "ChunkServer.RPCForwardData", args, reply)
-		return err
+		err := util.CallTLS(cs.tls, next, "ChunkServer.RPCPushData", args, reply)
+		if err != nil {
+			return fmt.Errorf("push data %v to %v: %v", args.DataID, next, err)
+		}
 	}
 	//log.Warning(cs.address, "data 4 ", args.DataID)
 
@@ -322,29 +505,45 @@ func (cs *ChunkServer) RPCForwardData(args gfs.ForwardDataArg, reply *gfs.Forwar
 }
 
 // RPCCreateChunk is called by master to create a new chunk given the chunk handle.
+// The space of a whole chunk is reserved for it until it is deleted, gfs.ErrNoSpace
+// is returned if the server cannot afford it, so master chooses another server
+// rather than copying data to a replica which cannot hold it.
 func (cs *ChunkServer) RPCCreateChunk(args gfs.CreateChunkArg, reply *gfs.CreateChunkReply) error {
 	cs.lock.Lock()
 	defer cs.lock.Unlock()
 	log.Infof("Server %v : create chunk %v", cs.address, args.Handle)
 
-	if _, ok := cs.chunk[args.Handle]; ok {
+	if ck, ok := cs.chunk[args.Handle]; ok && !ck.abandoned {
 		log.Warning("[ignored] recreate a chunk in RPCCreateChunk")
 		return nil // TODO : error handle
 		//return fmt.Errorf("Chunk %v already exists", args.Handle)
 	}
 
+	_, free, err := cs.usage()
+	if err != nil {
+		return err
+	}
+	if free < int64(cs.chunkSize) {
+		return gfs.Error{gfs.NoSpace, fmt.Sprintf("chunk %v needs %v bytes but %v has %v: %s",
+			args.Handle, cs.chunkSize, cs.address, free, gfs.ErrNoSpace.Err)}
+	}
+
 	cs.chunk[args.Handle] = &chunkInfo{
-		length: 0,
+		length:  0,
+		version: args.Version,
+		compressed: args.Compressed,
 	}
 	filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", args.Handle))
-	_, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+	_, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// RPCReadChunk is called by client, read chunk data and return
+// RPCReadChunk is called by client, reads args.Length bytes at args.Offset of a chunk.
+// The range should be within the chunk. Only the bytes written are returned, a read past
+// them is short and gets gfs.ReadEOF.
 func (cs *ChunkServer) RPCReadChunk(args gfs.ReadChunkArg, reply *gfs.ReadChunkReply) error {
 	handle := args.Handle
 	cs.lock.RLock()
@@ -354,16 +553,41 @@ func (cs *ChunkServer) RPCReadChunk(args gfs.ReadChunkArg, reply *gfs.ReadChunkR
 		return fmt.Errorf("Chunk %v does not exist or is abandoned", handle)
 	}
 
-	// read from disk
+	end := args.Offset + gfs.Offset(args.Length)
+	if args.Offset < 0 || args.Length < 0 || end > cs.maxChunkSize() {
+		return fmt.Errorf("read range [%v, %v) is out of chunk %v", args.Offset, end, handle)
+	}
+
+	// read from disk, only the range written is sent back
 	var err error
-	reply.Data = make([]byte, args.Length)
+	start := time.Now()
 	ck.RLock()
+	length := args.Length
+	if end > ck.length {
+		length = int(ck.length - args.Offset)
+		if length < 0 {
+			length = 0
+		}
+	}
+	reply.Data = make([]byte, length)
 	reply.Length, err = cs.readChunk(handle, args.Offset, reply.Data)
 	ck.RUnlock()
+	if err == nil && length < args.Length { // a short read
+		err = io.EOF
+	}
+	if reply.Length >= 0 && reply.Length < len(reply.Data) {
+		reply.Data = reply.Data[:reply.Length]
+	}
+	if reply.Length > 0 {
+		cs.stats.recordRead(start, reply.Length)
+	}
 	if err == io.EOF {
 		reply.ErrorCode = gfs.ReadEOF
 		return nil
 	}
+	if err == gfs.ErrChecksumMismatch {
+		reply.ErrorCode = gfs.ChecksumMismatch
+	}
 
 	if err != nil {
 		return err
@@ -380,8 +604,8 @@ func (cs *ChunkServer) RPCWriteChunk(args gfs.WriteChunkArg, reply *gfs.WriteChu
 	}
 
 	newLen := args.Offset + gfs.Offset(len(data))
-	if newLen > gfs.MaxChunkSize {
-		return fmt.Errorf("writeChunk new length is too large. Size %v > MaxSize %v", len(data), gfs.MaxChunkSize)
+	if chunkSize := cs.maxChunkSize(); newLen > chunkSize {
+		return fmt.Errorf("writeChunk new length is too large. Size %v > MaxSize %v", len(data), chunkSize)
 	}
 
 	handle := args.DataID.Handle
@@ -395,32 +619,17 @@ func (cs *ChunkServer) RPCWriteChunk(args gfs.WriteChunkArg, reply *gfs.WriteChu
 	if err = func() error {
 		ck.Lock()
 		defer ck.Unlock()
-		mutation := &Mutation{gfs.MutationWrite, data, args.Offset}
-
-		// apply to local
-		wait := make(chan error, 1)
-		go func() {
-			wait <- cs.doMutation(handle, mutation)
-		}()
-
-		// call secondaries
-		callArgs := gfs.ApplyMutationArg{gfs.MutationWrite, args.DataID, args.Offset}
-		err = util.CallAll(args.Secondaries, "ChunkServer.RPCApplyMutation", callArgs)
-		if err != nil {
-			return err
-		}
-
-		err = <-wait
-		if err != nil {
-			return err
+		if ck.revoked || ck.version != args.Version {
+			return cs.notPrimary(handle)
 		}
-		return nil
+		mutation := &Mutation{gfs.MutationWrite, data, args.Offset, 0}
+		return cs.mutate(args.DataID, mutation, args.Secondaries)
 	}(); err != nil {
 		return err
 	}
 
-	// extend lease
-	//cs.pendingLeaseExtensions.Add(handle)
+	// extend lease in next heartbeat, the chunk is being mutated under it
+	cs.pendingLeaseExtensions.Add(handle)
 
 	return nil
 }
@@ -435,8 +644,10 @@ func (cs *ChunkServer) RPCAppendChunk(args gfs.AppendChunkArg, reply *gfs.Append
 		return err
 	}
 
-	if len(data) > gfs.MaxAppendSize {
-		return fmt.Errorf("Append data size %v excceeds max append size %v", len(data), gfs.MaxAppendSize)
+	chunkSize := cs.maxChunkSize()
+	if gfs.Offset(len(data)) > chunkSize/4 {
+		reply.ErrorCode = gfs.AppendExceedMaxSize
+		return gfs.ErrAppendExceedMaxSize
 	}
 
 	handle := args.DataID.Handle
@@ -447,60 +658,139 @@ func (cs *ChunkServer) RPCAppendChunk(args gfs.AppendChunkArg, reply *gfs.Append
 		return fmt.Errorf("Chunk %v does not exist or is abandoned", handle)
 	}
 
+	record := args.RecordID
+	if args.Mode == gfs.AtLeastOnce { // no record is kept
+		record = 0
+	} else if record == 0 {
+		return fmt.Errorf("exactly-once append to chunk %v has no record ID", handle)
+	}
+
 	var mtype gfs.MutationType
 
 	if err = func() error {
 		ck.Lock()
 		defer ck.Unlock()
+		if ck.revoked || ck.version != args.Version {
+			return cs.notPrimary(handle)
+		}
+		// a retried record is not appended again
+		if offset, ok := ck.records[record]; ok && record != 0 {
+			reply.Offset = offset
+			return nil
+		}
+		// the length is extended by the mutation, so an aborted append leaves it as is
 		newLen := ck.length + gfs.Offset(len(data))
 		offset := ck.length
-		if newLen > gfs.MaxChunkSize {
+		if newLen > chunkSize {
 			mtype = gfs.MutationPad
-			ck.length = gfs.MaxChunkSize
 			reply.ErrorCode = gfs.AppendExceedChunkSize
 		} else {
 			mtype = gfs.MutationAppend
-			ck.length = newLen
 		}
 		reply.Offset = offset
 
-		mutation := &Mutation{mtype, data, offset}
+		mutation := &Mutation{mtype, data, offset, record}
 
 		//log.Infof("Primary %v : append chunk %v version %v", cs.address, args.DataID.Handle, version)
 
-		// apply to local
-		wait := make(chan error, 1)
-		go func() {
-			wait <- cs.doMutation(handle, mutation)
-		}()
+		return cs.mutate(args.DataID, mutation, args.Secondaries)
+	}(); err != nil {
+		return err
+	}
 
-		// call secondaries
-		callArgs := gfs.ApplyMutationArg{mtype, args.DataID, offset}
-		err = util.CallAll(args.Secondaries, "ChunkServer.RPCApplyMutation", callArgs)
-		if err != nil {
-			return err
-		}
+	// extend lease in next heartbeat, the chunk is being mutated under it
+	cs.pendingLeaseExtensions.Add(handle)
 
-		err = <-wait
-		if err != nil {
-			return err
+	return nil
+}
+
+// RPCTruncateChunk is called by master to cut a chunk to args.Length, it
+// applies the truncation to itself (primary) and asks secondaries to do the same.
+// gfs.ErrTruncateExceedLength is returned if the chunk is not longer than args.Length.
+func (cs *ChunkServer) RPCTruncateChunk(args gfs.TruncateChunkArg, reply *gfs.TruncateChunkReply) error {
+	handle := args.Handle
+	cs.lock.RLock()
+	ck, ok := cs.chunk[handle]
+	cs.lock.RUnlock()
+	if !ok || ck.abandoned {
+		return fmt.Errorf("Chunk %v does not exist or is abandoned", handle)
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+	if ck.revoked {
+		return cs.notPrimary(handle)
+	}
+	if args.Length > ck.length {
+		reply.ErrorCode = gfs.TruncateExceedLength
+		return gfs.ErrTruncateExceedLength
+	}
+	mutation := &Mutation{gfs.MutationTruncate, nil, args.Length, 0}
+	return cs.mutate(gfs.DataBufferID{Handle: handle}, mutation, args.Secondaries)
+}
+
+// mutate applies a mutation to a chunk (primary) and its secondaries in two phases.
+// The mutation is first prepared on all the secondaries, which stage it without
+// changing the chunk. If any of them fails to prepare, the staged ones are discarded
+// and an error is returned, so no replica reflects the mutation and the client retries.
+// Otherwise it is applied locally and committed on the secondaries.
+// The chunk should be locked in advance, which keeps the mutations in order.
+func (cs *ChunkServer) mutate(id gfs.DataBufferID, m *Mutation, secondaries []gfs.ServerAddress) error {
+	prepare := gfs.PrepareMutationArg{m.mtype, id, m.offset, m.record}
+	if err := util.CallAllTLS(cs.tls, secondaries, "ChunkServer.RPCPrepareMutation", prepare); err != nil {
+		e := util.CallAllTLS(cs.tls, secondaries, "ChunkServer.RPCAbortMutation", gfs.AbortMutationArg{id})
+		if e != nil {
+			log.Warningf("Server %v : abort mutation %v: %v", cs.address, id, e)
 		}
-		return nil
-	}(); err != nil {
-		return err
+		return fmt.Errorf("mutation %v is aborted: %v", id, err)
+	}
+
+	// apply to local
+	wait := make(chan error, 1)
+	go func() {
+		wait <- cs.doMutation(id.Handle, m)
+	}()
+
+	err := util.CallAllTLS(cs.tls, secondaries, "ChunkServer.RPCCommitMutation", gfs.CommitMutationArg{id})
+	if e := <-wait; e != nil {
+		return e
 	}
+	return err
+}
 
-	// extend lease
-	//cs.pendingLeaseExtensions.Add(handle)
+// notPrimary returns gfs.ErrNotPrimary for a mutation sent under a lease the server no longer
+// holds, i.e. the lease is revoked or a new one is granted at another version
+func (cs *ChunkServer) notPrimary(handle gfs.ChunkHandle) error {
+	return gfs.Error{gfs.NotPrimary, fmt.Sprintf("%v : lease of chunk %v %s", cs.address, handle, gfs.ErrNotPrimary.Err)}
+}
 
+// RPCRevokeLease is called by master to take back the lease of a chunk.
+// It waits for the mutation in progress, later mutations are rejected until a new lease is granted.
+func (cs *ChunkServer) RPCRevokeLease(args gfs.RevokeLeaseArg, reply *gfs.RevokeLeaseReply) error {
+	cs.lock.RLock()
+	ck, ok := cs.chunk[args.Handle]
+	cs.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Chunk %v does not exist", args.Handle)
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+	log.Infof("Server %v : lease of chunk %v is revoked", cs.address, args.Handle)
+	ck.revoked = true
 	return nil
 }
 
-// RPCApplyWriteChunk is called by primary to apply mutations
-func (cs *ChunkServer) RPCApplyMutation(args gfs.ApplyMutationArg, reply *gfs.ApplyMutationReply) error {
-	data, err := cs.dl.Fetch(args.DataID)
-	if err != nil {
-		return err
+// RPCPrepareMutation is called by primary to stage a mutation, which is applied when it
+// is committed. It fails if the mutation cannot be applied, e.g. its data is not pushed.
+func (cs *ChunkServer) RPCPrepareMutation(args gfs.PrepareMutationArg, reply *gfs.PrepareMutationReply) error {
+	var data []byte
+	var err error
+	if args.Mtype != gfs.MutationTruncate { // truncation carries no data
+		data, err = cs.dl.Fetch(args.DataID)
+		if err != nil {
+			return err
+		}
 	}
 
 	handle := args.DataID.Handle
@@ -511,20 +801,61 @@ func (cs *ChunkServer) RPCApplyMutation(args gfs.ApplyMutationArg, reply *gfs.Ap
 		return fmt.Errorf("cannot find chunk %v", handle)
 	}
 
+	// a pad carries the data which does not fit in the chunk, but does not write it
+	if newLen := args.Offset + gfs.Offset(len(data)); args.Mtype != gfs.MutationPad && newLen > cs.maxChunkSize() {
+		return fmt.Errorf("mutation %v new length %v exceeds max chunk size", args.DataID, newLen)
+	}
+
 	//log.Infof("Server %v : get mutation to chunk %v version %v", cs.address, handle, args.Version)
 
-	mutation := &Mutation{args.Mtype, data, args.Offset}
-	err = func() error {
-		ck.Lock()
-		defer ck.Unlock()
-		err = cs.doMutation(handle, mutation)
-		return err
-	}()
+	ck.Lock()
+	defer ck.Unlock()
+	if ck.prepared == nil {
+		ck.prepared = make(map[gfs.DataBufferID]*Mutation)
+	}
+	ck.prepared[args.DataID] = &Mutation{args.Mtype, data, args.Offset, args.RecordID}
+	return nil
+}
 
-	return err
+// RPCCommitMutation is called by primary to apply a prepared mutation
+func (cs *ChunkServer) RPCCommitMutation(args gfs.CommitMutationArg, reply *gfs.CommitMutationReply) error {
+	handle := args.DataID.Handle
+	cs.lock.RLock()
+	ck, ok := cs.chunk[handle]
+	cs.lock.RUnlock()
+	if !ok || ck.abandoned {
+		return fmt.Errorf("cannot find chunk %v", handle)
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+	mutation, ok := ck.prepared[args.DataID]
+	if !ok {
+		return fmt.Errorf("mutation %v is not prepared", args.DataID)
+	}
+	delete(ck.prepared, args.DataID)
+	return cs.doMutation(handle, mutation)
 }
 
-// RPCSendCCopy is called by master, send the whole copy to given address
+// RPCAbortMutation is called by primary to discard a prepared mutation.
+// It is not an error if the mutation is not prepared, e.g. preparing it failed.
+func (cs *ChunkServer) RPCAbortMutation(args gfs.AbortMutationArg, reply *gfs.AbortMutationReply) error {
+	cs.lock.RLock()
+	ck, ok := cs.chunk[args.DataID.Handle]
+	cs.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+	delete(ck.prepared, args.DataID)
+	return nil
+}
+
+// RPCSendCCopy is called by master, send the whole copy to given address.
+// The copy is stored as chunk args.NewHandle there.
+// gfs.ErrServerBusy is returned if the server is already sending as many copies as it may.
 func (cs *ChunkServer) RPCSendCopy(args gfs.SendCopyArg, reply *gfs.SendCopyReply) error {
 	handle := args.Handle
 	cs.lock.RLock()
@@ -534,18 +865,38 @@ func (cs *ChunkServer) RPCSendCopy(args gfs.SendCopyArg, reply *gfs.SendCopyRepl
 		return fmt.Errorf("Chunk %v does not exist or is abandoned", handle)
 	}
 
+	// a copy reads a whole chunk and pushes it over the network, so only a few are sent at
+	// once. The rest are rejected rather than queued, master can copy from another replica.
+	cs.lock.Lock()
+	if cs.maxSendCopies > 0 && cs.sendingCopies >= cs.maxSendCopies {
+		n := cs.sendingCopies
+		cs.lock.Unlock()
+		return gfs.Error{gfs.ServerBusy, fmt.Sprintf("%v : %v copies in progress, %s", cs.address, n, gfs.ErrServerBusy.Err)}
+	}
+	cs.sendingCopies++
+	cs.lock.Unlock()
+	defer func() {
+		cs.lock.Lock()
+		cs.sendingCopies--
+		cs.lock.Unlock()
+	}()
+
 	ck.RLock()
 	defer ck.RUnlock()
 
-	log.Infof("Server %v : Send copy of %v to %v", cs.address, handle, args.Address)
+	log.Infof("Server %v : Send copy of %v to %v as %v", cs.address, handle, args.Address, args.NewHandle)
 	data := make([]byte, ck.length)
 	_, err := cs.readChunk(handle, 0, data)
 	if err != nil {
 		return err
 	}
 
+	var checksums []uint32
+	if !ck.compressed {
+		checksums = ck.checksums
+	}
 	var r gfs.ApplyCopyReply
-	err = util.Call(args.Address, "ChunkServer.RPCApplyCopy", gfs.ApplyCopyArg{handle, data, ck.version}, &r)
+	err = util.CallTLS(cs.tls, args.Address, "ChunkServer.RPCApplyCopy", gfs.ApplyCopyArg{args.NewHandle, data, ck.version, ck.compressed, checksums}, &r)
 	if err != nil {
 		return err
 	}
@@ -569,7 +920,22 @@ func (cs *ChunkServer) RPCApplyCopy(args gfs.ApplyCopyArg, reply *gfs.ApplyCopyR
 
 	log.Infof("Server %v : Apply copy of %v", cs.address, handle)
 
+	// the data may be corrupted on its way, it must not become another bad replica
+	if i := verifyBlocks(args.Data, args.Checksums); i >= 0 {
+		log.Warningf("Server %v : copy of %v mismatches checksum in block %v", cs.address, handle, i)
+		reply.ErrorCode = gfs.ChecksumMismatch
+		return gfs.ErrChecksumMismatch
+	}
+
 	ck.version = args.Version
+	if ck.compressed != args.Compressed { // the copy is stored as the source is
+		ck.compressed = args.Compressed
+		ck.blockEnds, ck.checksums = nil, nil
+		filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", handle))
+		if err := os.Truncate(filename, 0); err != nil {
+			return err
+		}
+	}
 	err := cs.writeChunk(handle, args.Data, 0, true)
 	if err != nil {
 		return err
@@ -578,6 +944,55 @@ func (cs *ChunkServer) RPCApplyCopy(args gfs.ApplyCopyArg, reply *gfs.ApplyCopyR
 	return nil
 }
 
+// RPCDuplicateChunk is called by master when a chunk shared by snapshots is about to
+// diverge. It copies the chunk locally to a new handle with the same version.
+func (cs *ChunkServer) RPCDuplicateChunk(args gfs.DuplicateChunkArg, reply *gfs.DuplicateChunkReply) error {
+	handle := args.Handle
+	cs.lock.RLock()
+	ck, ok := cs.chunk[handle]
+	cs.lock.RUnlock()
+	if !ok || ck.abandoned {
+		return fmt.Errorf("Chunk %v does not exist or is abandoned", handle)
+	}
+
+	ck.RLock()
+	defer ck.RUnlock()
+
+	log.Infof("Server %v : duplicate chunk %v to %v", cs.address, handle, args.NewHandle)
+	var data []byte
+	var err error
+	if ck.compressed { // copy the streams as they are
+		data, err = ioutil.ReadFile(path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", handle)))
+	} else {
+		data = make([]byte, ck.length)
+		_, err = cs.readChunk(handle, 0, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if _, ok := cs.chunk[args.NewHandle]; ok {
+		return fmt.Errorf("Chunk %v already exists", args.NewHandle)
+	}
+
+	filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", args.NewHandle))
+	err = ioutil.WriteFile(filename, data, FilePerm)
+	if err != nil {
+		return err
+	}
+	cs.chunk[args.NewHandle] = &chunkInfo{
+		length:    ck.length,
+		version:   ck.version,
+		checksum:  ck.checksum,
+		checksums: append([]uint32(nil), ck.checksums...),
+		compressed: ck.compressed,
+		blockEnds: append([]int64(nil), ck.blockEnds...),
+	}
+	return nil
+}
+
 // writeChunk writes data at offset to a chunk at disk
 func (cs *ChunkServer) writeChunk(handle gfs.ChunkHandle, data []byte, offset gfs.Offset, lock bool) error {
 	cs.lock.RLock()
@@ -590,28 +1005,132 @@ func (cs *ChunkServer) writeChunk(handle gfs.ChunkHandle, data []byte, offset gf
 		ck.length = newLen
 	}
 
-	if newLen > gfs.MaxChunkSize {
-		log.Fatal("new length > gfs.MaxChunkSize")
+	if newLen > cs.maxChunkSize() {
+		log.Fatal("new length > max chunk size")
 	}
 
 	log.Infof("Server %v : write to chunk %v at %v len %v", cs.address, handle, offset, len(data))
+	start := time.Now()
 	filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", handle))
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, FilePerm)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, FilePerm)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	if ck.compressed {
+		if err := writeCompressed(file, ck, data, offset); err != nil {
+			return err
+		}
+		cs.stats.recordWrite(start, len(data))
+		return nil
+	}
+
 	_, err = file.WriteAt(data, int64(offset))
 	if err != nil {
 		return err
 	}
 
+	// recompute the checksums of the blocks touched by this write
+	first := int(offset) / gfs.ChecksumBlockSize
+	last := (int(newLen) - 1) / gfs.ChecksumBlockSize
+	for len(ck.checksums) <= last { // skipped blocks are holes filled with zero
+		ck.checksums = append(ck.checksums, zeroBlockChecksum)
+	}
+	block := make([]byte, gfs.ChecksumBlockSize)
+	for i := first; i <= last; i++ {
+		if err := readBlock(file, i, block); err != nil {
+			return err
+		}
+		ck.checksums[i] = crc32.ChecksumIEEE(block)
+	}
+
+	cs.stats.recordWrite(start, len(data))
+	return nil
+}
+
+// truncateChunk cuts a chunk to length and recomputes the checksum of its last block.
+// ck is already locked in top caller
+func (cs *ChunkServer) truncateChunk(handle gfs.ChunkHandle, length gfs.Offset) error {
+	cs.lock.RLock()
+	ck := cs.chunk[handle]
+	cs.lock.RUnlock()
+
+	log.Infof("Server %v : truncate chunk %v to %v", cs.address, handle, length)
+	filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", handle))
+	if ck.compressed {
+		file, err := os.OpenFile(filename, os.O_RDWR, FilePerm)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		ck.length = length
+		return truncateCompressed(file, ck, length)
+	}
+	if err := os.Truncate(filename, int64(length)); err != nil {
+		return err
+	}
+	ck.length = length
+
+	blocks := (int(length) + gfs.ChecksumBlockSize - 1) / gfs.ChecksumBlockSize
+	if len(ck.checksums) > blocks {
+		ck.checksums = ck.checksums[:blocks]
+	}
+	if int(length)%gfs.ChecksumBlockSize == 0 || len(ck.checksums) < blocks {
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	block := make([]byte, gfs.ChecksumBlockSize)
+	if err := readBlock(file, blocks-1, block); err != nil {
+		return err
+	}
+	ck.checksums[blocks-1] = crc32.ChecksumIEEE(block)
+	return nil
+}
+
+var zeroBlockChecksum = crc32.ChecksumIEEE(make([]byte, gfs.ChecksumBlockSize))
+
+// readBlock reads the i-th checksum block of a chunk file, the part after the end of file is zero
+func readBlock(f *os.File, i int, block []byte) error {
+	n, err := f.ReadAt(block, int64(i)*gfs.ChecksumBlockSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for j := n; j < len(block); j++ {
+		block[j] = 0
+	}
 	return nil
 }
 
-// readChunk reads data at offset from a chunk at dist
+// verifyBlocks returns the index of the first ChecksumBlockSize block of data which does
+// not match its checksum, or -1 if all match. The blocks without checksum are not verified.
+func verifyBlocks(data []byte, checksums []uint32) int {
+	block := make([]byte, gfs.ChecksumBlockSize)
+	for i := 0; i < len(checksums) && i*gfs.ChecksumBlockSize < len(data); i++ {
+		n := copy(block, data[i*gfs.ChecksumBlockSize:])
+		for j := n; j < len(block); j++ {
+			block[j] = 0
+		}
+		if crc32.ChecksumIEEE(block) != checksums[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// readChunk reads data at offset from a chunk at dist.
+// All the blocks covered by the read are verified against their checksums,
+// a corrupted chunk is reported to master in next heartbeat.
 func (cs *ChunkServer) readChunk(handle gfs.ChunkHandle, offset gfs.Offset, data []byte) (int, error) {
+	cs.lock.RLock()
+	ck := cs.chunk[handle]
+	cs.lock.RUnlock()
+
 	filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", handle))
 
 	f, err := os.Open(filename)
@@ -621,7 +1140,36 @@ func (cs *ChunkServer) readChunk(handle gfs.ChunkHandle, offset gfs.Offset, data
 	defer f.Close()
 
 	log.Infof("Server %v : read chunk %v at %v len %v", cs.address, handle, offset, len(data))
-	return f.ReadAt(data, int64(offset))
+	if ck.compressed {
+		return cs.readCompressed(f, handle, ck, offset, data)
+	}
+	n, err := f.ReadAt(data, int64(offset))
+	if n == 0 {
+		return n, err
+	}
+
+	// ck is already locked in top caller
+	first := int(offset) / gfs.ChecksumBlockSize
+	last := (int(offset) + n - 1) / gfs.ChecksumBlockSize
+	block := make([]byte, gfs.ChecksumBlockSize)
+	for i := first; i <= last && i < len(ck.checksums); i++ {
+		if e := readBlock(f, i, block); e != nil {
+			return 0, e
+		}
+		if crc32.ChecksumIEEE(block) != ck.checksums[i] {
+			return 0, cs.corrupted(handle, ck, i)
+		}
+	}
+	return n, err
+}
+
+// corrupted reports a chunk whose i-th block does not match its checksum to master in next
+// heartbeat. The replica is kept until master drops it after re-replication, since it may be
+// the last one, and the other blocks can still be read. ck may be read locked only.
+func (cs *ChunkServer) corrupted(handle gfs.ChunkHandle, ck *chunkInfo, i int) error {
+	log.Warningf("%v : checksum mismatch in block %v of chunk %v", cs.address, i, handle)
+	cs.pendingCorruptions.Add(handle)
+	return gfs.ErrChecksumMismatch
 }
 
 // deleteChunk deletes a chunk during garbage collection
@@ -648,20 +1196,27 @@ func (cs *ChunkServer) doMutation(handle gfs.ChunkHandle, m *Mutation) error {
 	var err error
 	if m.mtype == gfs.MutationPad {
 		data := []byte{0}
-		err = cs.writeChunk(handle, data, gfs.MaxChunkSize-1, lock)
+		err = cs.writeChunk(handle, data, cs.maxChunkSize()-1, lock)
+	} else if m.mtype == gfs.MutationTruncate {
+		err = cs.truncateChunk(handle, m.offset)
 	} else {
 		err = cs.writeChunk(handle, m.data, m.offset, lock)
 	}
 
+	cs.lock.RLock()
+	ck := cs.chunk[handle]
+	cs.lock.RUnlock()
 	if err != nil {
-		cs.lock.RLock()
-		ck := cs.chunk[handle]
-		cs.lock.RUnlock()
 		log.Warningf("%v abandon chunk %v", cs.address, handle)
 		ck.abandoned = true
 		return err
 	}
 
+	if m.mtype == gfs.MutationAppend {
+		ck.remember(m.record, m.offset)
+	} else if m.mtype == gfs.MutationTruncate { // the records may be cut off
+		ck.records, ck.recordOrder = nil, nil
+	}
 	return nil
 }
 
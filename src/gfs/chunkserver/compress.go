@@ -0,0 +1,208 @@
+package chunkserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"gfs"
+)
+
+// A compressed chunk is stored as a sequence of gzip streams, one for every checksum
+// block, so a read only decompresses the blocks it covers and a write only compresses
+// the blocks it touches. Blocks are compressed in full, the part after the end of chunk
+// is zero, and ck.blockEnds holds the end offset of each stream in the chunk file.
+// Checksums are computed over the uncompressed blocks, the same as plain chunks.
+
+// diskSize returns the bytes the chunk takes on disk
+func (ck *chunkInfo) diskSize() int64 {
+	if ck.compressed {
+		if n := len(ck.blockEnds); n > 0 {
+			return ck.blockEnds[n-1]
+		}
+		return 0
+	}
+	return int64(ck.length)
+}
+
+// readCompressedBlock decompresses the i-th block of a compressed chunk into block,
+// a block after the last stream is zero
+func readCompressedBlock(f *os.File, ck *chunkInfo, i int, block []byte) error {
+	if i >= len(ck.blockEnds) {
+		for j := range block {
+			block[j] = 0
+		}
+		return nil
+	}
+
+	var start int64
+	if i > 0 {
+		start = ck.blockEnds[i-1]
+	}
+	r, err := gzip.NewReader(io.NewSectionReader(f, start, ck.blockEnds[i]-start))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.ReadFull(r, block)
+	return err
+}
+
+// compressBlock returns block as a gzip stream
+func compressBlock(block []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(block); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteBlocks replaces the streams of blocks first to last with the blocks changed by
+// patch and updates their checksums. The streams after last are moved along unchanged.
+// first should not be beyond the last stream, so the streams stay contiguous.
+// ck is already locked in top caller
+func rewriteBlocks(f *os.File, ck *chunkInfo, first, last int, patch func(i int, block []byte)) error {
+	var start int64
+	if first > 0 {
+		start = ck.blockEnds[first-1]
+	}
+
+	var buf bytes.Buffer
+	var ends []int64
+	block := make([]byte, gfs.ChecksumBlockSize)
+	for i := first; i <= last; i++ {
+		if err := readCompressedBlock(f, ck, i, block); err != nil {
+			return err
+		}
+		patch(i, block)
+		z, err := compressBlock(block)
+		if err != nil {
+			return err
+		}
+		buf.Write(z)
+		ends = append(ends, start+int64(buf.Len()))
+
+		for len(ck.checksums) <= i {
+			ck.checksums = append(ck.checksums, zeroBlockChecksum)
+		}
+		ck.checksums[i] = crc32.ChecksumIEEE(block)
+	}
+
+	if last+1 < len(ck.blockEnds) {
+		old := ck.blockEnds[last]
+		tail := make([]byte, ck.blockEnds[len(ck.blockEnds)-1]-old)
+		if _, err := f.ReadAt(tail, old); err != nil {
+			return err
+		}
+		pos := start + int64(buf.Len())
+		for _, e := range ck.blockEnds[last+1:] {
+			ends = append(ends, e-old+pos)
+		}
+		buf.Write(tail)
+	}
+
+	if _, err := f.WriteAt(buf.Bytes(), start); err != nil {
+		return err
+	}
+	if err := f.Truncate(start + int64(buf.Len())); err != nil {
+		return err
+	}
+	ck.blockEnds = append(ck.blockEnds[:first:first], ends...)
+	return nil
+}
+
+// writeCompressed writes data at offset to a compressed chunk, the holes before
+// offset are filled with zero blocks. ck is already locked in top caller
+func writeCompressed(f *os.File, ck *chunkInfo, data []byte, offset gfs.Offset) error {
+	end := int(offset) + len(data)
+	first := int(offset) / gfs.ChecksumBlockSize
+	if first > len(ck.blockEnds) {
+		first = len(ck.blockEnds)
+	}
+	last := (end - 1) / gfs.ChecksumBlockSize
+
+	return rewriteBlocks(f, ck, first, last, func(i int, block []byte) {
+		lo, hi := i*gfs.ChecksumBlockSize, (i+1)*gfs.ChecksumBlockSize
+		if lo < int(offset) {
+			lo = int(offset)
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo < hi {
+			copy(block[lo-i*gfs.ChecksumBlockSize:], data[lo-int(offset):hi-int(offset)])
+		}
+	})
+}
+
+// truncateCompressed cuts a compressed chunk to length, the rest of its last block is
+// set to zero. ck is already locked in top caller
+func truncateCompressed(f *os.File, ck *chunkInfo, length gfs.Offset) error {
+	blocks := (int(length) + gfs.ChecksumBlockSize - 1) / gfs.ChecksumBlockSize
+	if len(ck.checksums) > blocks {
+		ck.checksums = ck.checksums[:blocks]
+	}
+	if len(ck.blockEnds) < blocks { // the blocks after the streams are zero already
+		return nil
+	}
+
+	if len(ck.blockEnds) > blocks {
+		ck.blockEnds = ck.blockEnds[:blocks]
+		if err := f.Truncate(ck.diskSize()); err != nil {
+			return err
+		}
+	}
+	rest := int(length) % gfs.ChecksumBlockSize
+	if rest == 0 {
+		return nil
+	}
+	return rewriteBlocks(f, ck, blocks-1, blocks-1, func(i int, block []byte) {
+		for j := rest; j < len(block); j++ {
+			block[j] = 0
+		}
+	})
+}
+
+// readCompressed reads data at offset from a compressed chunk, decompressing and
+// verifying only the blocks covered by the read. ck is already locked in top caller
+func (cs *ChunkServer) readCompressed(f *os.File, handle gfs.ChunkHandle, ck *chunkInfo, offset gfs.Offset, data []byte) (int, error) {
+	if offset >= ck.length {
+		return 0, io.EOF
+	}
+	n := len(data)
+	var err error
+	if rest := int(ck.length - offset); rest < n {
+		n, err = rest, io.EOF
+	}
+	if n == 0 {
+		return 0, err
+	}
+
+	first := int(offset) / gfs.ChecksumBlockSize
+	last := (int(offset) + n - 1) / gfs.ChecksumBlockSize
+	block := make([]byte, gfs.ChecksumBlockSize)
+	for i := first; i <= last; i++ {
+		if e := readCompressedBlock(f, ck, i, block); e != nil {
+			return 0, e
+		}
+		if i < len(ck.checksums) && crc32.ChecksumIEEE(block) != ck.checksums[i] {
+			return 0, cs.corrupted(handle, ck, i)
+		}
+
+		lo, hi := i*gfs.ChecksumBlockSize, (i+1)*gfs.ChecksumBlockSize
+		if lo < int(offset) {
+			lo = int(offset)
+		}
+		if hi > int(offset)+n {
+			hi = int(offset) + n
+		}
+		copy(data[lo-int(offset):hi-int(offset)], block[lo-i*gfs.ChecksumBlockSize:])
+	}
+	return n, err
+}
@@ -1,6 +1,7 @@
 package chunkserver
 
 import (
+	"container/list"
 	"fmt"
 	"sync"
 	"time"
@@ -9,24 +10,33 @@ import (
 )
 
 type downloadItem struct {
+	id     gfs.DataBufferID
 	data   []byte
 	expire time.Time
 }
 
+// downloadBuffer keeps the data pushed by clients until a mutation refers to it.
+// Items expire after they are not used for a while, and the least recently used
+// ones are evicted when the total size exceeds the limit. It is thread-safe since a mutex is used.
 type downloadBuffer struct {
-	sync.RWMutex
-	buffer map[gfs.DataBufferID]downloadItem
-	expire time.Duration
-	tick   time.Duration
+	sync.Mutex
+	buffer  map[gfs.DataBufferID]*list.Element
+	lru     *list.List // of *downloadItem, the most recently used first
+	size    int64      // total bytes of data in buffer
+	maxSize int64      // evict items if size exceeds it, unlimited if 0
+	expire  time.Duration
+	tick    time.Duration
 }
 
 // newDownloadBuffer returns a downloadBuffer. Default expire time is expire.
 // The downloadBuffer will cleanup expired items every tick.
-func newDownloadBuffer(expire, tick time.Duration) *downloadBuffer {
+func newDownloadBuffer(expire, tick time.Duration, maxSize int64) *downloadBuffer {
 	buf := &downloadBuffer{
-		buffer: make(map[gfs.DataBufferID]downloadItem),
-		expire: expire,
-		tick:   tick,
+		buffer:  make(map[gfs.DataBufferID]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+		expire:  expire,
+		tick:    tick,
 	}
 
 	// cleanup
@@ -36,10 +46,12 @@ func newDownloadBuffer(expire, tick time.Duration) *downloadBuffer {
 			<-ticker
 			now := time.Now()
 			buf.Lock()
-			for id, item := range buf.buffer {
-				if item.expire.Before(now) {
-					delete(buf.buffer, id)
+			for e := buf.lru.Back(); e != nil; {
+				prev := e.Prev()
+				if e.Value.(*downloadItem).expire.Before(now) {
+					buf.remove(e)
 				}
+				e = prev
 			}
 			buf.Unlock()
 		}
@@ -55,38 +67,92 @@ func NewDataID(handle gfs.ChunkHandle) gfs.DataBufferID {
 	return gfs.DataBufferID{handle, timeStamp}
 }
 
+// remove drops an item from buffer, buf should be locked in advance
+func (buf *downloadBuffer) remove(e *list.Element) {
+	item := buf.lru.Remove(e).(*downloadItem)
+	delete(buf.buffer, item.id)
+	buf.size -= int64(len(item.data))
+}
+
+// evict drops the least recently used items until the size is within limit.
+// The most recently used item is kept even if it alone exceeds the limit.
+func (buf *downloadBuffer) evict() {
+	for buf.maxSize > 0 && buf.size > buf.maxSize && buf.lru.Len() > 1 {
+		buf.remove(buf.lru.Back())
+	}
+}
+
+// lookup returns the unexpired item of id and marks it as recently used, buf should be locked in advance
+func (buf *downloadBuffer) lookup(id gfs.DataBufferID) (*list.Element, bool) {
+	e, ok := buf.buffer[id]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*downloadItem)
+	if item.expire.Before(time.Now()) {
+		buf.remove(e)
+		return nil, false
+	}
+	item.expire = time.Now().Add(buf.expire) // touch
+	buf.lru.MoveToFront(e)
+	return e, true
+}
+
 func (buf *downloadBuffer) Set(id gfs.DataBufferID, data []byte) {
 	buf.Lock()
 	defer buf.Unlock()
-	buf.buffer[id] = downloadItem{data, time.Now().Add(buf.expire)}
+	if e, ok := buf.buffer[id]; ok {
+		buf.remove(e)
+	}
+	buf.buffer[id] = buf.lru.PushFront(&downloadItem{id, data, time.Now().Add(buf.expire)})
+	buf.size += int64(len(data))
+	buf.evict()
 }
 
 func (buf *downloadBuffer) Get(id gfs.DataBufferID) ([]byte, bool) {
 	buf.Lock()
 	defer buf.Unlock()
-	item, ok := buf.buffer[id]
+	e, ok := buf.lookup(id)
 	if !ok {
 		return nil, ok
 	}
-	item.expire = time.Now().Add(buf.expire) // touch
-	return item.data, ok
+	return e.Value.(*downloadItem).data, ok
 }
 
+// Fetch removes the data of id from buffer and returns it.
+// gfs.ErrDataNotFound is returned if the data is evicted or expired, so it should be pushed again.
 func (buf *downloadBuffer) Fetch(id gfs.DataBufferID) ([]byte, error) {
 	buf.Lock()
 	defer buf.Unlock()
 
-	item, ok := buf.buffer[id]
+	e, ok := buf.lookup(id)
 	if !ok {
-		return nil, fmt.Errorf("DataID %v not found in download buffer.", id)
+		return nil, gfs.Error{gfs.DataNotFound, fmt.Sprintf("DataID %v %s", id, gfs.ErrDataNotFound.Err)}
 	}
 
-	delete(buf.buffer, id)
-	return item.data, nil
+	buf.remove(e)
+	return e.Value.(*downloadItem).data, nil
 }
 
 func (buf *downloadBuffer) Delete(id gfs.DataBufferID) {
 	buf.Lock()
 	defer buf.Unlock()
-	delete(buf.buffer, id)
+	if e, ok := buf.buffer[id]; ok {
+		buf.remove(e)
+	}
+}
+
+// SetMaxSize changes the size limit of buffer and evicts the extra items
+func (buf *downloadBuffer) SetMaxSize(n int64) {
+	buf.Lock()
+	defer buf.Unlock()
+	buf.maxSize = n
+	buf.evict()
+}
+
+// SetExpire changes how long an unused item is kept, it applies to items set or used later
+func (buf *downloadBuffer) SetExpire(d time.Duration) {
+	buf.Lock()
+	defer buf.Unlock()
+	buf.expire = d
 }
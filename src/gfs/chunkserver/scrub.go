@@ -0,0 +1,123 @@
+package chunkserver
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"time"
+
+	"gfs"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Scrubbing verifies the chunks against their checksums in background, so a replica
+// rotten on disk is found and re-replicated from a good copy before it is read.
+// A chunk is scrubbed every gfs.ScrubInterval in the order of handles. Its blocks
+// are read one by one at the scrub rate, and the chunk is left to the next round
+// when a block is locked by a mutation, so scrubbing never waits for client I/O.
+
+// scrub runs until the server is shut down
+func (cs *ChunkServer) scrub() {
+	var next gfs.ChunkHandle
+	for {
+		select {
+		case <-cs.shutdown:
+			return
+		case <-time.After(gfs.ScrubInterval):
+		}
+
+		handle, ck, ok := cs.nextScrub(next)
+		if !ok {
+			continue
+		}
+		next = handle + 1
+		cs.scrubChunk(handle, ck)
+	}
+}
+
+// nextScrub returns the chunk with the smallest handle not less than next,
+// or the first chunk if there is none. ok is false if nothing is to be scrubbed.
+func (cs *ChunkServer) nextScrub(next gfs.ChunkHandle) (handle gfs.ChunkHandle, ck *chunkInfo, ok bool) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	if cs.scrubRate <= 0 {
+		return 0, nil, false
+	}
+
+	var first gfs.ChunkHandle
+	var firstCk *chunkInfo
+	for h, c := range cs.chunk {
+		if h >= next && (ck == nil || h < handle) {
+			handle, ck = h, c
+		}
+		if firstCk == nil || h < first {
+			first, firstCk = h, c
+		}
+	}
+	if ck == nil {
+		handle, ck = first, firstCk
+	}
+	return handle, ck, ck != nil
+}
+
+// scrubDelay returns the pause after reading a block, which keeps scrubbing at the
+// scrub rate. ok is false if scrubbing is stopped.
+func (cs *ChunkServer) scrubDelay() (d time.Duration, ok bool) {
+	cs.lock.RLock()
+	rate := cs.scrubRate
+	cs.lock.RUnlock()
+	if rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(int64(time.Second) * gfs.ChecksumBlockSize / rate), true
+}
+
+// scrubChunk verifies the blocks of a chunk. A corrupted chunk is reported to master
+// in next heartbeat.
+func (cs *ChunkServer) scrubChunk(handle gfs.ChunkHandle, ck *chunkInfo) {
+	filename := path.Join(cs.rootDir, fmt.Sprintf("chunk%v.chk", handle))
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Warningf("%v : scrub chunk %v: %v", cs.address, handle, err)
+		return
+	}
+	defer f.Close()
+
+	block := make([]byte, gfs.ChecksumBlockSize)
+	for i := 0; ; i++ {
+		if !ck.TryRLock() {
+			return
+		}
+		if ck.abandoned || i >= len(ck.checksums) {
+			ck.RUnlock()
+			return
+		}
+		if ck.compressed {
+			err = readCompressedBlock(f, ck, i, block)
+		} else {
+			err = readBlock(f, i, block)
+		}
+		if err == nil && crc32.ChecksumIEEE(block) != ck.checksums[i] {
+			cs.corrupted(handle, ck, i)
+			ck.RUnlock()
+			return
+		}
+		ck.RUnlock()
+		if err != nil {
+			log.Warningf("%v : scrub chunk %v: %v", cs.address, handle, err)
+			return
+		}
+
+		d, ok := cs.scrubDelay()
+		if !ok {
+			return
+		}
+		select {
+		case <-cs.shutdown:
+			return
+		case <-time.After(d):
+		}
+	}
+}
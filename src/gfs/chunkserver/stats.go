@@ -0,0 +1,84 @@
+package chunkserver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gfs"
+)
+
+// latencyWindow is a ring buffer keeping the most recent latency samples
+type latencyWindow struct {
+	sync.Mutex
+	samples []float64
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]float64, size)}
+}
+
+// Add records a latency sample, overwriting the oldest one if the window is full
+func (w *latencyWindow) Add(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.samples[w.next] = float64(d) / float64(time.Millisecond)
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// Snapshot returns a copy of the samples in the window in milliseconds
+func (w *latencyWindow) Snapshot() []float64 {
+	w.Lock()
+	defer w.Unlock()
+	if w.full {
+		return append([]float64(nil), w.samples...)
+	}
+	return append([]float64(nil), w.samples[:w.next]...)
+}
+
+// serverStats collects performance statistics reported to master in heartbeat
+type serverStats struct {
+	readLatency  *latencyWindow
+	writeLatency *latencyWindow
+	chunksServed int64
+	writeOps     int64
+	readBytes    int64
+	writeBytes   int64
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		readLatency:  newLatencyWindow(gfs.StatsWindowSize),
+		writeLatency: newLatencyWindow(gfs.StatsWindowSize),
+	}
+}
+
+func (s *serverStats) recordRead(start time.Time, n int) {
+	s.readLatency.Add(time.Since(start))
+	atomic.AddInt64(&s.chunksServed, 1)
+	atomic.AddInt64(&s.readBytes, int64(n))
+}
+
+func (s *serverStats) recordWrite(start time.Time, n int) {
+	s.writeLatency.Add(time.Since(start))
+	atomic.AddInt64(&s.writeOps, 1)
+	atomic.AddInt64(&s.writeBytes, int64(n))
+}
+
+// Report returns the statistics to be sent in heartbeat
+func (s *serverStats) Report() gfs.ChunkServerStats {
+	return gfs.ChunkServerStats{
+		ReadLatencyMs:  s.readLatency.Snapshot(),
+		WriteLatencyMs: s.writeLatency.Snapshot(),
+		ChunksServed:   atomic.LoadInt64(&s.chunksServed),
+		WriteOps:       atomic.LoadInt64(&s.writeOps),
+		ReadBytes:      atomic.LoadInt64(&s.readBytes),
+		WriteBytes:     atomic.LoadInt64(&s.writeBytes),
+	}
+}
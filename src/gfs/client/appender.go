@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+
+	"gfs"
+	"gfs/util"
+)
+
+// Appender appends to a file through record appends, it implements io.Writer.
+// Small writes are buffered and coalesced into one record, which is appended when
+// the next write would make it longer than the append size limit, or on Flush.
+// A write longer than the limit is split into several records, so only a write
+// within the limit is appended atomically. The length of file is confirmed with
+// master on Flush and Close, so a reader opened after them sees all the records.
+type Appender struct {
+	c      *Client
+	path   gfs.Path
+	max    int        // max length of a record append
+	buf    []byte     // data written but not appended yet
+	offset gfs.Offset // end of the last record appended
+}
+
+// OpenAppender is a client API, opens a file for buffered record appends.
+func (c *Client) OpenAppender(path gfs.Path) (*Appender, error) {
+	var f gfs.GetFileInfoReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: path}, &f)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsDir {
+		return nil, fmt.Errorf("%v is a directory", path)
+	}
+
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return nil, err
+	}
+	return &Appender{c: c, path: path, max: int(chunkSize / 4)}, nil
+}
+
+// Write buffers p to be appended. The buffered data is flushed first if p does not fit
+// in the same record, and the part of p longer than the limit is appended right away.
+func (a *Appender) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(a.buf)+len(p) > a.max {
+		if err := a.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	for len(p) > a.max {
+		if err := a.append(p[:a.max], false); err != nil {
+			return n - len(p), err
+		}
+		p = p[a.max:]
+	}
+	a.buf = append(a.buf, p...)
+	return n, nil
+}
+
+// Flush appends the buffered data as one record and waits until master confirms the
+// length of file. The data stays buffered if the append fails. If the record is appended
+// but the length is not confirmed, gfs.ErrLengthNotUpdated is returned, and Flush may be
+// called again to report the length.
+func (a *Appender) Flush() error {
+	return a.flush(true)
+}
+
+// flush appends the buffered data, the length is confirmed if sync is set
+func (a *Appender) flush(sync bool) error {
+	if len(a.buf) == 0 {
+		if sync && a.offset > 0 {
+			return a.c.updateLength(a.path, a.offset)
+		}
+		return nil
+	}
+	err := a.append(a.buf, sync)
+	if err != nil && !gfs.IsError(err, gfs.ErrLengthNotUpdated) {
+		return err
+	}
+	a.buf = a.buf[:0] // the record is appended, don't append it again
+	return err
+}
+
+// Close flushes the buffered data and returns the end offset of the last record appended
+func (a *Appender) Close() (gfs.Offset, error) {
+	err := a.Flush()
+	return a.offset, err
+}
+
+// append appends data as one record
+func (a *Appender) append(data []byte, sync bool) error {
+	offset, err := a.c.AppendWith(gfs.AppendArg{Path: a.path, Data: data, Sync: sync})
+	if err != nil && !gfs.IsError(err, gfs.ErrLengthNotUpdated) {
+		return err
+	}
+	a.offset = offset + gfs.Offset(len(data))
+	return err
+}
@@ -1,9 +1,11 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
+	"sync"
 	"time"
 
 	"gfs"
@@ -15,41 +17,153 @@ import (
 // Client struct is the GFS client-side driver
 type Client struct {
 	master   gfs.ServerAddress
+	tls      *tls.Config // nil if rpc is in plaintext
 	leaseBuf *leaseBuffer
+	locCache *locationCache
+	zone     string // topology label of the client, replicas in the same zone are read first
+
+	configLock sync.Mutex
+	chunkSize  gfs.Offset // chunk size of master, 0 until it is asked
 }
 
 // NewClient returns a new gfs client.
-func NewClient(master gfs.ServerAddress) *Client {
+// If config is not nil, rpc is sent over TLS with it.
+func NewClient(master gfs.ServerAddress, config *tls.Config) *Client {
 	return &Client{
 		master:   master,
-		leaseBuf: newLeaseBuffer(master, gfs.LeaseBufferTick),
+		tls:      config,
+		leaseBuf: newLeaseBuffer(master, config, gfs.LeaseBufferTick),
+		locCache: newLocationCache(master, config, gfs.LocationCacheTTL),
+	}
+}
+
+// LocationLookups returns the number of chunk location lookups sent to master
+func (c *Client) LocationLookups() int64 {
+	return c.locCache.Lookups()
+}
+
+// ChunkSize returns the chunk size of master. It is asked from master on first use
+// and cached, so that offsets are always mapped to the same chunks as master does.
+func (c *Client) ChunkSize() (gfs.Offset, error) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	if c.chunkSize > 0 {
+		return c.chunkSize, nil
+	}
+
+	var reply gfs.GetConfigReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCGetConfig", gfs.GetConfigArg{}, &reply)
+	if err != nil {
+		return 0, err
 	}
+	c.chunkSize = gfs.Offset(reply.ChunkSize)
+	return c.chunkSize, nil
+}
+
+// SetZone sets the topology label of the client, such as "dc1/rack2"
+func (c *Client) SetZone(zone string) {
+	c.zone = zone
 }
 
 // Create is a client API, creates a file
 func (c *Client) Create(path gfs.Path) error {
 	var reply gfs.CreateFileReply
-	err := util.Call(c.master, "Master.RPCCreateFile", gfs.CreateFileArg{path}, &reply)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCCreateFile", gfs.CreateFileArg{Path: path}, &reply)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateSmallFile is a client API, creates a file with data in one call to master if data
+// fits in a chunk, otherwise it is created and written in the normal way
+func (c *Client) CreateSmallFile(path gfs.Path, data []byte) error {
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return err
+	}
+	if gfs.Offset(len(data)) > chunkSize {
+		if err := c.Create(path); err != nil {
+			return err
+		}
+		return c.Write(path, 0, data)
+	}
+	return util.CallTLS(c.tls, c.master, "Master.RPCCreateSmallFile", gfs.CreateSmallFileArg{path, data}, &gfs.CreateSmallFileReply{})
+}
+
+// CreateWithReplicaFactor is a client API, creates a file whose chunks have factor replicas
+func (c *Client) CreateWithReplicaFactor(path gfs.Path, factor int) error {
+	var reply gfs.CreateFileReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCCreateFile", gfs.CreateFileArg{Path: path, ReplicaFactor: factor}, &reply)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// CreateCompressed is a client API, creates a file whose chunks are stored compressed
+// on chunkservers. It saves disk space for compressible data such as logs and text,
+// reads and writes are the same as other files.
+func (c *Client) CreateCompressed(path gfs.Path) error {
+	var reply gfs.CreateFileReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCCreateFile", gfs.CreateFileArg{Path: path, Compressed: true}, &reply)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateWithMaxChunks is a client API, creates a file which may have at most n chunks
+// instead of the limit of master. Allocating a chunk beyond it fails with gfs.ErrFileTooLarge.
+func (c *Client) CreateWithMaxChunks(path gfs.Path, n int64) error {
+	var reply gfs.CreateFileReply
+	return util.CallTLS(c.tls, c.master, "Master.RPCCreateFile", gfs.CreateFileArg{Path: path, MaxChunks: n}, &reply)
+}
+
 // Delete is a client API, deletes a file
 func (c *Client) Delete(path gfs.Path) error {
 	var reply gfs.DeleteFileReply
-	err := util.Call(c.master, "Master.RPCDeleteFile", gfs.DeleteFileArg{path}, &reply)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCDeleteFile", gfs.DeleteFileArg{Path: path}, &reply)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Rename is a client API, deletes a file
+// SetQuota is a client API, limits the bytes of the files under a directory, unlimited if bytes is 0
+func (c *Client) SetQuota(path gfs.Path, bytes int64) error {
+	var reply gfs.SetQuotaReply
+	return util.CallTLS(c.tls, c.master, "Master.RPCSetQuota", gfs.SetQuotaArg{path, bytes}, &reply)
+}
+
+// SetReplicationFactor is a client API, changes the number of replicas of each chunk of a file
+func (c *Client) SetReplicationFactor(path gfs.Path, factor int) error {
+	var reply gfs.SetReplicationFactorReply
+	return util.CallTLS(c.tls, c.master, "Master.RPCSetReplicationFactor", gfs.SetReplicationFactorArg{path, factor}, &reply)
+}
+
+// Truncate is a client API, cuts a file to length bytes
+func (c *Client) Truncate(path gfs.Path, length int64) error {
+	var reply gfs.TruncateReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCTruncate", gfs.TruncateArg{path, length}, &reply)
+	if err != nil {
+		return err
+	}
+	// the last chunk may be replaced if it was shared with a snapshot
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return err
+	}
+	if length > 0 {
+		c.locCache.Invalidate(path, gfs.ChunkIndex((length-1)/int64(chunkSize)))
+	}
+	return nil
+}
+
+// Rename is a client API, renames or moves a file or directory
 func (c *Client) Rename(source gfs.Path, target gfs.Path) error {
 	var reply gfs.RenameFileReply
-	err := util.Call(c.master, "Master.RPCRenameFile", gfs.RenameFileArg{source, target}, &reply)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCRenameFile", gfs.RenameFileArg{source, target}, &reply)
 
 	if err != nil {
 		return err
@@ -58,10 +172,42 @@ func (c *Client) Rename(source gfs.Path, target gfs.Path) error {
 	return nil
 }
 
+// Snapshot is a client API, makes a point-in-time copy of a file or directory
+func (c *Client) Snapshot(source gfs.Path, target gfs.Path) error {
+	var reply gfs.SnapshotReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCSnapshot", gfs.SnapshotArg{source, target}, &reply)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CopyFile is a client API, copies a file on the server side. The copy has its own
+// chunks, and the data is copied between chunkservers without going through the client.
+func (c *Client) CopyFile(source gfs.Path, target gfs.Path) error {
+	var reply gfs.CopyFileReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCCopyFile", gfs.CopyFileArg{source, target}, &reply)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // Mkdir is a client API, makes a directory
 func (c *Client) Mkdir(path gfs.Path) error {
 	var reply gfs.MkdirReply
-	err := util.Call(c.master, "Master.RPCMkdir", gfs.MkdirArg{path}, &reply)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCMkdir", gfs.MkdirArg{Path: path}, &reply)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// MkdirAll is a client API, makes a directory along with all missing parents.
+// It succeeds if the directory already exists.
+func (c *Client) MkdirAll(path gfs.Path) error {
+	var reply gfs.MkdirReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCMkdir", gfs.MkdirArg{path, true}, &reply)
 	if err != nil {
 		return err
 	}
@@ -71,58 +217,96 @@ func (c *Client) Mkdir(path gfs.Path) error {
 // List is a client API, lists all files in specific directory
 func (c *Client) List(path gfs.Path) ([]gfs.PathInfo, error) {
 	var reply gfs.ListReply
-	err := util.Call(c.master, "Master.RPCList", gfs.ListArg{path}, &reply)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCList", gfs.ListArg{Path: path}, &reply)
 	if err != nil {
 		return nil, err
 	}
 	return reply.Files, nil
 }
 
+// BatchGetFileInfo is a client API, returns the info of several paths in one call.
+// The error of each path is nil if its info is found.
+func (c *Client) BatchGetFileInfo(paths []gfs.Path) ([]gfs.GetFileInfoReply, []error, error) {
+	var reply gfs.BatchGetFileInfoReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCBatchGetFileInfo", gfs.BatchGetFileInfoArg{paths}, &reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	errs := make([]error, len(paths))
+	for i, e := range reply.Errors {
+		if e.Code != gfs.Success {
+			errs[i] = e
+		}
+	}
+	return reply.Infos, errs, nil
+}
+
+// Walk is a client API, lists all files and directories below root in sorted order.
+// The subtree is fetched a page at a time, each page is consistent by itself.
+func (c *Client) Walk(root gfs.Path) ([]gfs.WalkEntry, error) {
+	var entries []gfs.WalkEntry
+	var after gfs.Path
+	for {
+		var reply gfs.WalkReply
+		err := util.CallTLS(c.tls, c.master, "Master.RPCWalk", gfs.WalkArg{Root: root, After: after}, &reply)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, reply.Entries...)
+		if reply.Next == "" {
+			return entries, nil
+		}
+		after = reply.Next
+	}
+}
+
 // Read is a client API, read file at specific offset
 // it reads up to len(data) bytes form the File. it return the number of bytes and an error.
 // the error is set to io.EOF if stream meets the end of file
+// A read spanning several chunks is split into chunk reads. If a chunk cannot be read
+// from any replica, the bytes read before it are returned with a gfs.PartialReadError.
 func (c *Client) Read(path gfs.Path, offset gfs.Offset, data []byte) (n int, err error) {
 	var f gfs.GetFileInfoReply
-	err = util.Call(c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{path}, &f)
+	err = util.CallTLS(c.tls, c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: path}, &f)
 	if err != nil {
 		return -1, err
 	}
 
-	if int64(offset/gfs.MaxChunkSize) > f.Chunks {
-		return -1, fmt.Errorf("read offset exceeds file size")
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return -1, err
+	}
+
+	if int64(offset/chunkSize) >= f.Chunks {
+		return 0, io.EOF
 	}
 
 	pos := 0
 	for pos < len(data) {
-		index := gfs.ChunkIndex(offset / gfs.MaxChunkSize)
-		chunkOffset := offset % gfs.MaxChunkSize
+		index := gfs.ChunkIndex(offset / chunkSize)
+		chunkOffset := offset % chunkSize
 
 		if int64(index) >= f.Chunks {
 			err = gfs.Error{gfs.ReadEOF, "EOF over chunks"}
 			break
 		}
 
+		var n int
 		var handle gfs.ChunkHandle
-		handle, err = c.GetChunkHandle(path, index)
-		if err != nil {
-			return
+		n, handle, err = c.readChunkOf(path, index, chunkOffset, data[pos:])
+		if err != nil && err.(gfs.Error).Code != gfs.ReadEOF {
+			return pos, gfs.PartialReadError{Read: pos, Offset: offset, Handle: handle, Err: err}
 		}
-
-		var n int
-		//wait := time.NewTimer(gfs.ClientTryTimeout)
-		//loop:
-		for {
-			//select {
-			//case <-wait.C:
-			//    err = gfs.Error{gfs.Timeout, "Read Timeout"}
-			//    break loop
-			//default:
-			//}
-			n, err = c.ReadChunk(handle, chunkOffset, data[pos:])
-			if err == nil || err.(gfs.Error).Code == gfs.ReadEOF {
-				break
+		// a chunk shorter than the ones after it is followed by a hole, which reads as zero
+		if err != nil && int64(index) < f.Chunks-1 {
+			rest := int(chunkSize - chunkOffset)
+			if rest > len(data)-pos {
+				rest = len(data) - pos
 			}
-			log.Warning("Read ", handle, " connection error, try again: ", err)
+			for i := n; i < rest; i++ {
+				data[pos+i] = 0
+			}
+			n, err = rest, nil
 		}
 
 		offset += gfs.Offset(n)
@@ -139,29 +323,64 @@ func (c *Client) Read(path gfs.Path, offset gfs.Offset, data []byte) (n int, err
 	}
 }
 
+// readChunkOf reads the chunk index of path at offset. The replicas are looked up again
+// if they fail, until gfs.ClientTryTimeout. handle is 0 if the chunk cannot be found.
+func (c *Client) readChunkOf(path gfs.Path, index gfs.ChunkIndex, offset gfs.Offset, data []byte) (n int, handle gfs.ChunkHandle, err error) {
+	wait := time.NewTimer(gfs.ClientTryTimeout)
+	defer wait.Stop()
+	for {
+		loc, e := c.locCache.Get(path, index, c.zone)
+		if e != nil {
+			return 0, handle, gfs.Error{gfs.UnknownError, e.Error()}
+		}
+		handle = loc.handle
+		_, n, err = c.readLocation(path, index, loc, offset, data)
+		if err == nil || err.(gfs.Error).Code == gfs.ReadEOF {
+			return n, handle, err
+		}
+		// the cached replicas may be moved or lost
+		c.locCache.Invalidate(path, index)
+		log.Warning("Read ", loc.handle, " connection error, try again: ", err)
+
+		select {
+		case <-wait.C:
+			return 0, handle, gfs.Error{gfs.Timeout, "Read Timeout: " + err.Error()}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
 // Write is a client API. write data to file at specific offset
+// A write spanning several chunks is split into chunk writes. If the write skips chunks
+// past the end of file and master enables sparse files, the chunks up to it are allocated,
+// and the ones skipped are holes read as zero. Otherwise it fails with gfs.ErrChunkGap.
+// The new end of data is reported to master, which keeps the length of file. If the data
+// is written but the report fails, gfs.ErrLengthNotUpdated is returned, see IsError.
 func (c *Client) Write(path gfs.Path, offset gfs.Offset, data []byte) error {
 	var f gfs.GetFileInfoReply
-	err := util.Call(c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{path}, &f)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: path}, &f)
 	if err != nil {
 		return err
 	}
 
-	if int64(offset/gfs.MaxChunkSize) > f.Chunks {
-		return fmt.Errorf("write offset exceeds file size")
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return err
 	}
 
 	begin := 0
 	for {
-		index := gfs.ChunkIndex(offset / gfs.MaxChunkSize)
-		chunkOffset := offset % gfs.MaxChunkSize
+		index := gfs.ChunkIndex(offset / chunkSize)
+		chunkOffset := offset % chunkSize
 
 		handle, err := c.GetChunkHandle(path, index)
 		if err != nil {
 			return err
 		}
+		// the write may allocate the chunk, or copy a chunk shared by snapshots
+		c.locCache.Invalidate(path, index)
 
-		writeMax := int(gfs.MaxChunkSize - chunkOffset)
+		writeMax := int(chunkSize - chunkOffset)
 		var writeLen int
 		if begin+writeMax > len(data) {
 			writeLen = len(data) - begin
@@ -169,21 +388,24 @@ func (c *Client) Write(path gfs.Path, offset gfs.Offset, data []byte) error {
 			writeLen = writeMax
 		}
 
-		//wait := time.NewTimer(gfs.ClientTryTimeout)
-		//loop:
+		// a failure on any replica fails the whole chunk write, retry it until timeout
+		wait := time.NewTimer(gfs.ClientTryTimeout)
+	loop:
 		for {
-			//select {
-			//case <-wait.C:
-			//    err = fmt.Errorf("Write Timeout")
-			//    break loop
-			//default:
-			//}
 			err = c.WriteChunk(handle, chunkOffset, data[begin:begin+writeLen])
 			if err == nil {
 				break
 			}
 			log.Warning("Write ", handle, "  connection error, try again ", err)
+
+			select {
+			case <-wait.C:
+				err = gfs.Error{gfs.Timeout, "Write Timeout: " + err.Error()}
+				break loop
+			case <-time.After(50 * time.Millisecond):
+			}
 		}
+		wait.Stop()
 		if err != nil {
 			return err
 		}
@@ -196,17 +418,80 @@ func (c *Client) Write(path gfs.Path, offset gfs.Offset, data []byte) error {
 		}
 	}
 
+	return c.updateLength(path, offset)
+}
+
+// updateLength tells master that path has data up to end. The data is written already,
+// so a failure is returned as gfs.ErrLengthNotUpdated, not to be taken as a failed write.
+func (c *Client) updateLength(path gfs.Path, end gfs.Offset) error {
+	var reply gfs.UpdateFileLengthReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCUpdateFileLength", gfs.UpdateFileLengthArg{path, int64(end)}, &reply)
+	if err != nil {
+		return gfs.Error{gfs.LengthNotUpdated, fmt.Sprintf("%v: path %s %s", err, path, gfs.ErrLengthNotUpdated.Err)}
+	}
 	return nil
 }
 
-// Append is a client API, append data to file
+// Append is a client API, append data to file atomically at an offset chosen by the primary.
+// If the record does not fit in the last chunk, the chunk is padded and the append is retried on the next one.
+// <code>len(data)</code> should be within 1/4 chunk size, otherwise gfs.ErrAppendExceedMaxSize is returned.
+// The new length of file is reported to master in background, so a reader opened right
+// after may not see the record yet. Use AppendWith with Sync set to wait for it.
 func (c *Client) Append(path gfs.Path, data []byte) (offset gfs.Offset, err error) {
-	if len(data) > gfs.MaxAppendSize {
-		return 0, fmt.Errorf("len(data) = %v > max append size %v", len(data), gfs.MaxAppendSize)
+	return c.append(gfs.AppendArg{Path: path, Data: data}, false)
+}
+
+// AppendWith is a client API, it is Append with the options in args.
+// If args.Sync is set, it returns after master confirms the new length of file. If the record
+// is appended but master is not told the length, the offset is returned with gfs.ErrLengthNotUpdated.
+// In the default gfs.AtLeastOnce mode, a record may be appended again by a retry after
+// its reply is lost, so the readers should tolerate duplicates.
+// In gfs.ExactlyOnce mode, an append retried with the same args.RecordID, e.g. after a
+// timeout or by a client restarted after a crash, returns the offset of the record
+// appended before rather than appending it again, as long as the record is among the
+// last gfs.AppendDedupWindow ones appended to the last chunk of file. A record which is
+// not found, e.g. the earlier try failed, is appended safely. The IDs are remembered by
+// the replicas in memory, so the record may be duplicated if all of them restart.
+func (c *Client) AppendWith(args gfs.AppendArg) (offset gfs.Offset, err error) {
+	return c.append(args, false)
+}
+
+// AppendOrCreate is a client API, it is Append but creates the file first if it does not exist.
+// Concurrent first appenders to a path race to create it, all of them append to the same file.
+func (c *Client) AppendOrCreate(path gfs.Path, data []byte) (offset gfs.Offset, err error) {
+	return c.append(gfs.AppendArg{Path: path, Data: data}, true)
+}
+
+// append appends args.Data to args.Path, which is created if it does not exist and create is set.
+// The new length is reported to master before it returns if args.Sync is set, otherwise in background.
+// In gfs.ExactlyOnce mode the record keeps its ID through the retries, so it is appended once.
+func (c *Client) append(args gfs.AppendArg, create bool) (offset gfs.Offset, err error) {
+	path, data := args.Path, args.Data
+	var id uint64 // no ID is sent in gfs.AtLeastOnce mode
+	if args.Mode == gfs.ExactlyOnce {
+		id = args.RecordID
+		if id == 0 {
+			id = newRecordID()
+		}
+	}
+
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return
+	}
+	if gfs.Offset(len(data)) > chunkSize/4 {
+		return 0, gfs.ErrAppendExceedMaxSize
 	}
 
 	var f gfs.GetFileInfoReply
-	err = util.Call(c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{path}, &f)
+	err = util.CallTLS(c.tls, c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: path}, &f)
+	if create && gfs.IsError(err, gfs.ErrNotExist) {
+		// another appender may create it meanwhile, which is as good
+		if err = c.Create(path); err != nil && !gfs.IsError(err, gfs.ErrAlreadyExists) {
+			return
+		}
+		err = util.CallTLS(c.tls, c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: path}, &f)
+	}
 	if err != nil {
 		return
 	}
@@ -223,6 +508,7 @@ func (c *Client) Append(path gfs.Path, data []byte) (offset gfs.Offset, err erro
 		if err != nil {
 			return
 		}
+		c.locCache.Invalidate(path, start)
 
 		//wait := time.NewTimer(gfs.ClientTryTimeout)
 		//loop:
@@ -233,7 +519,7 @@ func (c *Client) Append(path gfs.Path, data []byte) (offset gfs.Offset, err erro
 			//	break loop
 			//default:
 			//}
-			chunkOffset, err = c.AppendChunk(handle, data)
+			chunkOffset, err = c.appendChunk(handle, data, id)
 			if err == nil || err.(gfs.Error).Code == gfs.AppendExceedChunkSize {
 				break
 			}
@@ -253,7 +539,18 @@ func (c *Client) Append(path gfs.Path, data []byte) (offset gfs.Offset, err erro
 		return
 	}
 
-	offset = gfs.Offset(start)*gfs.MaxChunkSize + chunkOffset
+	offset = gfs.Offset(start)*chunkSize + chunkOffset
+	end := offset + gfs.Offset(len(data))
+	if args.Sync || args.Mode == gfs.ExactlyOnce {
+		err = c.updateLength(path, end)
+		return
+	}
+	// master keeps the max of the reports, so they may arrive in any order
+	go func() {
+		if err := c.updateLength(path, end); err != nil {
+			log.Warning("update length of ", path, ": ", err)
+		}
+	}()
 	return
 }
 
@@ -261,7 +558,7 @@ func (c *Client) Append(path gfs.Path, data []byte) (offset gfs.Offset, err erro
 // If the chunk doesn't exist, master will create one.
 func (c *Client) GetChunkHandle(path gfs.Path, index gfs.ChunkIndex) (gfs.ChunkHandle, error) {
 	var reply gfs.GetChunkHandleReply
-	err := util.Call(c.master, "Master.RPCGetChunkHandle", gfs.GetChunkHandleArg{path, index}, &reply)
+	err := util.CallTLS(c.tls, c.master, "Master.RPCGetChunkHandle", gfs.GetChunkHandleArg{path, index}, &reply)
 	if err != nil {
 		return 0, err
 	}
@@ -270,95 +567,212 @@ func (c *Client) GetChunkHandle(path gfs.Path, index gfs.ChunkIndex) (gfs.ChunkH
 
 // ReadChunk read data from the chunk at specific offset.
 // <code>len(data)+offset</data> should be within chunk size.
+// Replicas are tried in random order until one of them succeeds.
 func (c *Client) ReadChunk(handle gfs.ChunkHandle, offset gfs.Offset, data []byte) (int, error) {
-	var readLen int
+	var l gfs.GetReplicasReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCGetReplicas", gfs.GetReplicasArg{Handle: handle, ClientZone: c.zone}, &l)
+	if err != nil {
+		return 0, gfs.Error{gfs.UnknownError, err.Error()}
+	}
+	return c.readReplicas(handle, l.Locations, offset, data)
+}
 
-	if gfs.MaxChunkSize-offset > gfs.Offset(len(data)) {
-		readLen = len(data)
-	} else {
-		readLen = int(gfs.MaxChunkSize - offset)
+// readLocation reads the chunk index of path from the replicas in loc. If all of them
+// fail, the replicas are asked from master once more and tried before the read fails,
+// since they may be moved. It returns the location the read is sent to at last.
+// A hole has no replica, it reads as an empty chunk, which the callers fill with zeros.
+func (c *Client) readLocation(path gfs.Path, index gfs.ChunkIndex, loc *chunkLocation, offset gfs.Offset, data []byte) (*chunkLocation, int, error) {
+	if loc.hole {
+		return loc, 0, gfs.Error{gfs.ReadEOF, "read EOF"}
+	}
+	n, err := c.readReplicas(loc.handle, loc.locations, offset, data)
+	if err == nil || err.(gfs.Error).Code == gfs.ReadEOF {
+		return loc, n, err
 	}
 
-	var l gfs.GetReplicasReply
-	err := util.Call(c.master, "Master.RPCGetReplicas", gfs.GetReplicasArg{handle}, &l)
+	fresh, e := c.locCache.Refresh(path, index, loc.handle, c.zone)
+	if e != nil {
+		log.Warning("Refresh replicas of ", loc.handle, ": ", e)
+		return loc, n, err
+	}
+	log.Info("Read ", loc.handle, " fails on all cached replicas, try ", fresh.locations)
+	n, err = c.readReplicas(fresh.handle, fresh.locations, offset, data)
+	return fresh, n, err
+}
+
+// readReplicas reads data from the chunk at specific offset, trying the given replicas until one of them succeeds.
+func (c *Client) readReplicas(handle gfs.ChunkHandle, locations []gfs.ServerAddress, offset gfs.Offset, data []byte) (int, error) {
+	chunkSize, err := c.ChunkSize()
 	if err != nil {
 		return 0, gfs.Error{gfs.UnknownError, err.Error()}
 	}
-	loc := l.Locations[rand.Intn(len(l.Locations))]
-	if len(l.Locations) == 0 {
+
+	var readLen int
+	if chunkSize-offset > gfs.Offset(len(data)) {
+		readLen = len(data)
+	} else {
+		readLen = int(chunkSize - offset)
+	}
+
+	if len(locations) == 0 {
 		return 0, gfs.Error{gfs.UnknownError, "no replica"}
 	}
 
-	var r gfs.ReadChunkReply
-	r.Data = data
-	err = util.Call(loc, "ChunkServer.RPCReadChunk", gfs.ReadChunkArg{handle, offset, readLen}, &r)
-	if err != nil {
-		return 0, gfs.Error{gfs.UnknownError, err.Error()}
+	// replicas are sorted by proximity if the zone is known, otherwise spread the load
+	order := rand.Perm(len(locations))
+	if c.zone != "" {
+		for i := range order {
+			order[i] = i
+		}
 	}
-	if r.ErrorCode == gfs.ReadEOF {
-		return r.Length, gfs.Error{gfs.ReadEOF, "read EOF"}
+	for _, i := range order {
+		loc := locations[i]
+		var r gfs.ReadChunkReply
+		r.Data = data
+		err = util.CallTLS(c.tls, loc, "ChunkServer.RPCReadChunk", gfs.ReadChunkArg{handle, offset, readLen}, &r)
+		if err != nil {
+			log.Warning("Read ", handle, " from ", loc, " failed, try next replica: ", err)
+			if gfs.IsError(err, gfs.ErrChecksumMismatch) {
+				c.reportBadReplica(handle, loc)
+			}
+			continue
+		}
+		if r.ErrorCode == gfs.ReadEOF {
+			return r.Length, gfs.Error{gfs.ReadEOF, "read EOF"}
+		}
+		return r.Length, nil
+	}
+	return 0, gfs.Error{gfs.UnknownError, err.Error()}
+}
+
+// reportBadReplica lets master repair a replica not matching its checksum
+func (c *Client) reportBadReplica(handle gfs.ChunkHandle, loc gfs.ServerAddress) {
+	err := util.CallTLS(c.tls, c.master, "Master.RPCReportBadReplica", gfs.ReportBadReplicaArg{handle, loc}, &gfs.ReportBadReplicaReply{})
+	if err != nil {
+		log.Warning("Report bad replica of ", handle, " on ", loc, ": ", err)
 	}
-	return r.Length, nil
 }
 
 // WriteChunk writes data to the chunk at specific offset.
 // <code>len(data)+offset</data> should be within chunk size.
+// If the primary no longer holds the lease, the write is retried on the new primary.
 func (c *Client) WriteChunk(handle gfs.ChunkHandle, offset gfs.Offset, data []byte) error {
-	if len(data)+int(offset) > gfs.MaxChunkSize {
-		return fmt.Errorf("len(data)+offset = %v > max chunk size %v", len(data)+int(offset), gfs.MaxChunkSize)
-	}
-
-	l, err := c.leaseBuf.Get(handle)
+	chunkSize, err := c.ChunkSize()
 	if err != nil {
 		return err
 	}
+	if len(data)+int(offset) > int(chunkSize) {
+		return fmt.Errorf("len(data)+offset = %v > max chunk size %v", len(data)+int(offset), chunkSize)
+	}
 
+	for i := 0; ; i++ {
+		l, err := c.leaseBuf.Get(handle, c.zone)
+		if err != nil {
+			return err
+		}
+
+		dataID, err := c.pushData(handle, l, data)
+		if err != nil {
+			return err
+		}
+
+		wcargs := gfs.WriteChunkArg{dataID, offset, l.Secondaries, l.Version}
+		err = util.CallTLS(c.tls, l.Primary, "ChunkServer.RPCWriteChunk", wcargs, &gfs.WriteChunkReply{})
+		if !c.redirect(handle, err, i) {
+			return err
+		}
+	}
+}
+
+// redirect reports whether a mutation should be retried because it was sent to a primary
+// which no longer holds the lease. The buffered lease is dropped so that master is asked
+// for the new primary. A mutation is redirected at most gfs.ClientMaxRedirects times.
+func (c *Client) redirect(handle gfs.ChunkHandle, err error, tries int) bool {
+	if !gfs.IsError(err, gfs.ErrNotPrimary) {
+		return false
+	}
+	c.leaseBuf.Invalidate(handle)
+	if tries >= gfs.ClientMaxRedirects {
+		return false
+	}
+	log.Warning("Primary of ", handle, " changed, try the new one: ", err)
+	return true
+}
+
+// pushData sends data to the first replica in the push chain of lease, which forwards it
+// along the chain, and returns the data ID the mutation should refer to.
+// The lease is dropped if the push fails, so a retry asks master for the current replicas.
+func (c *Client) pushData(handle gfs.ChunkHandle, l *gfs.Lease, data []byte) (gfs.DataBufferID, error) {
 	dataID := chunkserver.NewDataID(handle)
-	chain := append(l.Secondaries, l.Primary)
+	chain := l.Chain
+	if len(chain) == 0 {
+		chain = append(append([]gfs.ServerAddress(nil), l.Secondaries...), l.Primary)
+	}
 
-	var d gfs.ForwardDataReply
-	err = util.Call(chain[0], "ChunkServer.RPCForwardData", gfs.ForwardDataArg{dataID, data, chain[1:]}, &d)
+	var d gfs.PushDataReply
+	err := util.CallTLS(c.tls, chain[0], "ChunkServer.RPCPushData", gfs.PushDataArg{dataID, data, chain[1:]}, &d)
 	if err != nil {
-		return err
+		c.leaseBuf.Invalidate(handle)
+		return dataID, fmt.Errorf("push data %v to %v: %v", dataID, chain[0], err)
 	}
-
-	wcargs := gfs.WriteChunkArg{dataID, offset, l.Secondaries}
-	err = util.Call(l.Primary, "ChunkServer.RPCWriteChunk", wcargs, &gfs.WriteChunkReply{})
-	return err
+	return dataID, nil
 }
 
 // AppendChunk appends data to a chunk.
 // Chunk offset of the start of data will be returned if success.
 // <code>len(data)</code> should be within 1/4 chunk size.
+// If the primary no longer holds the lease, the append is retried on the new primary.
 func (c *Client) AppendChunk(handle gfs.ChunkHandle, data []byte) (offset gfs.Offset, err error) {
-	if len(data) > gfs.MaxAppendSize {
-		return 0, gfs.Error{gfs.UnknownError, fmt.Sprintf("len(data) = %v > max append size %v", len(data), gfs.MaxAppendSize)}
-	}
-
-	//log.Infof("Client : get lease ")
+	return c.appendChunk(handle, data, newRecordID())
+}
 
-	l, err := c.leaseBuf.Get(handle)
-	if err != nil {
-		return -1, gfs.Error{gfs.UnknownError, err.Error()}
+// newRecordID returns a random ID of a record append, which is never 0
+func newRecordID() uint64 {
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
 	}
+}
 
-	dataID := chunkserver.NewDataID(handle)
-	chain := append(l.Secondaries, l.Primary)
-
-	//log.Warning("Client : get locations %v", chain)
-	var d gfs.ForwardDataReply
-	err = util.Call(chain[0], "ChunkServer.RPCForwardData", gfs.ForwardDataArg{dataID, data, chain[1:]}, &d)
+// appendChunk is AppendChunk of the record id, the chunk does not append it again
+// if it is appended already. The append is at least once if id is 0.
+func (c *Client) appendChunk(handle gfs.ChunkHandle, data []byte, id uint64) (offset gfs.Offset, err error) {
+	chunkSize, err := c.ChunkSize()
 	if err != nil {
-		return -1, gfs.Error{gfs.UnknownError, err.Error()}
+		return 0, gfs.Error{gfs.UnknownError, err.Error()}
+	}
+	if gfs.Offset(len(data)) > chunkSize/4 {
+		return 0, gfs.ErrAppendExceedMaxSize
 	}
 
-	//log.Warning("Client : send append request to primary. data : %v", dataID)
+	//log.Infof("Client : get lease ")
 
 	var a gfs.AppendChunkReply
-	acargs := gfs.AppendChunkArg{dataID, l.Secondaries}
-	err = util.Call(l.Primary, "ChunkServer.RPCAppendChunk", acargs, &a)
-	if err != nil {
-		return -1, gfs.Error{gfs.UnknownError, err.Error()}
+	for i := 0; ; i++ {
+		l, err := c.leaseBuf.Get(handle, c.zone)
+		if err != nil {
+			return -1, gfs.Error{gfs.UnknownError, err.Error()}
+		}
+
+		dataID, err := c.pushData(handle, l, data)
+		if err != nil {
+			return -1, gfs.Error{gfs.UnknownError, err.Error()}
+		}
+
+		//log.Warning("Client : send append request to primary. data : %v", dataID)
+
+		acargs := gfs.AppendChunkArg{dataID, l.Secondaries, l.Version, gfs.AtLeastOnce, id}
+		if id != 0 {
+			acargs.Mode = gfs.ExactlyOnce
+		}
+		err = util.CallTLS(c.tls, l.Primary, "ChunkServer.RPCAppendChunk", acargs, &a)
+		if err == nil {
+			break
+		}
+		if !c.redirect(handle, err, i) {
+			return -1, gfs.Error{gfs.UnknownError, err.Error()}
+		}
 	}
 	if a.ErrorCode == gfs.AppendExceedChunkSize {
 		return a.Offset, gfs.Error{a.ErrorCode, "append over chunks"}
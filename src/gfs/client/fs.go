@@ -0,0 +1,189 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"gfs"
+	"gfs/util"
+)
+
+// FS returns a read-only fs.FS over the namespace of c, so goGFS can be used by standard
+// library tools such as http.FileServer and template.ParseFS. Names are relative to the root
+// of the namespace, e.g. "a/b.txt" is "/a/b.txt". It also implements fs.ReadDirFS and fs.StatFS.
+func FS(c *Client) fs.FS {
+	return &gfsFS{c: c}
+}
+
+type gfsFS struct {
+	c *Client
+}
+
+// gfsPath returns the path of name in the namespace
+func gfsPath(op, name string) (gfs.Path, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return gfs.Path("/" + name), nil
+}
+
+// pathError translates the errors of goGFS to those of io/fs
+func pathError(op, name string, err error) error {
+	switch {
+	case gfs.IsError(err, gfs.ErrNotExist):
+		err = fs.ErrNotExist
+	case gfs.IsError(err, gfs.ErrAlreadyExists):
+		err = fs.ErrExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open opens a file for sequential reads, or a directory for ReadDir
+func (fsys *gfsFS) Open(name string) (fs.File, error) {
+	info, err := fsys.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.isDir {
+		return &dirFile{fsys: fsys, name: name, info: info}, nil
+	}
+
+	chunkSize, err := fsys.c.ChunkSize()
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	p, _ := gfsPath("open", name)
+	r := &Reader{c: fsys.c, path: p, length: info.size, chunkSize: chunkSize}
+	return &file{Reader: r, info: info}, nil
+}
+
+// Stat returns the info of a file or directory from master
+func (fsys *gfsFS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.stat("stat", name)
+}
+
+func (fsys *gfsFS) stat(op, name string) (*fileInfo, error) {
+	p, err := gfsPath(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == "/" { // the root has no metadata
+		return &fileInfo{name: ".", isDir: true}, nil
+	}
+
+	var f gfs.GetFileInfoReply
+	err = util.CallTLS(fsys.c.tls, fsys.c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: p}, &f)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return &fileInfo{name: path.Base(name), size: f.Length, isDir: f.IsDir, modTime: f.Mtime}, nil
+}
+
+// ReadDir lists a directory sorted by name
+func (fsys *gfsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := gfsPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := fsys.c.List(p)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, len(ls))
+	for i, v := range ls {
+		entries[i] = &dirEntry{fsys: fsys, name: path.Join(name, v.Name), info: v}
+	}
+	return entries, nil
+}
+
+// fileInfo implements fs.FileInfo
+type fileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// dirEntry implements fs.DirEntry, the full info is got from master when asked for
+type dirEntry struct {
+	fsys *gfsFS
+	name string // name in fsys
+	info gfs.PathInfo
+}
+
+func (e *dirEntry) Name() string               { return e.info.Name }
+func (e *dirEntry) IsDir() bool                { return e.info.IsDir }
+func (e *dirEntry) Info() (fs.FileInfo, error) { return e.fsys.Stat(e.name) }
+func (e *dirEntry) Type() fs.FileMode {
+	if e.info.IsDir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+// file is an opened file, read from the beginning
+type file struct {
+	*Reader
+	info *fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return nil }
+
+// dirFile is an opened directory, which is listed on the first ReadDir
+type dirFile struct {
+	fsys    *gfsFS
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all the rest if n <= 0
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if n <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	ret := d.entries[:n]
+	d.entries = d.entries[n:]
+	return ret, nil
+}
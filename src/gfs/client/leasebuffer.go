@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"gfs"
 	"gfs/util"
 	"sync"
@@ -11,17 +12,19 @@ import (
 type leaseBuffer struct {
 	sync.RWMutex
 	master gfs.ServerAddress
+	tls    *tls.Config
 	buffer map[gfs.ChunkHandle]*gfs.Lease
 	tick   time.Duration
 }
 
 // newLeaseBuffer returns a leaseBuffer.
 // The downloadBuffer will cleanup expired items every tick.
-func newLeaseBuffer(ms gfs.ServerAddress, tick time.Duration) *leaseBuffer {
+func newLeaseBuffer(ms gfs.ServerAddress, config *tls.Config, tick time.Duration) *leaseBuffer {
 	buf := &leaseBuffer{
 		buffer: make(map[gfs.ChunkHandle]*gfs.Lease),
 		tick:   tick,
 		master: ms,
+		tls:    config,
 	}
 
 	// cleanup
@@ -43,19 +46,23 @@ func newLeaseBuffer(ms gfs.ServerAddress, tick time.Duration) *leaseBuffer {
 	return buf
 }
 
-func (buf *leaseBuffer) Get(handle gfs.ChunkHandle) (*gfs.Lease, error) {
+// Get returns the lease of a chunk, asking master for one if it is not buffered.
+// The data push chain of a new lease starts from the replica nearest to zone.
+func (buf *leaseBuffer) Get(handle gfs.ChunkHandle, zone string) (*gfs.Lease, error) {
 	buf.Lock()
 	defer buf.Unlock()
 	lease, ok := buf.buffer[handle]
 
-	if !ok { // ask master to send one
+	// an expired lease may not be cleaned up yet, and the master may have
+	// granted a new one to another replica (e.g. after a snapshot)
+	if !ok || lease.Expire.Before(time.Now()) { // ask master to send one
 		var l gfs.GetPrimaryAndSecondariesReply
-		err := util.Call(buf.master, "Master.RPCGetPrimaryAndSecondaries", gfs.GetPrimaryAndSecondariesArg{handle}, &l)
+		err := util.CallTLS(buf.tls, buf.master, "Master.RPCGetPrimaryAndSecondaries", gfs.GetPrimaryAndSecondariesArg{handle, zone}, &l)
 		if err != nil {
 			return nil, err
 		}
 
-		lease = &gfs.Lease{l.Primary, l.Expire, l.Secondaries}
+		lease = &gfs.Lease{l.Primary, l.Expire, l.Secondaries, l.Chain, l.Version}
 		buf.buffer[handle] = lease
 		return lease, nil
 	}
@@ -69,3 +76,10 @@ func (buf *leaseBuffer) Get(handle gfs.ChunkHandle) (*gfs.Lease, error) {
 	*/
 	return lease, nil
 }
+
+// Invalidate drops the buffered lease of a chunk, e.g. after a replica fails
+func (buf *leaseBuffer) Invalidate(handle gfs.ChunkHandle) {
+	buf.Lock()
+	defer buf.Unlock()
+	delete(buf.buffer, handle)
+}
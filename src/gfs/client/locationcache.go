@@ -0,0 +1,140 @@
+package client
+
+import (
+	"crypto/tls"
+	"gfs"
+	"gfs/util"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type locationKey struct {
+	path  gfs.Path
+	index gfs.ChunkIndex
+}
+
+type chunkLocation struct {
+	handle    gfs.ChunkHandle
+	locations []gfs.ServerAddress
+	hole      bool // no replica until the chunk is written, see gfs.GetReplicasReply
+	expire    time.Time
+}
+
+// locationCache caches the handle and replicas of chunks, so that reads don't
+// ask master every time.
+type locationCache struct {
+	sync.RWMutex
+	master  gfs.ServerAddress
+	tls     *tls.Config
+	buffer  map[locationKey]*chunkLocation
+	ttl     time.Duration
+	lookups int64 // number of lookups sent to master
+}
+
+// newLocationCache returns a locationCache whose items expire after ttl.
+// Expired items are cleaned up every ttl.
+func newLocationCache(ms gfs.ServerAddress, config *tls.Config, ttl time.Duration) *locationCache {
+	cache := &locationCache{
+		master: ms,
+		tls:    config,
+		buffer: make(map[locationKey]*chunkLocation),
+		ttl:    ttl,
+	}
+
+	// cleanup
+	go func() {
+		ticker := time.Tick(ttl)
+		for {
+			<-ticker
+			now := time.Now()
+			cache.Lock()
+			for k, item := range cache.buffer {
+				if item.expire.Before(now) {
+					delete(cache.buffer, k)
+				}
+			}
+			cache.Unlock()
+		}
+	}()
+
+	return cache
+}
+
+// Get returns the handle and replicas of the index-th chunk of path, asks master if it is not cached.
+// If zone is set, replicas closer to zone come first.
+func (cache *locationCache) Get(path gfs.Path, index gfs.ChunkIndex, zone string) (*chunkLocation, error) {
+	key := locationKey{path, index}
+	cache.RLock()
+	loc, ok := cache.buffer[key]
+	cache.RUnlock()
+	if ok && loc.expire.After(time.Now()) {
+		return loc, nil
+	}
+
+	atomic.AddInt64(&cache.lookups, 1)
+	handle, err := cache.getChunkHandle(path, index)
+	if err != nil {
+		return nil, err
+	}
+	var l gfs.GetReplicasReply
+	err = util.CallTLS(cache.tls, cache.master, "Master.RPCGetReplicas", gfs.GetReplicasArg{Handle: handle, ClientZone: zone}, &l)
+	if err != nil {
+		return nil, err
+	}
+
+	loc = &chunkLocation{handle, l.Locations, l.Hole, time.Now().Add(cache.ttl)}
+	cache.Lock()
+	cache.buffer[key] = loc
+	cache.Unlock()
+	return loc, nil
+}
+
+// getChunkHandle asks master for the handle of a chunk. Master refuses new chunks while
+// the cluster is degraded, the request is retried with exponential backoff at most
+// gfs.RPCMaxRetries times then, so the clients back off rather than pile on.
+func (cache *locationCache) getChunkHandle(path gfs.Path, index gfs.ChunkIndex) (gfs.ChunkHandle, error) {
+	backoff := gfs.RPCRetryBackoff
+	for i := 0; ; i++ {
+		var h gfs.GetChunkHandleReply
+		err := util.CallTLS(cache.tls, cache.master, "Master.RPCGetChunkHandle", gfs.GetChunkHandleArg{path, index}, &h)
+		if err == nil || i >= gfs.RPCMaxRetries || !gfs.IsError(err, gfs.ErrClusterDegraded) {
+			return h.Handle, err
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > gfs.RPCRetryMaxBackoff {
+			backoff = gfs.RPCRetryMaxBackoff
+		}
+	}
+}
+
+// Refresh asks master for the current replicas of a cached chunk, e.g. when all the
+// cached ones fail. It does not wait for the item to expire, and keeps the handle,
+// so the chunk is not looked up by path again.
+func (cache *locationCache) Refresh(path gfs.Path, index gfs.ChunkIndex, handle gfs.ChunkHandle, zone string) (*chunkLocation, error) {
+	atomic.AddInt64(&cache.lookups, 1)
+	var l gfs.GetReplicasReply
+	err := util.CallTLS(cache.tls, cache.master, "Master.RPCGetReplicas", gfs.GetReplicasArg{Handle: handle, ClientZone: zone}, &l)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := &chunkLocation{handle, l.Locations, l.Hole, time.Now().Add(cache.ttl)}
+	cache.Lock()
+	cache.buffer[locationKey{path, index}] = loc
+	cache.Unlock()
+	return loc, nil
+}
+
+// Invalidate drops the cached location of the index-th chunk of path
+func (cache *locationCache) Invalidate(path gfs.Path, index gfs.ChunkIndex) {
+	cache.Lock()
+	defer cache.Unlock()
+	delete(cache.buffer, locationKey{path, index})
+}
+
+// Lookups returns the number of lookups sent to master
+func (cache *locationCache) Lookups() int64 {
+	return atomic.LoadInt64(&cache.lookups)
+}
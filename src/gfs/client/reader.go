@@ -0,0 +1,101 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gfs"
+	"gfs/util"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Reader reads a file sequentially from the beginning, it implements io.Reader.
+// The handle and replicas of the current chunk are kept, and looked up again only
+// when the reader moves to the next chunk or a read from the replicas fails.
+type Reader struct {
+	c         *Client
+	path      gfs.Path
+	length    int64      // length of file when it is opened
+	chunkSize gfs.Offset // chunk size of master
+	offset    gfs.Offset // position of the next read
+	index     gfs.ChunkIndex
+	loc       *chunkLocation // replicas of chunk index, nil until the first read
+}
+
+// OpenReader is a client API, opens a file for sequential reads.
+// The reader stops at the length of file when it is opened.
+func (c *Client) OpenReader(path gfs.Path) (*Reader, error) {
+	var f gfs.GetFileInfoReply
+	err := util.CallTLS(c.tls, c.master, "Master.RPCGetFileInfo", gfs.GetFileInfoArg{Path: path}, &f)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsDir {
+		return nil, fmt.Errorf("%v is a directory", path)
+	}
+
+	chunkSize, err := c.ChunkSize()
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{c: c, path: path, length: f.Length, chunkSize: chunkSize}, nil
+}
+
+// Read reads up to len(p) bytes at the current position, which is moved by the
+// bytes read. A read never spans two chunks, so it may return fewer bytes than asked.
+// It returns io.EOF at the end of file.
+func (r *Reader) Read(p []byte) (int, error) {
+	if int64(r.offset) >= r.length {
+		return 0, io.EOF
+	}
+	if rest := r.length - int64(r.offset); int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	chunkOffset := r.offset % r.chunkSize
+	if rest := r.chunkSize - chunkOffset; gfs.Offset(len(p)) > rest {
+		p = p[:rest]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	index := gfs.ChunkIndex(r.offset / r.chunkSize)
+	if r.loc == nil || index != r.index {
+		loc, err := r.c.locCache.Get(r.path, index, r.c.zone)
+		if err != nil {
+			return 0, err
+		}
+		r.loc, r.index = loc, index
+	}
+
+	// the replicas may be moved or lost, look them up again until timeout
+	wait := time.NewTimer(gfs.ClientTryTimeout)
+	defer wait.Stop()
+	for {
+		var n int
+		var err error
+		r.loc, n, err = r.c.readLocation(r.path, index, r.loc, chunkOffset, p)
+		if e, ok := err.(gfs.Error); err == nil || ok && e.Code == gfs.ReadEOF {
+			// a chunk shorter than the file is followed by a hole, which reads as zero
+			for i := n; i < len(p); i++ {
+				p[i] = 0
+			}
+			r.offset += gfs.Offset(len(p))
+			return len(p), nil
+		}
+		log.Warning("Read ", r.loc.handle, " connection error, try again: ", err)
+
+		select {
+		case <-wait.C:
+			return 0, gfs.Error{gfs.Timeout, "Read Timeout: " + err.Error()}
+		case <-time.After(50 * time.Millisecond):
+		}
+		r.c.locCache.Invalidate(r.path, index)
+		loc, err := r.c.locCache.Get(r.path, index, r.c.zone)
+		if err != nil {
+			return 0, err
+		}
+		r.loc = loc
+	}
+}
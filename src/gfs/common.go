@@ -1,6 +1,11 @@
 package gfs
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
 
 type Path string
 type ServerAddress string
@@ -19,6 +24,8 @@ type Lease struct {
 	Primary     ServerAddress
 	Expire      time.Time
 	Secondaries []ServerAddress
+	Chain       []ServerAddress // all replicas in the order to push data
+	Version     ChunkVersion    // version of the chunk when the lease is granted
 }
 
 type PersistentChunkInfo struct {
@@ -26,6 +33,11 @@ type PersistentChunkInfo struct {
 	Length   Offset
 	Version  ChunkVersion
 	Checksum Checksum
+
+	BlockChecksums []uint32 // crc32 of every ChecksumBlockSize block, only stored on chunkserver disk
+	Compressed     bool     // the chunk file is compressed, only stored on chunkserver disk
+	BlockEnds      []int64  // end offset of every compressed block in the chunk file
+	Hole           bool     // no replica is created until the chunk is written, only stored on master
 }
 
 type PathInfo struct {
@@ -39,12 +51,91 @@ type PathInfo struct {
 	Chunks int64
 }
 
+// ChunkMove is a replica of chunk moved from one chunkserver to another by rebalancing
+type ChunkMove struct {
+	Handle ChunkHandle
+	From   ServerAddress
+	To     ServerAddress
+}
+
+// WalkEntry is a file or directory returned by a tree walk
+type WalkEntry struct {
+	Path  Path
+	IsDir bool
+
+	// if it is a file
+	Length int64
+	Chunks int64
+
+	Mtime time.Time
+}
+
+type TaskStatus struct {
+	Name         string
+	LastRunAt    time.Time
+	LastDuration time.Duration
+	LastError    string
+	RunCount     int64
+	ErrorCount   int64
+}
+
+// ChunkServerStats is reported by chunkserver in heartbeat.
+// Latencies are the most recent samples, counters are accumulated since start.
+type ChunkServerStats struct {
+	ReadLatencyMs  []float64
+	WriteLatencyMs []float64
+	ChunksServed   int64 // reads served
+	WriteOps       int64 // writes and appends applied
+	ReadBytes      int64
+	WriteBytes     int64
+}
+
+type ServerStatSummary struct {
+	Address               ServerAddress
+	P50ReadLatencyMs      float64
+	P95ReadLatencyMs      float64
+	P99ReadLatencyMs      float64
+	P50WriteLatencyMs     float64
+	AvgChunksServedPerSec float64
+	TotalReadBytes        int64
+	TotalWriteBytes       int64
+}
+
+// ChunkServerInfo is what master knows about a live chunkserver
+type ChunkServerInfo struct {
+	Address       ServerAddress
+	Zone          string
+	LastHeartbeat time.Time
+	Registered    time.Time // time of the first heartbeat since the server starts
+	Chunks        int
+	UsedBytes     int64
+	FreeBytes     int64
+	Draining      bool    // being decommissioned
+	CopiesSent    int64   // copies sent as the source of re-replication
+	Load          float64 // recent reads and writes per second
+}
+
+// AppendMode is the guarantee of a record append that is retried, see AppendArg
+type AppendMode int
+
+const (
+	// AtLeastOnce never loses an acknowledged record, but a retry after a lost reply
+	// may append it again. Nothing is kept for the record and master is updated in
+	// background, so it is the cheapest.
+	AtLeastOnce AppendMode = iota
+	// ExactlyOnce appends a record once through the retries of its ID. The replicas
+	// remember the IDs, and master confirms the length of file before the append returns,
+	// which costs a round trip to master and lowers the throughput of a single appender.
+	ExactlyOnce
+)
+
 type MutationType int
 
 const (
 	MutationWrite = iota
 	MutationAppend
 	MutationPad
+	MutationTruncate
 )
 
 type ErrorCode int
@@ -57,6 +148,24 @@ const (
 	WriteExceedChunkSize
 	ReadEOF
 	NotAvailableForCopy
+	AlreadyReplicated
+	AppendExceedMaxSize
+	NoSpace
+	ChecksumMismatch
+	AlreadyExists
+	NotExist
+	TruncateExceedLength
+	DataNotFound
+	NotPrimary
+	ReadOnly
+	QuotaExceeded
+	FileTooLarge
+	LeaseGrace
+	ClusterDegraded
+	ChunkGap
+	TooStale
+	ServerBusy
+	LengthNotUpdated
 )
 
 // extended error type with error code
@@ -69,6 +178,68 @@ func (e Error) Error() string {
 	return e.Err
 }
 
+// Is reports whether e has the same code as target, so errors.Is works on errors built from sentinels
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.Code == e.Code
+}
+
+// PartialReadError is returned by a read spanning several chunks when a chunk cannot
+// be read from any replica. The data before Offset is read, and the read can be
+// retried from Offset.
+type PartialReadError struct {
+	Read   int         // bytes read before the failed chunk
+	Offset Offset      // file offset where the read fails
+	Handle ChunkHandle // the failed chunk, 0 if its replicas cannot be found
+	Err    error
+}
+
+func (e PartialReadError) Error() string {
+	return fmt.Sprintf("read %v bytes, then chunk %v fails at offset %v: %v", e.Read, e.Handle, e.Offset, e.Err)
+}
+
+func (e PartialReadError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	ErrAlreadyReplicated    = Error{AlreadyReplicated, "chunk is already fully replicated"}
+	ErrAppendExceedMaxSize  = Error{AppendExceedMaxSize, "append data exceeds max append size (1/4 chunk size)"}
+	ErrNoSpace              = Error{NoSpace, "no space left on chunkservers"}
+	ErrChecksumMismatch     = Error{ChecksumMismatch, "chunk data does not match its checksum"}
+	ErrAlreadyExists        = Error{AlreadyExists, "already exists"}
+	ErrNotExist             = Error{NotExist, "does not exist"}
+	ErrTruncateExceedLength = Error{TruncateExceedLength, "truncate length exceeds file length"}
+	ErrDataNotFound         = Error{DataNotFound, "is not in download buffer, it may be evicted or expired"}
+	ErrNotPrimary           = Error{NotPrimary, "is not held by the server, ask master for the primary"}
+	ErrReadOnly             = Error{ReadOnly, "shadow master is read-only"}
+	ErrQuotaExceeded        = Error{QuotaExceeded, "exceeds its quota"}
+	ErrFileTooLarge         = Error{FileTooLarge, "has as many chunks as a file may have"}
+	ErrTimeout              = Error{Timeout, "timed out waiting for a lock"}
+	ErrLeaseGrace           = Error{LeaseGrace, "has no lease granted until the leases before master restarts expire"}
+	ErrClusterDegraded      = Error{ClusterDegraded, "cluster is degraded, no new chunk is allocated until it recovers"}
+	ErrChunkGap             = Error{ChunkGap, "has no chunk right before the index, sparse files are disabled"}
+	ErrTooStale             = Error{TooStale, "shadow master is too far behind, read from master"}
+	ErrServerBusy           = Error{ServerBusy, "is busy sending copies, copy from another replica"}
+	ErrLengthNotUpdated     = Error{LengthNotUpdated, "is written, but master is not told its new length"}
+)
+
+// PathError returns err about path p, e.g. "path /foo/bar does not exist".
+// Its message ends with the message of err, see IsError.
+func PathError(p Path, err Error) Error {
+	return Error{err.Code, fmt.Sprintf("path %s %s", p, err.Err)}
+}
+
+// IsError reports whether err is target. An error returned by RPC only keeps its message,
+// so it is target if the message ends with the message of target, which is the convention
+// of the errors built from sentinels such as PathError.
+func IsError(err error, target Error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, target) || strings.HasSuffix(err.Error(), target.Err)
+}
+
 var (
 	Debug int
 )
@@ -81,22 +252,64 @@ const (
 	MinimumNumReplicas = 2
 	MaxChunkSize       = 32 << 20 // 512KB DEBUG ONLY 64 << 20
 	MaxAppendSize      = MaxChunkSize / 4
+	ChecksumBlockSize  = 64 << 10
 	DeletedFilePrefix  = "__del__"
 
 	// master
 	ServerCheckInterval = 400 * time.Millisecond //
 	MasterStoreInterval = 30 * time.Hour         // 30 * time.Minute
 	ServerTimeout       = 1 * time.Second
+	DeadServerChecks    = 2 // consecutive server checks a silent server fails before it is removed
+	RebalanceInterval   = 1 * time.Second
+	ReplicaScanInterval = 1 * time.Second
+	ReplicaScanBatch    = 1024             // chunks checked for missing replicas in one scan
+	OperationLogTail    = 4096             // logged operations kept in memory for shadow masters
+	RebalanceMaxMoves   = 2                // chunks moved in one rebalance cycle
+	RebalanceThreshold  = 0.2              // a server is overloaded if it holds 20% more chunks than average
+	MinFreeSpace        = 2 * MaxChunkSize // default free space of a server, with less it gets no new chunks
+	MaxConcurrentCopies = 8                // chunks re-replicated at once
+	MaxFileChunks       = 1 << 16          // chunks a file may have unless it is created with its own limit
+	LoadDecay           = 2 * time.Second  // time constant of the moving average of server load
+	LoadSlack           = 1.0              // servers whose loads differ less (ops per second) are as busy
+	MasterGCInterval    = 1 * time.Minute
+	MasterLockTimeout   = 10 * time.Second // an rpc gives up waiting for metadata locks after this long
+	DeletedFileExpire   = 1 * time.Hour    // 3 * 24 * time.Hour
+	WalkPageSize        = 1000             // entries returned by one RPCWalk if no limit is given
+	MasterDrainTimeout  = 5 * time.Second  // shutdown waits this long for the rpcs in flight
+	MaxNeedList         = 1024             // no new chunk is allocated while more chunks wait for re-replication
+	LogCompactSize      = 64 << 20         // the operation log is compacted by a checkpoint once it is longer
+	LogCompactRecords   = 1 << 16          // or once this many operations are logged since the last checkpoint
+	MismatchHalfLife    = 10 * time.Minute // checksum mismatches counted for a replica halve every half-life
+	MismatchQuarantine  = 3                // a replica is quarantined once this many mismatches are counted
+	QuarantineTime      = 1 * time.Hour    // a quarantined server gets no replica of the chunk for this long
+
+	// shadow master
+	ShadowPollInterval       = 200 * time.Millisecond // tail the operation log of master
+	ShadowCheckpointInterval = 10 * time.Second       // reload all metadata, chunk locations are not logged
 
 	// chunk server
 	HeartbeatInterval    = 200 * time.Millisecond
 	MutationWaitTimeout  = 4 * time.Second
 	ServerStoreInterval  = 40 * time.Hour // 30 * time.Minute
-	GarbageCollectionInt = 30 * time.Hour // 1 * time.Day
 	DownloadBufferExpire = 2 * time.Minute
 	DownloadBufferTick   = 30 * time.Second
+	DownloadBufferSize   = 256 << 20       // max bytes of pushed data kept by a chunkserver
+	ScrubInterval        = 1 * time.Second // a chunk is scrubbed for bit rot every interval
+	AppendDedupWindow    = 1024            // record IDs of the latest appends remembered per chunk, see AppendArg
+	ScrubRate            = 4 << 20         // bytes per second read by scrubbing
+	MaxSendCopies        = 4               // copies sent by a chunkserver at once, the rest are rejected
+	StatsWindowSize      = 128
+
+	// rpc
+	RPCRetryBackoff    = 50 * time.Millisecond // first backoff of CallWithRetry, doubled every retry
+	RPCRetryMaxBackoff = 1 * time.Second
+	RPCMaxRetries      = 3
+	RPCMaxIdleConns    = 4 // idle connections kept to one server
+	RPCIdleTimeout     = 30 * time.Second
 
 	// client
-	ClientTryTimeout = 2*LeaseExpire + 3*ServerTimeout
-	LeaseBufferTick  = 500 * time.Millisecond
+	ClientTryTimeout   = 2*LeaseExpire + 3*ServerTimeout
+	ClientMaxRedirects = 3 // times a mutation is retried on a new primary
+	LeaseBufferTick    = 500 * time.Millisecond
+	LocationCacheTTL   = 2 * time.Second
 )
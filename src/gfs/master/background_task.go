@@ -0,0 +1,106 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gfs"
+)
+
+// BackgroundTask is a job that master runs periodically in background
+type BackgroundTask interface {
+	Name() string
+	Interval() time.Duration
+	Run() error
+}
+
+// periodicTask wraps a function as a BackgroundTask
+type periodicTask struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+func (t *periodicTask) Name() string            { return t.name }
+func (t *periodicTask) Interval() time.Duration { return t.interval }
+func (t *periodicTask) Run() error              { return t.run() }
+
+// taskStatusMap records the outcome of every run of background tasks
+type taskStatusMap struct {
+	sync.RWMutex
+	status map[string]*gfs.TaskStatus
+}
+
+func newTaskStatusMap() *taskStatusMap {
+	return &taskStatusMap{
+		status: make(map[string]*gfs.TaskStatus),
+	}
+}
+
+// record updates the status of a task after it runs
+func (tm *taskStatusMap) record(name string, start time.Time, err error) {
+	tm.Lock()
+	defer tm.Unlock()
+
+	st, ok := tm.status[name]
+	if !ok {
+		st = &gfs.TaskStatus{Name: name}
+		tm.status[name] = st
+	}
+	st.LastRunAt = start
+	st.LastDuration = time.Since(start)
+	st.RunCount++
+	if err != nil {
+		st.LastError = err.Error()
+		st.ErrorCount++
+	} else {
+		st.LastError = ""
+	}
+}
+
+// GetAll returns the status of all tasks, sorted by name
+func (tm *taskStatusMap) GetAll() []gfs.TaskStatus {
+	tm.RLock()
+	defer tm.RUnlock()
+
+	ret := make([]gfs.TaskStatus, 0, len(tm.status))
+	for _, v := range tm.status {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// RegisterBackgroundTask runs t every t.Interval() until master shuts down.
+func (m *Master) RegisterBackgroundTask(t BackgroundTask) {
+	m.tasks.Lock()
+	if _, ok := m.tasks.status[t.Name()]; !ok {
+		m.tasks.status[t.Name()] = &gfs.TaskStatus{Name: t.Name()}
+	}
+	m.tasks.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(t.Interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.shutdown:
+				return
+			case <-ticker.C:
+				m.runTask(t)
+			}
+		}
+	}()
+}
+
+// runTask runs a background task once and records its outcome
+func (m *Master) runTask(t BackgroundTask) {
+	start := time.Now()
+	err := t.Run()
+	m.tasks.record(t.Name(), start, err)
+	if err != nil {
+		m.config.Logger.Error(fmt.Sprintf("Background error in %v: %v", t.Name(), err))
+	}
+}
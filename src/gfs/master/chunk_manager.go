@@ -1,10 +1,13 @@
 package master
 
 import (
+	"crypto/tls"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unsafe"
 
 	"gfs"
 	"gfs/util"
@@ -20,27 +23,48 @@ type chunkManager struct {
 
 	replicasNeedList []gfs.ChunkHandle // list of handles need a new replicas
 	// (happends when some servers are disconneted)
-	numChunkHandle gfs.ChunkHandle
+	numChunkHandle  gfs.ChunkHandle
+	scanCursor      gfs.ChunkHandle // next chunk checked by ScanReplicas
+	leaseExpire     time.Duration   // lifetime of a granted lease
+	defaultReplicas int             // replicas of a chunk whose file has no factor
+	graceHandle     gfs.ChunkHandle // chunks below it may have a lease granted before master restarts
+	graceUntil      time.Time       // no new lease of those chunks is granted before it
+	lockTimeout     time.Duration   // how long a client request waits for a chunk lock, no limit if 0
+	tls             *tls.Config     // nil if rpc to chunkservers is in plaintext
+	oplog           *operationLog   // new versions are not logged if nil (e.g. during replay)
+
+	mismatches map[gfs.ChunkHandle]map[gfs.ServerAddress]*mismatchInfo // see ReportMismatch
 }
 
 type chunkInfo struct {
-	sync.RWMutex
+	util.RWMutex
 	location []gfs.ServerAddress // set of replica locations
 	primary  gfs.ServerAddress   // primary chunkserver
 	expire   time.Time           // lease expire time
 	version  gfs.ChunkVersion
 	checksum gfs.Checksum
-	path     gfs.Path
+	path     gfs.Path // owner, which keeps the chunk when a shared chunk is copied, protected by cm lock
+	refcount int      // number of files referencing the chunk, protected by cm lock
+	hole     bool     // skipped by a sparse write, no replica until it is written, protected by cm lock
+}
+
+// checksum mismatches reported for a replica
+type mismatchInfo struct {
+	count int       // number of mismatches, halved every gfs.MismatchHalfLife
+	last  time.Time // when count is last halved
+	until time.Time // the replica is quarantined before it
 }
 
 type fileInfo struct {
 	sync.RWMutex
-	handles []gfs.ChunkHandle
+	handles  []gfs.ChunkHandle
+	replicas int // replication factor
 }
 
 type serialChunkInfo struct {
-	Path gfs.Path
-	Info []gfs.PersistentChunkInfo
+	Path     gfs.Path
+	Info     []gfs.PersistentChunkInfo
+	Replicas int
 }
 
 func (cm *chunkManager) Deserialize(files []serialChunkInfo) error {
@@ -50,23 +74,82 @@ func (cm *chunkManager) Deserialize(files []serialChunkInfo) error {
 	now := time.Now()
 	for _, v := range files {
 		log.Info("Master restore files ", v.Path)
-		f := new(fileInfo)
+		f := &fileInfo{replicas: v.Replicas}
 		for _, ck := range v.Info {
 			f.handles = append(f.handles, ck.Handle)
 			log.Info("Master restore chunk ", ck.Handle)
+			if c, ok := cm.chunk[ck.Handle]; ok { // shared with a snapshot
+				c.refcount++
+				continue
+			}
 			cm.chunk[ck.Handle] = &chunkInfo{
 				expire:   now,
 				version:  ck.Version,
 				checksum: ck.Checksum,
+				path:     v.Path,
+				refcount: 1,
+				hole:     ck.Hole,
+			}
+			if ck.Handle >= cm.numChunkHandle {
+				cm.numChunkHandle = ck.Handle + 1
 			}
 		}
-		cm.numChunkHandle += gfs.ChunkHandle(len(v.Info))
 		cm.file[v.Path] = f
 	}
 
 	return nil
 }
 
+// NextHandle returns the handle that will be assigned to the next new chunk
+func (cm *chunkManager) NextHandle() gfs.ChunkHandle {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.numChunkHandle
+}
+
+// SetNextHandle sets the handle of the next new chunk, used when loading metadata.
+func (cm *chunkManager) SetNextHandle(handle gfs.ChunkHandle) {
+	cm.Lock()
+	defer cm.Unlock()
+	if handle > cm.numChunkHandle {
+		cm.numChunkHandle = handle
+	}
+}
+
+// SetVersion raises the version of a chunk to the one of a lease granted before master
+// restarts, which is replayed from the operation log.
+func (cm *chunkManager) SetVersion(handle gfs.ChunkHandle, version gfs.ChunkVersion) {
+	cm.RLock()
+	ck, ok := cm.chunk[handle]
+	cm.RUnlock()
+	if !ok {
+		return
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+	if version > ck.version {
+		ck.version = version
+	}
+}
+
+// logOperation appends op to the operation log
+func (cm *chunkManager) logOperation(op operation) error {
+	if cm.oplog == nil {
+		return nil
+	}
+	return cm.oplog.Append(op)
+}
+
+// StartLeaseGrace refuses new leases of the chunks loaded so far for a lifetime of lease,
+// so a lease granted to them before master restarts expires before another is granted.
+func (cm *chunkManager) StartLeaseGrace() {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.graceHandle = cm.numChunkHandle
+	cm.graceUntil = time.Now().Add(cm.leaseExpire)
+}
+
 func (cm *chunkManager) Serialize() []serialChunkInfo {
 	cm.RLock()
 	defer cm.RUnlock()
@@ -80,24 +163,65 @@ func (cm *chunkManager) Serialize() []serialChunkInfo {
 				Length:   0,
 				Version:  cm.chunk[handle].version,
 				Checksum: 0,
+				Hole:     cm.chunk[handle].hole,
 			})
 		}
 
-		ret = append(ret, serialChunkInfo{Path: k, Info: chunks})
+		ret = append(ret, serialChunkInfo{Path: k, Info: chunks, Replicas: v.replicas})
 	}
 
 	return ret
 }
 
-func newChunkManager() *chunkManager {
+func newChunkManager(leaseExpire time.Duration, config *tls.Config) *chunkManager {
 	cm := &chunkManager{
-		chunk: make(map[gfs.ChunkHandle]*chunkInfo),
-		file:  make(map[gfs.Path]*fileInfo),
+		chunk:           make(map[gfs.ChunkHandle]*chunkInfo),
+		file:            make(map[gfs.Path]*fileInfo),
+		leaseExpire:     leaseExpire,
+		defaultReplicas: gfs.DefaultNumReplicas,
+		tls:             config,
+		mismatches:      make(map[gfs.ChunkHandle]map[gfs.ServerAddress]*mismatchInfo),
 	}
 	log.Info("-----------new chunk manager")
 	return cm
 }
 
+// lockChunk locks ck for a client request of handle, or returns gfs.ErrTimeout if
+// it is held by a slow operation such as a copy longer than lockTimeout
+func (cm *chunkManager) lockChunk(handle gfs.ChunkHandle, ck *chunkInfo, lock func(deadline time.Time) bool) error {
+	var deadline time.Time
+	if cm.lockTimeout > 0 {
+		deadline = time.Now().Add(cm.lockTimeout)
+	}
+	if !lock(deadline) {
+		return gfs.Error{gfs.Timeout, fmt.Sprintf("chunk %v %s", handle, gfs.ErrTimeout.Err)}
+	}
+	return nil
+}
+
+// replicaFactor returns the number of replicas ck needs, which is the replication
+// factor of its owner file. cm should be locked in top caller.
+func (cm *chunkManager) replicaFactor(ck *chunkInfo) int {
+	if f, ok := cm.file[ck.path]; ok && f.replicas > 0 {
+		return f.replicas
+	}
+	return cm.defaultReplicas
+}
+
+// needsReplica reports whether ck has fewer replicas than it needs. It never needs more
+// than servers, the number of chunkservers which may take a replica, and a hole needs none.
+// cm should be locked in top caller.
+func (cm *chunkManager) needsReplica(ck *chunkInfo, servers int) bool {
+	if ck.hole {
+		return false
+	}
+	n := cm.replicaFactor(ck)
+	if n > servers {
+		n = servers
+	}
+	return len(ck.location) < n
+}
+
 // RegisterReplica adds a replica for a chunk
 func (cm *chunkManager) RegisterReplica(handle gfs.ChunkHandle, addr gfs.ServerAddress, useLock bool) error {
 	var ck *chunkInfo
@@ -111,13 +235,20 @@ func (cm *chunkManager) RegisterReplica(handle gfs.ChunkHandle, addr gfs.ServerA
 		ck.Lock()
 		defer ck.Unlock()
 	} else {
+		cm.RLock()
 		ck, ok = cm.chunk[handle]
+		cm.RUnlock()
 	}
 
 	if !ok {
 		return fmt.Errorf("cannot find chunk %v", handle)
 	}
 
+	for _, v := range ck.location {
+		if v == addr { // e.g. the server restarts before it is detected as dead
+			return nil
+		}
+	}
 	ck.location = append(ck.location, addr)
 	return nil
 }
@@ -131,7 +262,386 @@ func (cm *chunkManager) GetReplicas(handle gfs.ChunkHandle) ([]gfs.ServerAddress
 	if !ok {
 		return nil, fmt.Errorf("cannot find chunk %v", handle)
 	}
-	return ck.location, nil
+
+	// quarantined replicas are read only if there is no other
+	quarantined := cm.Quarantined(handle)
+	if len(quarantined) == 0 {
+		return ck.location, nil
+	}
+	var ret []gfs.ServerAddress
+	for _, v := range ck.location {
+		if !containsServer(quarantined, v) {
+			ret = append(ret, v)
+		}
+	}
+	if len(ret) == 0 {
+		return ck.location, nil
+	}
+	return ret, nil
+}
+
+// GetChunkInfo fills reply with what master knows about a chunk, for inspection tools.
+// The chunk is read locked only while its fields are copied.
+func (cm *chunkManager) GetChunkInfo(handle gfs.ChunkHandle, reply *gfs.GetChunkInfoReply) error {
+	cm.RLock()
+	ck, ok := cm.chunk[handle]
+	for _, v := range cm.replicasNeedList {
+		if v == handle {
+			reply.NeedsReplica = true
+			break
+		}
+	}
+	cm.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("cannot find chunk %v", handle)
+	}
+
+	if err := cm.lockChunk(handle, ck, ck.RLockBefore); err != nil {
+		return err
+	}
+	defer ck.RUnlock()
+	reply.Locations = append([]gfs.ServerAddress(nil), ck.location...)
+	reply.Version = ck.version
+	reply.Expire = ck.expire
+	if ck.expire.After(time.Now()) {
+		reply.Primary = ck.primary
+	}
+	return nil
+}
+
+// Locations returns the replicas of all chunks, which are sent to shadow masters
+// since they are not part of the persistent metadata.
+func (cm *chunkManager) Locations() map[gfs.ChunkHandle][]gfs.ServerAddress {
+	cm.RLock()
+	cks := make(map[gfs.ChunkHandle]*chunkInfo, len(cm.chunk))
+	for h, ck := range cm.chunk {
+		cks[h] = ck
+	}
+	cm.RUnlock()
+	return replicasOf(cks)
+}
+
+// SetLocations sets the replicas of chunks known to the manager, others are ignored
+func (cm *chunkManager) SetLocations(locations map[gfs.ChunkHandle][]gfs.ServerAddress) {
+	cm.RLock()
+	defer cm.RUnlock()
+	for h, addrs := range locations {
+		if ck, ok := cm.chunk[h]; ok {
+			ck.Lock()
+			ck.location = addrs
+			ck.Unlock()
+		}
+	}
+}
+
+// Owners returns the files owning handles, i.e. the files written when the chunks are mutated
+func (cm *chunkManager) Owners(handles []gfs.ChunkHandle) []gfs.Path {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	var ret []gfs.Path
+	seen := make(map[gfs.Path]bool)
+	for _, h := range handles {
+		if ck, ok := cm.chunk[h]; ok && !seen[ck.path] {
+			seen[ck.path] = true
+			ret = append(ret, ck.path)
+		}
+	}
+	return ret
+}
+
+// GetPaths returns all file paths whose chunk list references handle.
+// A chunk shared by several files (e.g. after a snapshot) yields several paths.
+func (cm *chunkManager) GetPaths(handle gfs.ChunkHandle) ([]gfs.Path, error) {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	if _, ok := cm.chunk[handle]; !ok {
+		return nil, fmt.Errorf("cannot find chunk %v", handle)
+	}
+
+	var ret []gfs.Path
+	for p, f := range cm.file {
+		for _, h := range f.handles {
+			if h == handle {
+				ret = append(ret, p)
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+// MemoryUsage returns the number of chunks, the number of chunks holding an
+// unexpired lease and a rough estimation of the bytes used by chunk metadata.
+func (cm *chunkManager) MemoryUsage() (chunks, leases int, bytes int64) {
+	var handle gfs.ChunkHandle
+	var addr gfs.ServerAddress
+
+	// chunk locks are not taken under cm lock, GetLeaseHolder locks in the reverse order
+	cm.RLock()
+	cks := make([]*chunkInfo, 0, len(cm.chunk))
+	for _, ck := range cm.chunk {
+		cks = append(cks, ck)
+	}
+	for p, f := range cm.file {
+		bytes += int64(len(p)) + int64(unsafe.Sizeof(p)) + int64(unsafe.Sizeof(*f))
+		bytes += int64(len(f.handles)) * int64(unsafe.Sizeof(handle))
+	}
+	bytes += int64(len(cm.replicasNeedList)) * int64(unsafe.Sizeof(handle))
+	cm.RUnlock()
+
+	now := time.Now()
+	for _, ck := range cks {
+		ck.RLock()
+		if ck.expire.After(now) {
+			leases++
+		}
+		bytes += int64(unsafe.Sizeof(*ck)) + int64(unsafe.Sizeof(handle)) + int64(unsafe.Sizeof(ck))
+		bytes += int64(len(ck.location)) * int64(unsafe.Sizeof(addr))
+		for _, v := range ck.location {
+			bytes += int64(len(v))
+		}
+		bytes += int64(len(ck.path))
+		ck.RUnlock()
+	}
+
+	chunks = len(cks)
+	return
+}
+
+// OldestLease returns the earliest expire time of the unexpired leases,
+// or zero time if no chunk holds a lease.
+func (cm *chunkManager) OldestLease() (oldest time.Time) {
+	// chunk locks are not taken under cm lock, GetLeaseHolder locks in the reverse order
+	cm.RLock()
+	cks := make([]*chunkInfo, 0, len(cm.chunk))
+	for _, ck := range cm.chunk {
+		cks = append(cks, ck)
+	}
+	cm.RUnlock()
+
+	now := time.Now()
+	for _, ck := range cks {
+		// don't wait for the chunks being copied, their leases are revoked
+		if !ck.TryRLock() {
+			continue
+		}
+		if ck.expire.After(now) && (oldest.IsZero() || ck.expire.Before(oldest)) {
+			oldest = ck.expire
+		}
+		ck.RUnlock()
+	}
+	return
+}
+
+// NumChunks returns the number of chunks
+func (cm *chunkManager) NumChunks() int {
+	cm.RLock()
+	defer cm.RUnlock()
+	return len(cm.chunk)
+}
+
+// NeedListLen returns the number of chunks queued for re-replication. Unlike GetNeedlist,
+// it does not drop the satisfied ones, so it is cheap enough for monitoring.
+func (cm *chunkManager) NeedListLen() int {
+	cm.RLock()
+	defer cm.RUnlock()
+	return len(cm.replicasNeedList)
+}
+
+// SetReplicas sets the replication factor of file path, and adds its chunks to need list,
+// which keeps those with fewer replicas in GetNeedlist. The extra replicas are left to trimming.
+func (cm *chunkManager) SetReplicas(path gfs.Path, replicas int) {
+	cm.Lock()
+	defer cm.Unlock()
+	f, ok := cm.file[path]
+	if !ok { // no chunk yet
+		return
+	}
+	f.replicas = replicas
+	cm.replicasNeedList = append(cm.replicasNeedList, f.handles...)
+}
+
+// RenameFiles moves the chunk list of source, and of every file under source
+// if it is a directory, to the corresponding path under target.
+func (cm *chunkManager) RenameFiles(source, target gfs.Path) {
+	cm.Lock()
+	prefix := string(source) + "/"
+	var olds []gfs.Path
+	for p := range cm.file {
+		if p == source || strings.HasPrefix(string(p), prefix) {
+			olds = append(olds, p)
+		}
+	}
+
+	renamed := make(map[gfs.ChunkHandle]gfs.Path)
+	for _, p := range olds {
+		np := target + p[len(source):]
+		f := cm.file[p]
+		delete(cm.file, p)
+		cm.file[np] = f
+		for _, h := range f.handles {
+			renamed[h] = np
+		}
+	}
+
+	for h, np := range renamed {
+		if ck, ok := cm.chunk[h]; ok {
+			ck.path = np
+		}
+	}
+	cm.Unlock()
+}
+
+// RemoveFiles drops the chunk list of p, and of every file under p if it is a directory.
+// It returns the replicas of the chunks no longer referenced by any file.
+func (cm *chunkManager) RemoveFiles(p gfs.Path) map[gfs.ChunkHandle][]gfs.ServerAddress {
+	cm.Lock()
+	prefix := string(p) + "/"
+	removed := make(map[gfs.Path]bool)
+	for fp, f := range cm.file {
+		if fp != p && !strings.HasPrefix(string(fp), prefix) {
+			continue
+		}
+		removed[fp] = true
+		for _, h := range f.handles {
+			if ck, ok := cm.chunk[h]; ok {
+				ck.refcount--
+			}
+		}
+		delete(cm.file, fp)
+	}
+
+	garbage := make(map[gfs.ChunkHandle]*chunkInfo)
+	for fp, f := range cm.file { // shared chunks whose owner is removed
+		for _, h := range f.handles {
+			if ck, ok := cm.chunk[h]; ok && ck.refcount > 0 && removed[ck.path] {
+				ck.path = fp
+			}
+		}
+	}
+	for h, ck := range cm.chunk {
+		if ck.refcount <= 0 {
+			garbage[h] = ck
+			delete(cm.chunk, h)
+			delete(cm.mismatches, h)
+		}
+	}
+	cm.forgetNeeded(garbage)
+	cm.Unlock()
+	return replicasOf(garbage)
+}
+
+// TruncateFile keeps only the first n chunks of file p, and returns the replicas of
+// dropped chunks which are no longer referenced by any file.
+func (cm *chunkManager) TruncateFile(p gfs.Path, n int) map[gfs.ChunkHandle][]gfs.ServerAddress {
+	cm.Lock()
+	garbage := make(map[gfs.ChunkHandle]*chunkInfo)
+	f, ok := cm.file[p]
+	if !ok || n >= len(f.handles) {
+		cm.Unlock()
+		return replicasOf(garbage)
+	}
+
+	dropped := f.handles[n:]
+	f.handles = f.handles[:n:n]
+	shared := make(map[*chunkInfo]bool) // dropped chunks still used by snapshots
+	for _, h := range dropped {
+		ck, ok := cm.chunk[h]
+		if !ok {
+			continue
+		}
+		ck.refcount--
+		if ck.refcount <= 0 {
+			garbage[h] = ck
+			delete(cm.chunk, h)
+			delete(cm.mismatches, h)
+		} else {
+			shared[ck] = true
+		}
+	}
+	for fp, f := range cm.file {
+		for _, h := range f.handles {
+			if ck, ok := cm.chunk[h]; ok && shared[ck] && ck.path == p {
+				ck.path = fp
+			}
+		}
+	}
+	cm.forgetNeeded(garbage)
+	cm.Unlock()
+	return replicasOf(garbage)
+}
+
+// DropFile drops the chunk list of p, which is not a file in namespace, and returns
+// the replicas of its chunks which are no longer referenced by any file
+func (cm *chunkManager) DropFile(p gfs.Path) map[gfs.ChunkHandle][]gfs.ServerAddress {
+	garbage := cm.TruncateFile(p, 0)
+	cm.Lock()
+	delete(cm.file, p)
+	cm.Unlock()
+	return garbage
+}
+
+// FileChunks returns the number of chunks of every file
+func (cm *chunkManager) FileChunks() map[gfs.Path]int64 {
+	cm.RLock()
+	defer cm.RUnlock()
+	ret := make(map[gfs.Path]int64, len(cm.file))
+	for p, f := range cm.file {
+		ret[p] = int64(len(f.handles))
+	}
+	return ret
+}
+
+// RemoveOrphans drops the chunks not referenced by any file, and returns their replicas
+func (cm *chunkManager) RemoveOrphans() map[gfs.ChunkHandle][]gfs.ServerAddress {
+	cm.Lock()
+	referenced := make(map[gfs.ChunkHandle]bool)
+	for _, f := range cm.file {
+		for _, h := range f.handles {
+			referenced[h] = true
+		}
+	}
+	garbage := make(map[gfs.ChunkHandle]*chunkInfo)
+	for h, ck := range cm.chunk {
+		if !referenced[h] {
+			garbage[h] = ck
+			delete(cm.chunk, h)
+			delete(cm.mismatches, h)
+		}
+	}
+	cm.forgetNeeded(garbage)
+	cm.Unlock()
+
+	return replicasOf(garbage)
+}
+
+// forgetNeeded removes the dropped chunks from the need list. cm must be locked.
+func (cm *chunkManager) forgetNeeded(garbage map[gfs.ChunkHandle]*chunkInfo) {
+	if len(garbage) == 0 {
+		return
+	}
+	var list []gfs.ChunkHandle // GetNeedlist hands out the old slice
+	for _, h := range cm.replicasNeedList {
+		if _, ok := garbage[h]; !ok {
+			list = append(list, h)
+		}
+	}
+	cm.replicasNeedList = list
+}
+
+// replicasOf returns the locations of chunks which are already dropped from cm
+func replicasOf(cks map[gfs.ChunkHandle]*chunkInfo) map[gfs.ChunkHandle][]gfs.ServerAddress {
+	ret := make(map[gfs.ChunkHandle][]gfs.ServerAddress)
+	for h, ck := range cks {
+		ck.RLock()
+		ret[h] = append([]gfs.ServerAddress(nil), ck.location...)
+		ck.RUnlock()
+	}
+	return ret
 }
 
 // GetChunk returns the chunk handle for (path, index).
@@ -151,79 +661,76 @@ func (cm *chunkManager) GetChunk(path gfs.Path, index gfs.ChunkIndex) (gfs.Chunk
 	return fileinfo.handles[index], nil
 }
 
+// IsHole reports whether chunk handle is a hole of a sparse file, which has no replica
+// until it is written
+func (cm *chunkManager) IsHole(handle gfs.ChunkHandle) bool {
+	cm.RLock()
+	defer cm.RUnlock()
+	ck, ok := cm.chunk[handle]
+	return ok && ck.hole
+}
+
+// FillHole marks chunk handle as written, after its replicas are created. ck should be
+// locked in top caller, unless the operation log is replayed.
+func (cm *chunkManager) FillHole(handle gfs.ChunkHandle) {
+	cm.Lock()
+	defer cm.Unlock()
+	if ck, ok := cm.chunk[handle]; ok {
+		ck.hole = false
+	}
+}
+
 // GetLeaseHolder returns the chunkserver that hold the lease of a chunk
 // (i.e. primary) and expire time of the lease. If no one has a lease,
-// grants one to a replica it chooses.
-func (cm *chunkManager) GetLeaseHolder(handle gfs.ChunkHandle) (*gfs.Lease, []gfs.ServerAddress, error) {
+// grants one to the replica returned by choose among the up-to-date ones.
+// If the chunk is shared with snapshots, they are moved to a copy of it before
+// the lease is granted, and copied is called with the new chunk.
+func (cm *chunkManager) GetLeaseHolder(handle gfs.ChunkHandle, copied func(handle gfs.ChunkHandle, addrs []gfs.ServerAddress), choose func(handle gfs.ChunkHandle, addrs []gfs.ServerAddress, expire time.Time) gfs.ServerAddress) (*gfs.Lease, []gfs.ServerAddress, error) {
 	cm.RLock()
 	ck, ok := cm.chunk[handle]
+	grace := handle < cm.graceHandle && time.Now().Before(cm.graceUntil)
 	cm.RUnlock()
 
 	if !ok {
 		return nil, nil, fmt.Errorf("invalid chunk handle %v", handle)
 	}
 
-	ck.Lock()
+	if err := cm.lockChunk(handle, ck, ck.LockBefore); err != nil {
+		return nil, nil, err
+	}
 	defer ck.Unlock()
 
 	var staleServers []gfs.ServerAddress
 
 	ret := &gfs.Lease{}
 	if ck.expire.Before(time.Now()) { // grants a new lease
-		// check version
-		ck.version++
-		arg := gfs.CheckVersionArg{handle, ck.version}
-
-		var newlist []string
-		var lock sync.Mutex // lock for newlist
-
-		var wg sync.WaitGroup
-		wg.Add(len(ck.location))
-		for _, v := range ck.location {
-			go func(addr gfs.ServerAddress) {
-				var r gfs.CheckVersionReply
-
-				// TODO distinguish call error and r.Stale
-				err := util.Call(addr, "ChunkServer.RPCCheckVersion", arg, &r)
-				if err == nil && r.Stale == false {
-					lock.Lock()
-					newlist = append(newlist, string(addr))
-					lock.Unlock()
-				} else { // add to garbage collection
-					log.Warningf("detect stale chunk %v in %v (err: %v)", handle, addr, err)
-					staleServers = append(staleServers, addr)
-				}
-				wg.Done()
-			}(v)
-		}
-		wg.Wait()
-
-		//sort.Strings(newlist)
-		ck.location = make([]gfs.ServerAddress, len(newlist))
-		for i := range newlist {
-			ck.location[i] = gfs.ServerAddress(newlist[i])
+		if grace { // the lease granted before restart may still be held
+			return nil, nil, gfs.Error{gfs.LeaseGrace, fmt.Sprintf("chunk %v %v", handle, gfs.ErrLeaseGrace.Err)}
 		}
-		log.Warning(handle, " lease location ", ck.location)
 
-		if len(ck.location) < gfs.MinimumNumReplicas {
-			cm.Lock()
-			cm.replicasNeedList = append(cm.replicasNeedList, handle)
-			cm.Unlock()
-
-			if len(ck.location) == 0 {
-				// !! ATTENTION !!
-				ck.version--
-				return nil, nil, fmt.Errorf("no replica of %v", handle)
+		// copy-on-write, only the owner writes to a shared chunk
+		cm.RLock()
+		shared, owner := ck.refcount > 1, ck.path
+		cm.RUnlock()
+		if shared {
+			newHandle, addrs, err := cm.copyChunk(handle, ck, func(p gfs.Path) bool { return p != owner })
+			if err != nil {
+				return nil, nil, err
+			}
+			if copied != nil {
+				copied(newHandle, addrs)
 			}
 		}
 
-		// TODO choose primary, !!error handle no replicas!!
-		ck.primary = ck.location[0]
-		ck.expire = time.Now().Add(gfs.LeaseExpire)
+		var err error
+		if staleServers, err = cm.grantLease(handle, ck, choose); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	ret.Primary = ck.primary
 	ret.Expire = ck.expire
+	ret.Version = ck.version
 	for _, v := range ck.location {
 		if v != ck.primary {
 			ret.Secondaries = append(ret.Secondaries, v)
@@ -232,76 +739,602 @@ func (cm *chunkManager) GetLeaseHolder(handle gfs.ChunkHandle) (*gfs.Lease, []gf
 	return ret, staleServers, nil
 }
 
-// ExtendLease extends the lease of chunk if the lease holder is primary.
-func (cm *chunkManager) ExtendLease(handle gfs.ChunkHandle, primary gfs.ServerAddress) error {
-	return nil
-	log.Fatal("unsupported ExtendLease")
+// grantLease grants a new lease of a chunk with a new version, which is logged and checked
+// by every replica. The replicas failing the check are dropped from the locations and returned
+// as stale. The primary is chosen among the others by choose, or it is the first of them if
+// choose is nil. ck should be locked in top caller.
+func (cm *chunkManager) grantLease(handle gfs.ChunkHandle, ck *chunkInfo, choose func(handle gfs.ChunkHandle, addrs []gfs.ServerAddress, expire time.Time) gfs.ServerAddress) ([]gfs.ServerAddress, error) {
+	// check version
+	ck.version++
+	arg := gfs.CheckVersionArg{handle, ck.version}
+
+	var newlist []string
+	var staleServers []gfs.ServerAddress
+	var lock sync.Mutex // lock for newlist and staleServers
+
+	var wg sync.WaitGroup
+	wg.Add(len(ck.location))
+	for _, v := range ck.location {
+		go func(addr gfs.ServerAddress) {
+			var r gfs.CheckVersionReply
+
+			// TODO distinguish call error and r.Stale
+			err := util.CallTLS(cm.tls, addr, "ChunkServer.RPCCheckVersion", arg, &r)
+			lock.Lock()
+			if err == nil && r.Stale == false {
+				newlist = append(newlist, string(addr))
+			} else { // add to garbage collection
+				log.Warningf("detect stale chunk %v in %v (err: %v)", handle, addr, err)
+				staleServers = append(staleServers, addr)
+			}
+			lock.Unlock()
+			wg.Done()
+		}(v)
+	}
+	wg.Wait()
+
+	//sort.Strings(newlist)
+	ck.location = make([]gfs.ServerAddress, len(newlist))
+	for i := range newlist {
+		ck.location[i] = gfs.ServerAddress(newlist[i])
+	}
+	log.Warning(handle, " lease location ", ck.location)
+
+	cm.Lock()
+	if len(ck.location) < cm.replicaFactor(ck) {
+		cm.replicasNeedList = append(cm.replicasNeedList, handle)
+	}
+	cm.Unlock()
+
+	if len(ck.location) == 0 {
+		// !! ATTENTION !!
+		ck.version--
+		return staleServers, fmt.Errorf("no replica of %v", handle)
+	}
+
+	// the replicas report the new version when master restarts, it is discarded if unknown
+	if err := cm.logOperation(operation{Type: opSetVersion, Handle: handle, Version: ck.version}); err != nil {
+		return staleServers, err
+	}
+
+	ck.expire = time.Now().Add(cm.leaseExpire)
+	ck.primary = ck.location[0]
+	if choose != nil {
+		ck.primary = choose(handle, ck.location, ck.expire)
+	}
+	return staleServers, nil
+}
+
+// ExtendLease extends the lease of chunk held by requester. An expired or revoked lease is not
+// taken over, as a new lease is granted with a new version by GetLeaseHolder.
+// It returns the new expire time of the lease.
+func (cm *chunkManager) ExtendLease(handle gfs.ChunkHandle, primary gfs.ServerAddress) (time.Time, error) {
 	cm.RLock()
 	ck, ok := cm.chunk[handle]
 	cm.RUnlock()
 
-	ck.Lock()
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid chunk handle %v", handle)
+	}
+
+	// wait for re-replication, which holds the lock during copy
+	if err := cm.lockChunk(handle, ck, ck.LockBefore); err != nil {
+		return time.Time{}, err
+	}
 	defer ck.Unlock()
 
-	if !ok {
-		return fmt.Errorf("invalid chunk handle %v", handle)
+	now := time.Now()
+	if ck.primary != primary || !ck.expire.After(now) {
+		return time.Time{}, fmt.Errorf("%v does not hold the lease for chunk %v", primary, handle)
+	}
+
+	holder := false
+	for _, v := range ck.location {
+		if v == primary {
+			holder = true
+		}
+	}
+	if !holder {
+		return time.Time{}, fmt.Errorf("%v does not hold a replica of chunk %v", primary, handle)
 	}
 
+	ck.expire = now.Add(cm.leaseExpire)
+	return ck.expire, nil
+}
+
+// ExtendLeases extends the leases of handles held by primary, which asks for them in heartbeat.
+// Unlike ExtendLease, it never grants a lease, and the chunks primary no longer holds a lease of
+// are ignored. So are the chunks being re-replicated, rather than blocking the heartbeat during the copy.
+// It returns the chunks whose leases are extended and their new expire time.
+func (cm *chunkManager) ExtendLeases(handles []gfs.ChunkHandle, primary gfs.ServerAddress) ([]gfs.ChunkHandle, time.Time) {
+	cm.RLock()
+	cks := make(map[gfs.ChunkHandle]*chunkInfo, len(handles))
+	for _, h := range handles {
+		if ck, ok := cm.chunk[h]; ok {
+			cks[h] = ck
+		}
+	}
+	cm.RUnlock()
+
+	var extended []gfs.ChunkHandle
 	now := time.Now()
-	if ck.primary != primary && ck.expire.After(now) {
-		return fmt.Errorf("%v does not hold the lease for chunk %v", primary, handle)
+	expire := now.Add(cm.leaseExpire)
+	for h, ck := range cks {
+		if !ck.TryLock() {
+			continue
+		}
+		if ck.primary == primary && ck.expire.After(now) {
+			ck.expire = expire
+			extended = append(extended, h)
+		}
+		ck.Unlock()
 	}
-	ck.primary = primary
-	ck.expire = now.Add(gfs.LeaseExpire)
-	return nil
+	return extended, expire
 }
 
-// CreateChunk creates a new chunk for path. servers for the chunk are denoted by addrs
-// returns the handle of the new chunk, and the servers that create the chunk successfully
-func (cm *chunkManager) CreateChunk(path gfs.Path, addrs []gfs.ServerAddress) (gfs.ChunkHandle, []gfs.ServerAddress, error) {
-	cm.Lock()
-	defer cm.Unlock()
+// RenewLeases grants primary the leases of handles it may hold, for a chunkserver restarting
+// with many of them. A lease is only extended or granted if primary holds an up-to-date replica,
+// i.e. versions[i] is the version of handles[i]. A lease held by primary is extended, and a free
+// one is granted like GetLeaseHolder does, with a new version. A chunk shared with snapshots, or
+// one whose lease may be held before master restarts, is left to GetLeaseHolder. So are the chunks
+// being re-replicated. It returns the handles whose leases are held by primary, the earliest expire
+// time of them, and the stale replicas found by granting leases.
+func (cm *chunkManager) RenewLeases(handles []gfs.ChunkHandle, versions []gfs.ChunkVersion, primary gfs.ServerAddress) ([]gfs.ChunkHandle, time.Time, map[gfs.ChunkHandle][]gfs.ServerAddress, error) {
+	if len(handles) != len(versions) {
+		return nil, time.Time{}, nil, fmt.Errorf("%v handles with %v versions", len(handles), len(versions))
+	}
 
-	handle := cm.numChunkHandle
-	cm.numChunkHandle++
+	var granted []gfs.ChunkHandle
+	var expire time.Time
+	stale := make(map[gfs.ChunkHandle][]gfs.ServerAddress)
+	choose := func(handle gfs.ChunkHandle, addrs []gfs.ServerAddress, expire time.Time) gfs.ServerAddress {
+		if containsServer(addrs, primary) {
+			return primary
+		}
+		return addrs[0]
+	}
+	for i, h := range handles {
+		now := time.Now()
+		cm.RLock()
+		ck, ok := cm.chunk[h]
+		grace := h < cm.graceHandle && now.Before(cm.graceUntil)
+		shared := ok && ck.refcount > 1
+		cm.RUnlock()
+		if !ok || !ck.TryLock() {
+			continue
+		}
+
+		if versions[i] != ck.version || !containsServer(ck.location, primary) {
+			if versions[i] < ck.version {
+				log.Warningf("%v is behind on chunk %v, version %v < %v", primary, h, versions[i], ck.version)
+			}
+		} else if ck.primary == primary && ck.expire.After(now) {
+			ck.expire = now.Add(cm.leaseExpire)
+		} else if ck.expire.Before(now) && !grace && !shared {
+			servers, err := cm.grantLease(h, ck, choose)
+			if len(servers) > 0 {
+				stale[h] = servers
+			}
+			if err != nil {
+				log.Warning(err)
+			}
+		}
+
+		if ck.primary == primary && ck.expire.After(now) {
+			granted = append(granted, h)
+			if expire.IsZero() || ck.expire.Before(expire) {
+				expire = ck.expire
+			}
+		}
+		ck.Unlock()
+	}
+	return granted, expire, stale, nil
+}
+
+// UnshareChunk gives path a private copy of chunk handle if the chunk is shared
+// with other files after a snapshot and path is not its owner.
+// It returns the handle path should use, and the replicas if a copy is made.
+func (cm *chunkManager) UnshareChunk(path gfs.Path, handle gfs.ChunkHandle) (gfs.ChunkHandle, []gfs.ServerAddress, error) {
+	cm.RLock()
+	ck, ok := cm.chunk[handle]
+	cm.RUnlock()
 
-	// update file info
-	fileinfo, ok := cm.file[path]
 	if !ok {
-		fileinfo = new(fileInfo)
-		cm.file[path] = fileinfo
+		return -1, nil, fmt.Errorf("invalid chunk handle %v", handle)
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+
+	cm.RLock()
+	shared := ck.refcount > 1 && ck.path != path
+	cm.RUnlock()
+	if !shared {
+		return handle, nil, nil
+	}
+	return cm.copyChunk(handle, ck, func(p gfs.Path) bool { return p == path })
+}
+
+// copyChunk duplicates a shared chunk on all its replicas and moves the files chosen
+// by move to the copy. ck should be locked in top caller.
+// It returns the handle and the replicas of the copy.
+func (cm *chunkManager) copyChunk(handle gfs.ChunkHandle, ck *chunkInfo, move func(p gfs.Path) bool) (gfs.ChunkHandle, []gfs.ServerAddress, error) {
+	cm.RLock()
+	paths := cm.sharers(handle, move)
+	hole := ck.hole
+	cm.RUnlock()
+	if len(paths) == 0 {
+		return handle, nil, nil
 	}
-	fileinfo.handles = append(fileinfo.handles, handle)
 
-	// update chunk info
-	ck := &chunkInfo{path: path}
-	cm.chunk[handle] = ck
+	// the chunkservers are called without cm lock
+	reserved, err := cm.ReserveHandles(1)
+	if err != nil {
+		return -1, nil, err
+	}
+	newHandle := reserved[0]
 
 	var errList string
 	var success []gfs.ServerAddress
-	for _, v := range addrs {
-		var r gfs.CreateChunkReply
+	for _, v := range ck.location { // a hole has nothing to copy
+		var r gfs.DuplicateChunkReply
 
-		err := util.Call(v, "ChunkServer.RPCCreateChunk", gfs.CreateChunkArg{handle}, &r)
-		if err == nil { // register
-			ck.location = append(ck.location, v)
+		err := util.CallTLS(cm.tls, v, "ChunkServer.RPCDuplicateChunk", gfs.DuplicateChunkArg{handle, newHandle}, &r)
+		if err == nil {
 			success = append(success, v)
 		} else {
 			errList += err.Error() + ";"
 		}
 	}
+	if len(success) == 0 && !hole {
+		return -1, nil, fmt.Errorf("cannot copy chunk %v: %v", handle, errList)
+	}
+	log.Infof("Master copy shared chunk %v to %v on %v", handle, newHandle, success)
 
-	if errList == "" {
-		return handle, success, nil
-	} else {
-		// replicas are no enough, add to need list
-		cm.replicasNeedList = append(cm.replicasNeedList, handle)
-		return handle, success, fmt.Errorf(errList)
+	defer cm.oplog.Hold()()
+	cm.Lock()
+	defer cm.Unlock()
+
+	// the files may be deleted or renamed during the copy
+	paths = cm.sharers(handle, move)
+	if len(paths) == 0 {
+		util.CallAllTLS(cm.tls, success, "ChunkServer.RPCDeleteChunk", gfs.DeleteChunkArg{[]gfs.ChunkHandle{newHandle}})
+		return handle, nil, nil
+	}
+
+	// the replicas of the copy are collected as garbage if it is not logged
+	op := operation{Type: opCopyChunk, Handle: handle, Handles: []gfs.ChunkHandle{newHandle}, Version: ck.version, Paths: paths}
+	if err := cm.logOperation(op); err != nil {
+		return -1, nil, err
+	}
+	cm.moveToCopy(handle, newHandle, ck.version, paths, success)
+	return newHandle, success, nil
+}
+
+// sharers returns the files chosen by move which reference chunk handle.
+// cm should be locked in top caller.
+func (cm *chunkManager) sharers(handle gfs.ChunkHandle, move func(p gfs.Path) bool) []gfs.Path {
+	var paths []gfs.Path
+	for p, f := range cm.file {
+		if !move(p) {
+			continue
+		}
+		for _, h := range f.handles {
+			if h == handle {
+				paths = append(paths, p)
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// moveToCopy moves the files on paths from chunk handle to its copy newHandle, whose
+// version and replicas are given. The file sorted first owns the copy. cm should be locked in top caller.
+func (cm *chunkManager) moveToCopy(handle, newHandle gfs.ChunkHandle, version gfs.ChunkVersion, paths []gfs.Path, location []gfs.ServerAddress) {
+	if _, ok := cm.chunk[newHandle]; ok {
+		return
+	}
+
+	moved := 0
+	var owner gfs.Path
+	for _, p := range paths {
+		f, ok := cm.file[p]
+		if !ok {
+			continue
+		}
+		for i, h := range f.handles {
+			if h == handle {
+				f.handles[i] = newHandle
+				moved++
+				if owner == "" || p < owner {
+					owner = p
+				}
+			}
+		}
+	}
+	if moved == 0 {
+		return
+	}
+
+	nk := &chunkInfo{
+		location: location,
+		expire:   time.Now(),
+		version:  version,
+		path:     owner,
+		refcount: moved,
+	}
+	if ck, ok := cm.chunk[handle]; ok {
+		nk.checksum = ck.checksum
+		nk.hole = ck.hole
+		ck.refcount -= moved
+	}
+	cm.chunk[newHandle] = nk
+	if newHandle >= cm.numChunkHandle {
+		cm.numChunkHandle = newHandle + 1
+	}
+	if !nk.hole && len(location) < cm.replicaFactor(nk) {
+		cm.replicasNeedList = append(cm.replicasNeedList, newHandle)
+	}
+}
+
+// CopyChunk moves the files on paths to the copy of a shared chunk when the operation log is replayed
+func (cm *chunkManager) CopyChunk(handle, newHandle gfs.ChunkHandle, version gfs.ChunkVersion, paths []gfs.Path) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.moveToCopy(handle, newHandle, version, paths, nil)
+}
+
+// RevokeLease takes back the outstanding lease of a chunk from its primary, so no
+// mutation is applied until a new lease is granted. ck should be locked in top caller.
+func (cm *chunkManager) RevokeLease(handle gfs.ChunkHandle) error {
+	cm.RLock()
+	ck, ok := cm.chunk[handle]
+	cm.RUnlock()
+	if !ok {
+		return fmt.Errorf("invalid chunk handle %v", handle)
+	}
+
+	if ck.primary == "" || ck.expire.Before(time.Now()) {
+		return nil
+	}
+
+	var r gfs.RevokeLeaseReply
+	err := util.CallTLS(cm.tls, ck.primary, "ChunkServer.RPCRevokeLease", gfs.RevokeLeaseArg{handle}, &r)
+	if err != nil {
+		return err
+	}
+	ck.primary = ""
+	ck.expire = time.Now()
+	return nil
+}
+
+// RevokeLeases locks the chunks of source and every file under it, and revokes
+// their outstanding leases. No mutation is in flight and no lease is granted on them until
+// unlock is called. If a lease cannot be revoked, e.g. its primary is unreachable, no chunk
+// is left locked and it returns how long to wait for the lease to expire before trying again.
+func (cm *chunkManager) RevokeLeases(source gfs.Path) (unlock func(), wait time.Duration) {
+	prefix := string(source) + "/"
+	var handles []gfs.ChunkHandle
+	cks := make(map[gfs.ChunkHandle]*chunkInfo)
+
+	cm.RLock()
+	for p, f := range cm.file {
+		if p != source && !strings.HasPrefix(string(p), prefix) {
+			continue
+		}
+		for _, h := range f.handles {
+			if _, ok := cks[h]; !ok {
+				cks[h] = cm.chunk[h]
+				handles = append(handles, h)
+			}
+		}
+	}
+	cm.RUnlock()
+
+	// chunk locks are not taken under cm lock, GetLeaseHolder locks in the reverse order
+	sort.Slice(handles, func(i, j int) bool { return handles[i] < handles[j] })
+	unlock = func() {
+		for _, h := range handles {
+			cks[h].Unlock()
+		}
+	}
+	for _, h := range handles {
+		ck := cks[h]
+		ck.Lock()
+		if err := cm.RevokeLease(h); err != nil {
+			if d := ck.expire.Sub(time.Now()); d > wait {
+				wait = d
+			}
+			log.Infof("Master wait for the lease of chunk %v: %v", h, err)
+		}
+	}
+	if wait > 0 {
+		unlock()
+		return nil, wait
+	}
+	return unlock, 0
+}
+
+// CopyFiles makes target and the files under it reference the same chunks as
+// source and the corresponding files under source.
+func (cm *chunkManager) CopyFiles(source, target gfs.Path) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	prefix := string(source) + "/"
+	copies := make(map[gfs.Path]*fileInfo)
+	for p, f := range cm.file {
+		if p != source && !strings.HasPrefix(string(p), prefix) {
+			continue
+		}
+
+		nf := &fileInfo{handles: make([]gfs.ChunkHandle, len(f.handles)), replicas: f.replicas}
+		copy(nf.handles, f.handles)
+		for _, h := range f.handles {
+			cm.chunk[h].refcount++
+		}
+		copies[target+p[len(source):]] = nf
+	}
+
+	for p, f := range copies {
+		cm.file[p] = f
+	}
+}
+
+// ReserveHandles returns the handles of n new chunks, they are not in metadata until
+// they are added with AddChunks
+func (cm *chunkManager) ReserveHandles(n int) ([]gfs.ChunkHandle, error) {
+	cm.Lock()
+	defer cm.Unlock()
+	return cm.reserveHandles(n)
+}
+
+// reserveHandles logs the next new handle after n new chunks before returning their handles,
+// so a replica below it is never taken for one created by a newer master and is safe to
+// reclaim if it is unknown. cm should be locked in top caller.
+func (cm *chunkManager) reserveHandles(n int) ([]gfs.ChunkHandle, error) {
+	next := cm.numChunkHandle + gfs.ChunkHandle(n)
+	if err := cm.logOperation(operation{Type: opReserveHandles, Handle: next}); err != nil {
+		return nil, err
+	}
+	handles := make([]gfs.ChunkHandle, n)
+	for i := range handles {
+		handles[i] = cm.numChunkHandle + gfs.ChunkHandle(i)
+	}
+	cm.numChunkHandle = next
+	return handles, nil
+}
+
+// CreateReplicas creates chunk handles[i] on servers addrs[i], with versions[i] or version 0
+// if versions is nil. The chunk is stored compressed if compressed is set. It fails if any
+// replica is not created, and returns the replicas created, which should be collected as garbage.
+func (cm *chunkManager) CreateReplicas(handles []gfs.ChunkHandle, addrs [][]gfs.ServerAddress, versions []gfs.ChunkVersion, compressed bool) (map[gfs.ChunkHandle][]gfs.ServerAddress, error) {
+	created := make(map[gfs.ChunkHandle][]gfs.ServerAddress)
+	for i, h := range handles {
+		var version gfs.ChunkVersion
+		if versions != nil {
+			version = versions[i]
+		}
+		for _, v := range addrs[i] {
+			var r gfs.CreateChunkReply
+			err := util.CallTLS(cm.tls, v, "ChunkServer.RPCCreateChunk", gfs.CreateChunkArg{Handle: h, Version: version, Compressed: compressed}, &r)
+			if err != nil {
+				return created, fmt.Errorf("create chunk %v on %v: %v", h, v, err)
+			}
+			created[h] = append(created[h], v)
+		}
+	}
+	return created, nil
+}
+
+// AddChunks appends chunks handles to file p, replicas is the replication factor of the file.
+// versions and locations are those of the chunks, version 0 and no replicas known if nil,
+// e.g. when the operation log is replayed. The chunks in holes have no replica yet.
+// It returns how many of them are new, the others are loaded from the checkpoint already.
+func (cm *chunkManager) AddChunks(p gfs.Path, handles []gfs.ChunkHandle, versions []gfs.ChunkVersion, locations [][]gfs.ServerAddress, replicas int, holes []gfs.ChunkHandle) int {
+	cm.Lock()
+	defer cm.Unlock()
+
+	f, ok := cm.file[p]
+	if !ok {
+		f = &fileInfo{replicas: replicas}
+		cm.file[p] = f
 	}
+	n := 0
+	for i, h := range handles {
+		if _, ok := cm.chunk[h]; ok {
+			continue
+		}
+		ck := &chunkInfo{path: p, refcount: 1}
+		for _, v := range holes {
+			if v == h {
+				ck.hole = true
+			}
+		}
+		if versions != nil {
+			ck.version = versions[i]
+		}
+		if locations != nil {
+			ck.location = append([]gfs.ServerAddress(nil), locations[i]...)
+		}
+		cm.chunk[h] = ck
+		f.handles = append(f.handles, h)
+		if h >= cm.numChunkHandle {
+			cm.numChunkHandle = h + 1
+		}
+		n++
+	}
+	return n
+}
+
+// CopyChunks makes a new chunk for every chunk of file source, the i-th on servers addrs[i],
+// and copies the data to them from a replica of the source chunk. A copy has the version
+// of its source chunk. The chunks of source should be locked with their leases revoked in
+// top caller, so they don't change during the copy. The copies are not in metadata until
+// they are added with AddChunks. The copy of a hole is a hole, and its addrs are cleared.
+// It returns the handles and the versions of the copies, the copies which are holes, and the
+// replicas created, which should be collected as garbage if it fails.
+func (cm *chunkManager) CopyChunks(source gfs.Path, addrs [][]gfs.ServerAddress, compressed bool) ([]gfs.ChunkHandle, []gfs.ChunkVersion, []gfs.ChunkHandle, map[gfs.ChunkHandle][]gfs.ServerAddress, error) {
+	cm.RLock()
+	var handles []gfs.ChunkHandle
+	if f, ok := cm.file[source]; ok {
+		handles = append(handles, f.handles...)
+	}
+	if len(handles) != len(addrs) {
+		cm.RUnlock()
+		return nil, nil, nil, nil, fmt.Errorf("file %v has %v chunks, not %v", source, len(handles), len(addrs))
+	}
+	sources := make([]*chunkInfo, len(handles))
+	versions := make([]gfs.ChunkVersion, len(handles))
+	holes := make([]bool, len(handles))
+	for i, h := range handles {
+		sources[i] = cm.chunk[h]
+		versions[i] = sources[i].version
+		holes[i] = sources[i].hole
+	}
+	cm.RUnlock()
+
+	copies, err := cm.ReserveHandles(len(handles))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var copiedHoles []gfs.ChunkHandle
+	for i := range handles {
+		if holes[i] {
+			addrs[i] = nil
+			copiedHoles = append(copiedHoles, copies[i])
+		}
+	}
+	created, err := cm.CreateReplicas(copies, addrs, versions, compressed)
+	if err != nil {
+		return nil, nil, nil, created, err
+	}
+
+	for i, h := range handles {
+		for _, to := range addrs[i] {
+			var errList string
+			done := false
+			for _, from := range sources[i].location {
+				var r gfs.SendCopyReply
+				err := util.CallTLS(cm.tls, from, "ChunkServer.RPCSendCopy", gfs.SendCopyArg{h, to, copies[i]}, &r)
+				if err == nil {
+					done = true
+					break
+				}
+				errList += err.Error() + ";"
+			}
+			if !done {
+				return nil, nil, nil, created, fmt.Errorf("cannot copy chunk %v to %v on %v: %v", h, copies[i], to, errList)
+			}
+		}
+	}
+	log.Infof("Master copy chunks of %v", source)
+	return copies, versions, copiedHoles, created, nil
 }
 
 // RemoveChunks removes disconnected chunks
-// if replicas number of a chunk is less than gfs.MininumNumReplicas, add it to need list
+// if replicas number of a chunk is less than the replication factor of its file, add it to need list
 func (cm *chunkManager) RemoveChunks(handles []gfs.ChunkHandle, server gfs.ServerAddress) error {
 
 	errList := ""
@@ -322,12 +1355,20 @@ func (cm *chunkManager) RemoveChunks(handles []gfs.ChunkHandle, server gfs.Serve
 			}
 		}
 		ck.location = newlist
-		ck.expire = time.Now()
+		if ck.primary == server { // other leases are revoked before re-replication
+			ck.expire = time.Now()
+		}
 		num := len(ck.location)
-		ck.Unlock()
 
-		if num < gfs.MinimumNumReplicas {
+		cm.Lock()
+		need := num < cm.replicaFactor(ck)
+		if need {
 			cm.replicasNeedList = append(cm.replicasNeedList, v)
+		}
+		cm.Unlock()
+		ck.Unlock()
+
+		if need {
 			if num == 0 {
 				log.Error("lose all replica of %v", v)
 				errList += fmt.Sprintf("Lose all replicas of chunk %v;", v)
@@ -342,16 +1383,152 @@ func (cm *chunkManager) RemoveChunks(handles []gfs.ChunkHandle, server gfs.Serve
 	}
 }
 
+// InvalidateReplica removes the replica of a chunk on server, like RemoveChunks does for
+// a corrupted one, and adds the chunk to need list if it has too few replicas left.
+// The last replica of a chunk is kept unless force is set.
+func (cm *chunkManager) InvalidateReplica(handle gfs.ChunkHandle, server gfs.ServerAddress, force bool) error {
+	cm.RLock()
+	ck, ok := cm.chunk[handle]
+	cm.RUnlock()
+	if !ok {
+		return fmt.Errorf("invalid chunk handle %v", handle)
+	}
+
+	ck.Lock()
+	defer ck.Unlock()
+	var newlist []gfs.ServerAddress
+	for _, v := range ck.location {
+		if v != server {
+			newlist = append(newlist, v)
+		}
+	}
+	if len(newlist) == len(ck.location) {
+		return fmt.Errorf("chunk %v has no replica on %v", handle, server)
+	}
+	if len(newlist) == 0 && !force {
+		return fmt.Errorf("refuse to invalidate the last replica of chunk %v", handle)
+	}
+	ck.location = newlist
+	if ck.primary == server {
+		ck.expire = time.Now()
+	}
+
+	cm.Lock()
+	if len(ck.location) < cm.replicaFactor(ck) {
+		cm.replicasNeedList = append(cm.replicasNeedList, handle)
+	}
+	cm.Unlock()
+	return nil
+}
+
+// ReportMismatch counts a checksum mismatch of the replica of a chunk on server. The count
+// halves every gfs.MismatchHalfLife, so a one-off glitch is forgotten, but a bad sector that
+// corrupts every new copy put on it is not. Once gfs.MismatchQuarantine mismatches are counted,
+// the replica is quarantined for gfs.QuarantineTime and true is returned.
+func (cm *chunkManager) ReportMismatch(handle gfs.ChunkHandle, server gfs.ServerAddress) bool {
+	cm.Lock()
+	defer cm.Unlock()
+	if _, ok := cm.chunk[handle]; !ok {
+		return false
+	}
+
+	now := time.Now()
+	ms, ok := cm.mismatches[handle]
+	if !ok {
+		ms = make(map[gfs.ServerAddress]*mismatchInfo)
+		cm.mismatches[handle] = ms
+	}
+	v, ok := ms[server]
+	if !ok {
+		v = &mismatchInfo{last: now}
+		ms[server] = v
+	}
+	if n := now.Sub(v.last) / gfs.MismatchHalfLife; n > 0 {
+		v.count >>= uint(n)
+		v.last = v.last.Add(n * gfs.MismatchHalfLife)
+	}
+	v.count++
+	if v.count < gfs.MismatchQuarantine || v.until.After(now) {
+		return false
+	}
+	v.count = 0
+	v.until = now.Add(gfs.QuarantineTime)
+	return true
+}
+
+// Quarantined returns the servers whose replicas of a chunk are quarantined
+func (cm *chunkManager) Quarantined(handle gfs.ChunkHandle) []gfs.ServerAddress {
+	cm.RLock()
+	defer cm.RUnlock()
+	var ret []gfs.ServerAddress
+	now := time.Now()
+	for a, v := range cm.mismatches[handle] {
+		if v.until.After(now) {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+func containsServer(list []gfs.ServerAddress, a gfs.ServerAddress) bool {
+	for _, v := range list {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanReplicas checks at most n chunks for missing replicas, starting from where the last
+// scan stopped and wrapping around at the last handle, so the whole chunk space is covered
+// by successive scans. Chunks with fewer replicas than the replication factor, or than servers
+// if there are fewer chunkservers, are added to the need list, and their handles are returned.
+// Chunks locked by mutations or copies are skipped.
+func (cm *chunkManager) ScanReplicas(n, servers int) []gfs.ChunkHandle {
+	cm.Lock()
+	cks := make(map[gfs.ChunkHandle]*chunkInfo)
+	for i := 0; i < n && i < int(cm.numChunkHandle); i++ {
+		h := cm.scanCursor
+		cm.scanCursor++
+		if cm.scanCursor >= cm.numChunkHandle {
+			cm.scanCursor = 0
+		}
+		if ck, ok := cm.chunk[h]; ok {
+			cks[h] = ck
+		}
+	}
+	cm.Unlock()
+
+	// chunk locks are not taken under cm lock, GetLeaseHolder locks in the reverse order
+	var need []gfs.ChunkHandle
+	for h, ck := range cks {
+		if !ck.TryRLock() {
+			continue
+		}
+		cm.RLock()
+		if cm.needsReplica(ck, servers) {
+			need = append(need, h)
+		}
+		cm.RUnlock()
+		ck.RUnlock()
+	}
+
+	cm.Lock()
+	cm.replicasNeedList = append(cm.replicasNeedList, need...)
+	cm.Unlock()
+	return need
+}
+
 // GetNeedList clears the need list at first (removes the old handles that nolonger need replicas)
-// and then return all new handles
-func (cm *chunkManager) GetNeedlist() []gfs.ChunkHandle {
+// and then return all new handles. A chunk needs no more replicas than servers.
+func (cm *chunkManager) GetNeedlist(servers int) []gfs.ChunkHandle {
 	cm.Lock()
 	defer cm.Unlock()
 
 	// clear satisfied chunk
 	var newlist []int
 	for _, v := range cm.replicasNeedList {
-		if len(cm.chunk[v].location) < gfs.MinimumNumReplicas {
+		if ck, ok := cm.chunk[v]; ok && cm.needsReplica(ck, servers) {
 			newlist = append(newlist, int(v))
 		}
 	}
@@ -2,9 +2,13 @@ package master
 
 import (
 	"fmt"
-	//"math/rand"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unsafe"
 
 	"gfs"
 	"gfs/util"
@@ -15,11 +19,17 @@ import (
 type chunkServerManager struct {
 	sync.RWMutex
 	servers map[gfs.ServerAddress]*chunkServerInfo
+	timeout time.Duration // a server without heartbeat for this long is suspected
+	checks  int           // a suspected server is dead after it fails this many checks in a row
+	minFree int64         // a server with less free space gets no new chunks
 }
 
-func newChunkServerManager() *chunkServerManager {
+func newChunkServerManager(timeout time.Duration, checks int, minFree int64) *chunkServerManager {
 	csm := &chunkServerManager{
 		servers: make(map[gfs.ServerAddress]*chunkServerInfo),
+		timeout: timeout,
+		checks:  checks,
+		minFree: minFree,
 	}
 	log.Info("-----------new chunk server manager")
 	return csm
@@ -27,28 +37,238 @@ func newChunkServerManager() *chunkServerManager {
 
 type chunkServerInfo struct {
 	lastHeartbeat time.Time
+	missed        int                      // consecutive checks finding the server silent
 	chunks        map[gfs.ChunkHandle]bool // set of chunks that the chunkserver has
 	garbage       []gfs.ChunkHandle
+	leases        map[gfs.ChunkHandle]time.Time // expire time of the leases granted to the server
+
+	registered  time.Time            // time of the first heartbeat
+	stats       gfs.ChunkServerStats // stats in last heartbeat
+	draining    bool                 // being decommissioned, no new replica is placed on it
+	usedBytes   int64                // bytes used by chunks in last heartbeat
+	freeBytes   int64                // bytes available in last heartbeat
+	zone        string               // topology label
+	incarnation int64                // changes when the server restarts
+
+	load   float64   // moving average of operations per second, see updateLoad
+	ops    int64     // operations done by the server in last heartbeat
+	loadAt time.Time // time of last heartbeat folded into load
+
+	sending  int       // copies being sent by the server for re-replication
+	lastSent time.Time // when the server was last chosen as a copy source
+	sent     int64     // copies the server was chosen to send
 }
 
-func (csm *chunkServerManager) Heartbeat(addr gfs.ServerAddress, reply *gfs.HeartbeatReply) bool {
+// Heartbeat records a heartbeat of a chunkserver. isFirst is set if the server
+// registers, either for the first time or after a restart, which is told by a new
+// incarnation. A restarted server is registered afresh, and the chunks known on it
+// before are returned in lost, since it may no longer hold them.
+func (csm *chunkServerManager) Heartbeat(args gfs.HeartbeatArg, reply *gfs.HeartbeatReply) (isFirst bool, lost []gfs.ChunkHandle) {
 	csm.Lock()
 	defer csm.Unlock()
 
+	addr := args.Address
 	sv, ok := csm.servers[addr]
+	if ok && sv.incarnation != args.Incarnation {
+		log.Infof("chunk server %v restarts", addr)
+		for h := range sv.chunks {
+			lost = append(lost, h)
+		}
+		ok = false
+	}
 	if !ok {
 		log.Info("New chunk server" + addr)
-		csm.servers[addr] = &chunkServerInfo{time.Now(), make(map[gfs.ChunkHandle]bool), nil}
-		return true
+		now := time.Now()
+		info := &chunkServerInfo{
+			lastHeartbeat: now,
+			chunks:        make(map[gfs.ChunkHandle]bool),
+			leases:        make(map[gfs.ChunkHandle]time.Time),
+			registered:    now,
+			stats:         args.Stats,
+			usedBytes:     args.UsedBytes,
+			freeBytes:     args.FreeBytes,
+			zone:          args.Zone,
+			incarnation:   args.Incarnation,
+			ops:           args.Stats.ChunksServed + args.Stats.WriteOps,
+			loadAt:        now,
+		}
+		if sv != nil {
+			info.draining = sv.draining
+		}
+		csm.servers[addr] = info
+		return true, lost
 	} else {
-		// send garbage
-		reply.Garbage = csm.servers[addr].garbage
-		csm.servers[addr].garbage = make([]gfs.ChunkHandle, 0)
+		if sv.missed > 0 {
+			log.Infof("chunk server %v is back after %v missed checks", addr, sv.missed)
+		}
 		sv.lastHeartbeat = time.Now()
-		return false
+		sv.missed = 0
+		sv.updateLoad(args.Stats.ChunksServed+args.Stats.WriteOps, sv.lastHeartbeat)
+		sv.stats = args.Stats
+		sv.usedBytes = args.UsedBytes
+		sv.freeBytes = args.FreeBytes
+		sv.zone = args.Zone
+		return false, nil
 	}
 }
 
+// updateLoad folds the operations done since last heartbeat into the load of server,
+// an exponential moving average of operations per second with time constant gfs.LoadDecay.
+// ops is the number of operations the server has done since it starts.
+func (sv *chunkServerInfo) updateLoad(ops int64, now time.Time) {
+	dt := now.Sub(sv.loadAt).Seconds()
+	if dt <= 0 {
+		return
+	}
+	done := ops - sv.ops
+	if done < 0 {
+		done = 0
+	}
+	w := math.Exp(-dt / gfs.LoadDecay.Seconds())
+	sv.load = sv.load*w + float64(done)/dt*(1-w)
+	sv.ops, sv.loadAt = ops, now
+}
+
+// busier reports whether a load is higher than b by more than gfs.LoadSlack,
+// loads closer than that are taken as the same
+func busier(a, b float64) bool {
+	return a > b+gfs.LoadSlack
+}
+
+// Load returns the recent operations per second of a server
+func (csm *chunkServerManager) Load(addr gfs.ServerAddress) (float64, bool) {
+	csm.RLock()
+	defer csm.RUnlock()
+	sv, ok := csm.servers[addr]
+	if !ok {
+		return 0, false
+	}
+	return sv.load, true
+}
+
+// hasSpace reports whether the server can accept new chunks, keeping minFree bytes free
+func (sv *chunkServerInfo) hasSpace(minFree int64) bool {
+	return !sv.draining && sv.freeBytes >= minFree
+}
+
+// hasGarbage reports whether handle is waiting to be sent to the server as garbage
+func (sv *chunkServerInfo) hasGarbage(handle gfs.ChunkHandle) bool {
+	for _, v := range sv.garbage {
+		if v == handle {
+			return true
+		}
+	}
+	return false
+}
+
+// StatsSummary summarizes the stats reported by every chunkserver
+func (csm *chunkServerManager) StatsSummary() []gfs.ServerStatSummary {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	now := time.Now()
+	ret := make([]gfs.ServerStatSummary, 0, len(csm.servers))
+	for a, sv := range csm.servers {
+		st := sv.stats
+		sum := gfs.ServerStatSummary{
+			Address:           a,
+			P50ReadLatencyMs:  util.Percentile(st.ReadLatencyMs, 50),
+			P95ReadLatencyMs:  util.Percentile(st.ReadLatencyMs, 95),
+			P99ReadLatencyMs:  util.Percentile(st.ReadLatencyMs, 99),
+			P50WriteLatencyMs: util.Percentile(st.WriteLatencyMs, 50),
+			TotalReadBytes:    st.ReadBytes,
+			TotalWriteBytes:   st.WriteBytes,
+		}
+		if elapsed := now.Sub(sv.registered).Seconds(); elapsed > 0 {
+			sum.AvgChunksServedPerSec = float64(st.ChunksServed) / elapsed
+		}
+		ret = append(ret, sum)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Address < ret[j].Address })
+	return ret
+}
+
+// List returns the chunkservers known to master, the dead ones are removed already
+func (csm *chunkServerManager) List() []gfs.ChunkServerInfo {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	ret := make([]gfs.ChunkServerInfo, 0, len(csm.servers))
+	for a, sv := range csm.servers {
+		ret = append(ret, gfs.ChunkServerInfo{
+			Address:       a,
+			Zone:          sv.zone,
+			LastHeartbeat: sv.lastHeartbeat,
+			Registered:    sv.registered,
+			Chunks:        len(sv.chunks),
+			UsedBytes:     sv.usedBytes,
+			FreeBytes:     sv.freeBytes,
+			Draining:      sv.draining,
+			CopiesSent:    sv.sent,
+			Load:          sv.load,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Address < ret[j].Address })
+	return ret
+}
+
+// zoneProximity returns the number of leading components shared by two zone labels
+func zoneProximity(a, b string) int {
+	if a == "" || b == "" {
+		return 0
+	}
+	x, y := strings.Split(a, "/"), strings.Split(b, "/")
+	n := 0
+	for n < len(x) && n < len(y) && x[n] == y[n] {
+		n++
+	}
+	return n
+}
+
+// SortByZone sorts servers so that the ones closer to zone come first
+func (csm *chunkServerManager) SortByZone(addrs []gfs.ServerAddress, zone string) {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	proximity := make(map[gfs.ServerAddress]int)
+	for _, a := range addrs {
+		if sv, ok := csm.servers[a]; ok {
+			proximity[a] = zoneProximity(sv.zone, zone)
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool { return proximity[addrs[i]] > proximity[addrs[j]] })
+}
+
+// PushChain orders servers into a chain to push data along. The chain starts from the
+// server nearest to zone, and each server is followed by the nearest one left.
+// The order is kept among servers at the same distance.
+func (csm *chunkServerManager) PushChain(addrs []gfs.ServerAddress, zone string) []gfs.ServerAddress {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	zones := make(map[gfs.ServerAddress]string)
+	for _, a := range addrs {
+		if sv, ok := csm.servers[a]; ok {
+			zones[a] = sv.zone
+		}
+	}
+
+	left := append([]gfs.ServerAddress(nil), addrs...)
+	chain := make([]gfs.ServerAddress, 0, len(addrs))
+	for len(left) > 0 {
+		next := 0
+		for i := 1; i < len(left); i++ {
+			if zoneProximity(zones[left[i]], zone) > zoneProximity(zones[left[next]], zone) {
+				next = i
+			}
+		}
+		chain = append(chain, left[next])
+		zone = zones[left[next]]
+		left = append(left[:next], left[next+1:]...)
+	}
+	return chain
+}
+
 // register a chunk to servers
 func (csm *chunkServerManager) AddChunk(addrs []gfs.ServerAddress, handle gfs.ChunkHandle) {
 	csm.Lock()
@@ -76,65 +296,424 @@ func (csm *chunkServerManager) AddGarbage(addr gfs.ServerAddress, handle gfs.Chu
 	}
 }
 
-// ChooseReReplication chooses servers to perfomr re-replication
-// called when the replicas number of a chunk is less than gfs.MinimumNumReplicas
-// returns two server address, the master will call 'from' to send a copy to 'to'
-func (csm *chunkServerManager) ChooseReReplication(handle gfs.ChunkHandle) (from, to gfs.ServerAddress, err error) {
+// MostLoaded returns the server holding the most chunks among addrs, the busiest one
+// among equals, except exclude
+func (csm *chunkServerManager) MostLoaded(addrs []gfs.ServerAddress, exclude gfs.ServerAddress) (gfs.ServerAddress, bool) {
 	csm.RLock()
 	defer csm.RUnlock()
 
-	from = ""
-	to = ""
-	err = nil
+	var ret gfs.ServerAddress
+	max, maxBusy := -1, 0.0
+	for _, a := range addrs {
+		if a == exclude {
+			continue
+		}
+		load, busy := math.MaxInt32, 0.0 // removed server
+		if sv, ok := csm.servers[a]; ok {
+			load, busy = len(sv.chunks), sv.load
+		}
+		if load > max || load == max && busier(busy, maxBusy) {
+			ret, max, maxBusy = a, load, busy
+		}
+	}
+	return ret, max >= 0
+}
+
+// activeLeases returns the number of unexpired leases held by the server, and
+// forgets the expired ones. csm should be locked in top caller.
+func (sv *chunkServerInfo) activeLeases(now time.Time) int {
+	for h, expire := range sv.leases {
+		if !expire.After(now) {
+			delete(sv.leases, h)
+		}
+	}
+	return len(sv.leases)
+}
+
+// ChoosePrimary chooses the server to grant the lease of handle to among addrs, which
+// should be up to date. The server holding the fewest active leases is chosen, then the
+// least busy one, then the one holding the fewest chunks, so primary duty is spread across servers. The lease is
+// recorded with its expire time, and dropped from any server which held it before.
+func (csm *chunkServerManager) ChoosePrimary(handle gfs.ChunkHandle, addrs []gfs.ServerAddress, expire time.Time) gfs.ServerAddress {
+	csm.Lock()
+	defer csm.Unlock()
+
+	now := time.Now()
+	ret := addrs[0]
+	var min *chunkServerInfo
+	minLeases := 0
+	for _, a := range addrs {
+		sv, ok := csm.servers[a]
+		if !ok {
+			continue
+		}
+		leases := sv.activeLeases(now)
+		if min == nil || leases < minLeases || leases == minLeases &&
+			(busier(min.load, sv.load) || !busier(sv.load, min.load) && len(sv.chunks) < len(min.chunks)) {
+			ret, min, minLeases = a, sv, leases
+		}
+	}
+
+	for _, sv := range csm.servers {
+		delete(sv.leases, handle)
+	}
+	if sv, ok := csm.servers[ret]; ok {
+		sv.leases[handle] = expire
+	}
+	return ret
+}
+
+// ExtendLeases records that the leases of handles held by addr expire at expire
+func (csm *chunkServerManager) ExtendLeases(addr gfs.ServerAddress, handles []gfs.ChunkHandle, expire time.Time) {
+	csm.Lock()
+	defer csm.Unlock()
+
+	if sv, ok := csm.servers[addr]; ok {
+		for _, h := range handles {
+			sv.leases[h] = expire
+		}
+	}
+}
+
+// TakeGarbage returns the chunks to be deleted on a server, and clears them
+func (csm *chunkServerManager) TakeGarbage(addr gfs.ServerAddress) []gfs.ChunkHandle {
+	csm.Lock()
+	defer csm.Unlock()
+
+	sv, ok := csm.servers[addr]
+	if !ok {
+		return nil
+	}
+	garbage := sv.garbage
+	sv.garbage = nil
+	return garbage
+}
+
+// MarkFull takes a server as having no free space until its next heartbeat,
+// e.g. it refuses to create a chunk for lack of space
+func (csm *chunkServerManager) MarkFull(addr gfs.ServerAddress) {
+	csm.Lock()
+	defer csm.Unlock()
+	if sv, ok := csm.servers[addr]; ok {
+		sv.freeBytes = 0
+	}
+}
+
+// ChooseReReplication chooses servers to perfomr re-replication
+// called when the replicas number of a chunk is less than the replication factor of its file
+// returns two server address, the master will call 'from' to send a copy to 'to'.
+// 'from' is one of replicas, the up-to-date replicas known by master, so a stale replica
+// is never a source. The one sending the fewest copies is chosen, then the least busy one,
+// then the one chosen least recently, so the copies after a failure are spread over the
+// healthy replicas. 'to' is in a zone holding no replica of the chunk if there is one.
+// CopyDone should be called with 'from' when the copy ends.
+// The servers in excluded, such as quarantined ones, are neither 'from' nor 'to'.
+func (csm *chunkServerManager) ChooseReReplication(handle gfs.ChunkHandle, replicas, excluded []gfs.ServerAddress) (from, to gfs.ServerAddress, err error) {
+	csm.Lock()
+	defer csm.Unlock()
+
+	var src *chunkServerInfo
+	for _, a := range replicas {
+		sv, ok := csm.servers[a]
+		if !ok || !sv.chunks[handle] || containsServer(excluded, a) {
+			continue
+		}
+		if src == nil || sv.sending < src.sending || sv.sending == src.sending &&
+			(busier(src.load, sv.load) || !busier(sv.load, src.load) && sv.lastSent.Before(src.lastSent)) {
+			from, src = a, sv
+		}
+	}
+	held := make(map[string]bool)
+	for _, a := range replicas {
+		if sv, ok := csm.servers[a]; ok {
+			held[sv.zone] = true
+		}
+	}
 	for a, v := range csm.servers {
-		if v.chunks[handle] {
-			from = a
-		} else {
-			to = a
+		if containsServer(excluded, a) {
+			continue
+		}
+		if !v.chunks[handle] && !v.hasGarbage(handle) && v.hasSpace(csm.minFree) { // a stale replica is waiting for deletion
+			if to == "" || !held[v.zone] {
+				to = a
+			}
+			if !held[v.zone] {
+				break
+			}
 		}
-		if from != "" && to != "" {
+	}
+	if src == nil || to == "" {
+		return "", "", fmt.Errorf("No enough server for replica %v", handle)
+	}
+
+	src.sending++
+	src.lastSent = time.Now()
+	src.sent++
+	return from, to, nil
+}
+
+// CopyDone records the end of a copy sent by a server chosen in ChooseReReplication
+func (csm *chunkServerManager) CopyDone(addr gfs.ServerAddress) {
+	csm.Lock()
+	defer csm.Unlock()
+	if sv, ok := csm.servers[addr]; ok && sv.sending > 0 {
+		sv.sending--
+	}
+}
+
+// PlanRebalance returns at most n chunk moves, each from the server holding the most
+// chunks to the one holding the fewest, the busier and the less busy one among equals,
+// and stops when no server holds far more chunks than the average. Every move is planned as if the ones before it were done, the source
+// dropping its replica, so the plan is what the rebalancer executes in a cycle.
+// Nothing is changed here, the chunk with the smallest handle is chosen to be moved.
+func (csm *chunkServerManager) PlanRebalance(n int) []gfs.ChunkMove {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	if len(csm.servers) < 2 {
+		return nil
+	}
+
+	// the chunks of servers after the planned moves, a set is copied before it is changed
+	chunks := make(map[gfs.ServerAddress]map[gfs.ChunkHandle]bool)
+	total := 0
+	for a, sv := range csm.servers {
+		chunks[a] = sv.chunks
+		total += len(sv.chunks)
+	}
+	avg := float64(total) / float64(len(csm.servers))
+	copied := make(map[gfs.ServerAddress]bool)
+	clone := func(a gfs.ServerAddress) {
+		if copied[a] {
 			return
 		}
+		set := make(map[gfs.ChunkHandle]bool, len(chunks[a])+1)
+		for h := range chunks[a] {
+			set[h] = true
+		}
+		chunks[a], copied[a] = set, true
 	}
-	err = fmt.Errorf("No enough server for replica %v", handle)
-	return
+
+	var moves []gfs.ChunkMove
+	for len(moves) < n {
+		var from, to gfs.ServerAddress
+		for a, sv := range csm.servers {
+			if from == "" || len(chunks[a]) > len(chunks[from]) ||
+				len(chunks[a]) == len(chunks[from]) && busier(sv.load, csm.servers[from].load) {
+				from = a
+			}
+			if sv.hasSpace(csm.minFree) && (to == "" || len(chunks[a]) < len(chunks[to]) ||
+				len(chunks[a]) == len(chunks[to]) && busier(csm.servers[to].load, sv.load)) {
+				to = a
+			}
+		}
+		if to == "" {
+			break
+		}
+		if float64(len(chunks[from])) <= avg*(1+gfs.RebalanceThreshold) || len(chunks[from])-len(chunks[to]) < 2 {
+			break
+		}
+
+		found := false
+		var handle gfs.ChunkHandle
+		for h := range chunks[from] {
+			if !chunks[to][h] && !csm.servers[to].hasGarbage(h) && (!found || h < handle) {
+				handle, found = h, true
+			}
+		}
+		if !found {
+			break
+		}
+		moves = append(moves, gfs.ChunkMove{Handle: handle, From: from, To: to})
+		clone(from)
+		clone(to)
+		delete(chunks[from], handle)
+		chunks[to][handle] = true
+	}
+	return moves
 }
 
-// ChooseServers returns servers to store new chunk
-// called when a new chunk is create
-func (csm *chunkServerManager) ChooseServers(num int) ([]gfs.ServerAddress, error) {
+// SetDraining marks a server as being decommissioned and returns the chunks it holds
+func (csm *chunkServerManager) SetDraining(addr gfs.ServerAddress) ([]gfs.ChunkHandle, error) {
+	csm.Lock()
+	defer csm.Unlock()
 
-	if num > len(csm.servers) {
-		return nil, fmt.Errorf("no enough servers for %v replicas", num)
+	sv, ok := csm.servers[addr]
+	if !ok {
+		return nil, fmt.Errorf("cannot find chunk server %v", addr)
+	}
+	sv.draining = true
+
+	var handles []gfs.ChunkHandle
+	for h := range sv.chunks {
+		handles = append(handles, h)
 	}
+	sort.Slice(handles, func(i, j int) bool { return handles[i] < handles[j] })
+	return handles, nil
+}
+
+// IsDraining reports whether a server is being decommissioned
+func (csm *chunkServerManager) IsDraining(addr gfs.ServerAddress) bool {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	sv, ok := csm.servers[addr]
+	return ok && sv.draining
+}
+
+// RemoveChunk unregisters a chunk from a server
+func (csm *chunkServerManager) RemoveChunk(addr gfs.ServerAddress, handle gfs.ChunkHandle) {
+	csm.Lock()
+	defer csm.Unlock()
+
+	if sv, ok := csm.servers[addr]; ok {
+		delete(sv.chunks, handle)
+	}
+}
 
+// ChooseServers returns servers to store new chunk
+// called when a new chunk is create. A draining server or a server with less
+// than the min free space of master is never chosen, servers with more free space are preferred.
+// The servers are in distinct zones as long as there are zones not chosen yet,
+// so losing a rack doesn't lose all the replicas.
+func (csm *chunkServerManager) ChooseServers(num int) ([]gfs.ServerAddress, error) {
 	csm.RLock()
 	var all, ret []gfs.ServerAddress
-	for a, _ := range csm.servers {
-		all = append(all, a)
+	var free []int64
+	var zones []string
+	alive := 0
+	for a, sv := range csm.servers {
+		if !sv.draining {
+			alive++
+		}
+		if sv.hasSpace(csm.minFree) {
+			all = append(all, a)
+			free = append(free, int64(float64(sv.freeBytes)/(1+sv.load/100)))
+			zones = append(zones, sv.zone)
+		}
 	}
 	csm.RUnlock()
 
-	choose, err := util.Sample(len(all), num)
-	if err != nil {
-		return nil, err
+	if alive == 0 {
+		return nil, fmt.Errorf("no enough servers for %v replicas", num)
+	}
+	if num > alive { // a small cluster, e.g. two servers for the default of three replicas
+		log.Warningf("only %v servers for %v replicas", alive, num)
+		num = alive
+	}
+	if num > len(all) {
+		return nil, gfs.ErrNoSpace
 	}
-	for _, v := range choose {
-		ret = append(ret, all[v])
+
+	// weighted sampling without replacement, weight is the free space, discounted for busy
+	// servers so that a server taking a hundred operations per second gets half the share.
+	// Only the servers in the zones not chosen yet are sampled, unless there are none.
+	used := make(map[string]bool)
+	for len(ret) < num {
+		var total int64
+		for i, v := range free {
+			if !used[zones[i]] {
+				total += v
+			}
+		}
+		spread := total > 0
+		if !spread {
+			for _, v := range free {
+				total += v
+			}
+		}
+		if total == 0 { // no free space is reported at all, e.g. a min free space of 0
+			for i := range free {
+				free[i] = 1
+			}
+			continue
+		}
+
+		r := rand.Int63n(total)
+		i := 0
+		for ; ; i++ {
+			if spread && used[zones[i]] {
+				continue
+			}
+			if r < free[i] {
+				break
+			}
+			r -= free[i]
+		}
+		ret = append(ret, all[i])
+		used[zones[i]] = true
+		all = append(all[:i], all[i+1:]...)
+		free = append(free[:i], free[i+1:]...)
+		zones = append(zones[:i], zones[i+1:]...)
 	}
 
 	return ret, nil
 }
 
-// DetectDeadServers detect disconnected servers according to last heartbeat time
-func (csm *chunkServerManager) DetectDeadServers() []gfs.ServerAddress {
+// MemoryUsage returns the number of known chunkservers and a rough estimation
+// of the bytes used by their metadata.
+func (csm *chunkServerManager) MemoryUsage() (servers int, bytes int64) {
+	csm.RLock()
+	defer csm.RUnlock()
+
+	var handle gfs.ChunkHandle
+	for a, sv := range csm.servers {
+		bytes += int64(len(a)) + int64(unsafe.Sizeof(a)) + int64(unsafe.Sizeof(*sv))
+		bytes += int64(len(sv.chunks)) * int64(unsafe.Sizeof(handle)+unsafe.Sizeof(true))
+		bytes += int64(len(sv.garbage)) * int64(unsafe.Sizeof(handle))
+		bytes += int64(len(sv.leases)) * int64(unsafe.Sizeof(handle)+unsafe.Sizeof(time.Time{}))
+	}
+
+	servers = len(csm.servers)
+	return
+}
+
+// NumServers returns the number of live chunkservers
+func (csm *chunkServerManager) NumServers() int {
+	csm.RLock()
+	defer csm.RUnlock()
+	return len(csm.servers)
+}
+
+// NumActive returns the number of chunkservers which may take new replicas, i.e. not draining
+func (csm *chunkServerManager) NumActive() int {
 	csm.RLock()
 	defer csm.RUnlock()
+	n := 0
+	for _, sv := range csm.servers {
+		if !sv.draining {
+			n++
+		}
+	}
+	return n
+}
+
+// QueuedGarbage returns the number of replicas waiting to be sent to their servers for deletion
+func (csm *chunkServerManager) QueuedGarbage() int {
+	csm.RLock()
+	defer csm.RUnlock()
+	n := 0
+	for _, sv := range csm.servers {
+		n += len(sv.garbage)
+	}
+	return n
+}
+
+// DetectDeadServers detect disconnected servers according to last heartbeat time.
+// A server without heartbeat for the timeout is only suspected, it is dead if it is
+// still silent in the following checks, so a late heartbeat doesn't get it removed.
+func (csm *chunkServerManager) DetectDeadServers() []gfs.ServerAddress {
+	csm.Lock()
+	defer csm.Unlock()
 
 	var ret []gfs.ServerAddress
 	now := time.Now()
 	for k, v := range csm.servers {
-		if v.lastHeartbeat.Add(gfs.ServerTimeout).Before(now) {
+		if !v.lastHeartbeat.Add(csm.timeout).Before(now) {
+			continue
+		}
+		v.missed++
+		if v.missed >= csm.checks {
 			ret = append(ret, k)
 		}
 	}
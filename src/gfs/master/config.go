@@ -0,0 +1,199 @@
+package master
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"time"
+
+	"gfs"
+)
+
+// Logger receives the logs of a master, e.g. *logrus.Logger.
+// An embedding application may route them to its own logger and level.
+type Logger interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// stdLogger is the default Logger, which logs through the global logrus logger
+type stdLogger struct{}
+
+func (stdLogger) Debug(args ...interface{}) { log.Debug(args...) }
+func (stdLogger) Info(args ...interface{})  { log.Info(args...) }
+func (stdLogger) Warn(args ...interface{})  { log.Warn(args...) }
+func (stdLogger) Error(args ...interface{}) { log.Error(args...) }
+
+// Config holds the tunable parameters of master. The defaults are the constants in package gfs.
+type Config struct {
+	BackgroundInterval  time.Duration // interval of dead server detection and re-replication
+	LeaseDuration       time.Duration // lifetime of a lease granted to primary
+	ServerTimeout       time.Duration // a chunkserver is suspected if no heartbeat is received for this long
+	DeadServerChecks    int           // a suspected chunkserver is removed if still silent in this many server checks
+	GCInterval          time.Duration // interval of garbage collection
+	GCGracePeriod       time.Duration // a deleted file is reclaimed after this long
+	MaxConcurrentCopies int           // chunks copied between chunkservers at once
+	ChunkSize           int64         // max chunk length, it should not change once files are written
+	HealthAddress       string        // address of the HTTP health check server, disabled if empty
+	LockTimeout         time.Duration // an rpc waits this long for metadata locks before ErrTimeout, no limit if 0
+	StrictMetadata      bool          // refuse to start if metadata loaded from disk has too many inconsistencies
+	MaxMetadataErrors   int           // inconsistencies allowed in strict mode
+	MaxFileChunks       int64         // chunks a file may have unless created with its own limit, no limit if 0
+	Logger              Logger        // receives the logs of master
+	DrainTimeout        time.Duration // shutdown waits this long for the rpcs in flight
+	DefaultReplicas     int           // replicas of each chunk of a file created without its own factor
+	MaxNeedList         int           // no new chunk is allocated while more chunks wait for re-replication, no limit if 0
+	SparseFiles         bool          // a chunk past the end of file allocates the chunks skipped as holes
+	LogCompactSize      int64         // a checkpoint is stored once the operation log is longer, never if 0
+	LogCompactRecords   int64         // or once this many operations are logged since the last one, never if 0
+	MinFreeSpace        int64         // a chunkserver with less free bytes gets no new chunks
+}
+
+// DefaultConfig returns the default configuration of master
+func DefaultConfig() Config {
+	return Config{
+		BackgroundInterval:  gfs.ServerCheckInterval,
+		LeaseDuration:       gfs.LeaseExpire,
+		ServerTimeout:       gfs.ServerTimeout,
+		DeadServerChecks:    gfs.DeadServerChecks,
+		GCInterval:          gfs.MasterGCInterval,
+		GCGracePeriod:       gfs.DeletedFileExpire,
+		MaxConcurrentCopies: gfs.MaxConcurrentCopies,
+		ChunkSize:           gfs.MaxChunkSize,
+		LockTimeout:         gfs.MasterLockTimeout,
+		MaxFileChunks:       gfs.MaxFileChunks,
+		Logger:              stdLogger{},
+		DrainTimeout:        gfs.MasterDrainTimeout,
+		DefaultReplicas:     gfs.DefaultNumReplicas,
+		MaxNeedList:         gfs.MaxNeedList,
+		LogCompactSize:      gfs.LogCompactSize,
+		LogCompactRecords:   gfs.LogCompactRecords,
+		MinFreeSpace:        gfs.MinFreeSpace,
+	}
+}
+
+// Option changes a parameter of master, it is passed to NewAndServe
+type Option func(*Config)
+
+// WithBackgroundInterval sets the interval of dead server detection and re-replication
+func WithBackgroundInterval(d time.Duration) Option {
+	return func(c *Config) { c.BackgroundInterval = d }
+}
+
+// WithLeaseDuration sets the lifetime of leases
+func WithLeaseDuration(d time.Duration) Option {
+	return func(c *Config) { c.LeaseDuration = d }
+}
+
+// WithServerTimeout sets how long a chunkserver may miss heartbeats before it is considered dead
+func WithServerTimeout(d time.Duration) Option {
+	return func(c *Config) { c.ServerTimeout = d }
+}
+
+// WithDeadServerChecks sets how many consecutive server checks a chunkserver must stay silent
+// in after ServerTimeout before it is removed, so a late heartbeat doesn't cause re-replication
+func WithDeadServerChecks(n int) Option {
+	return func(c *Config) { c.DeadServerChecks = n }
+}
+
+// WithGCInterval sets the interval of garbage collection
+func WithGCInterval(d time.Duration) Option {
+	return func(c *Config) { c.GCInterval = d }
+}
+
+// WithGCGracePeriod sets how long a deleted file is kept before it is reclaimed
+func WithGCGracePeriod(d time.Duration) Option {
+	return func(c *Config) { c.GCGracePeriod = d }
+}
+
+// WithMaxConcurrentCopies sets how many chunks may be copied between chunkservers at once
+// by re-replication and rebalance
+func WithMaxConcurrentCopies(n int) Option {
+	return func(c *Config) { c.MaxConcurrentCopies = n }
+}
+
+// WithHealthAddress enables the HTTP health check server on addr, e.g. ":8080".
+// It serves /healthz for liveness and /readyz for readiness.
+func WithHealthAddress(addr string) Option {
+	return func(c *Config) { c.HealthAddress = addr }
+}
+
+// WithChunkSize sets the max chunk length, which is between gfs.ChecksumBlockSize and gfs.MaxChunkSize.
+// Clients and chunkservers ask master for it, so they always split files the same way.
+func WithChunkSize(n int64) Option {
+	return func(c *Config) { c.ChunkSize = n }
+}
+
+// WithLockTimeout sets how long an rpc waits for the locks of namespace and chunks.
+// It fails with gfs.ErrTimeout rather than being blocked by a slow operation, e.g. a copy
+// in re-replication. Zero means it waits as long as it takes.
+func WithLockTimeout(d time.Duration) Option {
+	return func(c *Config) { c.LockTimeout = d }
+}
+
+// WithMaxFileChunks sets the chunks a file may have, so a runaway writer cannot extend
+// a file without bound. A file created with its own limit is not affected. Zero means no limit.
+func WithMaxFileChunks(n int64) Option {
+	return func(c *Config) { c.MaxFileChunks = n }
+}
+
+// WithDrainTimeout sets how long shutdown waits for the rpcs in flight to complete
+// before it closes their connections
+func WithDrainTimeout(d time.Duration) Option {
+	return func(c *Config) { c.DrainTimeout = d }
+}
+
+// WithDefaultReplicas sets the replicas of each chunk of a file created without its own
+// factor, e.g. 2 for a cluster of two chunkservers
+func WithDefaultReplicas(n int) Option {
+	return func(c *Config) { c.DefaultReplicas = n }
+}
+
+// WithMaxNeedList sets how many chunks may wait for re-replication before new chunks
+// are refused with gfs.ErrClusterDegraded, so writes back off while the cluster recovers.
+// Zero means no limit.
+func WithMaxNeedList(n int) Option {
+	return func(c *Config) { c.MaxNeedList = n }
+}
+
+// WithSparseFiles lets a client ask for a chunk past the end of file, e.g. to write far
+// ahead. The chunks skipped are allocated as holes read as zero. Without it, such a
+// request fails with gfs.ErrChunkGap.
+func WithSparseFiles() Option {
+	return func(c *Config) { c.SparseFiles = true }
+}
+
+// WithLogCompaction sets when the operation log is compacted: a checkpoint is stored and
+// the operations in it are dropped from the log once the log is longer than size bytes or
+// has records operations logged since the last checkpoint. Zero disables either trigger.
+func WithLogCompaction(size, records int64) Option {
+	return func(c *Config) {
+		c.LogCompactSize = size
+		c.LogCompactRecords = records
+	}
+}
+
+// WithMinFreeSpace sets the free bytes a chunkserver keeps, a server with less gets no new
+// chunks or copies, e.g. to leave room for the other data on its disk
+func WithMinFreeSpace(n int64) Option {
+	return func(c *Config) { c.MinFreeSpace = n }
+}
+
+// WithLogger sends the logs of master to l rather than the global logrus logger
+func WithLogger(l Logger) Option {
+	return func(c *Config) {
+		if l == nil {
+			l = stdLogger{}
+		}
+		c.Logger = l
+	}
+}
+
+// WithStrictMetadata makes master refuse to start if the metadata loaded from disk has
+// more than maxErrors inconsistencies, rather than repairing them and serving the rest
+func WithStrictMetadata(maxErrors int) Option {
+	return func(c *Config) {
+		c.StrictMetadata = true
+		c.MaxMetadataErrors = maxErrors
+	}
+}
@@ -0,0 +1,71 @@
+package master
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"gfs"
+	log "github.com/Sirupsen/logrus"
+)
+
+// serveHealth starts an HTTP server on addr for load balancers and orchestration,
+// which don't speak the RPC protocol of master. /healthz returns 200 as long as
+// master is serving, and /readyz returns 200 once metadata is loaded and at least
+// one chunkserver is alive. Both return 503 otherwise. /metrics returns the stats of
+// RPCGetMasterStats as "name value" lines for alerting. The server is closed by Shutdown.
+func (m *Master) serveHealth(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("health check listen error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-m.shutdown:
+			http.Error(w, "shutdown", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-m.loaded:
+		default:
+			http.Error(w, "loading metadata", http.StatusServiceUnavailable)
+			return
+		}
+		if m.csm.NumServers() == 0 {
+			http.Error(w, "no chunkserver", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var st gfs.MasterStatsReply
+		if err := m.RPCGetMasterStats(gfs.GetMasterStatsArg{}, &st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "gfs_files %v\n", st.Files)
+		fmt.Fprintf(w, "gfs_directories %v\n", st.Directories)
+		fmt.Fprintf(w, "gfs_chunks %v\n", st.Chunks)
+		fmt.Fprintf(w, "gfs_chunkservers %v\n", st.ChunkServers)
+		fmt.Fprintf(w, "gfs_under_replicated %v\n", st.UnderReplicated)
+		fmt.Fprintf(w, "gfs_need_list_depth %v\n", st.NeedListDepth)
+		fmt.Fprintf(w, "gfs_garbage_queued %v\n", st.GarbageQueued)
+		fmt.Fprintf(w, "gfs_copies_in_flight %v\n", st.CopiesInFlight)
+		fmt.Fprintf(w, "gfs_re_replicated_total %v\n", st.ReReplicated)
+		fmt.Fprintf(w, "gfs_re_replicate_failed_total %v\n", st.ReReplicateFailed)
+	})
+
+	m.health = &http.Server{Handler: mux}
+	go func() {
+		if err := m.health.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Warning("health check serve error: ", err)
+		}
+	}()
+	return nil
+}
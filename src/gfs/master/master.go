@@ -1,13 +1,17 @@
 package master
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gfs"
@@ -19,39 +23,104 @@ type Master struct {
 	address    gfs.ServerAddress // master server address
 	serverRoot string
 	l          net.Listener
+	conns      *util.ArraySet // open connections, closed on shutdown
+	handlers   sync.WaitGroup // goroutines serving connections
+	accepting  chan struct{}  // closed when no more connections are accepted
+	tls        *tls.Config    // nil if rpc is in plaintext
 	shutdown   chan struct{}
-	dead       bool // set to ture if server is shuntdown
+	dead       bool          // set to ture if server is shuntdown
+	loaded     chan struct{} // closed when metadata is loaded
+	health     *http.Server  // nil if health check is disabled
 
-	nm  *namespaceManager
-	cm  *chunkManager
-	csm *chunkServerManager
+	nm     *namespaceManager
+	cm     *chunkManager
+	csm    *chunkServerManager
+	tasks  *taskStatusMap
+	oplog  *operationLog
+	config Config
+
+	copySlots chan struct{}            // a slot is taken during each chunk copy
+	copyLock  sync.Mutex               // protects copying
+	copying   map[gfs.ChunkHandle]bool // chunks being re-replicated in background
+	copied    int64                    // re-replications completed, accessed atomically
+	copyFails int64                    // re-replications failed, accessed atomically
+
+	storing     sync.Mutex // one checkpoint is stored at a time
+	storedIndex int64      // index of operation log covered by the last checkpoint, protected by storing
 }
 
 const (
 	MetaFileName = "gfs-master.meta"
+	LogFileName  = "gfs-master.log"
 	FilePerm     = 0755
 )
 
+// errLeaseOutstanding aborts a snapshot or a copy which waits for a lease to expire,
+// so it is retried after the wait without holding locks
+var errLeaseOutstanding = fmt.Errorf("lease is outstanding")
+
 // NewAndServe starts a master and returns the pointer to it.
-func NewAndServe(address gfs.ServerAddress, serverRoot string) *Master {
+// An error is returned if the master cannot listen on address or open its operation log.
+// If config is not nil, rpc is served and sent over TLS with it, so it should hold
+// both the certificate of master and the CAs to verify chunkservers.
+// opts override the parameters in DefaultConfig.
+func NewAndServe(address gfs.ServerAddress, serverRoot string, config *tls.Config, opts ...Option) (*Master, error) {
 	m := &Master{
 		address:    address,
 		serverRoot: serverRoot,
+		tls:        config,
+		conns:      new(util.ArraySet),
 		shutdown:   make(chan struct{}),
+		loaded:     make(chan struct{}),
+		accepting:  make(chan struct{}),
+		tasks:      newTaskStatusMap(),
+		config:     DefaultConfig(),
+	}
+	for _, opt := range opts {
+		opt(&m.config)
 	}
+	if m.config.ChunkSize < gfs.ChecksumBlockSize || m.config.ChunkSize > gfs.MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %v", m.config.ChunkSize)
+	}
+	if m.config.MaxConcurrentCopies < 1 {
+		return nil, fmt.Errorf("invalid max concurrent copies %v", m.config.MaxConcurrentCopies)
+	}
+	if m.config.MinFreeSpace < 0 {
+		return nil, fmt.Errorf("invalid min free space %v", m.config.MinFreeSpace)
+	}
+	m.copySlots = make(chan struct{}, m.config.MaxConcurrentCopies)
+	m.copying = make(map[gfs.ChunkHandle]bool)
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(m)
 	l, e := net.Listen("tcp", string(m.address))
 	if e != nil {
-		log.Fatal("listen error:", e)
+		return nil, fmt.Errorf("listen error: %v", e)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
 	}
 	m.l = l
 
-	m.initMetadata()
+	if m.config.HealthAddress != "" {
+		if err := m.serveHealth(m.config.HealthAddress); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	if err := m.initMetadata(); err != nil {
+		l.Close()
+		if m.health != nil {
+			m.health.Close()
+		}
+		return nil, err
+	}
+	close(m.loaded)
 
 	// RPC Handler
 	go func() {
+		defer close(m.accepting)
 		for {
 			select {
 			case <-m.shutdown:
@@ -59,125 +128,357 @@ func NewAndServe(address gfs.ServerAddress, serverRoot string) *Master {
 			default:
 			}
 			conn, err := m.l.Accept()
-			if err == nil {
-				go func() {
-					rpcs.ServeConn(conn)
-					conn.Close()
-				}()
-			} else {
-				if !m.dead {
-					log.Fatal("master accept error:", err)
+			if err != nil {
+				select {
+				case <-m.shutdown: // listener is closed by Shutdown
+					return
+				default:
 				}
+				m.config.Logger.Warn("master accept error: ", err)
+				continue
 			}
+			m.conns.Add(conn)
+			m.handlers.Add(1)
+			go func() {
+				defer m.handlers.Done()
+				rpcs.ServeConn(conn)
+				conn.Close()
+				m.conns.Delete(conn)
+			}()
 		}
 	}()
 
 	// Background Task
 	// BackgroundActivity does all the background activities
 	// server disconnection handle, garbage collection, stale replica detection, etc
-	go func() {
-		checkTicker := time.Tick(gfs.ServerCheckInterval)
-		storeTicker := time.Tick(gfs.MasterStoreInterval)
-		for {
-			var err error
-			select {
-			case <-m.shutdown:
-				return
-			case <-checkTicker:
-				err = m.serverCheck()
-			case <-storeTicker:
-				err = m.storeMeta()
-			}
-			if err != nil {
-				log.Error("Background error ", err)
-			}
-		}
-
-	}()
+	m.RegisterBackgroundTask(&periodicTask{"serverCheck", m.config.BackgroundInterval, m.serverCheck})
+	m.RegisterBackgroundTask(&periodicTask{"storeMeta", gfs.MasterStoreInterval, m.storeMeta})
+	m.RegisterBackgroundTask(&periodicTask{"compactLog", m.config.BackgroundInterval, m.compactLog})
+	m.RegisterBackgroundTask(&periodicTask{"rebalance", gfs.RebalanceInterval, m.rebalance})
+	m.RegisterBackgroundTask(&periodicTask{"replicaScan", gfs.ReplicaScanInterval, m.scanReplicas})
+	m.RegisterBackgroundTask(&periodicTask{"garbageCollection", m.config.GCInterval, m.garbageCollection})
 
-	log.Infof("Master is running now. addr = %v", address)
+	m.config.Logger.Info(fmt.Sprintf("Master is running now. addr = %v", address))
 
-	return m
+	return m, nil
 }
 
 // InitMetadata initiates meta data
-func (m *Master) initMetadata() {
+func (m *Master) initMetadata() error {
 	m.nm = newNamespaceManager()
-	m.cm = newChunkManager()
-	m.csm = newChunkServerManager()
-	m.loadMeta()
-	return
+	m.nm.lockTimeout = m.config.LockTimeout
+	m.nm.defaultReplicas = m.config.DefaultReplicas
+	m.cm = newChunkManager(m.config.LeaseDuration, m.tls)
+	m.cm.lockTimeout = m.config.LockTimeout
+	m.cm.defaultReplicas = m.config.DefaultReplicas
+	m.csm = newChunkServerManager(m.config.ServerTimeout, m.config.DeadServerChecks, m.config.MinFreeSpace)
+	seq, err := m.loadMeta()
+	if err != nil {
+		m.config.Logger.Warn("error in load metadata: ", err)
+	}
+	m.cm.StartLeaseGrace()
+	if n := m.verifyMetadata(); m.config.StrictMetadata && n > m.config.MaxMetadataErrors {
+		return fmt.Errorf("%v inconsistencies in metadata, more than %v allowed", n, m.config.MaxMetadataErrors)
+	}
+
+	m.oplog, err = openOperationLog(path.Join(m.serverRoot, LogFileName), seq)
+	if err != nil {
+		return fmt.Errorf("cannot open operation log: %v", err)
+	}
+	m.nm.oplog = m.oplog
+	m.cm.oplog = m.oplog
+	return nil
 }
 
 type PersistentBlock struct {
-	NamespaceTree []serialTreeNode
-	ChunkInfo     []serialChunkInfo
+	NamespaceTree  []serialTreeNode
+	ChunkInfo      []serialChunkInfo
+	NumChunkHandle gfs.ChunkHandle
+	LogSeq         int64 // sequence number of the last operation logged before the checkpoint
 }
 
-// loadMeta loads metadata from disk
-func (m *Master) loadMeta() error {
+// loadMeta loads the last checkpoint from disk and replays the operation log on it.
+// It returns the sequence number of the last operation loaded.
+func (m *Master) loadMeta() (int64, error) {
+	var meta PersistentBlock
 	filename := path.Join(m.serverRoot, MetaFileName)
 	file, err := os.OpenFile(filename, os.O_RDONLY, FilePerm)
-	if err != nil {
-		return err
+	if err == nil {
+		defer file.Close()
+
+		dec := gob.NewDecoder(file)
+		err = dec.Decode(&meta)
+		if err != nil {
+			return 0, err
+		}
+
+		m.restore(meta)
+	} else if !os.IsNotExist(err) {
+		return 0, err
 	}
-	defer file.Close()
 
-	var meta PersistentBlock
-	dec := gob.NewDecoder(file)
-	err = dec.Decode(&meta)
-	if err != nil {
-		return err
+	return m.replayLog(meta.LogSeq)
+}
+
+// checkpoint returns the metadata to be stored to disk or sent to shadow masters
+func (m *Master) checkpoint() PersistentBlock {
+	return PersistentBlock{
+		NamespaceTree:  m.nm.Serialize(),
+		ChunkInfo:      m.cm.Serialize(),
+		NumChunkHandle: m.cm.NextHandle(),
 	}
+}
 
+// restore loads the metadata of a checkpoint
+func (m *Master) restore(meta PersistentBlock) {
 	m.nm.Deserialize(meta.NamespaceTree)
 	m.cm.Deserialize(meta.ChunkInfo)
+	m.cm.SetNextHandle(meta.NumChunkHandle)
+}
 
-	return nil
+// replayLog applies the operations in log to the metadata loaded from checkpoint.
+// The operations up to seq are in the checkpoint already, they are left in the log if
+// master stops before it is compacted. A partially written trailing record is cut off
+// from the log. It returns the sequence number of the last operation in the log or checkpoint.
+func (m *Master) replayLog(seq int64) (int64, error) {
+	filename := path.Join(m.serverRoot, LogFileName)
+	ops, valid, err := readOperationLog(filename)
+	if err != nil {
+		return seq, err
+	}
+
+	replayed := 0
+	for _, op := range ops {
+		if op.Seq != 0 && op.Seq <= seq {
+			continue
+		}
+		if err := m.applyOperation(op); err != nil {
+			m.config.Logger.Info("Master : replay ", op, " ", err)
+		}
+		if op.Seq > seq {
+			seq = op.Seq
+		}
+		replayed++
+	}
+	m.config.Logger.Info(fmt.Sprintf("Master : replay %v of %v operations", replayed, len(ops)))
+
+	if info, err := os.Stat(filename); err == nil && info.Size() > valid {
+		return seq, os.Truncate(filename, valid)
+	}
+	return seq, nil
+}
+
+// applyOperation applies an operation of the log to metadata without logging it again
+func (m *Master) applyOperation(op operation) error {
+	var err error
+	switch op.Type {
+	case opCreate:
+		err = m.nm.Create(op.Path, op.Replicas, op.Compressed, op.MaxChunks, op.time())
+		if err == nil && len(op.Handles) > 0 { // a copy of file
+			err = m.replayChunks(op)
+		}
+	case opMkdir:
+		err = m.nm.Mkdir(op.Path, op.time())
+	case opDelete:
+		_, hiddenName := m.nm.PartionLastName(op.Target)
+		err = m.nm.deleteAs(op.Path, hiddenName, op.Recursive, func(hidden gfs.Path) {
+			m.cm.RenameFiles(op.Path, hidden)
+		})
+	case opRename:
+		err = m.nm.Rename(op.Path, op.Target, op.time(), func() {
+			m.cm.RenameFiles(op.Path, op.Target)
+		})
+	case opSnapshot:
+		err = m.nm.Snapshot(op.Path, op.Target, op.time(), func() error {
+			m.cm.CopyFiles(op.Path, op.Target)
+			return nil
+		})
+	case opPurge:
+		// the replicas are reported as garbage when chunkservers register
+		err = m.nm.Purge(op.Path, func() {
+			m.cm.RemoveFiles(op.Path)
+		})
+	case opSetQuota:
+		err = m.nm.SetQuota(op.Path, op.Quota)
+	case opSetReplicas:
+		err = m.nm.SetReplicas(op.Path, op.Replicas, func() {
+			m.cm.SetReplicas(op.Path, op.Replicas)
+		})
+	case opAddChunks:
+		err = m.replayChunks(op)
+	case opCopyChunk:
+		m.cm.CopyChunk(op.Handle, op.Handles[0], op.Version, op.Paths)
+	case opSetVersion:
+		m.cm.SetVersion(op.Handle, op.Version)
+	case opReserveHandles:
+		m.cm.SetNextHandle(op.Handle)
+	case opFillHole:
+		m.cm.FillHole(op.Handle)
+	case opSetLength:
+		err = m.nm.updateFile(op.Path, func(file *nsTree) {
+			if op.Length > file.length {
+				file.length = op.Length
+			}
+		})
+	case opTruncate:
+		err = m.nm.updateFile(op.Path, func(file *nsTree) {
+			m.truncateFile(op.Path, file, op.Length)
+		})
+	}
+	return err
+}
+
+// replayChunks appends the chunks logged in op to its file, and raises the length of file to op.Length
+func (m *Master) replayChunks(op operation) error {
+	return m.nm.updateFile(op.Path, func(file *nsTree) {
+		n := int64(m.cm.AddChunks(op.Path, op.Handles, op.Versions, nil, file.replicas, op.Holes))
+		parent, _ := m.nm.PartionLastName(op.Path)
+		m.nm.addUsage(parent, n)
+		file.chunks += n
+		if op.Length > file.length {
+			file.length = op.Length
+		}
+	})
 }
 
-// storeMeta stores metadata to disk
+// storeMeta stores metadata to disk.
+// It writes to a temporary file first, so a crash never leaves a torn metadata file.
+// The operations logged before the checkpoint starts are then dropped from the log.
 func (m *Master) storeMeta() error {
+	m.storing.Lock()
+	defer m.storing.Unlock()
+
+	// the log position and the metadata are taken together, see operationLog.Checkpoint
+	var logPos, logIndex int64
+	var meta PersistentBlock
+	m.oplog.Checkpoint(func() {
+		meta = m.checkpoint()
+		if m.oplog != nil {
+			logPos = m.oplog.Size()
+			_, logIndex = m.oplog.Index()
+			meta.LogSeq = m.oplog.Seq()
+		}
+	})
+
 	filename := path.Join(m.serverRoot, MetaFileName)
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, FilePerm)
+	tmpname := filename + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePerm)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	var meta PersistentBlock
-
-	meta.NamespaceTree = m.nm.Serialize()
-	meta.ChunkInfo = m.cm.Serialize()
 
-	log.Infof("Master : store metadata")
+	m.config.Logger.Info("Master : store metadata")
 	enc := gob.NewEncoder(file)
 	err = enc.Encode(meta)
-	return err
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpname, filename); err != nil {
+		return err
+	}
+
+	if m.oplog != nil {
+		m.storedIndex = logIndex
+		return m.oplog.Compact(logPos)
+	}
+	return nil
+}
+
+// compactLog stores a checkpoint if the operation log is longer than Config.LogCompactSize,
+// or has more than Config.LogCompactRecords operations logged since the last checkpoint,
+// so the log replayed when master restarts stays short. The metadata is only locked to be
+// copied, mutations go on while the checkpoint is written to disk.
+func (m *Master) compactLog() error {
+	if m.oplog == nil {
+		return nil
+	}
+	size := m.oplog.Size()
+	_, index := m.oplog.Index()
+	m.storing.Lock()
+	records := index - m.storedIndex
+	m.storing.Unlock()
+
+	maxSize, maxRecords := m.config.LogCompactSize, m.config.LogCompactRecords
+	if (maxSize > 0 && size > maxSize) || (maxRecords > 0 && records > maxRecords) {
+		m.config.Logger.Info(fmt.Sprintf("Master : compact operation log of %v bytes, %v records", size, records))
+		return m.storeMeta()
+	}
+	return nil
 }
 
-// Shutdown shuts down master
+// Shutdown shuts down master. It waits for the rpcs in flight, see drain,
+// so the metadata stored afterward has their changes.
 func (m *Master) Shutdown() {
 	if !m.dead {
-		log.Warning(m.address, " Shutdown")
+		m.config.Logger.Warn(m.address, " Shutdown")
 		m.dead = true
 		close(m.shutdown)
 		m.l.Close()
+		<-m.accepting
+		m.drain()
+		if m.health != nil {
+			m.health.Close()
+		}
 	}
 
 	err := m.storeMeta()
 	if err != nil {
-		log.Warning("error in store metadeta: ", err)
+		m.config.Logger.Warn("error in store metadeta: ", err)
+	}
+	if m.oplog != nil {
+		m.oplog.Close()
+	}
+}
+
+// drain stops reading requests from the open connections, which ends the idle ones,
+// and waits until the rpcs in flight reply or the drain timeout fires.
+// The connections left are closed then.
+func (m *Master) drain() {
+	for _, conn := range m.conns.GetAll() {
+		closeRead(conn.(net.Conn))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(m.config.DrainTimeout):
+		m.config.Logger.Warn(m.address, " shutdown does not wait for the rpcs in flight any more")
+	}
+
+	for _, conn := range m.conns.GetAllAndClear() {
+		conn.(net.Conn).Close()
+	}
+}
+
+// closeRead shuts down the reading side of conn, so the replies can still be sent.
+// conn is closed if it is not a TCP connection.
+func closeRead(conn net.Conn) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
 	}
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.CloseRead()
+		return
+	}
+	conn.Close()
 }
 
 // serverCheck checks all chunkserver according to last heartbeat time
 // then removes all the information of the disconnnected servers
 func (m *Master) serverCheck() error {
 	// detect dead servers
+	var lost []gfs.ChunkHandle
 	addrs := m.csm.DetectDeadServers()
 	for _, v := range addrs {
-		log.Warningf("remove server %v", v)
+		m.config.Logger.Warn(fmt.Sprintf("remove server %v", v))
 		handles, err := m.csm.RemoveServer(v)
 		if err != nil {
 			return err
@@ -186,218 +487,1422 @@ func (m *Master) serverCheck() error {
 		if err != nil {
 			return err
 		}
+		lost = append(lost, handles...)
 	}
 
-	// add replicas for need request
-	handles := m.cm.GetNeedlist()
+	// add replicas for need request, chunks of the dead servers go first
+	handles := m.cm.GetNeedlist(m.csm.NumActive())
 	if handles != nil {
-		log.Info("Master Need ", handles)
-		m.cm.RLock()
-		for i := 0; i < len(handles); i++ {
-			ck := m.cm.chunk[handles[i]]
-
-			if ck.expire.Before(time.Now()) {
-				ck.Lock() // don't grant lease during copy
-				err := m.reReplication(handles[i])
-				log.Info(err)
-				ck.Unlock()
-			}
-		}
-		m.cm.RUnlock()
+		m.config.Logger.Info("Master Need ", handles)
+		m.replicateAll(prioritize(handles, lost))
 	}
+
+	m.trimReplicas()
 	return nil
 }
 
-// reReplication performs re-replication, ck should be locked in top caller
-// new lease will not be granted during copy
-func (m *Master) reReplication(handle gfs.ChunkHandle) error {
-	// chunk are locked, so master will not grant lease during copy time
-	from, to, err := m.csm.ChooseReReplication(handle)
-	if err != nil {
-		return err
+// scanReplicas finds chunks which lost replicas without a server dying, e.g. to a disk
+// failure noticed after master restarts. They are re-replicated by the next serverCheck.
+// Only gfs.ReplicaScanBatch chunks are checked in one run.
+func (m *Master) scanReplicas() error {
+	if need := m.cm.ScanReplicas(gfs.ReplicaScanBatch, m.csm.NumActive()); len(need) > 0 {
+		m.config.Logger.Warn(fmt.Sprintf("replica scan finds under-replicated chunks %v", need))
 	}
-	log.Warningf("allocate new chunk %v from %v to %v", handle, from, to)
+	return nil
+}
 
-	var cr gfs.CreateChunkReply
-	err = util.Call(to, "ChunkServer.RPCCreateChunk", gfs.CreateChunkArg{handle}, &cr)
-	if err != nil {
-		return err
+// prioritize moves the handles in first to the front of handles
+func prioritize(handles, first []gfs.ChunkHandle) []gfs.ChunkHandle {
+	urgent := make(map[gfs.ChunkHandle]bool)
+	for _, h := range first {
+		urgent[h] = true
 	}
 
-	var sr gfs.SendCopyReply
-	err = util.Call(from, "ChunkServer.RPCSendCopy", gfs.SendCopyArg{handle, to}, &sr)
-	if err != nil {
-		return err
+	ret := make([]gfs.ChunkHandle, 0, len(handles))
+	for _, h := range handles {
+		if urgent[h] {
+			ret = append(ret, h)
+		}
 	}
+	for _, h := range handles {
+		if !urgent[h] {
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
 
-	m.cm.RegisterReplica(handle, to, false)
-	m.csm.AddChunk([]gfs.ServerAddress{to}, handle)
-	return nil
+// replicateAll re-replicates the chunks in background until each has as many replicas
+// as its replication factor. Copies are started in order and wait for copy slots, chunks
+// already being re-replicated are skipped. It returns without waiting for the copies,
+// so slow copies don't delay the detection of dead servers.
+func (m *Master) replicateAll(handles []gfs.ChunkHandle) {
+	// chunk locks are not taken under cm lock, GetLeaseHolder locks in the reverse order
+	m.cm.RLock()
+	cks := make([]*chunkInfo, len(handles))
+	factors := make([]int, len(handles))
+	for i, h := range handles {
+		if ck, ok := m.cm.chunk[h]; ok {
+			cks[i], factors[i] = ck, m.cm.replicaFactor(ck)
+		}
+	}
+	m.cm.RUnlock()
+
+	for i, ck := range cks {
+		if ck == nil { // reclaimed by garbage collection
+			continue
+		}
+
+		m.copyLock.Lock()
+		busy := m.copying[handles[i]]
+		m.copying[handles[i]] = true
+		m.copyLock.Unlock()
+		if busy {
+			continue
+		}
+
+		go func(handle gfs.ChunkHandle, ck *chunkInfo, factor int) {
+			defer func() {
+				m.copyLock.Lock()
+				delete(m.copying, handle)
+				m.copyLock.Unlock()
+			}()
+
+			defer m.takeCopySlot()()
+			ck.Lock() // don't grant lease during copy
+			defer ck.Unlock()
+			for len(ck.location) < factor {
+				if err := m.reReplication(handle); err != nil {
+					m.config.Logger.Info(err)
+					return
+				}
+			}
+		}(handles[i], ck, factors[i])
+	}
 }
 
-// RPCHeartbeat is called by chunkserver to let the master know that a chunkserver is alive
-func (m *Master) RPCHeartbeat(args gfs.HeartbeatArg, reply *gfs.HeartbeatReply) error {
-	isFirst := m.csm.Heartbeat(args.Address, reply)
+// trimReplicas removes the extra replicas of over-replicated chunks, e.g. when a
+// server rejoins after its chunks are re-replicated. Replicas are removed from the
+// most loaded holders, but never from the lease holder. Chunks locked by others are skipped,
+// so server checks are not blocked by copies in background.
+func (m *Master) trimReplicas() {
+	type replicated struct {
+		handle gfs.ChunkHandle
+		ck     *chunkInfo
+		factor int
+	}
 
-	for _, handle := range args.LeaseExtensions {
-		continue
-		// ATTENTION !! dead lock
-		m.cm.ExtendLease(handle, args.Address)
+	// chunk locks are not taken under cm lock, GetLeaseHolder locks in the reverse order
+	m.cm.RLock()
+	cks := make([]replicated, 0, len(m.cm.chunk))
+	for h, ck := range m.cm.chunk {
+		cks = append(cks, replicated{h, ck, m.cm.replicaFactor(ck)})
 	}
+	m.cm.RUnlock()
 
-	if isFirst { // if is first heartbeat, let chunkserver report itself
-		var r gfs.ReportSelfReply
-		err := util.Call(args.Address, "ChunkServer.RPCReportSelf", gfs.ReportSelfArg{}, &r)
-		if err != nil {
-			return err
+	for _, v := range cks {
+		ck := v.ck
+		// the chunk may be locked during a copy, it is trimmed on a later check
+		if !ck.TryLock() {
+			continue
 		}
-
-		for _, v := range r.Chunks {
-			m.cm.RLock()
-			ck, ok := m.cm.chunk[v.Handle]
+		for len(ck.location) > v.factor {
+			var holder gfs.ServerAddress
+			if ck.expire.After(time.Now()) {
+				holder = ck.primary
+			}
+			addr, ok := m.csm.MostLoaded(ck.location, holder)
 			if !ok {
-				continue
+				break
 			}
-			version := ck.version
-			m.cm.RUnlock()
+			m.config.Logger.Info(fmt.Sprintf("Master : trim replica of %v on %v", v.handle, addr))
 
-			if v.Version == version {
-				log.Infof("Master receive chunk %v from %v", v.Handle, args.Address)
-				m.cm.RegisterReplica(v.Handle, args.Address, true)
-				m.csm.AddChunk([]gfs.ServerAddress{args.Address}, v.Handle)
-			} else {
-				log.Infof("Master discard %v", v.Handle)
+			var newlist []gfs.ServerAddress
+			for _, a := range ck.location {
+				if a != addr {
+					newlist = append(newlist, a)
+				}
 			}
+			ck.location = newlist
+			m.csm.RemoveChunk(addr, v.handle)
+			m.csm.AddGarbage(addr, v.handle)
+		}
+		ck.Unlock()
+	}
+}
+
+// garbageCollection reclaims the files deleted longer than the grace period ago, and the
+// chunks no longer referenced by any file. A deleted file can be restored by renaming it
+// back before that. The replicas are deleted by chunkservers on their next heartbeat.
+func (m *Master) garbageCollection() error {
+	expired := m.nm.ExpiredDeleted(time.Now().Add(-m.config.GCGracePeriod))
+	for _, p := range expired {
+		var garbage map[gfs.ChunkHandle][]gfs.ServerAddress
+		err := m.nm.Purge(p, func() {
+			garbage = m.cm.RemoveFiles(p)
+		})
+		if err != nil { // restored or purged concurrently
+			m.config.Logger.Info("Master : purge ", p, " ", err)
+			continue
 		}
+		m.config.Logger.Info(fmt.Sprintf("Master : purge %v, reclaim %v chunks", p, len(garbage)))
+		m.addGarbage(garbage)
 	}
+
+	m.addGarbage(m.cm.RemoveOrphans())
 	return nil
 }
 
-// RPCGetPrimaryAndSecondaries returns lease holder and secondaries of a chunk.
-// If no one holds the lease currently, grant one.
-// Master will communicate with all replicas holder to check version, if stale replica is detected, add it to garbage collection
-func (m *Master) RPCGetPrimaryAndSecondaries(args gfs.GetPrimaryAndSecondariesArg, reply *gfs.GetPrimaryAndSecondariesReply) error {
-	lease, staleServers, err := m.cm.GetLeaseHolder(args.Handle)
-	if err != nil {
+// addGarbage asks the holders of replicas to delete them
+func (m *Master) addGarbage(garbage map[gfs.ChunkHandle][]gfs.ServerAddress) {
+	for handle, addrs := range garbage {
+		for _, addr := range addrs {
+			m.csm.RemoveChunk(addr, handle)
+			m.csm.AddGarbage(addr, handle)
+		}
+	}
+}
+
+// reReplication performs re-replication, ck should be locked in top caller
+// new lease will not be granted during copy. The new replica is created with version 0 and
+// gets the current version of chunk from the copy, so an empty replica left by a failed copy
+// is stale and collected as garbage once it is reported.
+// A copy slot should be taken in top caller before ck is locked, see takeCopySlot.
+// A source too busy to send the copy is skipped for another replica.
+func (m *Master) reReplication(handle gfs.ChunkHandle) (err error) {
+	defer func() {
+		if err != nil {
+			atomic.AddInt64(&m.copyFails, 1)
+		} else {
+			atomic.AddInt64(&m.copied, 1)
+		}
+	}()
+
+	// the outstanding lease is revoked and the chunk is locked, so no mutation is applied during copy time
+	if err := m.cm.RevokeLease(handle); err != nil {
 		return err
 	}
 
-	for _, v := range staleServers {
-		m.csm.AddGarbage(v, args.Handle)
+	m.cm.RLock()
+	ck, ok := m.cm.chunk[handle]
+	m.cm.RUnlock()
+	if !ok {
+		return fmt.Errorf("cannot find chunk %v", handle)
 	}
 
-	reply.Primary = lease.Primary
-	reply.Expire = lease.Expire
-	reply.Secondaries = lease.Secondaries
+	excluded := m.cm.Quarantined(handle)
+	var to gfs.ServerAddress
+	for {
+		var from gfs.ServerAddress
+		var err error
+		from, to, err = m.csm.ChooseReReplication(handle, ck.location, excluded)
+		if err != nil {
+			return err
+		}
+		m.config.Logger.Warn(fmt.Sprintf("allocate new chunk %v from %v to %v", handle, from, to))
+
+		var cr gfs.CreateChunkReply
+		err = util.CallTLSWithRetry(m.tls, to, "ChunkServer.RPCCreateChunk", gfs.CreateChunkArg{Handle: handle}, &cr, gfs.RPCMaxRetries)
+		if err != nil {
+			m.csm.CopyDone(from)
+			if !gfs.IsError(err, gfs.ErrNoSpace) {
+				return err
+			}
+			// the server is fuller than its last heartbeat tells, try another one
+			m.config.Logger.Warn(err)
+			m.csm.MarkFull(to)
+			continue
+		}
+
+		var sr gfs.SendCopyReply
+		err = util.CallTLSWithRetry(m.tls, from, "ChunkServer.RPCSendCopy", gfs.SendCopyArg{handle, to, handle}, &sr, gfs.RPCMaxRetries)
+		m.csm.CopyDone(from)
+		if err == nil {
+			break
+		}
+		if !gfs.IsError(err, gfs.ErrServerBusy) && !gfs.IsError(err, gfs.ErrChecksumMismatch) {
+			return err
+		}
+		// the source is sending as many copies as it may, or its replica is corrupted,
+		// copy from another replica
+		m.config.Logger.Warn(err)
+		excluded = append(excluded, from)
+	}
+
+	m.cm.RegisterReplica(handle, to, false)
+	m.csm.AddChunk([]gfs.ServerAddress{to}, handle)
 	return nil
 }
 
-// RPCExtendLease extends the lease of chunk if the lessee is nobody or requester.
-func (m *Master) RPCExtendLease(args gfs.ExtendLeaseArg, reply *gfs.ExtendLeaseReply) error {
-	//t, err := m.cm.ExtendLease(args.Handle, args.Address)
-	//if err != nil { return err }
-	//reply.Expire = *t
-	return nil
+// takeCopySlot waits for a free copy slot, at most MaxConcurrentCopies chunks are copied at once.
+// It is taken before the chunk is locked and its lease revoked, so a chunk waiting for a slot
+// is still writable. It returns a function to release the slot.
+func (m *Master) takeCopySlot() (release func()) {
+	m.copySlots <- struct{}{}
+	return func() { <-m.copySlots }
 }
 
-// RPCGetReplicas is called by client to find all chunkserver that holds the chunk.
-func (m *Master) RPCGetReplicas(args gfs.GetReplicasArg, reply *gfs.GetReplicasReply) error {
-	servers, err := m.cm.GetReplicas(args.Handle)
+// RPCDecommissionServer drains a chunkserver before it is taken out of service.
+// No new replica is placed on it, and every chunk it holds is re-replicated until it
+// has as many replicas elsewhere as its replication factor. The server is then removed
+// from the locations of its chunks. It returns after all chunks are handled.
+func (m *Master) RPCDecommissionServer(args gfs.DecommissionServerArg, reply *gfs.DecommissionServerReply) error {
+	handles, err := m.csm.SetDraining(args.Address)
 	if err != nil {
 		return err
 	}
-	for _, v := range servers {
-		reply.Locations = append(reply.Locations, v)
+	m.config.Logger.Info(fmt.Sprintf("Master decommission %v, drain %v chunks", args.Address, len(handles)))
+
+	for _, handle := range handles {
+		if err := m.drainChunk(handle, args.Address); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// RPCCreateFile is called by client to create a new file
-func (m *Master) RPCCreateFile(args gfs.CreateFileArg, reply *gfs.CreateFileReply) error {
-	err := m.nm.Create(args.Path)
-	return err
-}
-
-// RPCDelete is called by client to delete a file
-func (m *Master) RPCDeleteFile(args gfs.DeleteFileArg, reply *gfs.DeleteFileReply) error {
-	err := m.nm.Delete(args.Path)
-	return err
+// RPCInvalidateReplica drops a replica known to be bad, e.g. by an operator, without waiting
+// for a scrub to find it. The server is told to delete its copy, and the chunk is re-replicated
+// from the other replicas in background. The last replica is kept unless args.Force is set.
+func (m *Master) RPCInvalidateReplica(args gfs.InvalidateReplicaArg, reply *gfs.InvalidateReplicaReply) error {
+	return m.invalidateReplica(args.Handle, args.Server, args.Force)
 }
 
-// RPCRename is called by client to rename a file
-func (m *Master) RPCRenameFile(args gfs.RenameFileArg, reply *gfs.RenameFileReply) error {
-	err := m.nm.Rename(args.Source, args.Target)
-	return err
-}
+func (m *Master) invalidateReplica(handle gfs.ChunkHandle, server gfs.ServerAddress, force bool) error {
+	if err := m.cm.InvalidateReplica(handle, server, force); err != nil {
+		return err
+	}
+	m.csm.RemoveChunk(server, handle)
+	m.config.Logger.Warn(fmt.Sprintf("Master invalidate replica of chunk %v on %v", handle, server))
 
-// RPCMkdir is called by client to make a new directory
-func (m *Master) RPCMkdir(args gfs.MkdirArg, reply *gfs.MkdirReply) error {
-	err := m.nm.Mkdir(args.Path)
-	return err
+	err := util.CallTLS(m.tls, server, "ChunkServer.RPCDeleteChunk", gfs.DeleteChunkArg{[]gfs.ChunkHandle{handle}}, &gfs.DeleteChunkReply{})
+	if err != nil { // deleted in heartbeat when the server is back
+		m.config.Logger.Warn(fmt.Sprintf("Master delete chunk %v on %v: %v", handle, server, err))
+		m.csm.AddGarbage(server, handle)
+	}
+	return nil
 }
 
-// RPCList is called by client to list all files in specific directory
-func (m *Master) RPCList(args gfs.ListArg, reply *gfs.ListReply) error {
-	var err error
-	reply.Files, err = m.nm.List(args.Path)
-	return err
+// RPCReportBadReplica is called by a client whose read fails on a replica not matching its
+// checksum. The mismatch is counted towards quarantine, and the replica is replaced in background
+// as if the server reported it in heartbeat, rather than waiting for the heartbeat.
+func (m *Master) RPCReportBadReplica(args gfs.ReportBadReplicaArg, reply *gfs.ReportBadReplicaReply) error {
+	m.config.Logger.Warn(fmt.Sprintf("Master read repair of chunk %v on %v", args.Handle, args.Server))
+	m.reportMismatch(args.Handle, args.Server)
+	go m.replaceCorrupted(args.Handle, args.Server)
+	return nil
 }
 
-// RPCGetFileInfo is called by client to get file information
-func (m *Master) RPCGetFileInfo(args gfs.GetFileInfoArg, reply *gfs.GetFileInfoReply) error {
-	ps, cwd, err := m.nm.lockParents(args.Path, false)
-	defer m.nm.unlockParents(ps)
-	if err != nil {
-		return err
+// RPCReportChecksumMismatch is called by tools which find a replica not matching
+// its checksum. Chunkservers report their own mismatches in heartbeat. A replica with repeated
+// mismatches is quarantined: it is invalidated unless it is the last one, and its server is
+// neither a source nor a destination of re-replication of the chunk for gfs.QuarantineTime.
+func (m *Master) RPCReportChecksumMismatch(args gfs.ReportChecksumMismatchArg, reply *gfs.ReportChecksumMismatchReply) error {
+	reply.Quarantined = m.reportMismatch(args.Handle, args.Server)
+	if !reply.Quarantined {
+		return nil
 	}
-
-	file, ok := cwd.children[ps[len(ps)-1]]
-	if !ok {
-		return fmt.Errorf("File %v does not exist", args.Path)
+	if err := m.invalidateReplica(args.Handle, args.Server, false); err != nil {
+		m.config.Logger.Warn(err)
 	}
-	file.Lock()
-	defer file.Unlock()
-
-	reply.IsDir = file.isDir
-	reply.Length = file.length
-	reply.Chunks = file.chunks
 	return nil
 }
 
-// RPCGetChunkHandle returns the chunk handle of (path, index).
-// If the requested index is bigger than the number of chunks of this path by one, create one.
-func (m *Master) RPCGetChunkHandle(args gfs.GetChunkHandleArg, reply *gfs.GetChunkHandleReply) error {
-	ps, cwd, err := m.nm.lockParents(args.Path, false)
-	defer m.nm.unlockParents(ps)
-	if err != nil {
-		return err
+// reportMismatch counts a checksum mismatch of a replica, and reports whether it is quarantined
+func (m *Master) reportMismatch(handle gfs.ChunkHandle, server gfs.ServerAddress) bool {
+	if !m.cm.ReportMismatch(handle, server) {
+		return false
 	}
+	m.config.Logger.Error(fmt.Sprintf("Master quarantine replica of chunk %v on %v for %v, too many checksum mismatches",
+		handle, server, gfs.QuarantineTime))
+	return true
+}
 
-	// append new chunks
-	file, ok := cwd.children[ps[len(ps)-1]]
+// drainChunk re-replicates a chunk until it has enough replicas other than addr,
+// then drops the replica on addr
+func (m *Master) drainChunk(handle gfs.ChunkHandle, addr gfs.ServerAddress) error {
+	m.cm.RLock()
+	ck, ok := m.cm.chunk[handle]
+	m.cm.RUnlock()
 	if !ok {
-		return fmt.Errorf("File %v does not exist", args.Path)
+		return nil // not referenced any more
 	}
-	file.Lock()
-	defer file.Unlock()
 
-	if int(args.Index) == int(file.chunks) {
-		file.chunks++
+	for {
+		done, wait, err := m.drainOnce(handle, ck, addr)
+		if done || err != nil {
+			return err
+		}
+		if wait > 0 { // the chunk is unlocked until the lease expires
+			m.config.Logger.Info(fmt.Sprintf("Master wait %v for the lease of chunk %v to drain %v", wait, handle, addr))
+			time.Sleep(wait)
+		}
+	}
+}
+
+// replaceCorrupted replaces the replica of a chunk on server, which fails its checksum. The chunk
+// is re-replicated from the other replicas before the bad replica is dropped, so the last replica
+// is kept even if it is corrupted.
+func (m *Master) replaceCorrupted(handle gfs.ChunkHandle, server gfs.ServerAddress) {
+	m.copyLock.Lock()
+	busy := m.copying[handle]
+	m.copying[handle] = true
+	m.copyLock.Unlock()
+	if busy { // reported again, or being re-replicated
+		return
+	}
+	defer func() {
+		m.copyLock.Lock()
+		delete(m.copying, handle)
+		m.copyLock.Unlock()
+	}()
+
+	if err := m.drainChunk(handle, server); err != nil {
+		m.config.Logger.Warn(fmt.Sprintf("Master keep corrupted chunk %v on %v: %v", handle, server, err))
+	}
+}
+
+// drainOnce makes one more replica of a chunk drained from addr, or drops the replica on addr
+// if the chunk has enough others. It reports done when the replica is dropped, or how long to
+// wait for an outstanding lease which cannot be revoked. The chunk is locked only during the call.
+func (m *Master) drainOnce(handle gfs.ChunkHandle, ck *chunkInfo, addr gfs.ServerAddress) (done bool, wait time.Duration, err error) {
+	defer m.takeCopySlot()()
+	ck.Lock() // don't grant lease during copy
+	defer ck.Unlock()
+
+	// stop the mutations under the outstanding lease
+	if err := m.cm.RevokeLease(handle); err != nil {
+		return false, ck.expire.Sub(time.Now()), nil
+	}
+
+	m.cm.RLock()
+	factor := m.cm.replicaFactor(ck)
+	m.cm.RUnlock()
+	others := 0
+	for _, v := range ck.location {
+		if v != addr {
+			others++
+		}
+	}
+	if others < factor {
+		return false, 0, m.reReplication(handle)
+	}
+
+	var newlist []gfs.ServerAddress
+	for _, v := range ck.location {
+		if v != addr {
+			newlist = append(newlist, v)
+		}
+	}
+	ck.location = newlist
+	m.csm.RemoveChunk(addr, handle)
+	m.csm.AddGarbage(addr, handle)
+	return true, 0, nil
+}
+
+// rebalance moves chunks from the most loaded chunkservers to the least loaded ones,
+// at most gfs.RebalanceMaxMoves chunks in a call. It makes new servers share the load.
+func (m *Master) rebalance() error {
+	_, err := m.applyMoves(m.csm.PlanRebalance(gfs.RebalanceMaxMoves))
+	return err
+}
+
+// applyMoves moves chunks in order and returns the number of moves done. It stops
+// at the first move not done, since the moves after it are planned on top of it.
+func (m *Master) applyMoves(moves []gfs.ChunkMove) (int, error) {
+	for i, v := range moves {
+		moved, err := m.moveChunk(v.Handle, v.From, v.To)
+		if err != nil || !moved {
+			return i, err
+		}
+	}
+	return len(moves), nil
+}
+
+// RPCPlanRebalance returns the chunk moves the rebalancer would make in this cycle,
+// without moving anything. A chunk leased recently is skipped when the move is applied.
+func (m *Master) RPCPlanRebalance(args gfs.RebalancePlanArg, reply *gfs.RebalancePlanReply) error {
+	reply.Moves = m.csm.PlanRebalance(gfs.RebalanceMaxMoves)
+	return nil
+}
+
+// RPCApplyRebalance makes the chunk moves in args, usually a plan reviewed by an operator.
+// A move whose source no longer holds the chunk, or whose target already does, is not done.
+func (m *Master) RPCApplyRebalance(args gfs.ApplyRebalanceArg, reply *gfs.ApplyRebalanceReply) error {
+	var err error
+	reply.Moved, err = m.applyMoves(args.Moves)
+	return err
+}
+
+// moveChunk copies a chunk from one server to another in the same way as reReplication,
+// then drops the replica on the source if the chunk has more replicas than its replication
+// factor, so it never falls below the factor. A chunk leased recently is not moved.
+func (m *Master) moveChunk(handle gfs.ChunkHandle, from, to gfs.ServerAddress) (bool, error) {
+	m.cm.RLock()
+	ck, ok := m.cm.chunk[handle]
+	m.cm.RUnlock()
+	if !ok {
+		return false, fmt.Errorf("cannot find chunk %v", handle)
+	}
+
+	defer m.takeCopySlot()()
+	ck.Lock() // don't grant lease during copy
+	defer ck.Unlock()
+
+	// mutations may still be in flight shortly after the lease expires
+	if ck.expire.Add(m.config.LeaseDuration).After(time.Now()) {
+		return false, nil
+	}
+	// the move may be planned before the replicas change
+	found := false
+	for _, v := range ck.location {
+		if v == to {
+			return false, nil
+		}
+		found = found || v == from
+	}
+	if !found {
+		return false, nil
+	}
+
+	m.config.Logger.Info(fmt.Sprintf("Master rebalance: move chunk %v from %v to %v", handle, from, to))
+
+	var cr gfs.CreateChunkReply
+	err := util.CallTLS(m.tls, to, "ChunkServer.RPCCreateChunk", gfs.CreateChunkArg{Handle: handle}, &cr)
+	if err != nil {
+		return false, err
+	}
+
+	var sr gfs.SendCopyReply
+	err = util.CallTLS(m.tls, from, "ChunkServer.RPCSendCopy", gfs.SendCopyArg{handle, to, handle}, &sr)
+	if err != nil {
+		return false, err
+	}
+
+	m.cm.RegisterReplica(handle, to, false)
+	m.csm.AddChunk([]gfs.ServerAddress{to}, handle)
+
+	m.cm.RLock()
+	factor := m.cm.replicaFactor(ck)
+	m.cm.RUnlock()
+	if len(ck.location) <= factor {
+		return true, nil
+	}
+
+	var newlist []gfs.ServerAddress
+	for _, v := range ck.location {
+		if v != from {
+			newlist = append(newlist, v)
+		}
+	}
+	ck.location = newlist
+	m.csm.RemoveChunk(from, handle)
+	m.csm.AddGarbage(from, handle)
+	return true, nil
+}
+
+// RPCForceChunkReplication re-replicates a chunk right away instead of waiting for
+// the background task. It returns gfs.ErrAlreadyReplicated if the chunk has as many
+// replicas as the replication factor of its file.
+func (m *Master) RPCForceChunkReplication(args gfs.ForceChunkReplicationArg, reply *gfs.ForceChunkReplicationReply) error {
+	m.cm.RLock()
+	ck, ok := m.cm.chunk[args.Handle]
+	m.cm.RUnlock()
+	if !ok {
+		return fmt.Errorf("cannot find chunk %v", args.Handle)
+	}
+
+	defer m.takeCopySlot()()
+	ck.Lock() // don't grant lease during copy
+	defer ck.Unlock()
+	m.cm.RLock()
+	factor := m.cm.replicaFactor(ck)
+	m.cm.RUnlock()
+	if len(ck.location) >= factor {
+		return gfs.ErrAlreadyReplicated
+	}
+	return m.reReplication(args.Handle)
+}
+
+// RPCHeartbeat is called by chunkserver to let the master know that a chunkserver is alive
+func (m *Master) RPCHeartbeat(args gfs.HeartbeatArg, reply *gfs.HeartbeatReply) error {
+	isFirst, lost := m.csm.Heartbeat(args, reply)
+	if len(lost) > 0 { // a restarted server reports the chunks it still holds below
+		if err := m.cm.RemoveChunks(lost, args.Address); err != nil {
+			m.config.Logger.Warn(err)
+		}
+	}
+	reply.ChunkSize = m.config.ChunkSize
+
+	// the leases are asked for by primaries of the chunks mutated since last heartbeat
+	extended, expire := m.cm.ExtendLeases(args.LeaseExtensions, args.Address)
+	m.csm.ExtendLeases(args.Address, extended, expire)
+	now := time.Now()
+	for _, p := range m.cm.Owners(args.LeaseExtensions) {
+		m.nm.Touch(p, now)
+	}
+
+	// corrupted replicas are replaced in background, not to block the heartbeat during copies
+	if len(args.AbandondedChunks) > 0 {
+		m.config.Logger.Warn(fmt.Sprintf("Master replace corrupted chunks %v in %v", args.AbandondedChunks, args.Address))
+		for _, handle := range args.AbandondedChunks {
+			m.reportMismatch(handle, args.Address)
+			go m.replaceCorrupted(handle, args.Address)
+		}
+	}
+
+	if isFirst { // if is first heartbeat, let chunkserver report itself
+		var r gfs.ReportSelfReply
+		err := util.CallTLS(m.tls, args.Address, "ChunkServer.RPCReportSelf", gfs.ReportSelfArg{}, &r)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range r.Chunks {
+			m.cm.RLock()
+			ck, ok := m.cm.chunk[v.Handle]
+			hole := ok && ck.hole
+			m.cm.RUnlock()
+			if hole { // created for a hole, but master stops before it is logged as filled
+				m.csm.AddGarbage(args.Address, v.Handle)
+				continue
+			}
+			if !ok {
+				if v.Handle < m.cm.NextHandle() { // not referenced by any file
+					m.csm.AddGarbage(args.Address, v.Handle)
+				} else { // created after the metadata master has, e.g. it is restored from an old copy
+					m.config.Logger.Warn(fmt.Sprintf("Master keep unknown chunk %v in %v", v.Handle, args.Address))
+				}
+				continue
+			}
+
+			ck.RLock()
+			version := ck.version
+			ck.RUnlock()
+
+			if v.Version == version {
+				m.config.Logger.Info(fmt.Sprintf("Master receive chunk %v from %v", v.Handle, args.Address))
+				m.cm.RegisterReplica(v.Handle, args.Address, true)
+				m.csm.AddChunk([]gfs.ServerAddress{args.Address}, v.Handle)
+			} else if v.Version < version {
+				// the server missed mutations while it was offline
+				m.config.Logger.Warn(fmt.Sprintf("Master detect stale chunk %v in %v (version %v < %v)", v.Handle, args.Address, v.Version, version))
+				m.csm.AddGarbage(args.Address, v.Handle)
+			} else {
+				m.config.Logger.Info(fmt.Sprintf("Master discard %v", v.Handle))
+			}
+		}
+	}
+
+	if garbage := m.csm.TakeGarbage(args.Address); len(garbage) > 0 {
+		err := util.CallTLS(m.tls, args.Address, "ChunkServer.RPCDeleteChunk", gfs.DeleteChunkArg{garbage}, &gfs.DeleteChunkReply{})
+		if err != nil { // try again on next heartbeat
+			for _, v := range garbage {
+				m.csm.AddGarbage(args.Address, v)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// RPCRenewAllLeases is called by a restarted chunkserver to get back the leases of a batch of chunks
+// in one call, rather than one by one as it is asked for them. See chunkManager.RenewLeases.
+func (m *Master) RPCRenewAllLeases(args gfs.RenewAllLeasesArg, reply *gfs.RenewAllLeasesReply) error {
+	granted, expire, stale, err := m.cm.RenewLeases(args.Handles, args.Versions, args.Address)
+	if err != nil {
+		return err
+	}
+	for handle, servers := range stale {
+		for _, v := range servers {
+			m.csm.AddGarbage(v, handle)
+		}
+	}
+	m.csm.ExtendLeases(args.Address, granted, expire)
+	m.config.Logger.Info(fmt.Sprintf("Master renew %v of %v leases for %v", len(granted), len(args.Handles), args.Address))
+	reply.Granted = granted
+	reply.Expire = expire
+	return nil
+}
+
+// RPCGetPrimaryAndSecondaries returns lease holder and secondaries of a chunk.
+// If no one holds the lease currently, grant one.
+// Master will communicate with all replicas holder to check version, if stale replica is detected, add it to garbage collection
+func (m *Master) RPCGetPrimaryAndSecondaries(args gfs.GetPrimaryAndSecondariesArg, reply *gfs.GetPrimaryAndSecondariesReply) error {
+	// a lease is asked for before a write, so a hole gets its replicas now
+	if err := m.fillHole(args.Handle); err != nil {
+		return err
+	}
+	lease, staleServers, err := m.cm.GetLeaseHolder(args.Handle, func(handle gfs.ChunkHandle, addrs []gfs.ServerAddress) {
+		m.csm.AddChunk(addrs, handle)
+	}, m.csm.ChoosePrimary)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range staleServers {
+		m.csm.AddGarbage(v, args.Handle)
+	}
+
+	reply.Primary = lease.Primary
+	reply.Expire = lease.Expire
+	reply.Secondaries = lease.Secondaries
+	reply.Version = lease.Version
+	replicas := append([]gfs.ServerAddress{lease.Primary}, lease.Secondaries...)
+	reply.Chain = m.csm.PushChain(replicas, args.ClientZone)
+	return nil
+}
+
+// RPCExtendLease extends the lease of chunk held by requester.
+func (m *Master) RPCExtendLease(args gfs.ExtendLeaseArg, reply *gfs.ExtendLeaseReply) error {
+	t, err := m.cm.ExtendLease(args.Handle, args.Address)
+	if err != nil {
+		return err
+	}
+	m.csm.ExtendLeases(args.Address, []gfs.ChunkHandle{args.Handle}, t)
+	reply.Expire = t
+	return nil
+}
+
+// RPCGetReplicas is called by client to find all chunkserver that holds the chunk.
+func (m *Master) RPCGetReplicas(args gfs.GetReplicasArg, reply *gfs.GetReplicasReply) error {
+	servers, err := m.cm.GetReplicas(args.Handle)
+	if err != nil {
+		return err
+	}
+	reply.Hole = m.cm.IsHole(args.Handle)
+	for _, v := range servers {
+		reply.Locations = append(reply.Locations, v)
+	}
+	if args.ClientZone != "" {
+		m.csm.SortByZone(reply.Locations, args.ClientZone)
+	}
+	return nil
+}
+
+// RPCGetChunkInfo returns the replicas, version, lease and replication state of a chunk
+// known to master, e.g. for a fsck-style tool.
+func (m *Master) RPCGetChunkInfo(args gfs.GetChunkInfoArg, reply *gfs.GetChunkInfoReply) error {
+	return m.cm.GetChunkInfo(args.Handle, reply)
+}
+
+// RPCGetPathsByChunk returns all the files that reference a chunk.
+func (m *Master) RPCGetPathsByChunk(args gfs.GetPathsByChunkArg, reply *gfs.GetPathsByChunkReply) error {
+	paths, err := m.cm.GetPaths(args.Handle)
+	if err != nil {
+		return err
+	}
+	reply.Paths = paths
+	return nil
+}
+
+// RPCGetMasterMemoryUsage returns a breakdown of the in-memory metadata of master.
+// There is no write-ahead log buffer or cache in master, so these are always zero.
+func (m *Master) RPCGetMasterMemoryUsage(args gfs.GetMasterMemoryUsageArg, reply *gfs.GetMasterMemoryUsageReply) error {
+	var nsBytes, ckBytes, csBytes int64
+	reply.NamespaceNodes, nsBytes = m.nm.MemoryUsage()
+	reply.ChunkEntries, reply.LeaseEntries, ckBytes = m.cm.MemoryUsage()
+	reply.ChunkServerEntries, csBytes = m.csm.MemoryUsage()
+	reply.EstimatedTotalBytes = nsBytes + ckBytes + csBytes
+	return nil
+}
+
+// RPCGetConfig returns the parameters clients need to agree on with master,
+// such as the chunk size used to map file offsets to chunks.
+func (m *Master) RPCGetConfig(args gfs.GetConfigArg, reply *gfs.GetConfigReply) error {
+	reply.ChunkSize = m.config.ChunkSize
+	reply.MaxAppendSize = m.config.ChunkSize / 4
+	return nil
+}
+
+// RPCGetMasterStats returns the counts of files, chunks and servers known to master
+// for monitoring, and the progress of re-replication and garbage collection.
+// Each structure is read locked in turn, never all at once.
+func (m *Master) RPCGetMasterStats(args gfs.GetMasterStatsArg, reply *gfs.MasterStatsReply) error {
+	reply.Files, reply.Directories = m.nm.Stats()
+	reply.Chunks = m.cm.NumChunks()
+	reply.UnderReplicated = len(m.cm.GetNeedlist(m.csm.NumActive()))
+	reply.OldestLeaseExpire = m.cm.OldestLease()
+	reply.ChunkServers = m.csm.NumServers()
+	reply.CopiesInFlight = len(m.copySlots)
+	reply.NeedListDepth = m.cm.NeedListLen()
+	reply.GarbageQueued = m.csm.QueuedGarbage()
+	reply.ReReplicated = atomic.LoadInt64(&m.copied)
+	reply.ReReplicateFailed = atomic.LoadInt64(&m.copyFails)
+	if m.oplog != nil {
+		_, reply.LogIndex = m.oplog.Index()
+	}
+	return nil
+}
+
+// RPCGetCheckpoint is called by shadow masters to load all the metadata,
+// together with the position in operation log it reflects.
+func (m *Master) RPCGetCheckpoint(args gfs.GetCheckpointArg, reply *gfs.GetCheckpointReply) error {
+	var meta PersistentBlock
+	m.oplog.Checkpoint(func() {
+		meta = m.checkpoint()
+		if m.oplog != nil {
+			reply.Epoch, reply.Index = m.oplog.Index()
+			meta.LogSeq = m.oplog.Seq()
+		}
+	})
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(meta); err != nil {
+		return err
+	}
+	reply.Meta = buf.Bytes()
+	reply.Locations = m.cm.Locations()
+	reply.ChunkSize = m.config.ChunkSize
+	return nil
+}
+
+// RPCGetOperations is called by shadow masters to tail the operation log.
+// Reload is set if the operations are no longer kept in memory or master has restarted.
+func (m *Master) RPCGetOperations(args gfs.GetOperationsArg, reply *gfs.GetOperationsReply) error {
+	if m.oplog == nil {
+		reply.Reload = true
+		return nil
+	}
+	records, ok := m.oplog.Since(args.Epoch, args.Index)
+	reply.Records = records
+	reply.Reload = !ok
+	return nil
+}
+
+// RPCGetBackgroundTaskStatus returns the execution status of every background task
+func (m *Master) RPCGetBackgroundTaskStatus(args gfs.GetBackgroundTaskStatusArg, reply *gfs.GetBackgroundTaskStatusReply) error {
+	reply.Tasks = m.tasks.GetAll()
+	return nil
+}
+
+// RPCGetChunkServerStatsSummary returns the performance summary of every chunkserver
+func (m *Master) RPCGetChunkServerStatsSummary(args gfs.GetChunkServerStatsSummaryArg, reply *gfs.GetChunkServerStatsSummaryReply) error {
+	reply.Servers = m.csm.StatsSummary()
+	return nil
+}
+
+// RPCListChunkServers returns the live chunkservers with their space and chunk counts
+func (m *Master) RPCListChunkServers(args gfs.ListChunkServersArg, reply *gfs.ListChunkServersReply) error {
+	reply.Servers = m.csm.List()
+	return nil
+}
+
+// RPCCreateFile is called by client to create a new file
+func (m *Master) RPCCreateFile(args gfs.CreateFileArg, reply *gfs.CreateFileReply) error {
+	err := m.nm.Create(args.Path, args.ReplicaFactor, args.Compressed, args.MaxChunks, time.Now())
+	return err
+}
+
+// RPCCreateSmallFile creates a file and writes its first and only chunk in one call, which saves
+// a client the round trips of a normal write for a small file. Data longer than a chunk is
+// rejected, it should be written in the normal way. It returns after the data is written on all
+// replicas. If the write fails, the file is deleted rather than left empty.
+func (m *Master) RPCCreateSmallFile(args gfs.CreateSmallFileArg, reply *gfs.CreateSmallFileReply) error {
+	if int64(len(args.Data)) > m.config.ChunkSize {
+		return fmt.Errorf("%v bytes of %v do not fit in a chunk of %v bytes", len(args.Data), args.Path, m.config.ChunkSize)
+	}
+	if err := m.nm.Create(args.Path, 0, false, 0, time.Now()); err != nil {
+		return err
+	}
+	if len(args.Data) == 0 {
+		return nil
+	}
+
+	if err := m.writeSmallFile(args.Path, args.Data); err != nil {
+		m.config.Logger.Warn(fmt.Sprintf("Master create small file %v: %v", args.Path, err))
+		if e := m.RPCDeleteFile(gfs.DeleteFileArg{Path: args.Path}, &gfs.DeleteFileReply{}); e != nil {
+			m.config.Logger.Warn(e)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeSmallFile writes data at the beginning of an empty file as a client does
+func (m *Master) writeSmallFile(p gfs.Path, data []byte) error {
+	var ch gfs.GetChunkHandleReply
+	if err := m.RPCGetChunkHandle(gfs.GetChunkHandleArg{p, 0}, &ch); err != nil {
+		return err
+	}
+	var l gfs.GetPrimaryAndSecondariesReply
+	if err := m.RPCGetPrimaryAndSecondaries(gfs.GetPrimaryAndSecondariesArg{Handle: ch.Handle}, &l); err != nil {
+		return err
+	}
+
+	dataID := gfs.DataBufferID{ch.Handle, int(time.Now().UnixNano())}
+	err := util.CallTLS(m.tls, l.Chain[0], "ChunkServer.RPCPushData", gfs.PushDataArg{dataID, data, l.Chain[1:]}, &gfs.PushDataReply{})
+	if err != nil {
+		return err
+	}
+	err = util.CallTLS(m.tls, l.Primary, "ChunkServer.RPCWriteChunk", gfs.WriteChunkArg{dataID, 0, l.Secondaries, l.Version}, &gfs.WriteChunkReply{})
+	if err != nil {
+		return err
+	}
+	return m.RPCUpdateFileLength(gfs.UpdateFileLengthArg{p, int64(len(data))}, &gfs.UpdateFileLengthReply{})
+}
+
+// RPCDeleteFile is called by client to delete a file or directory.
+// Its chunks are reclaimed lazily by garbage collection.
+func (m *Master) RPCDeleteFile(args gfs.DeleteFileArg, reply *gfs.DeleteFileReply) error {
+	err := m.nm.Delete(args.Path, args.Recursive, func(hidden gfs.Path) {
+		m.cm.RenameFiles(args.Path, hidden)
+	})
+	return err
+}
+
+// RPCTruncate is called by client to cut a file to args.Length bytes.
+// The chunks after the new end of file are dropped and the last chunk is
+// truncated on its replicas.
+func (m *Master) RPCTruncate(args gfs.TruncateArg, reply *gfs.TruncateReply) error {
+	deadline := m.nm.deadline()
+	ps, cwd, err := m.nm.lockParents(args.Path, false, deadline)
+	defer m.nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(args.Path, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(args.Path, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+	if file.isDir {
+		return fmt.Errorf("%v is a directory", args.Path)
+	}
+	if args.Length < 0 {
+		return fmt.Errorf("invalid length %v", args.Length)
+	}
+
+	chunkSize := m.config.ChunkSize
+	chunks := (args.Length + chunkSize - 1) / chunkSize
+	if chunks > file.chunks {
+		return gfs.ErrTruncateExceedLength
+	}
+
+	// cut the chunk holding the new end of file, a hole has nothing to cut
+	if chunks > 0 {
+		index := gfs.ChunkIndex(chunks - 1)
+		handle, err := m.cm.GetChunk(args.Path, index)
+		if err != nil {
+			return err
+		}
+		if !m.cm.IsHole(handle) {
+			var addrs []gfs.ServerAddress
+			handle, addrs, err = m.cm.UnshareChunk(args.Path, handle)
+			if err != nil {
+				return err
+			}
+			if addrs != nil {
+				m.csm.AddChunk(addrs, handle)
+			}
+
+			lease, staleServers, err := m.cm.GetLeaseHolder(handle, func(handle gfs.ChunkHandle, addrs []gfs.ServerAddress) {
+				m.csm.AddChunk(addrs, handle)
+			}, m.csm.ChoosePrimary)
+			if err != nil {
+				return err
+			}
+			for _, v := range staleServers {
+				m.csm.AddGarbage(v, handle)
+			}
+
+			offset := gfs.Offset(args.Length - int64(index)*chunkSize)
+			var r gfs.TruncateChunkReply
+			err = util.CallTLS(m.tls, lease.Primary, "ChunkServer.RPCTruncateChunk", gfs.TruncateChunkArg{handle, offset, lease.Secondaries}, &r)
+			// a chunk before the last one may be shorter than the new length, which is fine
+			if err != nil && !(gfs.IsError(err, gfs.ErrTruncateExceedLength) && chunks < file.chunks) {
+				return err
+			}
+		}
+	}
+
+	defer m.nm.hold()()
+	if err := m.nm.logOperation(operation{Type: opTruncate, Path: args.Path, Length: args.Length}); err != nil {
+		return err
+	}
+	m.truncateFile(args.Path, file, args.Length)
+	return nil
+}
+
+// truncateFile drops the chunks of file p after length, which is locked in top caller
+func (m *Master) truncateFile(p gfs.Path, file *nsTree, length int64) {
+	chunkSize := m.config.ChunkSize
+	chunks := (length + chunkSize - 1) / chunkSize
+	m.addGarbage(m.cm.TruncateFile(p, int(chunks)))
+	parent, _ := m.nm.PartionLastName(p)
+	m.nm.addUsage(parent, chunks-file.chunks)
+	file.chunks = chunks
+	file.length = length
+}
+
+// RPCSetQuota is called by client to limit the bytes of the files under a directory.
+// A new chunk is not allocated if it would exceed the quota of any of its parents.
+func (m *Master) RPCSetQuota(args gfs.SetQuotaArg, reply *gfs.SetQuotaReply) error {
+	return m.nm.SetQuota(args.Path, args.Bytes)
+}
+
+// RPCSetReplicationFactor changes the number of replicas of each chunk of an existing file.
+// The chunks with fewer replicas are re-replicated, and the extra replicas are trimmed,
+// in the next serverCheck.
+func (m *Master) RPCSetReplicationFactor(args gfs.SetReplicationFactorArg, reply *gfs.SetReplicationFactorReply) error {
+	return m.nm.SetReplicas(args.Path, args.Factor, func() {
+		m.cm.SetReplicas(args.Path, args.Factor)
+	})
+}
+
+// RPCSnapshot is called by client to make a point-in-time copy of a file or directory.
+// The copy shares chunks with source until either of them accesses them. It blocks
+// until the outstanding leases on the chunks of source are revoked or expire.
+func (m *Master) RPCSnapshot(args gfs.SnapshotArg, reply *gfs.SnapshotReply) error {
+	for {
+		var wait time.Duration
+		err := m.nm.Snapshot(args.Source, args.Target, time.Now(), func() error {
+			var unlock func()
+			if unlock, wait = m.cm.RevokeLeases(args.Source); wait > 0 {
+				return errLeaseOutstanding
+			}
+			defer unlock()
+			m.cm.CopyFiles(args.Source, args.Target)
+			return nil
+		})
+		if err != errLeaseOutstanding {
+			return err
+		}
+		// wait without locks, so the namespace is not blocked
+		time.Sleep(wait)
+	}
+}
+
+// RPCCopyFile is called by client to copy a file on the server side. Unlike a snapshot,
+// the copy gets its own chunks at once, each copied by a replica of the source chunk to
+// the new replicas, so the data never goes through the client. The leases on the chunks
+// of source are revoked and no mutation is applied to them during the copy.
+func (m *Master) RPCCopyFile(args gfs.CopyFileArg, reply *gfs.CopyFileReply) error {
+	for {
+		wait, err := m.copyFile(args.Source, args.Target)
+		if err != errLeaseOutstanding {
+			return err
+		}
+		// wait without locks, so the namespace is not blocked
+		time.Sleep(wait)
+	}
+}
 
-		addrs, err := m.csm.ChooseServers(gfs.DefaultNumReplicas)
+// copyFile copies file source to target, see RPCCopyFile. It returns errLeaseOutstanding
+// and how long to wait if a lease on the chunks of source cannot be revoked.
+func (m *Master) copyFile(source, target gfs.Path) (time.Duration, error) {
+	parent, _ := m.nm.PartionLastName(target)
+	var reserved int64
+	var created map[gfs.ChunkHandle][]gfs.ServerAddress
+	var wait time.Duration
+	committed := false
+	err := m.nm.Copy(source, target, time.Now(), func(src, dst *nsTree, op *operation) (func(), error) {
+		replicas := dst.replicas
+		if replicas == 0 { // metadata of old version
+			replicas = m.config.DefaultReplicas
+		}
+		addrs := make([][]gfs.ServerAddress, src.chunks)
+		for i := range addrs {
+			var err error
+			addrs[i], err = m.csm.ChooseServers(replicas)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for ; reserved < src.chunks; reserved++ {
+			if err := m.nm.ReserveChunk(parent, m.config.ChunkSize); err != nil {
+				return nil, err
+			}
+		}
+
+		var unlock func()
+		if unlock, wait = m.cm.RevokeLeases(source); wait > 0 {
+			return nil, errLeaseOutstanding
+		}
+		defer unlock()
+		handles, versions, holes, c, err := m.cm.CopyChunks(source, addrs, dst.compressed)
+		created = c
 		if err != nil {
+			return nil, err
+		}
+		op.Handles, op.Versions, op.Holes, op.Length = handles, versions, holes, src.length
+		dst.chunks, dst.length = src.chunks, src.length
+		return func() {
+			committed = true
+			m.cm.AddChunks(target, handles, versions, addrs, replicas, holes)
+			for i, h := range handles {
+				m.csm.AddChunk(addrs[i], h)
+			}
+		}, nil
+	})
+	if err != nil && !committed {
+		m.nm.addUsage(parent, -reserved)
+		m.addGarbage(created)
+	}
+	return wait, err
+}
+
+// RPCRenameFile is called by client to rename or move a file or directory.
+// The chunks are moved with it.
+func (m *Master) RPCRenameFile(args gfs.RenameFileArg, reply *gfs.RenameFileReply) error {
+	err := m.nm.Rename(args.Source, args.Target, time.Now(), func() {
+		m.cm.RenameFiles(args.Source, args.Target)
+	})
+	return err
+}
+
+// RPCMkdir is called by client to make a new directory
+func (m *Master) RPCMkdir(args gfs.MkdirArg, reply *gfs.MkdirReply) error {
+	if args.Recursive {
+		return m.nm.MkdirAll(args.Path, time.Now())
+	}
+	err := m.nm.Mkdir(args.Path, time.Now())
+	return err
+}
+
+// RPCList is called by client to list all files in specific directory
+func (m *Master) RPCList(args gfs.ListArg, reply *gfs.ListReply) error {
+	var err error
+	reply.Files, err = m.nm.List(args.Path)
+	return err
+}
+
+// RPCWalk is called by client to list the whole subtree under a directory, a page
+// of entries at a time. Pass reply.Next as args.After to get the next page.
+func (m *Master) RPCWalk(args gfs.WalkArg, reply *gfs.WalkReply) error {
+	var err error
+	reply.Entries, reply.Next, err = m.nm.Walk(args.Root, args.After, args.Limit)
+	return err
+}
+
+// RPCGetFileInfo is called by client to get file information
+func (m *Master) RPCGetFileInfo(args gfs.GetFileInfoArg, reply *gfs.GetFileInfoReply) error {
+	deadline := m.nm.deadline()
+	ps, cwd, err := m.nm.lockParents(args.Path, false, deadline)
+	defer m.nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(args.Path, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(args.Path, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+
+	reply.IsDir = file.isDir
+	reply.Length = file.length
+	reply.Chunks = file.chunks
+	reply.Ctime = file.ctime
+	reply.Mtime = file.mtime
+	reply.Compressed = file.compressed
+	reply.LostChunks = file.lost
+	return nil
+}
+
+// RPCBatchGetFileInfo returns the info of several paths in one call. The paths are
+// locked together in the global order, and a path which does not exist only fails its
+// own entry in reply.Errors.
+func (m *Master) RPCBatchGetFileInfo(args gfs.BatchGetFileInfoArg, reply *gfs.BatchGetFileInfoReply) error {
+	nodes, unlock, err := m.nm.lockPathsPartial(args.Paths, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	reply.Infos = make([]gfs.GetFileInfoReply, len(args.Paths))
+	reply.Errors = make([]gfs.Error, len(args.Paths))
+	for i, p := range args.Paths {
+		file, ok := nodes[p]
+		if !ok {
+			reply.Errors[i] = gfs.PathError(p, gfs.ErrNotExist)
+			continue
+		}
+		info := &reply.Infos[i]
+		info.IsDir = file.isDir
+		info.Length = file.length
+		info.Chunks = file.chunks
+		info.Ctime = file.ctime
+		info.Mtime = file.mtime
+		info.Compressed = file.compressed
+		info.LostChunks = file.lost
+	}
+	return nil
+}
+
+// RPCUpdateFileLength is called by client after it writes or appends data up to
+// args.Length bytes of a file. The length of file only grows here, so the reports of
+// concurrent writes may come in any order. It is cut by RPCTruncate.
+func (m *Master) RPCUpdateFileLength(args gfs.UpdateFileLengthArg, reply *gfs.UpdateFileLengthReply) error {
+	deadline := m.nm.deadline()
+	ps, cwd, err := m.nm.lockParents(args.Path, false, deadline)
+	defer m.nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(args.Path, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(args.Path, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+	if file.isDir {
+		return fmt.Errorf("%v is a directory", args.Path)
+	}
+	if args.Length < 0 || args.Length > file.chunks*m.config.ChunkSize {
+		return fmt.Errorf("invalid length %v of %v with %v chunks", args.Length, args.Path, file.chunks)
+	}
+
+	if args.Length > file.length {
+		defer m.nm.hold()()
+		if err := m.nm.logOperation(operation{Type: opSetLength, Path: args.Path, Length: args.Length}); err != nil {
 			return err
 		}
+		file.length = args.Length
+	}
+	return nil
+}
+
+// RPCAllocateChunks appends args.Count new chunks to a file in one call, so a large
+// sequential write doesn't take a round trip to master for each chunk. The file is
+// locked throughout, so the chunks of concurrent allocations on it never interleave.
+func (m *Master) RPCAllocateChunks(args gfs.AllocateChunksArg, reply *gfs.AllocateChunksReply) error {
+	if args.Count <= 0 {
+		return fmt.Errorf("invalid chunk count %v", args.Count)
+	}
+
+	deadline := m.nm.deadline()
+	ps, cwd, err := m.nm.lockParents(args.Path, false, deadline)
+	defer m.nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(args.Path, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(args.Path, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+	if file.isDir {
+		return fmt.Errorf("%v is a directory", args.Path)
+	}
+
+	reply.Index = gfs.ChunkIndex(file.chunks)
+	reply.Handles, reply.Locations, err = m.allocateChunks(args.Path, file, args.Count, 0)
+	return err
+}
+
+// degraded reports whether new chunks of replicas replicas should be refused, since
+// re-replication is behind by more than Config.MaxNeedList chunks, or too few servers
+// are alive to keep gfs.MinimumNumReplicas of them. Reads are not affected.
+func (m *Master) degraded(replicas int) bool {
+	if max := m.config.MaxNeedList; max > 0 && m.cm.NeedListLen() > max {
+		return true
+	}
+	if replicas > gfs.MinimumNumReplicas {
+		replicas = gfs.MinimumNumReplicas
+	}
+	return m.csm.NumActive() < replicas
+}
+
+// allocateChunks appends n new chunks to file p, which should be locked in top caller.
+// The first holes of them are holes, which get no replica until they are written.
+// The chunks are counted in the quotas of the parents of p, and may not make the file
+// longer than its chunk limit. It fails if any replica is not created. The chunks are
+// added to the metadata after they are logged.
+func (m *Master) allocateChunks(p gfs.Path, file *nsTree, n, holes int) ([]gfs.ChunkHandle, [][]gfs.ServerAddress, error) {
+	limit := file.maxChunks
+	if limit == 0 {
+		limit = m.config.MaxFileChunks
+	}
+	if limit > 0 && file.chunks+int64(n) > limit {
+		return nil, nil, gfs.PathError(p, gfs.ErrFileTooLarge)
+	}
+
+	replicas := file.replicas
+	if replicas == 0 { // metadata of old version
+		replicas = m.config.DefaultReplicas
+	}
+	if m.degraded(replicas) {
+		return nil, nil, gfs.PathError(p, gfs.ErrClusterDegraded)
+	}
+	addrs := make([][]gfs.ServerAddress, n)
+	for i := holes; i < n; i++ {
+		var err error
+		addrs[i], err = m.csm.ChooseServers(replicas)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	parent, _ := m.nm.PartionLastName(p)
+	for i := 0; i < n; i++ {
+		if err := m.nm.ReserveChunk(parent, m.config.ChunkSize); err != nil {
+			m.nm.addUsage(parent, -int64(i))
+			return nil, nil, err
+		}
+	}
+
+	var created map[gfs.ChunkHandle][]gfs.ServerAddress
+	handles, err := m.cm.ReserveHandles(n)
+	if err == nil {
+		created, err = m.cm.CreateReplicas(handles, addrs, nil, file.compressed)
+	}
+	if err == nil {
+		defer m.nm.hold()()
+		// the chunks are lost if master crashes before the next checkpoint without it
+		err = m.nm.logOperation(operation{Type: opAddChunks, Path: p, Handles: handles, Holes: handles[:holes]})
+	}
+	if err != nil {
+		m.addGarbage(created)
+		m.nm.addUsage(parent, -int64(n))
+		return nil, nil, err
+	}
+
+	file.chunks += int64(n)
+	m.cm.AddChunks(p, handles, nil, addrs, replicas, handles[:holes])
+	for i, h := range handles {
+		m.csm.AddChunk(addrs[i], h)
+	}
+	return handles, addrs, nil
+}
+
+// fillHole creates the replicas of chunk handle if it is a hole, before it is written.
+// The owner file is locked like allocateChunks does. If the hole is shared with snapshots,
+// they are moved to a copy first, which is still a hole. The replicas are added to the
+// metadata after the chunk is logged as filled.
+func (m *Master) fillHole(handle gfs.ChunkHandle) error {
+	if !m.cm.IsHole(handle) {
+		return nil
+	}
+	owners := m.cm.Owners([]gfs.ChunkHandle{handle})
+	if len(owners) == 0 {
+		return fmt.Errorf("invalid chunk handle %v", handle)
+	}
+
+	var err error
+	e := m.nm.updateFile(owners[0], func(file *nsTree) {
+		m.cm.RLock()
+		ck, ok := m.cm.chunk[handle]
+		m.cm.RUnlock()
+		if !ok {
+			err = fmt.Errorf("invalid chunk handle %v", handle)
+			return
+		}
+		if err = m.cm.lockChunk(handle, ck, ck.LockBefore); err != nil {
+			return
+		}
+		defer ck.Unlock()
 
-		reply.Handle, addrs, err = m.cm.CreateChunk(args.Path, addrs)
+		m.cm.RLock()
+		hole, shared := ck.hole, ck.refcount > 1
+		m.cm.RUnlock()
+		if !hole { // filled by another writer
+			return
+		}
+		if shared {
+			if _, _, err = m.cm.copyChunk(handle, ck, func(p gfs.Path) bool { return p != owners[0] }); err != nil {
+				return
+			}
+		}
+
+		replicas := file.replicas
+		if replicas == 0 { // metadata of old version
+			replicas = m.config.DefaultReplicas
+		}
+		if m.degraded(replicas) {
+			err = gfs.PathError(owners[0], gfs.ErrClusterDegraded)
+			return
+		}
+		var addrs []gfs.ServerAddress
+		if addrs, err = m.csm.ChooseServers(replicas); err != nil {
+			return
+		}
+
+		var created map[gfs.ChunkHandle][]gfs.ServerAddress
+		created, err = m.cm.CreateReplicas([]gfs.ChunkHandle{handle}, [][]gfs.ServerAddress{addrs}, []gfs.ChunkVersion{ck.version}, file.compressed)
+		if err == nil {
+			defer m.nm.hold()()
+			err = m.nm.logOperation(operation{Type: opFillHole, Path: owners[0], Handle: handle})
+		}
 		if err != nil {
-			// WARNING
-			log.Warning("[ignored] An ignored error in RPCGetChunkHandle when create ", err, " in create chunk ", reply.Handle)
+			m.addGarbage(created)
+			return
 		}
 
-		m.csm.AddChunk(addrs, reply.Handle)
+		ck.location = addrs
+		m.cm.FillHole(handle)
+		m.csm.AddChunk(addrs, handle)
+		m.config.Logger.Info(fmt.Sprintf("Master fill hole %v of %v on %v", handle, owners[0], addrs))
+	})
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+// RPCGetChunkHandle returns the chunk handle of (path, index).
+// If the requested index is the next one of this path, the chunk is created. A larger index
+// fails with gfs.ErrChunkGap, unless sparse files are enabled, see WithSparseFiles. Then the
+// chunks up to it are created, and the ones before index are holes read as zero, which have
+// no replica until the first lease of them is asked for a write, see fillHole.
+func (m *Master) RPCGetChunkHandle(args gfs.GetChunkHandleArg, reply *gfs.GetChunkHandleReply) error {
+	if args.Index < 0 {
+		return fmt.Errorf("invalid chunk index %v of %v", args.Index, args.Path)
+	}
+
+	deadline := m.nm.deadline()
+	ps, cwd, err := m.nm.lockParents(args.Path, false, deadline)
+	defer m.nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	// append new chunks
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(args.Path, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(args.Path, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+
+	if int64(args.Index) > file.chunks && !m.config.SparseFiles {
+		return gfs.PathError(args.Path, gfs.ErrChunkGap)
+	}
+	if int64(args.Index) >= file.chunks {
+		n := int(int64(args.Index) - file.chunks + 1)
+		handles, _, err := m.allocateChunks(args.Path, file, n, n-1)
+		if err != nil {
+			return err
+		}
+		reply.Handle = handles[len(handles)-1]
 	} else {
 		reply.Handle, err = m.cm.GetChunk(args.Path, args.Index)
+		if err != nil {
+			return err
+		}
+
+		// a snapshot gets its own copy of a shared chunk on first access
+		var addrs []gfs.ServerAddress
+		reply.Handle, addrs, err = m.cm.UnshareChunk(args.Path, reply.Handle)
+		if addrs != nil {
+			m.csm.AddChunk(addrs, reply.Handle)
+		}
 	}
 
 	return err
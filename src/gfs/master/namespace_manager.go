@@ -3,39 +3,66 @@ package master
 import (
 	"fmt"
 	//"path"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"gfs"
+	"gfs/util"
 	log "github.com/Sirupsen/logrus"
 )
 
 type namespaceManager struct {
 	root     *nsTree
 	serialCt int
+	oplog    *operationLog // mutations are not logged if nil (e.g. during replay)
+
+	lockTimeout     time.Duration // how long an operation waits for locks, no limit if 0
+	defaultReplicas int           // replicas of a file created without its own factor
 }
 
 type nsTree struct {
-	sync.RWMutex
+	util.RWMutex
 
 	// if it is a directory
 	isDir    bool
 	children map[string]*nsTree
+	quota    int64 // max bytes of the files below, unlimited if 0
+	usage    int64 // chunks of the files below, changed atomically since parents are only read locked
 
 	// if it is a file
-	length int64
-	chunks int64
+	length     int64
+	chunks     int64
+	replicas   int   // replication factor
+	compressed bool  // chunks are stored compressed on chunkservers
+	lost       int64 // chunks missing from metadata, dropped by verifyMetadata
+	maxChunks  int64 // chunks the file may have, the limit of master if 0
+
+	ctime time.Time // when it is created
+	mtime time.Time // when a file is written or a child of a directory is added or removed
 }
 
 type serialTreeNode struct {
-	IsDir    bool
-	Children map[string]int
-	Chunks   int64
+	IsDir      bool
+	Children   map[string]int
+	Length     int64
+	Chunks     int64
+	Replicas   int
+	Compressed bool
+	Lost       int64
+	MaxChunks  int64
+	Quota      int64
+	Ctime      time.Time
+	Mtime      time.Time
 }
 
 // tree2array transforms the namespace tree into an array for serialization
 func (nm *namespaceManager) tree2array(array *[]serialTreeNode, node *nsTree) int {
-	n := serialTreeNode{IsDir: node.isDir, Chunks: node.chunks}
+	n := serialTreeNode{IsDir: node.isDir, Length: node.length, Chunks: node.chunks, Replicas: node.replicas, Quota: node.quota,
+		Compressed: node.compressed, Lost: node.lost, MaxChunks: node.maxChunks, Ctime: node.ctime, Mtime: node.mtime}
 	if node.isDir {
 		n.Children = make(map[string]int)
 		for k, v := range node.children {
@@ -50,10 +77,8 @@ func (nm *namespaceManager) tree2array(array *[]serialTreeNode, node *nsTree) in
 }
 
 // Serializa the metadata for storing to disk
+// It is called in operationLog.Checkpoint, so no logged mutation changes the tree meanwhile.
 func (nm *namespaceManager) Serialize() []serialTreeNode {
-	nm.root.RLock()
-	defer nm.root.RUnlock()
-
 	nm.serialCt = 0
 	var ret []serialTreeNode
 	nm.tree2array(&ret, nm.root)
@@ -63,14 +88,24 @@ func (nm *namespaceManager) Serialize() []serialTreeNode {
 // array2tree transforms the an serialized array to namespace tree
 func (nm *namespaceManager) array2tree(array []serialTreeNode, id int) *nsTree {
 	n := &nsTree{
-		isDir:  array[id].IsDir,
-		chunks: array[id].Chunks,
+		isDir:      array[id].IsDir,
+		length:     array[id].Length,
+		chunks:     array[id].Chunks,
+		replicas:   array[id].Replicas,
+		compressed: array[id].Compressed,
+		lost:       array[id].Lost,
+		maxChunks:  array[id].MaxChunks,
+		quota:      array[id].Quota,
+		ctime:      array[id].Ctime,
+		mtime:      array[id].Mtime,
 	}
 
 	if array[id].IsDir {
 		n.children = make(map[string]*nsTree)
 		for k, v := range array[id].Children {
-			n.children[k] = nm.array2tree(array, v)
+			c := nm.array2tree(array, v)
+			n.children[k] = c
+			n.usage += c.size()
 		}
 	}
 
@@ -89,26 +124,50 @@ func newNamespaceManager() *namespaceManager {
 	nm := &namespaceManager{
 		root: &nsTree{isDir: true,
 			children: make(map[string]*nsTree)},
+		defaultReplicas: gfs.DefaultNumReplicas,
 	}
 	log.Info("-----------new namespace manager")
 	return nm
 }
 
-// lockParents place read lock on all parents of p. It returns the list of
-// parents' name, the direct parent nsTree. If a parent does not exist,
-// an error is also returned.
-func (nm *namespaceManager) lockParents(p gfs.Path, goDown bool) ([]string, *nsTree, error) {
+// deadline returns the time an operation starting now gives up waiting for locks,
+// zero if there is no limit
+func (nm *namespaceManager) deadline() time.Time {
+	if nm.lockTimeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(nm.lockTimeout)
+}
+
+// lockBefore write locks node, it reports false if the lock is not acquired by deadline
+func (node *nsTree) lockBefore(deadline time.Time) bool {
+	return node.LockBefore(deadline)
+}
+
+// rlockBefore read locks node, it reports false if the lock is not acquired by deadline
+func (node *nsTree) rlockBefore(deadline time.Time) bool {
+	return node.RLockBefore(deadline)
+}
+
+// lockParents place read lock on all parents of p, strictly top-down from root,
+// which is the order of pathLess. It returns the list of parents' name, the direct
+// parent nsTree. If a parent does not exist or is not locked by deadline, an error
+// is returned and no lock is held.
+func (nm *namespaceManager) lockParents(p gfs.Path, goDown bool, deadline time.Time) ([]string, *nsTree, error) {
 	ps := strings.Split(string(p), "/")[1:]
 	cwd := nm.root
 	//log.Info("ps ", ps, " len: ", len(ps))
 	if len(ps) > 0 {
-		cwd.RLock()
+		if !cwd.rlockBefore(deadline) {
+			return nil, cwd, gfs.PathError(p, gfs.ErrTimeout)
+		}
 		//log.Info("lock root")
 		for i, name := range ps[:len(ps)] {
 			// TODO : check path name
 			c, ok := cwd.children[name]
 			if !ok {
-				return ps, cwd, fmt.Errorf("path %s not found", p)
+				nm.unlockParents(ps[:i+1])
+				return nil, cwd, gfs.PathError(p, gfs.ErrNotExist)
 			}
 			if i == len(ps)-1 {
 				if goDown { // go down deeper?
@@ -117,7 +176,10 @@ func (nm *namespaceManager) lockParents(p gfs.Path, goDown bool) ([]string, *nsT
 			} else {
 				cwd = c
 				//log.Info("lock ", name)
-				cwd.RLock()
+				if !cwd.rlockBefore(deadline) {
+					nm.unlockParents(ps[:i+1])
+					return nil, cwd, gfs.PathError(p, gfs.ErrTimeout)
+				}
 			}
 		}
 	}
@@ -133,7 +195,7 @@ func (nm *namespaceManager) unlockParents(ps []string) {
 		for _, name := range ps[:len(ps)-1] {
 			c, ok := cwd.children[name]
 			if !ok {
-				log.Fatal("error in unlock")
+				log.Error("error in unlock: ", name, " does not exist")
 				return
 			}
 			cwd = c
@@ -142,6 +204,441 @@ func (nm *namespaceManager) unlockParents(ps []string) {
 	}
 }
 
+// pathLess compares paths component by component. It is the global order of
+// namespace locks: a node is locked after its parents and before any node that
+// sorts after it. lockParents (parents first) and walking a subtree in sorted order
+// follow it, and an operation on several paths must take its locks through
+// lockPaths, which sorts them, so no two operations wait for each other in a cycle.
+func pathLess(a, b gfs.Path) bool {
+	as := strings.Split(string(a), "/")
+	bs := strings.Split(string(b), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// lockPaths locks the nodes on paths and read locks all their parents. Nodes
+// in writes are locked exclusively, the others are read locked. Nodes in trees are
+// read locked along with all their descendants, at their place in the order, so the
+// subtree is never locked after a node that sorts after it. Root is denoted by "".
+// It returns the locked nodes and a function to unlock them. If a path does not
+// exist or the nodes are not locked in time, an error is returned and no lock is held.
+func (nm *namespaceManager) lockPaths(reads, writes, trees []gfs.Path) (map[gfs.Path]*nsTree, func(), error) {
+	return nm.lockPathsPartial(reads, writes, trees, false)
+}
+
+// lockPathsPartial is lockPaths, but if partial is set, the paths which do not exist are
+// left out of the nodes returned rather than failing all.
+func (nm *namespaceManager) lockPathsPartial(reads, writes, trees []gfs.Path, partial bool) (map[gfs.Path]*nsTree, func(), error) {
+	deadline := nm.deadline()
+	exclusive := make(map[gfs.Path]bool)
+	var add func(p gfs.Path, write bool)
+	add = func(p gfs.Path, write bool) {
+		if p != "" {
+			parent, _ := nm.PartionLastName(p)
+			add(parent, false)
+		}
+		exclusive[p] = exclusive[p] || write
+	}
+	for _, p := range reads {
+		add(p, false)
+	}
+	for _, p := range writes {
+		add(p, true)
+	}
+	tree := make(map[gfs.Path]bool)
+	for _, p := range trees {
+		add(p, false)
+		tree[p] = true
+	}
+
+	var paths []gfs.Path
+	for p := range exclusive {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return pathLess(paths[i], paths[j]) })
+
+	nodes := make(map[gfs.Path]*nsTree)
+	var locked []gfs.Path
+	unlock := func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			if tree[locked[i]] {
+				nm.runlockTree(nodes[locked[i]])
+			}
+			if exclusive[locked[i]] {
+				nodes[locked[i]].Unlock()
+			} else {
+				nodes[locked[i]].RUnlock()
+			}
+		}
+	}
+
+	for _, p := range paths {
+		node := nm.root
+		if p != "" {
+			parent, name := nm.PartionLastName(p)
+			var c *nsTree
+			ok := false
+			if nodes[parent] != nil {
+				c, ok = nodes[parent].children[name]
+			}
+			if !ok && partial { // the paths under it are missing too
+				continue
+			}
+			if !ok {
+				unlock()
+				return nil, nil, gfs.PathError(p, gfs.ErrNotExist)
+			}
+			node = c
+		}
+
+		ok := false
+		if exclusive[p] {
+			ok = node.lockBefore(deadline)
+		} else {
+			ok = node.rlockBefore(deadline)
+		}
+		if !ok {
+			unlock()
+			return nil, nil, gfs.PathError(p, gfs.ErrTimeout)
+		}
+		if tree[p] {
+			nm.rlockTree(node)
+		}
+		nodes[p] = node
+		locked = append(locked, p)
+	}
+	return nodes, unlock, nil
+}
+
+// rlockTree read locks all descendants of node in sorted order, parents first
+func (nm *namespaceManager) rlockTree(node *nsTree) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := node.children[name]
+		c.RLock()
+		nm.rlockTree(c)
+	}
+}
+
+// runlockTree is the inverse of rlockTree
+func (nm *namespaceManager) runlockTree(node *nsTree) {
+	for _, c := range node.children {
+		nm.runlockTree(c)
+		c.RUnlock()
+	}
+}
+
+// copyTree returns a deep copy of node. node and its descendants should be locked in top caller.
+func (nm *namespaceManager) copyTree(node *nsTree) *nsTree {
+	n := &nsTree{isDir: node.isDir, length: node.length, chunks: node.chunks, replicas: node.replicas,
+		compressed: node.compressed, lost: node.lost, maxChunks: node.maxChunks, quota: node.quota, usage: node.size(), ctime: node.ctime, mtime: node.mtime}
+	if node.isDir {
+		n.children = make(map[string]*nsTree)
+		for name, c := range node.children {
+			n.children[name] = nm.copyTree(c)
+		}
+	}
+	return n
+}
+
+// size returns the chunks of a file, or of all the files below a directory
+func (node *nsTree) size() int64 {
+	if node.isDir {
+		return atomic.LoadInt64(&node.usage)
+	}
+	return node.chunks
+}
+
+// dirsOf returns root and the directories on path p. They should be at least
+// read locked in top caller. A missing directory ends the list.
+func (nm *namespaceManager) dirsOf(p gfs.Path) []*nsTree {
+	ret := []*nsTree{nm.root}
+	if p == "" || p == "/" {
+		return ret
+	}
+	cwd := nm.root
+	for _, name := range strings.Split(string(p), "/")[1:] {
+		c, ok := cwd.children[name]
+		if !ok || !c.isDir {
+			break
+		}
+		ret = append(ret, c)
+		cwd = c
+	}
+	return ret
+}
+
+// addUsage adds delta chunks to the usage of directory p and all its parents,
+// which should be at least read locked in top caller.
+func (nm *namespaceManager) addUsage(p gfs.Path, delta int64) {
+	if delta == 0 {
+		return
+	}
+	for _, dir := range nm.dirsOf(p) {
+		atomic.AddInt64(&dir.usage, delta)
+	}
+}
+
+// ReserveChunk counts a new chunk of a file in directory p, and fails with gfs.ErrQuotaExceeded
+// if p or a parent would hold more than its quota, with each chunk taking chunkSize bytes.
+// The chunk is counted before the quotas are checked, so concurrent reservations never overshoot.
+// p and all its parents should be at least read locked in top caller.
+func (nm *namespaceManager) ReserveChunk(p gfs.Path, chunkSize int64) error {
+	dirs := nm.dirsOf(p)
+	for _, dir := range dirs {
+		atomic.AddInt64(&dir.usage, 1)
+	}
+	for i, dir := range dirs {
+		if dir.quota > 0 && atomic.LoadInt64(&dir.usage)*chunkSize > dir.quota {
+			for _, dir := range dirs {
+				atomic.AddInt64(&dir.usage, -1)
+			}
+			name := gfs.Path("/")
+			if i > 0 {
+				name = gfs.Path("/" + strings.Join(strings.Split(string(p), "/")[1:i+1], "/"))
+			}
+			return gfs.PathError(name, gfs.ErrQuotaExceeded)
+		}
+	}
+	return nil
+}
+
+// Touch sets the modification time of file p to at, unless it is modified later already
+func (nm *namespaceManager) Touch(p gfs.Path, at time.Time) error {
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(p, false, deadline)
+	defer nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(p, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+	if !file.isDir && at.After(file.mtime) {
+		file.mtime = at
+	}
+	return nil
+}
+
+// SetQuota limits the bytes of the files under directory p, files are counted by
+// their chunks, i.e. lengths rounded up to chunk size. A quota of 0 removes the limit.
+// The files already under p are kept even if they exceed the quota.
+func (nm *namespaceManager) SetQuota(p gfs.Path, bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("invalid quota %v", bytes)
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+
+	deadline := nm.deadline()
+	ps, dir, err := nm.lockParents(p, true, deadline)
+	defer nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	if !dir.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
+	defer dir.Unlock()
+
+	if !dir.isDir {
+		return fmt.Errorf("path %s is a file, not directory", p)
+	}
+	defer nm.hold()()
+	old := dir.quota
+	dir.quota = bytes
+	if err := nm.logOperation(operation{Type: opSetQuota, Path: p, Quota: bytes}); err != nil {
+		dir.quota = old
+		return err
+	}
+	return nil
+}
+
+// SetReplicas changes the replication factor of file p to replicas, which is at least 1.
+// update is called with p locked to apply the change to its chunks.
+func (nm *namespaceManager) SetReplicas(p gfs.Path, replicas int, update func()) error {
+	if replicas < 1 {
+		return fmt.Errorf("invalid replica factor %v", replicas)
+	}
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(p, false, deadline)
+	defer nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(p, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+
+	if file.isDir {
+		return fmt.Errorf("path %s is a directory, not file", p)
+	}
+	defer nm.hold()()
+	old := file.replicas
+	file.replicas = replicas
+	if err := nm.logOperation(operation{Type: opSetReplicas, Path: p, Replicas: replicas}); err != nil {
+		file.replicas = old
+		return err
+	}
+	update()
+	return nil
+}
+
+// MemoryUsage returns the number of nodes in the namespace (root excluded)
+// and a rough estimation of the bytes they occupy.
+func (nm *namespaceManager) MemoryUsage() (nodes int, bytes int64) {
+	var walk func(node *nsTree)
+	walk = func(node *nsTree) {
+		node.RLock()
+		defer node.RUnlock()
+
+		bytes += int64(unsafe.Sizeof(*node))
+		for name, child := range node.children {
+			nodes++
+			bytes += int64(len(name)) + int64(unsafe.Sizeof(name)) + int64(unsafe.Sizeof(child))
+			walk(child)
+		}
+	}
+	walk(nm.root)
+	return
+}
+
+// Stats returns the number of files and directories in the namespace (root excluded)
+func (nm *namespaceManager) Stats() (files, dirs int) {
+	var walk func(node *nsTree)
+	walk = func(node *nsTree) {
+		node.RLock()
+		defer node.RUnlock()
+
+		for _, child := range node.children {
+			if child.isDir {
+				dirs++
+				walk(child)
+			} else {
+				files++
+			}
+		}
+	}
+	walk(nm.root)
+	return
+}
+
+// FileChunks returns the number of chunks of every file
+func (nm *namespaceManager) FileChunks() map[gfs.Path]int64 {
+	ret := make(map[gfs.Path]int64)
+	var walk func(node *nsTree, p string)
+	walk = func(node *nsTree, p string) {
+		node.RLock()
+		defer node.RUnlock()
+
+		for name, child := range node.children {
+			if child.isDir {
+				walk(child, p+"/"+name)
+			} else {
+				ret[gfs.Path(p+"/"+name)] = child.chunks
+			}
+		}
+	}
+	walk(nm.root, "")
+	return ret
+}
+
+// MarkLost drops the last n chunks of file p, which are missing from metadata.
+// The file keeps the chunks before them, so new chunks are appended at the right index.
+// Its length is cut to the chunks left, each taking chunkSize bytes.
+func (nm *namespaceManager) MarkLost(p gfs.Path, n int64, chunkSize int64) error {
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(p, false, deadline)
+	defer nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(p, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+	file.chunks -= n
+	file.lost += n
+	if file.length > file.chunks*chunkSize {
+		file.length = file.chunks * chunkSize
+	}
+	parent, _ := nm.PartionLastName(p)
+	nm.addUsage(parent, -n)
+	return nil
+}
+
+// updateFile calls update with the node of file p locked, e.g. to replay the chunks
+// allocated to it from the operation log
+func (nm *namespaceManager) updateFile(p gfs.Path, update func(file *nsTree)) error {
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(p, false, deadline)
+	defer nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	file, ok := cwd.children[ps[len(ps)-1]]
+	if !ok {
+		return gfs.PathError(p, gfs.ErrNotExist)
+	}
+	if !file.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
+	defer file.Unlock()
+	if file.isDir {
+		return fmt.Errorf("%v is a directory", p)
+	}
+	update(file)
+	return nil
+}
+
+// hold is called by a logged mutation before it changes the tree, see operationLog.Hold
+func (nm *namespaceManager) hold() (release func()) {
+	return nm.oplog.Hold()
+}
+
+// logOperation appends op to the operation log. It is called with the
+// mutated directory locked, so the log order is the same as the apply order.
+func (nm *namespaceManager) logOperation(op operation) error {
+	if nm.oplog == nil {
+		return nil
+	}
+	return nm.oplog.Append(op)
+}
+
 // PartionLastName partions the last filename from p
 // e.g. /foo/bar/haha.txt -> /foo/bar , haha.txt
 func (nm *namespaceManager) PartionLastName(p gfs.Path) (gfs.Path, string) {
@@ -153,95 +650,445 @@ func (nm *namespaceManager) PartionLastName(p gfs.Path) (gfs.Path, string) {
 	return "", ""
 }
 
-// Create creates an empty file on path p. All parents should exist.
-func (nm *namespaceManager) Create(p gfs.Path) error {
+// cleanPath validates p and returns its canonical form, e.g. /foo//bar/ -> /foo/bar.
+// p must be absolute and must not name the root or contain "." or ".." components,
+// nor the hidden names of deleted files.
+func cleanPath(p gfs.Path) (gfs.Path, error) {
+	if !strings.HasPrefix(string(p), "/") {
+		return "", fmt.Errorf("path %q is not absolute", p)
+	}
+
+	var ret string
+	for _, name := range strings.Split(string(p), "/") {
+		switch name {
+		case "":
+			continue
+		case ".", "..":
+			return "", fmt.Errorf("path %q contains %q", p, name)
+		}
+		if isDeleted(name) {
+			return "", fmt.Errorf("path %q contains the hidden name of a deleted file %q", p, name)
+		}
+		ret += "/" + name
+	}
+	if ret == "" {
+		return "", fmt.Errorf("path %q has no name", p)
+	}
+	return gfs.Path(ret), nil
+}
+
+// Create creates an empty file on path p at time at. All parents should exist.
+// Each chunk of the file has replicas replicas, the default of master if it is 0,
+// and is stored compressed on chunkservers if compressed is set. The file may have
+// maxChunks chunks, or as many as the limit of master if it is 0.
+func (nm *namespaceManager) Create(p gfs.Path, replicas int, compressed bool, maxChunks int64, at time.Time) error {
+	if replicas < 0 {
+		return fmt.Errorf("invalid replica factor %v", replicas)
+	}
+	if maxChunks < 0 {
+		return fmt.Errorf("invalid max chunks %v", maxChunks)
+	}
+	if replicas == 0 {
+		replicas = nm.defaultReplicas
+	}
+
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	full := p
 	var filename string
 	p, filename = nm.PartionLastName(p)
 
 	log.Info("create file ", p, "/", filename)
 
-	ps, cwd, err := nm.lockParents(p, true)
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(p, true, deadline)
 	defer nm.unlockParents(ps)
 	if err != nil {
 		return err
 	}
 
-	cwd.Lock()
+	if !cwd.lockBefore(deadline) {
+		return gfs.PathError(full, gfs.ErrTimeout)
+	}
 	defer cwd.Unlock()
 
 	if _, ok := cwd.children[filename]; ok {
-		return fmt.Errorf("path %s already exists", p)
+		return gfs.PathError(full, gfs.ErrAlreadyExists)
 	}
-	cwd.children[filename] = new(nsTree)
+	defer nm.hold()()
+	cwd.children[filename] = &nsTree{replicas: replicas, compressed: compressed, maxChunks: maxChunks, ctime: at, mtime: at}
+	op := operation{Type: opCreate, Path: full, Replicas: replicas, Compressed: compressed, MaxChunks: maxChunks, Time: at.UnixNano()}
+	if err := nm.logOperation(op); err != nil {
+		delete(cwd.children, filename)
+		return err
+	}
+	cwd.mtime = at
 	return nil
 }
 
-// Delete deletes an file on path p.
-func (nm *namespaceManager) Delete(p gfs.Path) error {
-	ps, cwd, err := nm.lockParents(p, false)
+// Delete lazily deletes the file or directory on path p. It is renamed to a
+// hidden name carrying the deletion timestamp and reclaimed by garbage collection later.
+// A non-empty directory is deleted only if recursive is set.
+// renamed is called with the hidden path while the parent directory is still locked.
+func (nm *namespaceManager) Delete(p gfs.Path, recursive bool, renamed func(hidden gfs.Path)) error {
+	_, filename := nm.PartionLastName(p)
+	hiddenName := fmt.Sprintf("%s%d_%s", gfs.DeletedFilePrefix, time.Now().UnixNano(), filename)
+	return nm.deleteAs(p, hiddenName, recursive, renamed)
+}
+
+// deleteAs deletes p by renaming it to hiddenName in the same directory
+func (nm *namespaceManager) deleteAs(p gfs.Path, hiddenName string, recursive bool, renamed func(hidden gfs.Path)) error {
+	parent, filename := nm.PartionLastName(p)
+	if filename == "" {
+		return fmt.Errorf("cannot delete %s", p)
+	}
+
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(parent, true, deadline)
 	defer nm.unlockParents(ps)
 	if err != nil {
 		return err
 	}
 
-	filename := ps[len(ps)-1]
-
-	cwd.Lock()
+	if !cwd.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
 	defer cwd.Unlock()
 
+	node, ok := cwd.children[filename]
+	if !ok {
+		return gfs.PathError(p, gfs.ErrNotExist)
+	}
+	if node.isDir && !recursive {
+		node.RLock()
+		empty := len(node.children) == 0
+		node.RUnlock()
+		if !empty {
+			return fmt.Errorf("directory %s is not empty", p)
+		}
+	}
+
 	// rename, laze delete
-	node := cwd.children[filename]
+	defer nm.hold()()
+	hidden := parent + "/" + gfs.Path(hiddenName)
+	delete(cwd.children, filename)
+	cwd.children[hiddenName] = node
+	cwd.mtime, _ = deletedTime(hiddenName)
+	if renamed != nil {
+		renamed(hidden)
+	}
+	return nm.logOperation(operation{Type: opDelete, Path: p, Target: hidden, Recursive: recursive})
+}
+
+// isDeleted tells whether name is reserved for the hidden names given by Delete
+func isDeleted(name string) bool {
+	return strings.HasPrefix(name, gfs.DeletedFilePrefix)
+}
+
+// inDeleted tells whether any component of p is the hidden name of a deleted file
+func inDeleted(p gfs.Path) bool {
+	for _, name := range strings.Split(string(p), "/") {
+		if isDeleted(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// deletedTime parses the deletion timestamp in a hidden name given by Delete
+func deletedTime(name string) (time.Time, bool) {
+	if !isDeleted(name) {
+		return time.Time{}, false
+	}
+	name = name[len(gfs.DeletedFilePrefix):]
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// ExpiredDeleted returns the hidden paths of the files and directories deleted before t
+func (nm *namespaceManager) ExpiredDeleted(t time.Time) []gfs.Path {
+	var ret []gfs.Path
+	nm.walkDeleted(nm.root, "", t, &ret)
+	return ret
+}
+
+func (nm *namespaceManager) walkDeleted(node *nsTree, p gfs.Path, t time.Time, ret *[]gfs.Path) {
+	node.RLock()
+	defer node.RUnlock()
+
+	for name, c := range node.children {
+		full := p + "/" + gfs.Path(name)
+		if at, ok := deletedTime(name); ok {
+			if at.Before(t) {
+				*ret = append(*ret, full)
+			}
+			continue
+		}
+		if c.isDir {
+			nm.walkDeleted(c, full, t, ret)
+		}
+	}
+}
+
+// Purge permanently removes the hidden path p of a deleted file or directory.
+// removed is called while the parent directory is still locked.
+func (nm *namespaceManager) Purge(p gfs.Path, removed func()) error {
+	parent, filename := nm.PartionLastName(p)
+	if _, ok := deletedTime(filename); !ok {
+		return fmt.Errorf("path %s is not deleted", p)
+	}
+
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(parent, true, deadline)
+	defer nm.unlockParents(ps)
+	if err != nil {
+		return err
+	}
+
+	if !cwd.lockBefore(deadline) {
+		return gfs.PathError(p, gfs.ErrTimeout)
+	}
+	defer cwd.Unlock()
+
+	node, ok := cwd.children[filename]
+	if !ok {
+		return gfs.PathError(p, gfs.ErrNotExist)
+	}
+	defer nm.hold()()
 	delete(cwd.children, filename)
-	cwd.children[gfs.DeletedFilePrefix+filename] = node
+	nm.addUsage(parent, -node.size())
+	if removed != nil {
+		removed()
+	}
+	return nm.logOperation(operation{Type: opPurge, Path: p})
+}
+
+// Snapshot makes a copy of the file or directory on path source at path target at time at.
+// The copy keeps the timestamps of source.
+// The whole source subtree is read locked during the snapshot, and copied is called
+// after the namespace is copied. If copied returns an error, the copy is removed.
+func (nm *namespaceManager) Snapshot(source, target gfs.Path, at time.Time, copied func() error) error {
+	_, sname := nm.PartionLastName(source)
+	parent, tname := nm.PartionLastName(target)
+	if sname == "" || tname == "" || inDeleted(target) {
+		return fmt.Errorf("cannot snapshot %s to %s", source, target)
+	}
+	if target == source || strings.HasPrefix(string(target), string(source)+"/") {
+		return fmt.Errorf("cannot snapshot %s into itself", source)
+	}
+
+	nodes, unlock, err := nm.lockPaths(nil, []gfs.Path{parent}, []gfs.Path{source})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir := nodes[parent]
+	if !dir.isDir {
+		return fmt.Errorf("path %s is a file, not directory", parent)
+	}
+	if _, ok := dir.children[tname]; ok {
+		return gfs.PathError(target, gfs.ErrAlreadyExists)
+	}
+
+	defer nm.hold()()
+	src := nodes[source]
+	dir.children[tname] = nm.copyTree(src)
+	nm.addUsage(parent, src.size())
+	if copied != nil {
+		if err := copied(); err != nil {
+			delete(dir.children, tname)
+			nm.addUsage(parent, -src.size())
+			return err
+		}
+	}
+	dir.mtime = at
+	return nm.logOperation(operation{Type: opSnapshot, Path: source, Target: target, Time: at.UnixNano()})
+}
+
+// Copy creates a file on path target at time at, with the replication factor and the
+// compression of the file on path source. copied is called with source read locked and
+// the parent of target write locked to copy the chunks of the new file, and fills them
+// in dst and in op, the record logged for it. The new file is added to the namespace
+// only if copied succeeds and the file is logged, then commit returned by copied is
+// called to add the chunks to metadata.
+func (nm *namespaceManager) Copy(source, target gfs.Path, at time.Time, copied func(src, dst *nsTree, op *operation) (commit func(), err error)) error {
+	parent, tname := nm.PartionLastName(target)
+	if tname == "" || inDeleted(target) {
+		return fmt.Errorf("cannot copy %s to %s", source, target)
+	}
+
+	nodes, unlock, err := nm.lockPaths([]gfs.Path{source}, []gfs.Path{parent}, nil)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	src, dir := nodes[source], nodes[parent]
+	if src.isDir {
+		return fmt.Errorf("%v is a directory", source)
+	}
+	if !dir.isDir {
+		return fmt.Errorf("path %s is a file, not directory", parent)
+	}
+	if _, ok := dir.children[tname]; ok {
+		return gfs.PathError(target, gfs.ErrAlreadyExists)
+	}
+
+	dst := &nsTree{replicas: src.replicas, compressed: src.compressed, maxChunks: src.maxChunks, ctime: at, mtime: at}
+	op := operation{Type: opCreate, Path: target, Replicas: dst.replicas, Compressed: dst.compressed, MaxChunks: dst.maxChunks, Time: at.UnixNano()}
+	commit, err := copied(src, dst, &op)
+	if err != nil {
+		return err
+	}
+
+	defer nm.hold()()
+	if err := nm.logOperation(op); err != nil {
+		return err
+	}
+	dir.children[tname] = dst
+	dir.mtime = at
+	commit()
 	return nil
 }
 
-// Rename rename an file on path p.
-func (nm *namespaceManager) Rename(source, target gfs.Path) error {
-	log.Fatal("Unsupported Rename")
+// Rename moves the file or directory on path source, with its whole subtree, to path target at time at.
+// source may be the hidden name of a deleted file to restore it, but target may not.
+// The parents of both are locked in the order of pathLess, and renamed is called
+// before they are unlocked.
+func (nm *namespaceManager) Rename(source, target gfs.Path, at time.Time, renamed func()) error {
+	sparent, sname := nm.PartionLastName(source)
+	tparent, tname := nm.PartionLastName(target)
+	if sname == "" || tname == "" || inDeleted(target) {
+		return fmt.Errorf("cannot rename %s to %s", source, target)
+	}
+	if target == source || strings.HasPrefix(string(target), string(source)+"/") {
+		return fmt.Errorf("cannot move %s into itself", source)
+	}
+
+	nodes, unlock, err := nm.lockPaths(nil, []gfs.Path{sparent, tparent}, nil)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	src, dst := nodes[sparent], nodes[tparent]
+	node, ok := src.children[sname]
+	if !ok {
+		return gfs.PathError(source, gfs.ErrNotExist)
+	}
+	if !dst.isDir {
+		return fmt.Errorf("path %s is a file, not directory", tparent)
+	}
+	if _, ok := dst.children[tname]; ok {
+		return gfs.PathError(target, gfs.ErrAlreadyExists)
+	}
+
+	defer nm.hold()()
+	delete(src.children, sname)
+	dst.children[tname] = node
+	nm.addUsage(sparent, -node.size())
+	nm.addUsage(tparent, node.size())
+	src.mtime, dst.mtime = at, at
+	if renamed != nil {
+		renamed()
+	}
+	return nm.logOperation(operation{Type: opRename, Path: source, Target: target, Time: at.UnixNano()})
+}
+
+// Mkdir creates a directory on path p at time at. All parents should exist.
+func (nm *namespaceManager) Mkdir(p gfs.Path, at time.Time) error {
+	return nm.mkdir(p, false, at)
+}
+
+// MkdirAll creates a directory on path p along with all missing parents, like mkdir -p.
+// It succeeds if p is already a directory. Each directory is created in turn with the
+// same locks as Mkdir, so concurrent calls sharing a prefix don't deadlock.
+func (nm *namespaceManager) MkdirAll(p gfs.Path, at time.Time) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+
+	names := strings.Split(string(p), "/")[1:]
+	for i := range names {
+		if err := nm.mkdir(gfs.Path("/"+strings.Join(names[:i+1], "/")), true, at); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Mkdir creates a directory on path p. All parents should exist.
-func (nm *namespaceManager) Mkdir(p gfs.Path) error {
+// mkdir creates a directory on path p. If existOK is set, it succeeds if p is already a directory.
+func (nm *namespaceManager) mkdir(p gfs.Path, existOK bool, at time.Time) error {
+	p, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	full := p
 	var filename string
 	p, filename = nm.PartionLastName(p)
 
 	log.Info("mkdir ", p, "/", filename)
 
-	ps, cwd, err := nm.lockParents(p, true)
+	deadline := nm.deadline()
+	ps, cwd, err := nm.lockParents(p, true, deadline)
 	defer nm.unlockParents(ps)
 	if err != nil {
 		return err
 	}
 
-	cwd.Lock()
+	if !cwd.lockBefore(deadline) {
+		return gfs.PathError(full, gfs.ErrTimeout)
+	}
 	defer cwd.Unlock()
 
-	if _, ok := cwd.children[filename]; ok {
-		return fmt.Errorf("path %s already exists", p)
+	if c, ok := cwd.children[filename]; ok {
+		if existOK && c.isDir {
+			return nil
+		}
+		return gfs.PathError(full, gfs.ErrAlreadyExists)
 	}
+	defer nm.hold()()
 	cwd.children[filename] = &nsTree{isDir: true,
-		children: make(map[string]*nsTree)}
+		children: make(map[string]*nsTree), ctime: at, mtime: at}
+	if err := nm.logOperation(operation{Type: opMkdir, Path: full, Time: at.UnixNano()}); err != nil {
+		delete(cwd.children, filename)
+		return err
+	}
+	cwd.mtime = at
 	return nil
 }
 
-// List returns information of all files and directories inside p.
+// List returns information of all files and directories inside p, sorted by name.
+// Deleted files waiting for garbage collection are left out.
 func (nm *namespaceManager) List(p gfs.Path) ([]gfs.PathInfo, error) {
 	log.Info("list ", p)
 
 	var dir *nsTree
+	deadline := nm.deadline()
 	if p == gfs.Path("/") {
 		dir = nm.root
 	} else {
-		ps, cwd, err := nm.lockParents(p, true)
+		ps, cwd, err := nm.lockParents(p, true, deadline)
 		defer nm.unlockParents(ps)
 		if err != nil {
 			return nil, err
 		}
 		dir = cwd
 	}
-	dir.RLock()
+	if !dir.rlockBefore(deadline) {
+		return nil, gfs.PathError(p, gfs.ErrTimeout)
+	}
 	defer dir.RUnlock()
 
 	if !dir.isDir {
@@ -250,6 +1097,9 @@ func (nm *namespaceManager) List(p gfs.Path) ([]gfs.PathInfo, error) {
 
 	ls := make([]gfs.PathInfo, 0, len(dir.children))
 	for name, v := range dir.children {
+		if isDeleted(name) {
+			continue
+		}
 		ls = append(ls, gfs.PathInfo{
 			Name:   name,
 			IsDir:  v.isDir,
@@ -257,5 +1107,87 @@ func (nm *namespaceManager) List(p gfs.Path) ([]gfs.PathInfo, error) {
 			Chunks: v.chunks,
 		})
 	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
 	return ls, nil
 }
+
+// Walk returns the files and directories below root in pathLess order, which is a
+// depth-first walk with the children of each directory sorted by name. It resumes
+// after the path after, or starts at the beginning if after is empty, and returns at
+// most limit entries. next is the last path returned if there are more, otherwise empty.
+// The subtree is read locked during the walk, so each page is a consistent snapshot.
+// Across pages, a path that exists during the whole walk is returned exactly once.
+// Deleted files and directories are skipped along with their subtrees.
+func (nm *namespaceManager) Walk(root, after gfs.Path, limit int) (entries []gfs.WalkEntry, next gfs.Path, err error) {
+	log.Info("walk ", root, " after ", after)
+
+	var key gfs.Path // root is denoted by "" in lockPaths
+	if root != "/" {
+		if key, err = cleanPath(root); err != nil {
+			return nil, "", err
+		}
+	}
+	if after != "" && !strings.HasPrefix(string(after), string(key)+"/") {
+		return nil, "", fmt.Errorf("cannot resume walk of %s after %s", root, after)
+	}
+	if limit <= 0 {
+		limit = gfs.WalkPageSize
+	}
+
+	nodes, unlock, err := nm.lockPaths(nil, nil, []gfs.Path{key})
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	dir := nodes[key]
+	if !dir.isDir {
+		return nil, "", fmt.Errorf("path %s is a file, not directory", root)
+	}
+
+	more := false
+	var walk func(node *nsTree, p gfs.Path)
+	walk = func(node *nsTree, p gfs.Path) {
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			if !isDeleted(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if more {
+				return
+			}
+			c, cp := node.children[name], p+"/"+gfs.Path(name)
+			if after != "" && !pathLess(after, cp) {
+				// only the nodes below after or its parents may come after it
+				if cp == after || strings.HasPrefix(string(after), string(cp)+"/") {
+					walk(c, cp)
+				}
+				continue
+			}
+			if len(entries) == limit {
+				more = true
+				return
+			}
+			entries = append(entries, gfs.WalkEntry{
+				Path:   cp,
+				IsDir:  c.isDir,
+				Length: c.length,
+				Chunks: c.chunks,
+				Mtime:  c.mtime,
+			})
+			if c.isDir {
+				walk(c, cp)
+			}
+		}
+	}
+	walk(dir, key)
+
+	if more {
+		next = entries[len(entries)-1].Path
+	}
+	return entries, next, nil
+}
@@ -0,0 +1,284 @@
+package master
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gfs"
+	log "github.com/Sirupsen/logrus"
+)
+
+type opType int
+
+const (
+	opCreate opType = iota
+	opMkdir
+	opDelete
+	opSnapshot
+	opRename
+	opPurge
+	opSetQuota
+	opSetReplicas
+	opAddChunks
+	opSetVersion
+	opSetLength
+	opTruncate
+	opCopyChunk
+	opReserveHandles
+	opFillHole
+)
+
+// operation is a record of metadata mutation in operation log.
+// Replaying an operation whose effect is already in the checkpoint must be harmless.
+type operation struct {
+	Seq        int64 // sequence number of the record, kept across restarts, 0 in older logs
+	Type       opType
+	Path       gfs.Path
+	Target     gfs.Path // hidden path of deleted file, path of snapshot or new path of renamed file
+	Recursive  bool
+	Replicas   int                // replication factor of created file, or the new one of a file
+	Compressed bool               // created file is stored compressed
+	MaxChunks  int64              // chunks the created file may have, the limit of master if 0
+	Quota      int64              // bytes of directory quota
+	Time       int64              // when the operation is applied, in unix nanoseconds
+	Handles    []gfs.ChunkHandle  // chunks appended to the file, or the copy of a shared chunk
+	Versions   []gfs.ChunkVersion // versions of Handles, 0 if nil
+	Holes      []gfs.ChunkHandle  // chunks of Handles which are holes, without replicas
+	Handle     gfs.ChunkHandle    // chunk leased with a new version, a shared chunk copied, a hole filled, or the next new handle
+	Version    gfs.ChunkVersion   // the new version of Handle, or the version of its copy
+	Paths      []gfs.Path         // files moved to the copy of a shared chunk
+	Length     int64              // new length of the file
+}
+
+// time returns when op is applied, or now for the records written before it is logged
+func (op operation) time() time.Time {
+	if op.Time == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, op.Time)
+}
+
+// record header: length and crc32 checksum of the gob encoded operation
+const opHeaderSize = 8
+
+// operationLog is an append-only log of metadata mutations.
+// Every record is written to disk before the mutation is acknowledged.
+// The latest records are also kept in memory for shadow masters to tail.
+type operationLog struct {
+	sync.Mutex
+	filename string
+	file     *os.File
+	size     int64
+
+	epoch int64    // identifies the log since it is opened, indexes restart from 0 in a new epoch
+	index int64    // number of records appended since the log is opened
+	seq   int64    // sequence number of the last record
+	tail  [][]byte // the last appended records, at most 2 * gfs.OperationLogTail
+
+	// held shared by a mutation from the time it changes the metadata until it is logged,
+	// and exclusively by Checkpoint, so a checkpoint never has a mutation half applied
+	applying sync.RWMutex
+}
+
+// openOperationLog opens the log for appending, creating it if necessary.
+// seq is the sequence number of the last record, in the log or in the checkpoint.
+func openOperationLog(filename string, seq int64) (*operationLog, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, FilePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &operationLog{filename: filename, file: file, size: info.Size(), epoch: time.Now().UnixNano(), seq: seq}, nil
+}
+
+// Append writes an operation to the end of the log with the next sequence number and syncs it to disk
+func (ol *operationLog) Append(op operation) error {
+	ol.Lock()
+	defer ol.Unlock()
+
+	op.Seq = ol.seq + 1
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	record := make([]byte, opHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	copy(record[opHeaderSize:], data)
+
+	n, err := ol.file.Write(record)
+	ol.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err = ol.file.Sync(); err != nil {
+		return err
+	}
+
+	ol.index++
+	ol.seq = op.Seq
+	ol.tail = append(ol.tail, data)
+	if len(ol.tail) > 2*gfs.OperationLogTail {
+		ol.tail = append([][]byte(nil), ol.tail[len(ol.tail)-gfs.OperationLogTail:]...)
+	}
+	return nil
+}
+
+// Index returns the epoch of the log and the number of records appended in it
+func (ol *operationLog) Index() (epoch, index int64) {
+	ol.Lock()
+	defer ol.Unlock()
+	return ol.epoch, ol.index
+}
+
+// Seq returns the sequence number of the last record
+func (ol *operationLog) Seq() int64 {
+	ol.Lock()
+	defer ol.Unlock()
+	return ol.seq
+}
+
+// Hold is called by a mutation before it changes the metadata, and the returned func
+// after the mutation is logged. It is called with the namespace locks of the mutation held.
+// The log may be nil, e.g. during replay.
+func (ol *operationLog) Hold() (release func()) {
+	if ol == nil {
+		return func() {}
+	}
+	ol.applying.RLock()
+	return ol.applying.RUnlock
+}
+
+// Checkpoint calls capture while no mutation is in progress, so the metadata copied by
+// capture has the effects of exactly the operations logged so far. capture must not
+// take namespace locks, a mutation holding them may be waiting for it.
+func (ol *operationLog) Checkpoint(capture func()) {
+	if ol == nil {
+		capture()
+		return
+	}
+	ol.applying.Lock()
+	defer ol.applying.Unlock()
+	capture()
+}
+
+// Since returns the records appended after the first index ones of epoch.
+// ok is false if some of them are no longer kept in memory or epoch is over.
+func (ol *operationLog) Since(epoch, index int64) (records [][]byte, ok bool) {
+	ol.Lock()
+	defer ol.Unlock()
+	first := ol.index - int64(len(ol.tail))
+	if epoch != ol.epoch || index < first || index > ol.index {
+		return nil, false
+	}
+	return append([][]byte(nil), ol.tail[index-first:]...), true
+}
+
+// Size returns the current size of the log in bytes
+func (ol *operationLog) Size() int64 {
+	ol.Lock()
+	defer ol.Unlock()
+	return ol.size
+}
+
+// Compact drops the first pos bytes of the log, which are covered by a checkpoint
+func (ol *operationLog) Compact(pos int64) error {
+	ol.Lock()
+	defer ol.Unlock()
+
+	src, err := os.Open(ol.filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err = src.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpname := ol.filename + ".tmp"
+	dst, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePerm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpname, ol.filename); err != nil {
+		return err
+	}
+
+	ol.file.Close()
+	ol.file, err = os.OpenFile(ol.filename, os.O_WRONLY|os.O_APPEND, FilePerm)
+	ol.size = n
+	return err
+}
+
+// Close closes the log file
+func (ol *operationLog) Close() error {
+	ol.Lock()
+	defer ol.Unlock()
+	return ol.file.Close()
+}
+
+// readOperationLog reads all complete records of the log. A partially written
+// or corrupted trailing record is skipped, and the length of the valid prefix is returned.
+func readOperationLog(filename string) ([]operation, int64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ops []operation
+	var pos int64
+	for int64(len(data))-pos >= opHeaderSize {
+		length := int64(binary.LittleEndian.Uint32(data[pos:]))
+		checksum := binary.LittleEndian.Uint32(data[pos+4:])
+		end := pos + opHeaderSize + length
+		if end > int64(len(data)) {
+			break
+		}
+		body := data[pos+opHeaderSize : end]
+		if crc32.ChecksumIEEE(body) != checksum {
+			break
+		}
+
+		op, err := decodeOperation(body)
+		if err != nil {
+			break
+		}
+		ops = append(ops, op)
+		pos = end
+	}
+
+	if pos < int64(len(data)) {
+		log.Warningf("Master : skip %v bytes of incomplete record at the end of operation log", int64(len(data))-pos)
+	}
+	return ops, pos, nil
+}
+
+// decodeOperation decodes the body of a record
+func decodeOperation(body []byte) (operation, error) {
+	var op operation
+	err := gob.NewDecoder(bytes.NewReader(body)).Decode(&op)
+	return op, err
+}
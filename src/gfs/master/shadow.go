@@ -0,0 +1,335 @@
+package master
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"gfs"
+	"gfs/util"
+	log "github.com/Sirupsen/logrus"
+)
+
+// ShadowMaster is a read-only replica of master. It loads a checkpoint of the
+// metadata from master and then tails its operation log, so clients may read
+// the namespace and chunk locations from it, slightly behind master.
+// Chunk locations are not logged, so the checkpoint is reloaded periodically.
+type ShadowMaster struct {
+	address  gfs.ServerAddress
+	primary  gfs.ServerAddress // address of master
+	l        net.Listener
+	conns    *util.ArraySet // open connections, closed on shutdown
+	tls      *tls.Config    // nil if rpc is in plaintext
+	shutdown chan struct{}
+	dead     bool
+
+	lock   sync.RWMutex // protects the fields below
+	m      *Master      // metadata replicated from master, no background task runs on it
+	epoch  int64        // epoch of the operation log of master
+	index  int64        // operations of epoch applied to m
+	synced time.Time    // last time all operations of master were applied
+}
+
+// NewShadowMaster loads the metadata from master at primary and starts serving reads at address.
+// config is used both for serving rpc and for calling master, as in NewAndServe.
+func NewShadowMaster(address, primary gfs.ServerAddress, config *tls.Config) (*ShadowMaster, error) {
+	s := &ShadowMaster{
+		address:  address,
+		primary:  primary,
+		tls:      config,
+		conns:    new(util.ArraySet),
+		shutdown: make(chan struct{}),
+	}
+	if err := s.loadCheckpoint(); err != nil {
+		return nil, fmt.Errorf("cannot load metadata from %v: %v", primary, err)
+	}
+
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("Master", s)
+	l, e := net.Listen("tcp", string(s.address))
+	if e != nil {
+		return nil, fmt.Errorf("listen error: %v", e)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	s.l = l
+
+	// RPC Handler
+	go func() {
+		for {
+			select {
+			case <-s.shutdown:
+				return
+			default:
+			}
+			conn, err := s.l.Accept()
+			if err != nil {
+				select {
+				case <-s.shutdown: // listener is closed by Shutdown
+					return
+				default:
+				}
+				log.Warning("shadow master accept error: ", err)
+				continue
+			}
+			s.conns.Add(conn)
+			go func() {
+				rpcs.ServeConn(conn)
+				conn.Close()
+				s.conns.Delete(conn)
+			}()
+		}
+	}()
+
+	// Background Task
+	go func() {
+		poll := time.NewTicker(gfs.ShadowPollInterval)
+		reload := time.NewTicker(gfs.ShadowCheckpointInterval)
+		defer poll.Stop()
+		defer reload.Stop()
+		for {
+			var err error
+			select {
+			case <-s.shutdown:
+				return
+			case <-poll.C:
+				err = s.tail()
+			case <-reload.C:
+				err = s.loadCheckpoint()
+			}
+			if err != nil {
+				log.Warning("shadow master ", s.address, ": ", err)
+			}
+		}
+	}()
+
+	log.Infof("Shadow master of %v is running now. addr = %v", primary, address)
+
+	return s, nil
+}
+
+// Shutdown shuts down the shadow master
+func (s *ShadowMaster) Shutdown() {
+	if !s.dead {
+		log.Warning(s.address, " Shutdown")
+		s.dead = true
+		close(s.shutdown)
+		s.l.Close()
+		for _, conn := range s.conns.GetAllAndClear() {
+			conn.(net.Conn).Close()
+		}
+	}
+}
+
+// loadCheckpoint replaces the metadata with a checkpoint from master
+func (s *ShadowMaster) loadCheckpoint() error {
+	var r gfs.GetCheckpointReply
+	err := util.CallTLS(s.tls, s.primary, "Master.RPCGetCheckpoint", gfs.GetCheckpointArg{}, &r)
+	if err != nil {
+		return err
+	}
+
+	var meta PersistentBlock
+	if err := gob.NewDecoder(bytes.NewReader(r.Meta)).Decode(&meta); err != nil {
+		return err
+	}
+
+	config := DefaultConfig()
+	config.ChunkSize = r.ChunkSize
+	m := &Master{
+		address: s.address,
+		tls:     s.tls,
+		tasks:   newTaskStatusMap(),
+		config:  config,
+		nm:      newNamespaceManager(),
+		cm:      newChunkManager(config.LeaseDuration, s.tls),
+		csm:     newChunkServerManager(config.ServerTimeout, config.DeadServerChecks, config.MinFreeSpace),
+	}
+	m.restore(meta)
+	m.cm.SetLocations(r.Locations)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.m = m
+	s.epoch, s.index = r.Epoch, r.Index
+	s.synced = time.Now()
+	return nil
+}
+
+// tail applies the operations logged by master since the last poll
+func (s *ShadowMaster) tail() error {
+	s.lock.RLock()
+	args := gfs.GetOperationsArg{Epoch: s.epoch, Index: s.index}
+	s.lock.RUnlock()
+
+	var r gfs.GetOperationsReply
+	err := util.CallTLS(s.tls, s.primary, "Master.RPCGetOperations", args, &r)
+	if err != nil {
+		return err
+	}
+	if r.Reload {
+		return s.loadCheckpoint()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.epoch != args.Epoch || s.index != args.Index { // a checkpoint is loaded meanwhile
+		return nil
+	}
+	for _, record := range r.Records {
+		op, err := decodeOperation(record)
+		if err != nil {
+			return err
+		}
+		// the effect may be in the checkpoint already
+		if err := s.m.applyOperation(op); err != nil {
+			log.Info("Shadow master : apply ", op, " ", err)
+		}
+		s.index++
+	}
+	s.synced = time.Now()
+	return nil
+}
+
+// master returns the current metadata, the read lock is held until release is called
+func (s *ShadowMaster) master() (m *Master, release func()) {
+	s.lock.RLock()
+	return s.m, s.lock.RUnlock
+}
+
+// checkStaleness returns gfs.ErrTooStale, which names master, if the metadata is behind
+// master by more than maxStaleness, i.e. it is synced longer ago. s.lock should be held.
+func (s *ShadowMaster) checkStaleness(maxStaleness time.Duration) error {
+	if lag := time.Since(s.synced); maxStaleness > 0 && lag > maxStaleness {
+		return gfs.Error{gfs.TooStale, fmt.Sprintf("behind %v by %v, %s", s.primary, lag, gfs.ErrTooStale.Err)}
+	}
+	return nil
+}
+
+// RPCGetFileInfo is called by client to get file information
+func (s *ShadowMaster) RPCGetFileInfo(args gfs.GetFileInfoArg, reply *gfs.GetFileInfoReply) error {
+	m, release := s.master()
+	defer release()
+	if err := s.checkStaleness(args.MaxStaleness); err != nil {
+		return err
+	}
+	return m.RPCGetFileInfo(args, reply)
+}
+
+// RPCList returns the files and directories under a directory
+func (s *ShadowMaster) RPCList(args gfs.ListArg, reply *gfs.ListReply) error {
+	m, release := s.master()
+	defer release()
+	if err := s.checkStaleness(args.MaxStaleness); err != nil {
+		return err
+	}
+	return m.RPCList(args, reply)
+}
+
+// RPCGetReplicas is called by client to find all chunkserver that holds the chunk.
+func (s *ShadowMaster) RPCGetReplicas(args gfs.GetReplicasArg, reply *gfs.GetReplicasReply) error {
+	m, release := s.master()
+	defer release()
+	if err := s.checkStaleness(args.MaxStaleness); err != nil {
+		return err
+	}
+	return m.RPCGetReplicas(args, reply)
+}
+
+// RPCGetPathsByChunk returns all the files that reference a chunk.
+func (s *ShadowMaster) RPCGetPathsByChunk(args gfs.GetPathsByChunkArg, reply *gfs.GetPathsByChunkReply) error {
+	m, release := s.master()
+	defer release()
+	return m.RPCGetPathsByChunk(args, reply)
+}
+
+// RPCGetChunkInfo returns the replicas, version and lease of a chunk known to master
+func (s *ShadowMaster) RPCGetChunkInfo(args gfs.GetChunkInfoArg, reply *gfs.GetChunkInfoReply) error {
+	m, release := s.master()
+	defer release()
+	return m.RPCGetChunkInfo(args, reply)
+}
+
+// RPCGetConfig returns the parameters of master
+func (s *ShadowMaster) RPCGetConfig(args gfs.GetConfigArg, reply *gfs.GetConfigReply) error {
+	m, release := s.master()
+	defer release()
+	return m.RPCGetConfig(args, reply)
+}
+
+// RPCGetMasterStats returns the counts of replicated metadata and how far it is behind master
+func (s *ShadowMaster) RPCGetMasterStats(args gfs.GetMasterStatsArg, reply *gfs.MasterStatsReply) error {
+	m, release := s.master()
+	defer release()
+	if err := m.RPCGetMasterStats(args, reply); err != nil {
+		return err
+	}
+	reply.LogIndex = s.index
+	reply.Synced = s.synced
+	return nil
+}
+
+// RPCGetChunkHandle returns the chunk handle of (path, index).
+// Unlike master, it never creates a chunk.
+func (s *ShadowMaster) RPCGetChunkHandle(args gfs.GetChunkHandleArg, reply *gfs.GetChunkHandleReply) error {
+	m, release := s.master()
+	defer release()
+	handle, err := m.cm.GetChunk(args.Path, args.Index)
+	if err != nil {
+		return err
+	}
+	reply.Handle = handle
+	return nil
+}
+
+// The RPCs below change metadata or chunk leases, they must go to master.
+
+func (s *ShadowMaster) RPCCreateFile(args gfs.CreateFileArg, reply *gfs.CreateFileReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCMkdir(args gfs.MkdirArg, reply *gfs.MkdirReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCDeleteFile(args gfs.DeleteFileArg, reply *gfs.DeleteFileReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCRenameFile(args gfs.RenameFileArg, reply *gfs.RenameFileReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCSnapshot(args gfs.SnapshotArg, reply *gfs.SnapshotReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCSetQuota(args gfs.SetQuotaArg, reply *gfs.SetQuotaReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCSetReplicationFactor(args gfs.SetReplicationFactorArg, reply *gfs.SetReplicationFactorReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCTruncate(args gfs.TruncateArg, reply *gfs.TruncateReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCAllocateChunks(args gfs.AllocateChunksArg, reply *gfs.AllocateChunksReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCGetPrimaryAndSecondaries(args gfs.GetPrimaryAndSecondariesArg, reply *gfs.GetPrimaryAndSecondariesReply) error {
+	return gfs.ErrReadOnly
+}
+
+func (s *ShadowMaster) RPCHeartbeat(args gfs.HeartbeatArg, reply *gfs.HeartbeatReply) error {
+	return gfs.ErrReadOnly
+}
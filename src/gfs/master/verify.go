@@ -0,0 +1,48 @@
+package master
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// verifyMetadata cross-checks the namespace loaded from disk against the chunk lists
+// of files, and repairs what does not match, which is possible if a checkpoint and the
+// operation log replayed on it disagree. It returns the number of inconsistencies.
+// The chunk list of a path which is not a file in namespace is dropped, so are the chunks
+// in the list of a file after its chunk count. The chunks referenced by no other file are
+// forgotten, and their replicas are deleted as garbage once chunkservers report them.
+// If a file has fewer chunks in its list than its chunk count, the missing chunks are lost.
+// The file keeps the chunks known, and the lost ones are counted in GetFileInfo.
+func (m *Master) verifyMetadata() int {
+	files := m.nm.FileChunks()
+	errors := 0
+	for p, n := range m.cm.FileChunks() {
+		count, ok := files[p]
+		switch {
+		case !ok:
+			log.Warningf("Master : chunks of %v which is not a file, drop them", p)
+			m.addGarbage(m.cm.DropFile(p))
+		case n > count:
+			log.Warningf("Master : %v has %v chunks but %v in chunk list, drop the rest", p, count, n)
+			m.addGarbage(m.cm.TruncateFile(p, int(count)))
+		default:
+			continue
+		}
+		errors++
+	}
+
+	known := m.cm.FileChunks()
+	for p, count := range files {
+		if n := known[p]; n < count {
+			log.Warningf("Master : %v lost %v of %v chunks", p, count-n, count)
+			if err := m.nm.MarkLost(p, count-n, m.config.ChunkSize); err != nil {
+				log.Warning(err)
+			}
+			errors++
+		}
+	}
+
+	if errors > 0 {
+		log.Warningf("Master : %v inconsistencies in metadata", errors)
+	}
+	return errors
+}
@@ -18,17 +18,19 @@ type CheckVersionReply struct {
 }
 
 // chunk IO
-type ForwardDataArg struct {
+type PushDataArg struct {
 	DataID     DataBufferID
 	Data       []byte
-	ChainOrder []ServerAddress
+	ChainOrder []ServerAddress // replicas to forward the data to, in order
 }
-type ForwardDataReply struct {
+type PushDataReply struct {
 	ErrorCode ErrorCode
 }
 
 type CreateChunkArg struct {
-	Handle ChunkHandle
+	Handle     ChunkHandle
+	Version    ChunkVersion
+	Compressed bool // store the chunk compressed on disk
 }
 type CreateChunkReply struct {
 	ErrorCode ErrorCode
@@ -38,26 +40,54 @@ type WriteChunkArg struct {
 	DataID      DataBufferID
 	Offset      Offset
 	Secondaries []ServerAddress
+	Version     ChunkVersion // version of the lease, the write is rejected by a primary of other versions
 }
 type WriteChunkReply struct {
 	ErrorCode ErrorCode
 }
 
+// AppendArg is the argument of client.AppendWith
+type AppendArg struct {
+	Path     Path
+	Data     []byte
+	Sync     bool       // wait until master confirms the new length of file, always in ExactlyOnce mode
+	Mode     AppendMode // AtLeastOnce by default
+	RecordID uint64     // identifies the record among retries in ExactlyOnce mode, chosen by client if 0
+}
+
 type AppendChunkArg struct {
 	DataID      DataBufferID
 	Secondaries []ServerAddress
+	Version     ChunkVersion // version of the lease, the append is rejected by a primary of other versions
+	Mode        AppendMode   // the primary keeps the record IDs only in ExactlyOnce mode
+	RecordID    uint64       // a record appended already is not appended again, required in ExactlyOnce mode
 }
 type AppendChunkReply struct {
 	Offset    Offset
 	ErrorCode ErrorCode
 }
 
-type ApplyMutationArg struct {
-	Mtype  MutationType
-	DataID DataBufferID
-	Offset Offset
+type PrepareMutationArg struct {
+	Mtype    MutationType
+	DataID   DataBufferID
+	Offset   Offset
+	RecordID uint64 // of an append, remembered by the replica on commit
+}
+type PrepareMutationReply struct {
+	ErrorCode ErrorCode
+}
+
+type CommitMutationArg struct {
+	DataID DataBufferID // of the prepared mutation
 }
-type ApplyMutationReply struct {
+type CommitMutationReply struct {
+	ErrorCode ErrorCode
+}
+
+type AbortMutationArg struct {
+	DataID DataBufferID // of the prepared mutation
+}
+type AbortMutationReply struct {
 	ErrorCode ErrorCode
 }
 
@@ -68,6 +98,15 @@ type PadChunkReply struct {
 	ErrorCode ErrorCode
 }
 
+type TruncateChunkArg struct {
+	Handle      ChunkHandle
+	Length      Offset
+	Secondaries []ServerAddress
+}
+type TruncateChunkReply struct {
+	ErrorCode ErrorCode
+}
+
 type ReadChunkArg struct {
 	Handle ChunkHandle
 	Offset Offset
@@ -81,22 +120,50 @@ type ReadChunkReply struct {
 
 // re-replication
 type SendCopyArg struct {
-	Handle  ChunkHandle
-	Address ServerAddress
+	Handle    ChunkHandle
+	Address   ServerAddress
+	NewHandle ChunkHandle // handle of the copy on Address, Handle for a new replica
 }
 type SendCopyReply struct {
 	ErrorCode ErrorCode
 }
 
 type ApplyCopyArg struct {
-	Handle  ChunkHandle
-	Data    []byte
-	Version ChunkVersion
+	Handle     ChunkHandle
+	Data       []byte
+	Version    ChunkVersion
+	Compressed bool // the copy is stored compressed, as the source is
+
+	// crc32 of every ChecksumBlockSize block of the source, the data is verified against
+	// them before it is applied. It is nil for a compressed chunk, which is verified
+	// when the source reads it.
+	Checksums []uint32
 }
 type ApplyCopyReply struct {
 	ErrorCode ErrorCode
 }
 
+// lease
+type RevokeLeaseArg struct {
+	Handle ChunkHandle
+}
+type RevokeLeaseReply struct{}
+
+// garbage collection
+type DeleteChunkArg struct {
+	Handles []ChunkHandle
+}
+type DeleteChunkReply struct{}
+
+// copy-on-write
+type DuplicateChunkArg struct {
+	Handle    ChunkHandle
+	NewHandle ChunkHandle
+}
+type DuplicateChunkReply struct {
+	ErrorCode ErrorCode
+}
+
 // no use argument
 type Nouse struct{}
 
@@ -108,10 +175,26 @@ type Nouse struct{}
 type HeartbeatArg struct {
 	Address          ServerAddress // chunkserver address
 	LeaseExtensions  []ChunkHandle // leases to be extended
-	AbandondedChunks []ChunkHandle // unrecoverable chunks
+	AbandondedChunks []ChunkHandle // unrecoverable chunks, e.g. corrupted
+	Stats            ChunkServerStats
+	UsedBytes        int64  // bytes used by chunks
+	FreeBytes        int64  // bytes available for new chunks
+	Zone             string // topology label such as "dc1/rack2"
+	Incarnation      int64  // changes when the server restarts, so master forgets its chunks
 }
 type HeartbeatReply struct {
-	Garbage []ChunkHandle
+	ChunkSize int64 // max chunk length of master
+}
+
+// a restarted chunkserver asks for the leases it may still hold at once
+type RenewAllLeasesArg struct {
+	Address  ServerAddress
+	Handles  []ChunkHandle
+	Versions []ChunkVersion // version of each handle on the server
+}
+type RenewAllLeasesReply struct {
+	Granted []ChunkHandle // handles the server is primary for
+	Expire  time.Time     // when the first of the granted leases expires
 }
 
 type ReportSelfArg struct {
@@ -122,12 +205,15 @@ type ReportSelfReply struct {
 
 // chunk info
 type GetPrimaryAndSecondariesArg struct {
-	Handle ChunkHandle
+	Handle     ChunkHandle
+	ClientZone string // topology label of the client, the push chain starts from the nearest replica
 }
 type GetPrimaryAndSecondariesReply struct {
 	Primary     ServerAddress
 	Expire      time.Time
 	Secondaries []ServerAddress
+	Chain       []ServerAddress // all replicas in the order to push data
+	Version     ChunkVersion    // version of the chunk when the lease is granted
 }
 
 type ExtendLeaseArg struct {
@@ -139,19 +225,180 @@ type ExtendLeaseReply struct {
 }
 
 type GetReplicasArg struct {
-	Handle ChunkHandle
+	Handle       ChunkHandle
+	ClientZone   string        // if set, replicas closer to the zone come first
+	MaxStaleness time.Duration // see GetFileInfoArg
 }
 type GetReplicasReply struct {
 	Locations []ServerAddress
+	Hole      bool // the chunk is a hole of a sparse file, which has no replica and reads as zero
+}
+
+type GetChunkInfoArg struct {
+	Handle ChunkHandle
+}
+type GetChunkInfoReply struct {
+	Locations    []ServerAddress
+	Version      ChunkVersion
+	Primary      ServerAddress // empty if no lease is held
+	Expire       time.Time     // expire time of the lease, in the past if no lease is held
+	NeedsReplica bool          // the chunk is waiting for re-replication
 }
 
 type GetFileInfoArg struct {
 	Path Path
+	// a shadow master answers only if it is behind master by at most this long,
+	// otherwise it fails with ErrTooStale. Any staleness is allowed if 0.
+	MaxStaleness time.Duration
 }
 type GetFileInfoReply struct {
 	IsDir  bool
 	Length int64
 	Chunks int64
+	Ctime  time.Time
+	Mtime  time.Time // a write is seen by master in the next heartbeat of primary
+
+	Compressed bool  // chunks are stored compressed on chunkservers
+	LostChunks int64 // chunks found missing from metadata when master restarts, see Chunks
+}
+
+type BatchGetFileInfoArg struct {
+	Paths []Path
+}
+type BatchGetFileInfoReply struct {
+	Infos  []GetFileInfoReply // in the order of Paths
+	Errors []Error            // Code is Success if the info of the path is found
+}
+
+type UpdateFileLengthArg struct {
+	Path   Path
+	Length int64 // end offset of the data written
+}
+type UpdateFileLengthReply struct{}
+
+type GetPathsByChunkArg struct {
+	Handle ChunkHandle
+}
+type GetPathsByChunkReply struct {
+	Paths []Path
+}
+
+type GetMasterMemoryUsageArg struct {
+}
+type GetMasterMemoryUsageReply struct {
+	NamespaceNodes      int
+	ChunkEntries        int
+	ChunkServerEntries  int
+	LeaseEntries        int
+	WALBufferBytes      int
+	CacheEntries        int
+	EstimatedTotalBytes int64
+}
+
+type GetMasterStatsArg struct {
+}
+type MasterStatsReply struct {
+	Files             int
+	Directories       int // root excluded
+	Chunks            int
+	ChunkServers      int // live chunkservers
+	UnderReplicated   int
+	OldestLeaseExpire time.Time // zero if no chunk holds an unexpired lease
+	CopiesInFlight    int       // chunks being copied between chunkservers
+	NeedListDepth     int       // chunks queued for re-replication, some may be satisfied already
+	GarbageQueued     int       // replicas waiting to be deleted by chunkservers
+	ReReplicated      int64     // re-replications completed since master starts
+	ReReplicateFailed int64     // re-replications failed since master starts
+	LogIndex          int64     // operations logged by master, or applied by a shadow master
+	Synced            time.Time // last time a shadow master caught up with master, zero on master
+}
+
+type GetCheckpointArg struct {
+}
+type GetCheckpointReply struct {
+	Epoch     int64  // identifies the operation log, it changes when master restarts
+	Index     int64  // operations logged in epoch before the checkpoint
+	Meta      []byte // gob encoded metadata
+	Locations map[ChunkHandle][]ServerAddress
+	ChunkSize int64
+}
+
+type GetOperationsArg struct {
+	Epoch int64
+	Index int64 // operations already applied
+}
+type GetOperationsReply struct {
+	Records [][]byte // encoded operations logged after the first Index ones
+	Reload  bool     // the operations are no longer kept, load a checkpoint instead
+}
+
+type GetConfigArg struct {
+}
+type GetConfigReply struct {
+	ChunkSize     int64 // max chunk length, files are split into chunks of this size
+	MaxAppendSize int64 // max length of a record append, 1/4 chunk size
+}
+
+type GetBackgroundTaskStatusArg struct {
+}
+type GetBackgroundTaskStatusReply struct {
+	Tasks []TaskStatus
+}
+
+type RebalancePlanArg struct {
+}
+type RebalancePlanReply struct {
+	Moves []ChunkMove
+}
+
+type ApplyRebalanceArg struct {
+	Moves []ChunkMove // usually a plan returned by RPCPlanRebalance
+}
+type ApplyRebalanceReply struct {
+	Moved int // moves done, the first move not done is Moves[Moved]
+}
+
+type ForceChunkReplicationArg struct {
+	Handle ChunkHandle
+}
+type ForceChunkReplicationReply struct{}
+
+type GetChunkServerStatsSummaryArg struct {
+}
+type GetChunkServerStatsSummaryReply struct {
+	Servers []ServerStatSummary
+}
+
+type ListChunkServersArg struct {
+}
+type ListChunkServersReply struct {
+	Servers []ChunkServerInfo // sorted by address
+}
+
+type DecommissionServerArg struct {
+	Address ServerAddress
+}
+type DecommissionServerReply struct{}
+
+type InvalidateReplicaArg struct {
+	Handle ChunkHandle
+	Server ServerAddress
+	Force  bool // invalidate even the last replica of the chunk
+}
+type InvalidateReplicaReply struct{}
+
+type ReportBadReplicaArg struct {
+	Handle ChunkHandle
+	Server ServerAddress
+}
+type ReportBadReplicaReply struct{}
+
+type ReportChecksumMismatchArg struct {
+	Handle ChunkHandle
+	Server ServerAddress
+}
+type ReportChecksumMismatchReply struct {
+	Quarantined bool // the replica is quarantined by this report
 }
 
 type GetChunkHandleArg struct {
@@ -162,14 +409,52 @@ type GetChunkHandleReply struct {
 	Handle ChunkHandle
 }
 
+type AllocateChunksArg struct {
+	Path  Path
+	Count int // number of chunks appended to the file
+}
+type AllocateChunksReply struct {
+	Index     ChunkIndex    // index of the first new chunk in the file
+	Handles   []ChunkHandle // contiguous handles of the new chunks
+	Locations [][]ServerAddress
+}
+
 // namespace operation
 type CreateFileArg struct {
-	Path Path
+	Path          Path
+	ReplicaFactor int   // number of replicas of each chunk, DefaultNumReplicas if 0
+	Compressed    bool  // chunks are stored compressed on chunkservers, see CreateCompressed of client
+	MaxChunks     int64 // chunks the file may have, the limit of master if 0
 }
 type CreateFileReply struct{}
 
-type DeleteFileArg struct {
+type CreateSmallFileArg struct {
 	Path Path
+	Data []byte // at most one chunk
+}
+type CreateSmallFileReply struct{}
+
+type TruncateArg struct {
+	Path   Path
+	Length int64
+}
+type TruncateReply struct{}
+
+type SetQuotaArg struct {
+	Path  Path
+	Bytes int64 // max bytes of the files under the directory, unlimited if 0
+}
+type SetQuotaReply struct{}
+
+type SetReplicationFactorArg struct {
+	Path   Path
+	Factor int // new number of replicas of each chunk, at least 1
+}
+type SetReplicationFactorReply struct{}
+
+type DeleteFileArg struct {
+	Path      Path
+	Recursive bool // delete a non-empty directory
 }
 type DeleteFileReply struct{}
 
@@ -179,14 +464,38 @@ type RenameFileArg struct {
 }
 type RenameFileReply struct{}
 
+type SnapshotArg struct {
+	Source Path
+	Target Path
+}
+type SnapshotReply struct{}
+
+type CopyFileArg struct {
+	Source Path
+	Target Path
+}
+type CopyFileReply struct{}
+
 type MkdirArg struct {
-	Path Path
+	Path      Path
+	Recursive bool // create missing parents, succeed if path is already a directory
 }
 type MkdirReply struct{}
 
 type ListArg struct {
-	Path Path
+	Path         Path
+	MaxStaleness time.Duration // see GetFileInfoArg
 }
 type ListReply struct {
 	Files []PathInfo
 }
+
+type WalkArg struct {
+	Root  Path
+	After Path // continuation token, the walk resumes after this path; empty to start
+	Limit int  // max entries returned, gfs.WalkPageSize if 0
+}
+type WalkReply struct {
+	Entries []WalkEntry
+	Next    Path // pass as After to get the next page, empty if the walk is done
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"crypto/tls"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"gfs"
+)
+
+type poolKey struct {
+	config *tls.Config
+	srv    gfs.ServerAddress
+}
+
+type idleClient struct {
+	c      *rpc.Client
+	expire time.Time
+}
+
+// connPool keeps idle rpc connections to each server, so that calls don't dial
+// a new connection every time. It is thread-safe since a mutex is used.
+type connPool struct {
+	sync.Mutex
+	idle        map[poolKey][]idleClient
+	maxIdle     int // max idle connections to one server, no connection is kept if 0
+	idleTimeout time.Duration
+}
+
+var pool = newConnPool(gfs.RPCMaxIdleConns, gfs.RPCIdleTimeout)
+
+// newConnPool returns a connPool whose idle connections are closed after idleTimeout.
+// Expired connections are cleaned up every idleTimeout.
+func newConnPool(maxIdle int, idleTimeout time.Duration) *connPool {
+	p := &connPool{
+		idle:        make(map[poolKey][]idleClient),
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+	}
+
+	// cleanup
+	go func() {
+		ticker := time.Tick(idleTimeout)
+		for {
+			<-ticker
+			now := time.Now()
+			p.Lock()
+			for k, list := range p.idle {
+				var alive []idleClient
+				for _, v := range list {
+					if v.expire.Before(now) {
+						v.c.Close()
+					} else {
+						alive = append(alive, v)
+					}
+				}
+				if len(alive) == 0 {
+					delete(p.idle, k)
+				} else {
+					p.idle[k] = alive
+				}
+			}
+			p.Unlock()
+		}
+	}()
+
+	return p
+}
+
+// get checks out an idle connection to the server, or returns nil if there is none
+func (p *connPool) get(key poolKey) *rpc.Client {
+	p.Lock()
+	defer p.Unlock()
+
+	list := p.idle[key]
+	now := time.Now()
+	for len(list) > 0 {
+		v := list[len(list)-1]
+		list = list[:len(list)-1]
+		if v.expire.After(now) {
+			p.idle[key] = list
+			return v.c
+		}
+		v.c.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// put returns a healthy connection to the pool, it is closed if the pool is full
+func (p *connPool) put(key poolKey, c *rpc.Client) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.idle[key]) >= p.maxIdle {
+		c.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleClient{c, time.Now().Add(p.idleTimeout)})
+}
+
+// setMaxIdle changes the max idle connections to one server and closes the extra ones
+func (p *connPool) setMaxIdle(n int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.maxIdle = n
+	for k, list := range p.idle {
+		for len(list) > n {
+			list[len(list)-1].c.Close()
+			list = list[:len(list)-1]
+		}
+		if len(list) == 0 {
+			delete(p.idle, k)
+		} else {
+			p.idle[k] = list
+		}
+	}
+}
+
+// SetMaxIdleConns sets the max number of idle connections kept to one server.
+// Connections are not reused if n is 0.
+func SetMaxIdleConns(n int) {
+	pool.setMaxIdle(n)
+}
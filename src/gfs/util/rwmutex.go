@@ -0,0 +1,139 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// RWMutex is a reader/writer lock which may give up waiting at a deadline.
+// Like sync.RWMutex, a waiting writer blocks new readers, so writers are not starved by
+// a stream of readers. The zero value is an unlocked mutex.
+type RWMutex struct {
+	mu       sync.Mutex
+	readers  int           // readers holding the lock
+	writer   bool          // a writer holds the lock
+	writers  int           // writers waiting for the lock
+	released chan struct{} // closed when the lock is released, nil if nobody waits
+}
+
+// Lock write locks m, it blocks until the lock is available
+func (m *RWMutex) Lock() {
+	m.LockBefore(time.Time{})
+}
+
+// RLock read locks m, it blocks until the lock is available
+func (m *RWMutex) RLock() {
+	m.RLockBefore(time.Time{})
+}
+
+// TryLock write locks m if it is free, and reports whether it does
+func (m *RWMutex) TryLock() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writer || m.readers > 0 {
+		return false
+	}
+	m.writer = true
+	return true
+}
+
+// TryRLock read locks m if no writer holds or waits for it, and reports whether it does
+func (m *RWMutex) TryRLock() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writer || m.writers > 0 {
+		return false
+	}
+	m.readers++
+	return true
+}
+
+// LockBefore write locks m, it reports false if the lock is not acquired by deadline.
+// It never gives up if deadline is zero.
+func (m *RWMutex) LockBefore(deadline time.Time) bool {
+	m.mu.Lock()
+	m.writers++
+	for m.writer || m.readers > 0 {
+		if !m.wait(deadline) {
+			m.writers--
+			m.wake() // readers behind this writer may go on
+			m.mu.Unlock()
+			return false
+		}
+	}
+	m.writers--
+	m.writer = true
+	m.mu.Unlock()
+	return true
+}
+
+// RLockBefore read locks m, it reports false if the lock is not acquired by deadline.
+// It never gives up if deadline is zero.
+func (m *RWMutex) RLockBefore(deadline time.Time) bool {
+	m.mu.Lock()
+	for m.writer || m.writers > 0 {
+		if !m.wait(deadline) {
+			m.mu.Unlock()
+			return false
+		}
+	}
+	m.readers++
+	m.mu.Unlock()
+	return true
+}
+
+// Unlock releases the write lock of m
+func (m *RWMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.writer {
+		panic("util: Unlock of unlocked RWMutex")
+	}
+	m.writer = false
+	m.wake()
+}
+
+// RUnlock releases a read lock of m
+func (m *RWMutex) RUnlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readers <= 0 {
+		panic("util: RUnlock of unlocked RWMutex")
+	}
+	m.readers--
+	if m.readers == 0 {
+		m.wake()
+	}
+}
+
+// wait releases m.mu until the lock is released or deadline passes, and reports
+// false if deadline passes. m.mu should be locked by caller.
+func (m *RWMutex) wait(deadline time.Time) bool {
+	if m.released == nil {
+		m.released = make(chan struct{})
+	}
+	released := m.released
+	m.mu.Unlock()
+	defer m.mu.Lock()
+
+	if deadline.IsZero() {
+		<-released
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-released:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// wake tells the waiters that the lock is released. m.mu should be locked by caller.
+func (m *RWMutex) wake() {
+	if m.released != nil {
+		close(m.released)
+		m.released = nil
+	}
+}
@@ -1,31 +1,129 @@
 package util
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"net"
 	"net/rpc"
+	"sort"
+	"time"
 
 	"gfs"
 )
 
 // Call is RPC call helper
 func Call(srv gfs.ServerAddress, rpcname string, args interface{}, reply interface{}) error {
-	c, errx := rpc.Dial("tcp", string(srv))
-	if errx != nil {
-		return errx
+	return CallTLS(nil, srv, rpcname, args, reply)
+}
+
+// CallTLS is Call over a TLS connection, it dials in plaintext if config is nil.
+// The server name is taken from srv if config does not set it, "localhost" if srv has no host.
+// Connections are reused across calls, broken ones are discarded.
+func CallTLS(config *tls.Config, srv gfs.ServerAddress, rpcname string, args interface{}, reply interface{}) error {
+	key := poolKey{config, srv}
+	if c := pool.get(key); c != nil {
+		err := c.Call(rpcname, args, reply)
+		if err != rpc.ErrShutdown {
+			release(key, c, err)
+			return err
+		}
+		// the idle connection is closed by server, e.g. the server restarts. The request
+		// is not sent, so it is safe to send it again. Other errors are returned, as the
+		// server may have applied it.
+		c.Close()
 	}
-	defer c.Close()
 
-	err := c.Call(rpcname, args, reply)
+	c, err := dial(config, srv)
+	if err != nil {
+		return err
+	}
+	err = c.Call(rpcname, args, reply)
+	release(key, c, err)
 	return err
 }
 
+// dial connects to srv, over TLS if config is not nil
+func dial(config *tls.Config, srv gfs.ServerAddress) (*rpc.Client, error) {
+	if config == nil {
+		return rpc.Dial("tcp", string(srv))
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(string(srv))
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	conn, err := tls.Dial("tcp", string(srv), config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// release returns c to the pool if the call on it returns err, errors of the rpc
+// method don't break the connection.
+func release(key poolKey, c *rpc.Client, err error) {
+	if _, ok := err.(rpc.ServerError); err == nil || ok {
+		pool.put(key, c)
+	} else {
+		c.Close()
+	}
+}
+
+// CallWithRetry is Call that retries on network errors, such as connection refused or
+// timeout, at most maxRetries times with exponential backoff. Errors returned by the
+// rpc method itself are returned immediately.
+func CallWithRetry(srv gfs.ServerAddress, rpcname string, args interface{}, reply interface{}, maxRetries int) error {
+	return CallTLSWithRetry(nil, srv, rpcname, args, reply, maxRetries)
+}
+
+// CallTLSWithRetry is CallWithRetry over a TLS connection, see CallTLS.
+func CallTLSWithRetry(config *tls.Config, srv gfs.ServerAddress, rpcname string, args interface{}, reply interface{}, maxRetries int) error {
+	backoff := gfs.RPCRetryBackoff
+	for i := 0; ; i++ {
+		err := CallTLS(config, srv, rpcname, args, reply)
+		if err == nil || i >= maxRetries || !retryable(err) {
+			return err
+		}
+
+		// sleep for a random time in [backoff/2, backoff)
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		if backoff *= 2; backoff > gfs.RPCRetryMaxBackoff {
+			backoff = gfs.RPCRetryMaxBackoff
+		}
+	}
+}
+
+// retryable returns whether err is a network error, the rpc may be not received by server
+func retryable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == rpc.ErrShutdown
+}
+
 // CallAll applies the rpc call to all destinations.
 func CallAll(dst []gfs.ServerAddress, rpcname string, args interface{}) error {
+	return CallAllTLS(nil, dst, rpcname, args)
+}
+
+// CallAllTLS is CallAll over TLS connections, see CallTLS.
+func CallAllTLS(config *tls.Config, dst []gfs.ServerAddress, rpcname string, args interface{}) error {
 	ch := make(chan error)
 	for _, d := range dst {
 		go func(addr gfs.ServerAddress) {
-			ch <- Call(addr, rpcname, args, nil)
+			ch <- CallTLS(config, addr, rpcname, args, nil)
 		}(d)
 	}
 	errList := ""
@@ -50,3 +148,22 @@ func Sample(n, k int) ([]int, error) {
 	}
 	return rand.Perm(n)[:k], nil
 }
+
+// Percentile returns the p-th percentile (0 < p <= 100) of samples using the
+// nearest-rank method. It returns 0 if there is no sample.
+func Percentile(samples []float64, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}